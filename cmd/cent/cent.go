@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/robertlestak/centauri/internal/cfg"
 	"github.com/robertlestak/centauri/pkg/agent"
+	"github.com/robertlestak/centauri/pkg/client"
 	"github.com/robertlestak/centauri/pkg/keys"
 	log "github.com/sirupsen/logrus"
 )
@@ -20,12 +23,34 @@ var (
 	flagClientOutputFormat       *string
 	flagClientPrivateKeyPath     *string
 	flagClientRecipientPublicKey *string
+	flagClientRecipients         *string
 	flagClientMessageType        *string
 	flagClientMessageFileName    *string
 	flagClientMessageInput       *string
 	flagClientMessageID          *string
+	flagClientConfirm            *bool
+	flagClientIDsFile            *string
+	flagClientAllChannels        *bool
+	flagClientDryRun             *bool
+	flagClientOlderThan          *time.Duration
+	flagClientMinSize            *int64
+	flagClientMaxSize            *int64
+	flagClientCreatedAfter       *string
+	flagClientCreatedBefore      *string
+	flagClientSort               *string
+	flagClientDesc               *bool
+	flagClientLimit              *int
+	flagClientCursor             *string
 	flagServerAuthToken          *string
 	flagUpstreamServerAddrs      *string
+	flagDataDir                  *string
+	flagKeyBits                  *int
+	flagPassphraseFD             *int
+	flagKeyEncrypt               *bool
+	flagKeyOverlap               *time.Duration
+	flagRevokeReason             *string
+	flagContactNote              *string
+	flagContactExpires           *string
 )
 
 func init() {
@@ -64,8 +89,20 @@ func loadcfg() {
 		}
 		cfg.Config.Client.ServerAddrs = addrs
 	}
-	if cfg.Config.Client.ServerAuthToken != "" {
-		agent.ServerAuthToken = cfg.Config.Client.ServerAuthToken
+	if *flagDataDir != "" {
+		cfg.Config.Client.DataDir = *flagDataDir
+	}
+	if cfg.Config.Client.DataDir == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			cfg.Config.Client.DataDir = filepath.Join(home, ".centauri")
+		}
+	}
+	if cfg.Config.Client.PrivateKeyPath == "" {
+		// the key created by cent keys generate
+		kp := filepath.Join(cfg.Config.Client.DataDir, "key.pem")
+		if _, err := os.Stat(kp); err == nil {
+			cfg.Config.Client.PrivateKeyPath = kp
+		}
 	}
 }
 
@@ -73,24 +110,83 @@ func version() {
 	fmt.Printf("version: %s\n", Version)
 }
 
-func clnt() {
+// needsPrivateKey reports whether the command uses the private key, so
+// that an encrypted key is only decrypted when it is needed.
+func needsPrivateKey(args []string) bool {
+	switch os.Args[1] {
+	case "send", "contacts":
+		return false
+	case "keys":
+		// export, fingerprint and revoke of the own key
+		switch os.Args[2] {
+		case "rotate", "publish", "revoke-cert":
+			return true
+		case "export", "fingerprint", "revoke":
+			return len(args) == 0
+		}
+		return false
+	}
+	return true
+}
+
+func clnt(args []string) {
 	l := log.WithFields(log.Fields{
 		"pkg": "main",
 		"fn":  "clnt",
 	})
 	l.Debug("starting")
 	loadcfg()
-	agent.ServerAddrs = cfg.Config.Client.ServerAddrs
-	if cfg.Config.Client.PrivateKeyPath != "" {
-		if err := agent.LoadPrivateKeyFromFile(cfg.Config.Client.PrivateKeyPath); err != nil {
+	a := agent.New()
+	if cfg.Config.Client.ServerAuthToken != "" {
+		a.ServerAuthToken = cfg.Config.Client.ServerAuthToken
+	}
+	a.ServerAddrs = cfg.Config.Client.ServerAddrs
+	a.DataDir = cfg.Config.Client.DataDir
+	a.PassphraseFD = *flagPassphraseFD
+	a.DefaultChannel = cfg.Config.Client.Channel
+	if cfg.Config.Client.PrivateKeyPath != "" && needsPrivateKey(args) {
+		if err := a.LoadPrivateKeyFromFile(cfg.Config.Client.PrivateKeyPath); err != nil {
 			l.Errorf("failed to load private key: %v", err)
 			os.Exit(1)
 		}
 	}
+	o := &agent.ClientOptions{
+		Output:          cfg.Config.Client.Output,
+		OutputFormat:    cfg.Config.Client.Format,
+		MessageID:       *flagClientMessageID,
+		MessageInput:    *flagClientMessageInput,
+		MessageType:     *flagClientMessageType,
+		MessageFileName: *flagClientMessageFileName,
+		Confirm:         *flagClientConfirm,
+		IDsFile:         *flagClientIDsFile,
+		Filter: agent.MessageFilter{
+			OlderThan: *flagClientOlderThan,
+			MinSize:   *flagClientMinSize,
+			MaxSize:   *flagClientMaxSize,
+		},
+		List: client.ListQuery{
+			Sort:   *flagClientSort,
+			Desc:   *flagClientDesc,
+			Limit:  *flagClientLimit,
+			Cursor: *flagClientCursor,
+		},
+		CreatedAfter:   *flagClientCreatedAfter,
+		CreatedBefore:  *flagClientCreatedBefore,
+		AllChannels:    *flagClientAllChannels,
+		DryRun:         *flagClientDryRun,
+		KeyBits:        *flagKeyBits,
+		KeyEncrypt:     *flagKeyEncrypt,
+		KeyFile:        cfg.Config.Client.PrivateKeyPath,
+		KeyOverlap:     *flagKeyOverlap,
+		KeyExpires:     *flagContactExpires,
+		RevokeReason:   *flagRevokeReason,
+		ContactNote:    *flagContactNote,
+		ContactExpires: *flagContactExpires,
+	}
 	if flagClientRecipientPublicKey != nil && *flagClientRecipientPublicKey != "" {
 		if *flagClientRecipientPublicKey == "-" {
 			var err error
-			agent.ClientRecipientPublicKey, err = ioutil.ReadAll(os.Stdin)
+			o.RecipientPublicKey, err = ioutil.ReadAll(os.Stdin)
 			if err != nil {
 				l.Errorf("failed to read public key: %v", err)
 				os.Exit(1)
@@ -98,22 +194,33 @@ func clnt() {
 		} else {
 			// read from file
 			var err error
-			agent.ClientRecipientPublicKey, err = ioutil.ReadFile(*flagClientRecipientPublicKey)
+			o.RecipientPublicKey, err = ioutil.ReadFile(*flagClientRecipientPublicKey)
 			if err != nil {
 				l.Errorf("failed to read public key: %v", err)
 				os.Exit(1)
 			}
 		}
-		keys.AddKeyToPublicChain(agent.ClientRecipientPublicKey)
-	}
-	agent.DefaultChannel = cfg.Config.Client.Channel
-	agent.Output = cfg.Config.Client.Output
-	agent.OutputFormat = cfg.Config.Client.Format
-	agent.ClientMessageID = *flagClientMessageID
-	agent.ClientMessageType = *flagClientMessageType
-	agent.ClientMessageFileName = *flagClientMessageFileName
-	agent.ClientMessageInput = *flagClientMessageInput
-	if err := agent.Client(); err != nil {
+	}
+	for _, r := range strings.Split(*flagClientRecipients, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			o.Recipients = append(o.Recipients, r)
+		}
+	}
+	switch os.Args[1] {
+	case "keys":
+		if err := a.Keys(os.Args[2], args, o); err != nil {
+			l.Errorf("keys %s failed: %v", os.Args[2], err)
+			os.Exit(1)
+		}
+		return
+	case "contacts":
+		if err := a.Contacts(os.Args[2], args, o); err != nil {
+			l.Errorf("contacts %s failed: %v", os.Args[2], err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := a.Client(os.Args[1], o); err != nil {
 		l.Errorf("failed to start client: %v", err)
 		os.Exit(1)
 	}
@@ -129,20 +236,55 @@ func main() {
 	flagAgentChannel = flagClient.String("channel", "default", "channel to listen on")
 	flagClientPrivateKeyPath = flagClient.String("key", "", "path to private key for client")
 	flagClientMessageID = flagClient.String("id", "", "message id to retrieve")
+	flagClientConfirm = flagClient.Bool("confirm", false, "confirm every message written by watch")
+	flagClientIDsFile = flagClient.String("ids", "", "file of message ids, one per line, for delete and confirm (- for stdin)")
+	flagClientAllChannels = flagClient.Bool("all", false, "list, delete and purge messages of all channels")
+	flagClientDryRun = flagClient.Bool("dry-run", false, "list the messages delete and purge would delete")
+	flagClientOlderThan = flagClient.Duration("older-than", 0, "delete messages older than this")
+	flagClientMinSize = flagClient.Int64("min-size", 0, "list or delete messages of at least this many bytes")
+	flagClientMaxSize = flagClient.Int64("max-size", 0, "list or delete messages of at most this many bytes")
+	flagClientCreatedAfter = flagClient.String("created-after", "", "list messages created after this time (RFC 3339 or 2006-01-02)")
+	flagClientCreatedBefore = flagClient.String("created-before", "", "list messages created before this time (RFC 3339 or 2006-01-02)")
+	flagClientSort = flagClient.String("sort", "created", "order of list (created, size)")
+	flagClientDesc = flagClient.Bool("desc", false, "list the newest or largest messages first")
+	flagClientLimit = flagClient.Int("limit", 0, "most messages listed at once, all if 0")
+	flagClientCursor = flagClient.String("cursor", "", "cursor of the page to list, printed by the previous page")
 	flagClientMessageFileName = flagClient.String("file", "", "filename to set for outbound file message")
 	flagClientRecipientPublicKey = flagClient.String("to-key", "", "public key of recipient")
+	flagClientRecipients = flagClient.String("to", "", "comma separated recipients: contacts, groups, key IDs, unique ID prefixes, key names or public key files")
 	flagClientMessageType = flagClient.String("type", "bytes", "message type to set for outbound message (bytes, file)")
 	flagClientMessageInput = flagClient.String("in", "-", "input to set for outbound message")
 	flagClientOutput = flagClient.String("out", "-", "path to output file.")
 	flagClientOutputFormat = flagClient.String("format", "text", "output format (json, text)")
 	flagServerAuthToken = flagClient.String("server-token", "", "auth token for server")
 	flagUpstreamServerAddrs = flagClient.String("server-addrs", "", "addresses to join as an agent")
+	flagDataDir = flagClient.String("data", "", "data directory for keys (default ~/.centauri)")
+	flagKeyBits = flagClient.Int("bits", keys.DefaultKeyBits, "size of keys created by keys generate")
+	flagKeyEncrypt = flagClient.Bool("encrypt", false, "encrypt the private key created by keys generate with a passphrase")
+	flagKeyOverlap = flagClient.Duration("overlap", time.Hour*24*7, "how long keys rotate keeps receiving messages to the old key")
+	flagRevokeReason = flagClient.String("reason", "", "reason of the revocation created by keys revoke and keys revoke-cert")
+	flagPassphraseFD = flagClient.Int("passphrase-fd", -1, "file descriptor to read the passphrase of an encrypted private key from")
+	flagContactNote = flagClient.String("note", "", "note of the contact created by contacts add")
+	flagContactExpires = flagClient.String("expires", "", "expiry of the contact created by contacts add or the key published by keys publish (RFC 3339 or 2006-01-02)")
 	if len(os.Args) < 2 {
 		fmt.Println(agent.ClientHelp())
 		flagClient.PrintDefaults()
 		os.Exit(1)
 	}
-	if err := flagClient.Parse(os.Args[2:]); err != nil {
+	fargs := os.Args[2:]
+	if os.Args[1] == "keys" || os.Args[1] == "contacts" {
+		if len(os.Args) < 3 {
+			if os.Args[1] == "keys" {
+				fmt.Println(agent.KeysHelp())
+			} else {
+				fmt.Println(agent.ContactsHelp())
+			}
+			flagClient.PrintDefaults()
+			os.Exit(1)
+		}
+		fargs = os.Args[3:]
+	}
+	if err := flagClient.Parse(fargs); err != nil {
 		l.Errorf("failed to parse flags: %v", err)
 		os.Exit(1)
 	}
@@ -150,5 +292,5 @@ func main() {
 		version()
 		os.Exit(0)
 	}
-	clnt()
+	clnt(flagClient.Args())
 }
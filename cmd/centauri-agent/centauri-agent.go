@@ -10,7 +10,6 @@ import (
 	"github.com/robertlestak/centauri/internal/cfg"
 	"github.com/robertlestak/centauri/internal/persist"
 	"github.com/robertlestak/centauri/pkg/agent"
-	"github.com/robertlestak/centauri/pkg/keys"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -20,6 +19,8 @@ var (
 	flagAgentChannel        *string
 	flagAgentPrivateKeyPath *string
 	flagDataDir             *string
+	flagPassphraseFD        *int
+	flagPreviousKeyPaths    *string
 	flagServerAuthToken     *string
 	flagUpstreamServerAddrs *string
 )
@@ -40,6 +41,16 @@ func loadcfg() {
 	if *flagAgentPrivateKeyPath != "" {
 		cfg.Config.Agent.PrivateKeyPath = *flagAgentPrivateKeyPath
 	}
+	if *flagPreviousKeyPaths != "" {
+		var paths []string
+		for _, p := range strings.Split(*flagPreviousKeyPaths, ",") {
+			if strings.TrimSpace(p) == "" {
+				continue
+			}
+			paths = append(paths, p)
+		}
+		cfg.Config.Agent.PreviousKeyPaths = paths
+	}
 	if *flagServerAuthToken != "" {
 		cfg.Config.Agent.ServerAuthToken = *flagServerAuthToken
 	}
@@ -70,21 +81,57 @@ func agnt() {
 	})
 	l.Debug("starting")
 	loadcfg()
-	if err := persist.InitAgent(cfg.Config.Agent.DataDir); err != nil {
+	store, err := persist.NewAgent(cfg.Config.Agent.DataDir)
+	if err != nil {
 		l.Errorf("failed to init persist: %v", err)
 		os.Exit(1)
 	}
-	agent.ServerAddrs = cfg.Config.Agent.ServerAddrs
-	if err := agent.LoadPrivateKeyFromFile(cfg.Config.Agent.PrivateKeyPath); err != nil {
+	a := agent.New()
+	a.Store = store
+	a.ServerAddrs = cfg.Config.Agent.ServerAddrs
+	a.PassphraseFD = *flagPassphraseFD
+	if err := a.LoadPrivateKeyFromFile(cfg.Config.Agent.PrivateKeyPath); err != nil {
 		l.Errorf("failed to load private key: %v", err)
 		os.Exit(1)
 	}
-	go keys.PubKeyLoader(cfg.Config.Agent.DataDir + "/pubkeys")
-	agent.DefaultChannel = cfg.Config.Agent.Channel
+	for _, p := range cfg.Config.Agent.PreviousKeyPaths {
+		if err := a.LoadPreviousKeyFromFile(p); err != nil {
+			l.Errorf("failed to load previous key %s: %v", p, err)
+			os.Exit(1)
+		}
+	}
+	a.DefaultChannel = cfg.Config.Agent.Channel
 	if cfg.Config.Agent.ServerAuthToken != "" {
-		agent.ServerAuthToken = cfg.Config.Agent.ServerAuthToken
+		a.ServerAuthToken = cfg.Config.Agent.ServerAuthToken
+	}
+	if cfg.Config.Agent.QueueMaxAttempts > 0 {
+		a.QueueMaxAttempts = cfg.Config.Agent.QueueMaxAttempts
+	}
+	if cfg.Config.Agent.QueueMinBackoff > 0 {
+		a.QueueMinBackoff = cfg.Config.Agent.QueueMinBackoff
+	}
+	if cfg.Config.Agent.QueueMaxBackoff > 0 {
+		a.QueueMaxBackoff = cfg.Config.Agent.QueueMaxBackoff
+	}
+	for _, sc := range cfg.Config.Agent.Subscriptions {
+		sub := agent.Subscription{
+			Channel:     sc.Channel,
+			OutputDir:   sc.OutputDir,
+			Concurrency: sc.Concurrency,
+			Action:      sc.Action,
+		}
+		if sc.Hook != nil {
+			sub.Hook = &agent.Hook{
+				Command:      sc.Hook.Command,
+				Stdin:        sc.Hook.Stdin,
+				Timeout:      sc.Hook.Timeout,
+				MaxAttempts:  sc.Hook.MaxAttempts,
+				RetryBackoff: sc.Hook.RetryBackoff,
+			}
+		}
+		a.Subscriptions = append(a.Subscriptions, sub)
 	}
-	if err := agent.Agent(); err != nil {
+	if err := a.Run(); err != nil {
 		l.Errorf("failed to start agent: %v", err)
 		os.Exit(1)
 	}
@@ -102,6 +149,8 @@ func main() {
 	flagServerAuthToken = flagAgent.String("server-token", "", "auth token for server")
 	flagUpstreamServerAddrs = flagAgent.String("server-addrs", "", "addresses to join as an agent")
 	flagDataDir = flagAgent.String("data", "", "data directory")
+	flagPreviousKeyPaths = flagAgent.String("previous-keys", "", "comma separated paths to the keys the private key was rotated from")
+	flagPassphraseFD = flagAgent.Int("passphrase-fd", -1, "file descriptor to read the passphrase of an encrypted private key from")
 	if len(os.Args) > 1 {
 		if err := flagAgent.Parse(os.Args[1:]); err != nil {
 			l.Errorf("failed to parse flags: %v", err)
@@ -1,29 +1,22 @@
 package main
 
 import (
-	"encoding/hex"
+	"context"
 	"flag"
 	"fmt"
-	network "net"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/google/uuid"
-	"github.com/hashicorp/memberlist"
+	"github.com/robertlestak/centauri"
 	"github.com/robertlestak/centauri/internal/cfg"
-	"github.com/robertlestak/centauri/internal/events"
-	"github.com/robertlestak/centauri/internal/net"
-	"github.com/robertlestak/centauri/internal/persist"
-	"github.com/robertlestak/centauri/internal/server"
-	"github.com/robertlestak/centauri/pkg/message"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	Version                     = "unknown"
-	wg                          sync.WaitGroup
 	flagPeerConnectionMode      *string
 	flagPeerGossipBindPort      *int
 	flagPeerGossipAdvertisePort *int
@@ -39,7 +32,10 @@ var (
 	flagPeerName                *string
 	flagDataDir                 *string
 	flagServerAuthToken         *string
+	flagAdminToken              *string
 	flagPeerKey                 *string
+	flagDrainHandoff            *bool
+	flagShutdownTimeout         *time.Duration
 )
 
 func init() {
@@ -56,42 +52,40 @@ func version() {
 
 func loadcfg() {
 	cfg.Init()
+	applyFlags(&cfg.Config.Peer)
+}
+
+// applyFlags overrides the peer config with the command line flags.
+func applyFlags(p *cfg.PeerConfig) {
 	if *flagPeerName != "" {
-		cfg.Config.Peer.Name = *flagPeerName
-	}
-	if cfg.Config.Peer.Name == "" {
-		hostname, err := os.Hostname()
-		if err != nil {
-			log.Fatal(err)
-		}
-		cfg.Config.Peer.Name = hostname + "-" + uuid.New().String()
+		p.Name = *flagPeerName
 	}
 	if *flagDataDir != "" {
-		cfg.Config.Peer.DataDir = *flagDataDir
+		p.DataDir = *flagDataDir
 	}
 	if *flagPeerConnectionMode != "" {
-		cfg.Config.Peer.ConnectionMode = *flagPeerConnectionMode
+		p.ConnectionMode = *flagPeerConnectionMode
 	}
 	if *flagPeerGossipBindPort != 0 {
-		cfg.Config.Peer.GossipBindPort = *flagPeerGossipBindPort
+		p.GossipBindPort = *flagPeerGossipBindPort
 	}
 	if *flagPeerGossipAdvertisePort != 0 {
-		cfg.Config.Peer.GossipAdvertisePort = *flagPeerGossipAdvertisePort
+		p.GossipAdvertisePort = *flagPeerGossipAdvertisePort
 	}
-	if cfg.Config.Peer.GossipAdvertisePort == 0 {
-		cfg.Config.Peer.GossipAdvertisePort = cfg.Config.Peer.GossipBindPort
+	if p.GossipAdvertisePort == 0 {
+		p.GossipAdvertisePort = p.GossipBindPort
 	}
 	if *flagPeerAdvertiseAddr != "" {
-		cfg.Config.Peer.AdvertiseAddr = *flagPeerAdvertiseAddr
+		p.AdvertiseAddr = *flagPeerAdvertiseAddr
 	}
 	if *flagPeerDataBindPort != 0 {
-		cfg.Config.Peer.DataBindPort = *flagPeerDataBindPort
+		p.DataBindPort = *flagPeerDataBindPort
 	}
 	if *flagPeerDataAdvertisePort != 0 {
-		cfg.Config.Peer.DataAdvertisePort = *flagPeerDataAdvertisePort
+		p.DataAdvertisePort = *flagPeerDataAdvertisePort
 	}
-	if cfg.Config.Peer.DataAdvertisePort == 0 {
-		cfg.Config.Peer.DataAdvertisePort = cfg.Config.Peer.DataBindPort
+	if p.DataAdvertisePort == 0 {
+		p.DataAdvertisePort = p.DataBindPort
 	}
 	if *flagPeerAllowedCidrs != "" {
 		cidrSpl := strings.Split(*flagPeerAllowedCidrs, ",")
@@ -99,171 +93,78 @@ func loadcfg() {
 			if strings.TrimSpace(cidr) == "" {
 				continue
 			}
-			cfg.Config.Peer.AllowedCidrs = append(cfg.Config.Peer.AllowedCidrs, cidr)
+			p.AllowedCidrs = append(p.AllowedCidrs, cidr)
 		}
 	}
 	if *flagServerPort != 0 {
-		cfg.Config.Peer.ServerPort = *flagServerPort
+		p.ServerPort = *flagServerPort
 	}
 	if *flagServerTLSCertPath != "" {
-		cfg.Config.Peer.ServerTLSCertPath = *flagServerTLSCertPath
+		p.ServerTLSCertPath = *flagServerTLSCertPath
 	}
 	if *flagServerTLSKeyPath != "" {
-		cfg.Config.Peer.ServerTLSKeyPath = *flagServerTLSKeyPath
+		p.ServerTLSKeyPath = *flagServerTLSKeyPath
 	}
 	if *flagServerAuthToken != "" {
-		cfg.Config.Peer.ServerAuthToken = *flagServerAuthToken
+		p.ServerAuthToken = *flagServerAuthToken
+	}
+	if *flagAdminToken != "" {
+		p.AdminToken = *flagAdminToken
 	}
 	if *flagPeerKey != "" {
-		cfg.Config.Peer.PeerKey = *flagPeerKey
+		p.PeerKey = *flagPeerKey
 	}
 	if *flagServerCors != "" {
 		for _, cors := range strings.Split(*flagServerCors, ",") {
 			if strings.TrimSpace(cors) == "" {
 				continue
 			}
-			cfg.Config.Peer.ServerCors = append(cfg.Config.Peer.ServerCors, cors)
+			p.ServerCors = append(p.ServerCors, cors)
 		}
 	}
+	if *flagDrainHandoff {
+		p.DrainHandoff = true
+	}
+	if *flagShutdownTimeout != 0 {
+		p.ShutdownTimeout = *flagShutdownTimeout
+	}
+	if p.ShutdownTimeout == 0 {
+		p.ShutdownTimeout = time.Second * 30
+	}
 	if *flagPeerAddrs != "" {
 		addrSpl := strings.Split(*flagPeerAddrs, ",")
 		for _, addr := range addrSpl {
 			if strings.TrimSpace(addr) == "" {
 				continue
 			}
-			cfg.Config.Peer.PeerAddrs = append(cfg.Config.Peer.PeerAddrs, addr)
-		}
-	}
-}
-
-func peerWatcher() {
-	l := log.WithFields(log.Fields{
-		"pkg": "centaurid",
-		"fn":  "peerWatcher",
-	})
-	l.Debug("starting")
-	for {
-		time.Sleep(time.Second * 30)
-		l.Debug("checking for peers")
-		var err error
-		var liveNodes int
-		for _, n := range net.ListMembers() {
-			if n.Name == cfg.Config.Peer.Name {
-				continue
-			}
-			if n.State == memberlist.StateAlive {
-				liveNodes++
-			}
-		}
-		if liveNodes == 0 && len(cfg.Config.Peer.PeerAddrs) > 0 {
-			l.Debug("no peers, trying to join")
-			err = net.Join(cfg.Config.Peer.PeerAddrs)
-			if err != nil {
-				l.Errorf("failed: %v", err)
-				os.Exit(1)
-			}
+			p.PeerAddrs = append(p.PeerAddrs, addr)
 		}
 	}
 }
 
-func peer() {
+// reload re-reads the config file and flags and applies the settings
+// which can be changed while the peer is running.
+func reload(n *centauri.Node) (*centauri.ReloadResult, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "main",
-		"fn":  "peer",
+		"fn":  "reload",
 	})
-	l.Debug("starting")
-	if err := persist.Init(cfg.Config.Peer.DataDir, cfg.Config.Peer.Name); err != nil {
-		l.Errorf("failed to init persist: %v", err)
-		os.Exit(1)
-	}
-
-	var cidrs []network.IPNet
-	for _, cidr := range cfg.Config.Peer.AllowedCidrs {
-		if strings.TrimSpace(cidr) == "" {
-			continue
-		}
-		_, ipnet, err := network.ParseCIDR(cidr)
-		if err != nil {
-			l.Errorf("failed to parse cidr: %v", err)
-			os.Exit(1)
-		}
-		cidrs = append(cidrs, *ipnet)
-	}
-	if len(cidrs) == 0 {
-		cidrs = nil
-	}
-	var err error
-	if cfg.Config.Peer.PeerKey != "" {
-		bd, err := hex.DecodeString(cfg.Config.Peer.PeerKey)
-		if err != nil {
-			l.Errorf("failed to decode secret key: %v", err)
-			os.Exit(1)
-		}
-		net.PeerKey = bd
-	}
-	if cfg.Config.Peer.DataAdvertisePort == 0 {
-		cfg.Config.Peer.DataAdvertisePort = cfg.Config.Peer.DataBindPort
-	}
-	net.PeerName = cfg.Config.Peer.Name
-	net.PeerAddr = cfg.Config.Peer.AdvertiseAddr
-	net.PeerDataPort = cfg.Config.Peer.DataAdvertisePort
-	err = net.Create(
-		cfg.Config.Peer.Name,
-		cfg.Config.Peer.AdvertiseAddr,
-		cfg.Config.Peer.GossipAdvertisePort,
-		cfg.Config.Peer.GossipBindPort,
-		cfg.Config.Peer.ConnectionMode,
-		cidrs,
-	)
+	l.Debug("reloading config")
+	cfgPath, err := cfg.Path()
 	if err != nil {
-		l.Errorf("failed to create peer: %v", err)
-		os.Exit(1)
-	}
-	if len(cfg.Config.Peer.PeerAddrs) > 0 {
-		err = net.Join(cfg.Config.Peer.PeerAddrs)
-		if err != nil {
-			l.Errorf("failed: %v", err)
-			os.Exit(1)
+		l.Errorf("failed to get config path: %v", err)
+		return nil, err
+	}
+	c := &cfg.Cfg{}
+	if _, err := os.Stat(cfgPath); err == nil {
+		if err := c.Load(cfgPath); err != nil {
+			l.Errorf("failed to load config: %v", err)
+			return nil, err
 		}
 	}
-	net.CreateQueue()
-	go net.DataServer(cfg.Config.Peer.DataBindPort)
-	go net.CacheCleaner()
-	go peerWatcher()
-	go persist.TimeoutCleaner()
-	// DeletionHandlers are called when a file is deleted on this peer
-	// these will notify other peers to delete the file locally
-	events.DeletionHandlers = append(events.DeletionHandlers, net.BroadcastDeleteMessage)
-	// NewMessageHandlers are called when a new message is sent to this peer
-	// these will notify other peers to retrieve the message and store it locally
-	events.NewMessageHandlers = append(events.NewMessageHandlers, net.BroadcastNewMessage)
-	// ReceivedDeletionHandlers are called when a file is deleted on another peer
-	// these will notify this peer to delete the file locally
-	events.ReceivedDeletionHandlers = append(events.ReceivedDeletionHandlers, message.DeleteMessageByID)
-	// ReceivedMessageHandlers are called when a new message is received from another peer
-	// these will notify this peer to retrieve the message from the other peer and store it locally
-	events.ReceivedMessageHandlers = append(events.ReceivedMessageHandlers, message.GetMessageFromPeer)
-	// NotifyMessageEventHandler is called when a new message is received from another peer
-	// this will inspect the message and call the appropriate event handler
-	net.NotifyMessageEventHandler = events.ReceiveMessage
-}
-
-func serv() {
-	l := log.WithFields(log.Fields{
-		"pkg": "main",
-		"fn":  "serv",
-	})
-	l.Debug("starting")
-	if err := server.Server(
-		cfg.Config.Peer.ServerPort,
-		cfg.Config.Peer.ServerAuthToken,
-		cfg.Config.Peer.ServerCors,
-		cfg.Config.Peer.ServerTLSCertPath,
-		cfg.Config.Peer.ServerTLSKeyPath,
-	); err != nil {
-		l.Errorf("failed to start server: %v", err)
-		os.Exit(1)
-	}
+	next := c.Peer
+	applyFlags(&next)
+	return n.Reload(next)
 }
 
 func main() {
@@ -283,12 +184,15 @@ func main() {
 	flagPeerAllowedCidrs = flagPeer.String("cidrs", "", "cidrs to allow. comma separated. empty for all")
 	flagPeerConnectionMode = flagPeer.String("mode", "lan", "peer connection mode (lan, wan, local)")
 	flagServerAuthToken = flagPeer.String("server-token", "", "auth token for server")
+	flagAdminToken = flagPeer.String("admin-token", "", "auth token for admin api. leave blank to disable the admin api")
 	flagServerPort = flagPeer.Int("server-port", 5666, "port to use for server")
 	flagServerCors = flagPeer.String("server-cors", "*", "comma separated cors for server")
 	flagServerTLSCertPath = flagPeer.String("server-cert", "", "path to server TLS cert")
 	flagServerTLSKeyPath = flagPeer.String("server-key", "", "path to server TLS key")
 	flagPeerName = flagPeer.String("name", "", "name of this node")
 	flagDataDir = flagPeer.String("data", "", "data directory")
+	flagDrainHandoff = flagPeer.Bool("drain-handoff", false, "on shutdown, hand off messages only this peer holds to other peers")
+	flagShutdownTimeout = flagPeer.Duration("shutdown-timeout", 0, "maximum time to wait for a graceful shutdown (default 30s)")
 	if len(os.Args) > 1 {
 		if err := flagPeer.Parse(os.Args[1:]); err != nil {
 			l.Errorf("failed to parse flags: %v", err)
@@ -299,9 +203,31 @@ func main() {
 			os.Exit(0)
 		}
 	}
-	wg.Add(1)
 	loadcfg()
-	go peer()
-	go serv()
-	wg.Wait()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	n, err := centauri.New(cfg.Config.Peer)
+	if err != nil {
+		l.Errorf("failed to create node: %v", err)
+		os.Exit(1)
+	}
+	n.Server.ReloadHandler = func() (*cfg.ReloadResult, error) {
+		return reload(n)
+	}
+	if err := n.Start(); err != nil {
+		l.Errorf("failed to start node: %v", err)
+		os.Exit(1)
+	}
+	for sig := range sigs {
+		l.Infof("received signal: %v", sig)
+		if sig == syscall.SIGHUP {
+			if _, err := reload(n); err != nil {
+				l.Errorf("failed to reload config: %v", err)
+			}
+			continue
+		}
+		// the node applies its configured shutdown timeout
+		n.Shutdown(context.Background())
+		return
+	}
 }
@@ -8,6 +8,8 @@ require (
 	github.com/hashicorp/memberlist v0.3.1
 	github.com/rs/cors v1.8.2
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/crypto v0.0.0-20190923035154-9ee001bba392
+	golang.org/x/sys v0.0.0-20220702020025-31831981b65f
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -22,7 +24,5 @@ require (
 	github.com/hashicorp/golang-lru v0.5.0 // indirect
 	github.com/miekg/dns v1.1.26 // indirect
 	github.com/sean-/seed v0.0.0-20170313163322-e2103e2c3529 // indirect
-	golang.org/x/crypto v0.0.0-20190923035154-9ee001bba392 // indirect
 	golang.org/x/net v0.0.0-20190923162816-aa69164e4478 // indirect
-	golang.org/x/sys v0.0.0-20220702020025-31831981b65f // indirect
 )
@@ -3,6 +3,7 @@ package cfg
 import (
 	"io/ioutil"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
@@ -20,33 +21,65 @@ type ClientConfig struct {
 	PrivateKeyPath  string   `yaml:"privateKeyPath"`
 	ServerAuthToken string   `yaml:"serverAuthToken"`
 	ServerAddrs     []string `yaml:"serverAddrs"`
+	// DataDir holds the keys of the client, ~/.centauri if empty.
+	DataDir string `yaml:"dataDir"`
 }
 
 type PeerConfig struct {
-	Name                string   `yaml:"name"`
-	ConnectionMode      string   `yaml:"connectionMode"`
-	GossipBindPort      int      `yaml:"gossipBindPort"`
-	GossipAdvertisePort int      `yaml:"gossipAdvertisePort"`
-	PeerKey             string   `yaml:"peerKey"`
-	DataBindPort        int      `yaml:"dataBindPort"`
-	DataAdvertisePort   int      `yaml:"dataAdvertisePort"`
-	AdvertiseAddr       string   `yaml:"advertiseAddr"`
-	AllowedCidrs        []string `yaml:"allowedCidrs"`
-	ServerPort          int      `yaml:"serverPort"`
-	ServerCors          []string `yaml:"serverCors"`
-	ServerTLSCertPath   string   `yaml:"serverTLSCertPath"`
-	ServerTLSKeyPath    string   `yaml:"serverTLSKeyPath"`
-	PeerAddrs           []string `yaml:"peerAddrs"`
-	DataDir             string   `yaml:"dataDir"`
-	ServerAuthToken     string   `yaml:"serverAuthToken"`
+	Name                string        `yaml:"name"`
+	ConnectionMode      string        `yaml:"connectionMode"`
+	GossipBindPort      int           `yaml:"gossipBindPort"`
+	GossipAdvertisePort int           `yaml:"gossipAdvertisePort"`
+	PeerKey             string        `yaml:"peerKey"`
+	DataBindPort        int           `yaml:"dataBindPort"`
+	DataAdvertisePort   int           `yaml:"dataAdvertisePort"`
+	AdvertiseAddr       string        `yaml:"advertiseAddr"`
+	AllowedCidrs        []string      `yaml:"allowedCidrs"`
+	ServerPort          int           `yaml:"serverPort"`
+	ServerCors          []string      `yaml:"serverCors"`
+	ServerTLSCertPath   string        `yaml:"serverTLSCertPath"`
+	ServerTLSKeyPath    string        `yaml:"serverTLSKeyPath"`
+	PeerAddrs           []string      `yaml:"peerAddrs"`
+	DataDir             string        `yaml:"dataDir"`
+	ServerAuthToken     string        `yaml:"serverAuthToken"`
+	AdminToken          string        `yaml:"adminToken"`
+	DrainHandoff        bool          `yaml:"drainHandoff"`
+	ShutdownTimeout     time.Duration `yaml:"shutdownTimeout"`
+}
+
+// SubscriptionConfig is a channel, or a pattern of channels, the agent
+// receives messages from.
+type SubscriptionConfig struct {
+	Channel     string `yaml:"channel"`
+	OutputDir   string `yaml:"outputDir"`
+	Concurrency int    `yaml:"concurrency"`
+	// Action is "confirm" or "keep"
+	Action string      `yaml:"action"`
+	Hook   *HookConfig `yaml:"hook"`
+}
+
+// HookConfig is a command run for every message of a subscription.
+type HookConfig struct {
+	Command      []string      `yaml:"command"`
+	Stdin        bool          `yaml:"stdin"`
+	Timeout      time.Duration `yaml:"timeout"`
+	MaxAttempts  int           `yaml:"maxAttempts"`
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
 }
 
 type AgentConfig struct {
-	Channel         string   `yaml:"channel"`
-	PrivateKeyPath  string   `yaml:"privateKeyPath"`
-	DataDir         string   `yaml:"dataDir"`
-	ServerAuthToken string   `yaml:"serverAuthToken"`
-	ServerAddrs     []string `yaml:"serverAddrs"`
+	Channel          string        `yaml:"channel"`
+	PrivateKeyPath   string        `yaml:"privateKeyPath"`
+	DataDir          string        `yaml:"dataDir"`
+	ServerAuthToken  string        `yaml:"serverAuthToken"`
+	ServerAddrs      []string      `yaml:"serverAddrs"`
+	QueueMaxAttempts int           `yaml:"queueMaxAttempts"`
+	QueueMinBackoff  time.Duration `yaml:"queueMinBackoff"`
+	QueueMaxBackoff  time.Duration `yaml:"queueMaxBackoff"`
+	// PreviousKeyPaths are the keys the private key was rotated from.
+	PreviousKeyPaths []string `yaml:"previousKeyPaths"`
+	// Subscriptions replace Channel if set.
+	Subscriptions []SubscriptionConfig `yaml:"subscriptions"`
 }
 
 type Cfg struct {
@@ -94,18 +127,25 @@ func LoadIfExists(path string) error {
 	return nil
 }
 
-func Init() {
-	var cfgPath string
+// Path returns the path of the config file, from CENTAURI_CONFIG or
+// ~/.centauri/config.yaml.
+func Path() (string, error) {
 	if os.Getenv("CENTAURI_CONFIG") != "" {
-		cfgPath = os.Getenv("CENTAURI_CONFIG")
-	} else {
-		// get user's home directory
-		home, err := os.UserHomeDir()
-		if err != nil {
-			log.Fatal(err)
-		}
-		// append config file to home directory
-		cfgPath = home + "/.centauri/config.yaml"
+		return os.Getenv("CENTAURI_CONFIG"), nil
+	}
+	// get user's home directory
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	// append config file to home directory
+	return home + "/.centauri/config.yaml", nil
+}
+
+func Init() {
+	cfgPath, err := Path()
+	if err != nil {
+		log.Fatal(err)
 	}
 	if err := LoadIfExists(cfgPath); err != nil {
 		log.Fatal(err)
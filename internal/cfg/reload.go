@@ -0,0 +1,59 @@
+package cfg
+
+import (
+	"reflect"
+	"strings"
+)
+
+var (
+	// peerRestartRequired lists the peer settings which only take effect
+	// when centaurid is restarted.
+	peerRestartRequired = map[string]bool{
+		"name":                true,
+		"connectionMode":      true,
+		"gossipBindPort":      true,
+		"gossipAdvertisePort": true,
+		"peerKey":             true,
+		"dataBindPort":        true,
+		"dataAdvertisePort":   true,
+		"advertiseAddr":       true,
+		"serverPort":          true,
+		"dataDir":             true,
+	}
+)
+
+// ReloadResult reports which changed settings were applied to the
+// running peer and which will only take effect after a restart.
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RequiresRestart []string `json:"requiresRestart"`
+}
+
+// DiffPeerConfig compares two peer configs and classifies the changed
+// settings, by yaml name, as live or restart-only.
+func DiffPeerConfig(prev PeerConfig, next PeerConfig) *ReloadResult {
+	res := &ReloadResult{
+		Applied:         []string{},
+		RequiresRestart: []string{},
+	}
+	// enabling or disabling TLS changes the listener, but swapping
+	// certificates does not
+	tlsToggled := (prev.ServerTLSCertPath != "" && prev.ServerTLSKeyPath != "") !=
+		(next.ServerTLSCertPath != "" && next.ServerTLSKeyPath != "")
+	pv := reflect.ValueOf(prev)
+	nv := reflect.ValueOf(next)
+	t := pv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if reflect.DeepEqual(pv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		isTLS := name == "serverTLSCertPath" || name == "serverTLSKeyPath"
+		if peerRestartRequired[name] || (isTLS && tlsToggled) {
+			res.RequiresRestart = append(res.RequiresRestart, name)
+		} else {
+			res.Applied = append(res.Applied, name)
+		}
+	}
+	return res
+}
@@ -7,37 +7,104 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	PeerName                 string
-	DeletionHandlers         = []func(pubKeyID, channel string, id string) error{}
-	NewMessageHandlers       = []func(pubKeyID, channel string, id string) error{}
-	ReceivedDeletionHandlers = []func(pubKeyID, channel string, id string, eventTrigger bool) error{}
-	ReceivedMessageHandlers  = []func(pubKeyID string, channel string, id string, peerAddr string, peerPort int) error{}
-)
+// Bus dispatches message events of a single peer to the registered handlers.
+type Bus struct {
+	DeletionHandlers         []func(pubKeyID, channel string, id string) error
+	NewMessageHandlers       []func(pubKeyID, channel string, id string) error
+	ReceivedDeletionHandlers []func(pubKeyID, channel string, id string, eventTrigger bool) error
+	ReceivedMessageHandlers  []func(pubKeyID string, channel string, id string, peerAddr string, peerPort int) error
+	// RotationHandlers are called when a key is rotated on this peer and
+	// ReceivedRotationHandlers when another peer announces a rotation.
+	RotationHandlers         []func(pubKeyID string, newKeyID string) error
+	ReceivedRotationHandlers []func(pubKeyID string, peerAddr string, peerPort int) error
+	// KeyRecordHandlers are called when a key directory record is
+	// published on this peer and ReceivedKeyRecordHandlers when another
+	// peer announces one.
+	KeyRecordHandlers         []func(pubKeyID string, version string) error
+	ReceivedKeyRecordHandlers []func(pubKeyID string, peerAddr string, peerPort int) error
+	// RevocationHandlers are called when a key is revoked on this peer
+	// and ReceivedRevocationHandlers when another peer announces a
+	// revocation.
+	RevocationHandlers         []func(pubKeyID string) error
+	ReceivedRevocationHandlers []func(pubKeyID string, peerAddr string, peerPort int) error
+	// DeletionSetHandlers are called when a batch of messages is deleted
+	// on this peer and ReceivedDeletionSetHandlers when another peer
+	// announces one.
+	DeletionSetHandlers         []func(pubKeyID string, setID string) error
+	ReceivedDeletionSetHandlers []func(pubKeyID string, setID string, peerAddr string, peerPort int) error
+}
+
+func New() *Bus {
+	return &Bus{}
+}
 
-func DeleteMessage(pubKeyID, channel, id string) {
+func (b *Bus) DeleteMessage(pubKeyID, channel, id string) {
 	l := log.WithFields(log.Fields{
 		"pkg": "events",
 		"fn":  "DeleteMessage",
 	})
 	l.Debug("deleting message")
-	for _, f := range DeletionHandlers {
+	for _, f := range b.DeletionHandlers {
 		go f(pubKeyID, channel, id)
 	}
 }
 
-func NewMessage(pubKeyID, channel string, id string) {
+func (b *Bus) NewMessage(pubKeyID, channel string, id string) {
 	l := log.WithFields(log.Fields{
 		"pkg": "events",
 		"fn":  "NewMessage",
 	})
 	l.Debug("new message")
-	for _, f := range NewMessageHandlers {
+	for _, f := range b.NewMessageHandlers {
 		go f(pubKeyID, channel, id)
 	}
 }
 
-func ReceiveMessage(data []byte) error {
+func (b *Bus) NewRotation(pubKeyID, newKeyID string) {
+	l := log.WithFields(log.Fields{
+		"pkg": "events",
+		"fn":  "NewRotation",
+	})
+	l.Debug("new rotation")
+	for _, f := range b.RotationHandlers {
+		go f(pubKeyID, newKeyID)
+	}
+}
+
+func (b *Bus) NewKeyRecord(pubKeyID, version string) {
+	l := log.WithFields(log.Fields{
+		"pkg": "events",
+		"fn":  "NewKeyRecord",
+	})
+	l.Debug("new key record")
+	for _, f := range b.KeyRecordHandlers {
+		go f(pubKeyID, version)
+	}
+}
+
+func (b *Bus) NewRevocation(pubKeyID string) {
+	l := log.WithFields(log.Fields{
+		"pkg": "events",
+		"fn":  "NewRevocation",
+	})
+	l.Debug("new revocation")
+	for _, f := range b.RevocationHandlers {
+		go f(pubKeyID)
+	}
+}
+
+func (b *Bus) DeleteMessages(pubKeyID, setID string) {
+	l := log.WithFields(log.Fields{
+		"pkg": "events",
+		"fn":  "DeleteMessages",
+	})
+	l.Debug("deleting messages")
+	for _, f := range b.DeletionSetHandlers {
+		go f(pubKeyID, setID)
+	}
+}
+
+func (b *Bus) ReceiveMessage(data []byte) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "events",
 		"fn":  "ReceiveMessage",
@@ -56,7 +123,7 @@ func ReceiveMessage(data []byte) error {
 		channel := md["channel"].(string)
 		peerAddr := md["peerAddr"].(string)
 		peerDataPort := int(md["peerPort"].(float64))
-		for _, f := range ReceivedMessageHandlers {
+		for _, f := range b.ReceivedMessageHandlers {
 			if err := f(pubKeyID, channel, id, peerAddr, peerDataPort); err != nil {
 				l.Errorf("error receiving message: %v", err)
 				return err
@@ -67,12 +134,57 @@ func ReceiveMessage(data []byte) error {
 		pubKeyID := md["pubKeyID"].(string)
 		channel := md["channel"].(string)
 		id := md["id"].(string)
-		for _, f := range ReceivedDeletionHandlers {
+		for _, f := range b.ReceivedDeletionHandlers {
 			if err := f(pubKeyID, channel, id, true); err != nil {
 				l.Errorf("error deleting message: %v", err)
 				return err
 			}
 		}
+	case "keyRotation":
+		l.Debug("key rotation")
+		pubKeyID := md["pubKeyID"].(string)
+		peerAddr := md["peerAddr"].(string)
+		peerDataPort := int(md["peerPort"].(float64))
+		for _, f := range b.ReceivedRotationHandlers {
+			if err := f(pubKeyID, peerAddr, peerDataPort); err != nil {
+				l.Errorf("error receiving rotation: %v", err)
+				return err
+			}
+		}
+	case "keyRecord":
+		l.Debug("key record")
+		pubKeyID := md["pubKeyID"].(string)
+		peerAddr := md["peerAddr"].(string)
+		peerDataPort := int(md["peerPort"].(float64))
+		for _, f := range b.ReceivedKeyRecordHandlers {
+			if err := f(pubKeyID, peerAddr, peerDataPort); err != nil {
+				l.Errorf("error receiving key record: %v", err)
+				return err
+			}
+		}
+	case "keyRevocation":
+		l.Debug("key revocation")
+		pubKeyID := md["pubKeyID"].(string)
+		peerAddr := md["peerAddr"].(string)
+		peerDataPort := int(md["peerPort"].(float64))
+		for _, f := range b.ReceivedRevocationHandlers {
+			if err := f(pubKeyID, peerAddr, peerDataPort); err != nil {
+				l.Errorf("error receiving revocation: %v", err)
+				return err
+			}
+		}
+	case "deleteMessages":
+		l.Debug("delete messages")
+		pubKeyID := md["pubKeyID"].(string)
+		setID := md["id"].(string)
+		peerAddr := md["peerAddr"].(string)
+		peerDataPort := int(md["peerPort"].(float64))
+		for _, f := range b.ReceivedDeletionSetHandlers {
+			if err := f(pubKeyID, setID, peerAddr, peerDataPort); err != nil {
+				l.Errorf("error receiving deletion set: %v", err)
+				return err
+			}
+		}
 	default:
 		l.Errorf("unknown message type: %v", md["type"])
 		return errors.New("unknown message type")
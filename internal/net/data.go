@@ -7,10 +7,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"strconv"
 	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/pkg/api"
 	"github.com/robertlestak/centauri/pkg/keys"
 	log "github.com/sirupsen/logrus"
 )
@@ -18,10 +22,13 @@ import (
 type DataMessageType string
 
 var (
-	DataMessageRequest  = DataMessageType("request")
-	DataMessageResponse = DataMessageType("response")
-	ErrorMissingFields  = "missing fields"
-	SearchingPeerData   = make(map[*DataMessage][]*NodeMeta)
+	DataMessageRequest       = DataMessageType("request")
+	DataMessageResponse      = DataMessageType("response")
+	DataMessageStatusRequest = DataMessageType("status")
+	DataMessageStoreRequest  = DataMessageType("store")
+	ErrorMissingFields       = "missing fields"
+	ErrorKeyRevoked          = "key revoked"
+	SearchingPeerData        = make(map[*DataMessage][]*NodeMeta)
 )
 
 type DataMessage struct {
@@ -34,16 +41,17 @@ type DataMessage struct {
 	Sig      *string         `json:"sig,omitempty"`
 	ID       *string         `json:"id,omitempty"`
 	Data     *[]byte         `json:"data,omitempty"`
+	Status   *api.PeerStatus `json:"status,omitempty"`
 	Error    *string         `json:"error,omitempty"`
 }
 
-func (m *DataMessage) createSig() error {
+func (m *DataMessage) createSig(key []byte) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "DataMessage.createSig",
 	})
 	l.Debug("Creating signature")
-	if len(PeerKey) == 0 {
+	if len(key) == 0 {
 		l.Debugf("Peer token is nil")
 		return nil
 	}
@@ -57,8 +65,8 @@ func (m *DataMessage) createSig() error {
 		return err
 	}
 	l.Debugf("Marshalled message: %s", string(data))
-	// encrypt message with PeerKey
-	enc, err := keys.AESEncrypt(data, PeerKey)
+	// encrypt message with the peer key
+	enc, err := keys.AESEncrypt(data, key)
 	if err != nil {
 		l.Errorf("failed to encrypt message: %v", err)
 		return err
@@ -68,13 +76,13 @@ func (m *DataMessage) createSig() error {
 	return nil
 }
 
-func (m *DataMessage) validateSig() error {
+func (m *DataMessage) validateSig(key []byte) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "DataMessage.validateSig",
 	})
 	l.Debug("Validating signature")
-	if len(PeerKey) == 0 {
+	if len(key) == 0 {
 		l.Debugf("Peer token is nil")
 		return nil
 	}
@@ -82,8 +90,8 @@ func (m *DataMessage) validateSig() error {
 		l.Error("Signature is nil")
 		return errors.New("signature is nil")
 	}
-	// decrypt message with PeerKey
-	dec, err := keys.AESDecrypt(*m.Sig, PeerKey)
+	// decrypt message with the peer key
+	dec, err := keys.AESDecrypt(*m.Sig, key)
 	if err != nil {
 		l.Errorf("failed to decrypt message: %v", err)
 		return err
@@ -102,13 +110,13 @@ func (m *DataMessage) validateSig() error {
 	return nil
 }
 
-func writeMessage(conn net.Conn, m *DataMessage) error {
+func (p *Peer) writeMessage(conn net.Conn, m *DataMessage) error {
 	l := log.WithFields(log.Fields{
 		"module": "net",
 		"method": "writeMessage",
 	})
 	l.Debug("Writing message")
-	if err := m.createSig(); err != nil {
+	if err := m.createSig(p.Key); err != nil {
 		l.Errorf("failed to create signature: %v", err)
 		return err
 	}
@@ -131,7 +139,7 @@ func writeMessage(conn net.Conn, m *DataMessage) error {
 	return nil
 }
 
-func readMessage(conn net.Conn) (*DataMessage, error) {
+func (p *Peer) readMessage(conn net.Conn) (*DataMessage, error) {
 	l := log.WithFields(log.Fields{
 		"module": "net",
 		"method": "readMessage",
@@ -166,40 +174,42 @@ func readMessage(conn net.Conn) (*DataMessage, error) {
 		return nil, err
 	}
 	l.Debugf("Parsed message: %v", dataMsg)
-	if err := dataMsg.validateSig(); err != nil {
+	if err := dataMsg.validateSig(p.Key); err != nil {
 		l.Errorf("failed to validate signature: %v", err)
 		return nil, err
 	}
 	return &dataMsg, nil
 }
 
-func RequestDataFromPeerBestEffort(peerAddr string, peerPort int, pubKeyID string, channel string, id string) ([]byte, error) {
+func (p *Peer) RequestDataFromPeerBestEffort(peerAddr string, peerPort int, pubKeyID string, channel string, id string) ([]byte, error) {
 	l := log.WithFields(log.Fields{
 		"module": "net",
 		"method": "RequestDataFromPeerBestEffort",
 	})
 	l.Debug("Requesting data from peer")
-	d, err := RequestDataFromPeer(peerAddr, peerPort, pubKeyID, channel, id)
+	p.startFetching(pubKeyID, channel, id)
+	defer p.stopFetching(pubKeyID, channel, id)
+	d, err := p.RequestDataFromPeer(peerAddr, peerPort, pubKeyID, channel, id)
 	if err != nil {
 		l.Errorf("failed to request data from original peer: %v", err)
 		// we were unable to get the data from the original peer, let's try from our other peers
 		checkLimit := 10
-		for i, p := range ListMembers() {
+		for i, m := range p.ListMembers() {
 			if i >= checkLimit {
 				return nil, errors.New("failed to get data from any peer")
 			}
 			nm := &NodeMeta{}
-			if err := json.Unmarshal(p.Meta, nm); err != nil {
+			if err := json.Unmarshal(m.Meta, nm); err != nil {
 				l.Errorf("failed to unmarshal meta: %v", err)
 				continue
 			}
 			if nm.PeerAddr == peerAddr && nm.PeerPort == peerPort {
 				continue
 			}
-			if nm.PeerAddr == PeerAddr && nm.PeerPort == PeerDataPort {
+			if nm.PeerAddr == p.Addr && nm.PeerPort == p.DataPort {
 				continue
 			}
-			d, err := RequestDataFromPeer(nm.PeerAddr, nm.PeerPort, pubKeyID, channel, id)
+			d, err := p.RequestDataFromPeer(nm.PeerAddr, nm.PeerPort, pubKeyID, channel, id)
 			if err != nil {
 				l.Errorf("failed to request data from peer: %v", err)
 				continue
@@ -210,33 +220,54 @@ func RequestDataFromPeerBestEffort(peerAddr string, peerPort int, pubKeyID strin
 	return d, nil
 }
 
-func RequestDataFromPeer(peerAddr string, peerPort int, pubKeyID string, channel string, id string) ([]byte, error) {
+func (p *Peer) RequestDataFromPeer(peerAddr string, peerPort int, pubKeyID string, channel string, id string) ([]byte, error) {
 	l := log.WithFields(log.Fields{
 		"module": "net",
 		"method": "RequestDataFromPeer",
 	})
 	l.Debugf("Requesting data from peer %s:%d", peerAddr, peerPort)
+	dataMsg, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+		Type:     DataMessageRequest,
+		PeerName: &p.Name,
+		PubKeyID: &pubKeyID,
+		Channel:  &channel,
+		ID:       &id,
+	})
+	if err != nil {
+		l.Errorf("failed to exchange message: %v", err)
+		return nil, err
+	}
+	if dataMsg.Data == nil {
+		l.Error("no data in message")
+		return nil, errors.New("no data in message")
+	}
+	l.Debug("Message handled")
+	// return data
+	return *dataMsg.Data, nil
+}
+
+// exchangeMessage sends a single request to the data port of the specified
+// peer and returns its response.
+func (p *Peer) exchangeMessage(peerAddr string, peerPort int, m *DataMessage) (*DataMessage, error) {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "exchangeMessage",
+	})
 	// create a tcp connection
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", peerAddr, peerPort))
+	conn, err := p.transport().DialData(net.JoinHostPort(peerAddr, strconv.Itoa(peerPort)))
 	if err != nil {
 		l.Errorf("failed to connect to peer: %v", err)
 		return nil, err
 	}
+	defer conn.Close()
 	l.Debug("connected to peer")
 	// write message
-	err = writeMessage(conn, &DataMessage{
-		Type:     DataMessageRequest,
-		PeerName: &PeerName,
-		PubKeyID: &pubKeyID,
-		Channel:  &channel,
-		ID:       &id,
-	})
-	if err != nil {
+	if err := p.writeMessage(conn, m); err != nil {
 		l.Errorf("failed to write message: %v", err)
 		return nil, err
 	}
 	l.Debug("wrote message")
-	dataMsg, err := readMessage(conn)
+	dataMsg, err := p.readMessage(conn)
 	if err != nil {
 		l.Errorf("failed to read message: %v", err)
 		return nil, err
@@ -250,12 +281,10 @@ func RequestDataFromPeer(peerAddr string, peerPort int, pubKeyID string, channel
 		l.Errorf("error in message: %v", *dataMsg.Error)
 		return nil, fmt.Errorf("error in message: %v", *dataMsg.Error)
 	}
-	l.Debug("Message handled")
-	// return data
-	return *dataMsg.Data, nil
+	return dataMsg, nil
 }
 
-func handleDataConnection(conn net.Conn) {
+func (p *Peer) handleDataConnection(conn net.Conn) {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "handleDataConnection",
@@ -264,7 +293,7 @@ func handleDataConnection(conn net.Conn) {
 	defer conn.Close()
 	var err error
 	// read message
-	dataMsg, err := readMessage(conn)
+	dataMsg, err := p.readMessage(conn)
 	if err != nil {
 		l.Errorf("failed to read message: %v", err)
 		return
@@ -273,10 +302,10 @@ func handleDataConnection(conn net.Conn) {
 		l.Debug("No message received")
 		return
 	}
-	if !PeerInList(*dataMsg.PeerName) {
+	if !p.PeerInList(*dataMsg.PeerName) {
 		l.Debug("Peer not in list")
 		err := "Peer not in list"
-		writeMessage(conn, &DataMessage{
+		p.writeMessage(conn, &DataMessage{
 			Type:  DataMessageResponse,
 			Error: &err,
 		})
@@ -285,42 +314,192 @@ func handleDataConnection(conn net.Conn) {
 	switch dataMsg.Type {
 	case DataMessageRequest:
 		l.Debugf("Received message: %v", dataMsg)
-		md, err := persist.GetMessageByID(*dataMsg.PubKeyID, *dataMsg.Channel, *dataMsg.ID)
+		md, err := p.Store.GetMessageByID(*dataMsg.PubKeyID, *dataMsg.Channel, *dataMsg.ID)
 		if err != nil {
 			e := err.Error()
 			l.Errorf("failed to get message: %v", err)
-			writeMessage(conn, &DataMessage{
+			p.writeMessage(conn, &DataMessage{
 				Type:     DataMessageResponse,
-				PeerName: &PeerName,
+				PeerName: &p.Name,
 				Error:    &e,
 			})
 			return
 		}
 		l.Debugf("Got message: %v", md)
 		// write message
-		writeMessage(conn, &DataMessage{
+		p.writeMessage(conn, &DataMessage{
 			Type:     DataMessageResponse,
-			PeerName: &PeerName,
+			PeerName: &p.Name,
 			ID:       dataMsg.ID,
 			PubKeyID: dataMsg.PubKeyID,
 			Channel:  dataMsg.Channel,
 			Data:     &md,
 		})
+	case DataMessageStoreRequest:
+		l.Debugf("Received store request: %v", dataMsg)
+		e := p.handleStoreRequest(dataMsg)
+		if e != nil {
+			es := e.Error()
+			p.writeMessage(conn, &DataMessage{
+				Type:     DataMessageResponse,
+				PeerName: &p.Name,
+				Error:    &es,
+			})
+			return
+		}
+		p.writeMessage(conn, &DataMessage{
+			Type:     DataMessageResponse,
+			PeerName: &p.Name,
+			ID:       dataMsg.ID,
+			PubKeyID: dataMsg.PubKeyID,
+			Channel:  dataMsg.Channel,
+		})
+	case DataMessageStatusRequest:
+		l.Debugf("Received status request: %v", dataMsg)
+		if dataMsg.PubKeyID == nil || dataMsg.Channel == nil || dataMsg.ID == nil {
+			e := ErrorMissingFields
+			p.writeMessage(conn, &DataMessage{
+				Type:     DataMessageResponse,
+				PeerName: &p.Name,
+				Error:    &e,
+			})
+			return
+		}
+		st := p.LocalMessageStatus(*dataMsg.PubKeyID, *dataMsg.Channel, *dataMsg.ID)
+		p.writeMessage(conn, &DataMessage{
+			Type:     DataMessageResponse,
+			PeerName: &p.Name,
+			ID:       dataMsg.ID,
+			PubKeyID: dataMsg.PubKeyID,
+			Channel:  dataMsg.Channel,
+			Status:   st,
+		})
+	case DataMessageStatusesRequest:
+		l.Debugf("Received statuses request: %v", dataMsg)
+		p.writeMessage(conn, p.handleStatusesRequest(dataMsg))
+	case DataMessageRotationRequest:
+		l.Debugf("Received rotation request: %v", dataMsg)
+		p.writeMessage(conn, p.handleRotationRequest(dataMsg))
+	case DataMessageKeyRecordRequest:
+		l.Debugf("Received key record request: %v", dataMsg)
+		p.writeMessage(conn, p.handleKeyRecordRequest(dataMsg))
+	case DataMessageDirectoryRequest:
+		l.Debugf("Received directory request: %v", dataMsg)
+		p.writeMessage(conn, p.handleDirectoryRequest(dataMsg))
+	case DataMessageRevocationRequest:
+		l.Debugf("Received revocation request: %v", dataMsg)
+		p.writeMessage(conn, p.handleRevocationRequest(dataMsg))
+	case DataMessageRevocationsRequest:
+		l.Debugf("Received revocations request: %v", dataMsg)
+		p.writeMessage(conn, p.handleRevocationsRequest(dataMsg))
+	case DataMessageDeletionSetRequest:
+		l.Debugf("Received deletion set request: %v", dataMsg)
+		p.writeMessage(conn, p.handleDeletionSetRequest(dataMsg))
 	default:
 		l.Errorf("Unknown message type: %v", dataMsg.Type)
 	}
 }
 
-func DataServer(port int) {
+func (p *Peer) handleStoreRequest(dataMsg *DataMessage) error {
+	if dataMsg.PubKeyID == nil || dataMsg.Channel == nil || dataMsg.ID == nil || dataMsg.Data == nil {
+		return errors.New(ErrorMissingFields)
+	}
+	// the names come from the peer and become path elements
+	if !persist.ValidName(*dataMsg.PubKeyID) || (*dataMsg.Channel != "" && !persist.ValidName(*dataMsg.Channel)) || !persist.ValidName(*dataMsg.ID) {
+		return errors.New("invalid message name")
+	}
+	if p.Store.TombstoneExists(*dataMsg.PubKeyID, *dataMsg.Channel, *dataMsg.ID) {
+		// the message has already been deleted, nothing to store
+		return nil
+	}
+	return p.Store.StoreMessage(*dataMsg.PubKeyID, *dataMsg.Channel, *dataMsg.ID, *dataMsg.Data)
+}
+
+// PushDataToPeer sends a full copy of a message to the specified peer,
+// which will store it locally.
+func (p *Peer) PushDataToPeer(peerAddr string, peerPort int, pubKeyID string, channel string, id string, data []byte) error {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "PushDataToPeer",
+	})
+	l.Debugf("Pushing data to peer %s:%d", peerAddr, peerPort)
+	_, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+		Type:     DataMessageStoreRequest,
+		PeerName: &p.Name,
+		PubKeyID: &pubKeyID,
+		Channel:  &channel,
+		ID:       &id,
+		Data:     &data,
+	})
+	if err != nil {
+		l.Errorf("failed to exchange message: %v", err)
+		return err
+	}
+	return nil
+}
+
+// HandoffData pushes a copy of the message to the first live peer,
+// in random order, which accepts it.
+func (p *Peer) HandoffData(pubKeyID string, channel string, id string, data []byte) error {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "HandoffData",
+	})
+	members := p.ListMembers()
+	for _, i := range rand.Perm(len(members)) {
+		m := members[i]
+		if m.Name == p.Name || m.State != memberlist.StateAlive {
+			continue
+		}
+		nm := &NodeMeta{}
+		if err := json.Unmarshal(m.Meta, nm); err != nil {
+			l.Errorf("failed to unmarshal meta: %v", err)
+			continue
+		}
+		if err := p.PushDataToPeer(nm.PeerAddr, nm.PeerPort, pubKeyID, channel, id, data); err != nil {
+			l.Errorf("failed to push data to peer %s: %v", m.Name, err)
+			continue
+		}
+		l.Debugf("handed off message %s to peer %s", id, m.Name)
+		return nil
+	}
+	return errors.New("no peer accepted the message")
+}
+
+// ListenData opens the data port listener and returns the bound port,
+// which is chosen by the system if port is 0.
+func (p *Peer) ListenData(port int) (int, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
-		"fn":  "DataServer",
+		"fn":  "ListenData",
 	})
-	l.Debugf("Starting data server on port %d", port)
-	// create a tcp listener
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	l.Debugf("Listening for data on port %d", port)
+	listener, err := p.transport().ListenData(port)
 	if err != nil {
 		l.Errorf("failed to start data server: %v", err)
+		return 0, err
+	}
+	p.dataListenerMtx.Lock()
+	p.dataListener = listener
+	p.dataListenerMtx.Unlock()
+	if a, ok := listener.Addr().(*net.TCPAddr); ok {
+		return a.Port, nil
+	}
+	return port, nil
+}
+
+// DataServer accepts connections on the data port until StopDataServer is
+// called. ListenData must be called first.
+func (p *Peer) DataServer() {
+	l := log.WithFields(log.Fields{
+		"pkg": "net",
+		"fn":  "DataServer",
+	})
+	p.dataListenerMtx.Lock()
+	listener := p.dataListener
+	p.dataListenerMtx.Unlock()
+	if listener == nil {
+		l.Error("data server not listening")
 		return
 	}
 	l.Debug("data server started")
@@ -328,11 +507,33 @@ func DataServer(port int) {
 		// accept a connection
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.Debug("data server stopped")
+				return
+			}
 			l.Errorf("failed to accept connection: %v", err)
 			continue
 		}
 		l.Debug("accepted connection")
+		if !p.addrAllowed(conn.RemoteAddr()) {
+			l.Debugf("rejecting connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
 		// handle the connection
-		go handleDataConnection(conn)
+		go p.handleDataConnection(conn)
+	}
+}
+
+// StopDataServer closes the data server listener. Connections which
+// have already been accepted are allowed to finish.
+func (p *Peer) StopDataServer() error {
+	p.dataListenerMtx.Lock()
+	defer p.dataListenerMtx.Unlock()
+	if p.dataListener == nil {
+		return nil
 	}
+	err := p.dataListener.Close()
+	p.dataListener = nil
+	return err
 }
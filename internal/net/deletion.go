@@ -0,0 +1,95 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// DataMessageDeletionSetRequest asks a peer for the batch deletion ID
+	// of the key PubKeyID.
+	DataMessageDeletionSetRequest = DataMessageType("deletionSet")
+)
+
+// BroadcastDeletionSet tells the other peers that the messages of the
+// batch deletion setID of the key pubKeyID have been deleted. The peers
+// fetch the set from this peer, so that a single broadcast is sent for
+// any number of messages.
+func (p *Peer) BroadcastDeletionSet(pubKeyID string, setID string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "net",
+		"fn":  "BroadcastDeletionSet",
+	})
+	l.Debugf("Broadcasting deletion set %s for pubKeyID: %s", setID, pubKeyID)
+	msg := &BroadcastMessage{
+		Type:     "deleteMessages",
+		PubKeyID: pubKeyID,
+		ID:       setID,
+		PeerAddr: p.AdvertiseAddr(),
+		PeerPort: p.DataPort,
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		l.Errorf("failed to marshal message: %v", err)
+		return err
+	}
+	bm := &broadcast{
+		msgType:  "deleteMessages",
+		pubKeyID: pubKeyID,
+		msgID:    setID,
+		msg:      b,
+		notify:   nil,
+	}
+	go p.Broadcast(bm)
+	p.storeNewMessage(msg.Type, msg.PubKeyID, msg.Channel, msg.ID)
+	return nil
+}
+
+// RequestDeletionSetFromPeer returns the batch deletion setID of the key
+// pubKeyID held by the peer.
+func (p *Peer) RequestDeletionSetFromPeer(peerAddr string, peerPort int, pubKeyID string, setID string) ([]byte, error) {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "RequestDeletionSetFromPeer",
+	})
+	l.Debugf("Requesting deletion set from peer %s:%d", peerAddr, peerPort)
+	dataMsg, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+		Type:     DataMessageDeletionSetRequest,
+		PeerName: &p.Name,
+		PubKeyID: &pubKeyID,
+		ID:       &setID,
+	})
+	if err != nil {
+		l.Errorf("failed to exchange message: %v", err)
+		return nil, err
+	}
+	if dataMsg.Data == nil {
+		l.Error("no data in message")
+		return nil, errors.New("no data in message")
+	}
+	return *dataMsg.Data, nil
+}
+
+func (p *Peer) handleDeletionSetRequest(dataMsg *DataMessage) *DataMessage {
+	res := &DataMessage{
+		Type:     DataMessageResponse,
+		PeerName: &p.Name,
+		PubKeyID: dataMsg.PubKeyID,
+		ID:       dataMsg.ID,
+	}
+	if dataMsg.PubKeyID == nil || dataMsg.ID == nil {
+		e := ErrorMissingFields
+		res.Error = &e
+		return res
+	}
+	data, err := p.Store.GetDeletionSet(*dataMsg.ID)
+	if err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	res.Data = &data
+	return res
+}
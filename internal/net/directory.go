@@ -0,0 +1,151 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// DataMessageKeyRecordRequest asks a peer for the key directory record
+	// of the key PubKeyID.
+	DataMessageKeyRecordRequest = DataMessageType("keyRecord")
+	// DataMessageDirectoryRequest asks a peer for all records of its key
+	// directory, to sync the directory of a peer which missed broadcasts.
+	DataMessageDirectoryRequest = DataMessageType("directory")
+)
+
+// BroadcastKeyRecord tells the other peers that the key directory record
+// of the key pubKeyID was published. version tells apart the records
+// published for the same key.
+func (p *Peer) BroadcastKeyRecord(pubKeyID string, version string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "net",
+		"fn":  "BroadcastKeyRecord",
+	})
+	l.Debugf("Broadcasting key record of pubKeyID: %s", pubKeyID)
+	msg := &BroadcastMessage{
+		Type:     "keyRecord",
+		PubKeyID: pubKeyID,
+		ID:       version,
+		PeerAddr: p.AdvertiseAddr(),
+		PeerPort: p.DataPort,
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		l.Errorf("failed to marshal message: %v", err)
+		return err
+	}
+	bm := &broadcast{
+		msgType:  "keyRecord",
+		pubKeyID: pubKeyID,
+		msgID:    version,
+		msg:      b,
+		notify:   nil,
+	}
+	go p.Broadcast(bm)
+	p.storeNewMessage(msg.Type, msg.PubKeyID, msg.Channel, msg.ID)
+	return nil
+}
+
+// RequestKeyRecordFromPeer returns the key directory record of the key
+// pubKeyID held by the peer.
+func (p *Peer) RequestKeyRecordFromPeer(peerAddr string, peerPort int, pubKeyID string) ([]byte, error) {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "RequestKeyRecordFromPeer",
+	})
+	l.Debugf("Requesting key record from peer %s:%d", peerAddr, peerPort)
+	dataMsg, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+		Type:     DataMessageKeyRecordRequest,
+		PeerName: &p.Name,
+		PubKeyID: &pubKeyID,
+	})
+	if err != nil {
+		l.Errorf("failed to exchange message: %v", err)
+		return nil, err
+	}
+	if dataMsg.Data == nil {
+		l.Error("no data in message")
+		return nil, errors.New("no data in message")
+	}
+	return *dataMsg.Data, nil
+}
+
+// RequestDirectoryFromPeer returns all key directory records held by the
+// peer.
+func (p *Peer) RequestDirectoryFromPeer(peerAddr string, peerPort int) ([][]byte, error) {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "RequestDirectoryFromPeer",
+	})
+	l.Debugf("Requesting directory from peer %s:%d", peerAddr, peerPort)
+	dataMsg, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+		Type:     DataMessageDirectoryRequest,
+		PeerName: &p.Name,
+	})
+	if err != nil {
+		l.Errorf("failed to exchange message: %v", err)
+		return nil, err
+	}
+	if dataMsg.Data == nil {
+		return nil, nil
+	}
+	var rs []json.RawMessage
+	if err := json.Unmarshal(*dataMsg.Data, &rs); err != nil {
+		l.Errorf("failed to unmarshal directory: %v", err)
+		return nil, err
+	}
+	var records [][]byte
+	for _, r := range rs {
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+func (p *Peer) handleKeyRecordRequest(dataMsg *DataMessage) *DataMessage {
+	res := &DataMessage{
+		Type:     DataMessageResponse,
+		PeerName: &p.Name,
+		PubKeyID: dataMsg.PubKeyID,
+	}
+	if dataMsg.PubKeyID == nil {
+		e := ErrorMissingFields
+		res.Error = &e
+		return res
+	}
+	data, err := p.Store.GetKeyRecord(*dataMsg.PubKeyID)
+	if err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	res.Data = &data
+	return res
+}
+
+func (p *Peer) handleDirectoryRequest(dataMsg *DataMessage) *DataMessage {
+	res := &DataMessage{
+		Type:     DataMessageResponse,
+		PeerName: &p.Name,
+	}
+	records, err := p.Store.ListKeyRecords()
+	if err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	rs := make([]json.RawMessage, 0, len(records))
+	for _, r := range records {
+		rs = append(rs, r)
+	}
+	data, err := json.Marshal(rs)
+	if err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	res.Data = &data
+	return res
+}
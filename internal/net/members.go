@@ -0,0 +1,192 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/memberlist"
+	log "github.com/sirupsen/logrus"
+)
+
+// MemberStatus is the operator-facing view of a single memberlist member.
+type MemberStatus struct {
+	Name            string    `json:"name"`
+	Addr            string    `json:"addr"`
+	Port            uint16    `json:"port"`
+	State           string    `json:"state"`
+	Meta            *NodeMeta `json:"meta,omitempty"`
+	ProtocolVersion uint8     `json:"protocolVersion"`
+	ProtocolMin     uint8     `json:"protocolMin"`
+	ProtocolMax     uint8     `json:"protocolMax"`
+	DelegateVersion uint8     `json:"delegateVersion"`
+	Local           bool      `json:"local"`
+}
+
+// ClusterStatus is the local node's view of the cluster.
+type ClusterStatus struct {
+	LocalName       string         `json:"localName"`
+	HealthScore     int            `json:"healthScore"`
+	ProtocolVersion uint8          `json:"protocolVersion"`
+	NumAlive        int            `json:"numAlive"`
+	Members         []MemberStatus `json:"members"`
+}
+
+func stateString(s memberlist.NodeStateType) string {
+	switch s {
+	case memberlist.StateAlive:
+		return "alive"
+	case memberlist.StateSuspect:
+		return "suspect"
+	case memberlist.StateDead:
+		return "dead"
+	case memberlist.StateLeft:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+func (p *Peer) isForcedLeft(name string) bool {
+	p.forcedLeftMtx.RLock()
+	defer p.forcedLeftMtx.RUnlock()
+	return p.forcedLeft[name]
+}
+
+func (p *Peer) clearForcedLeft(name string) {
+	p.forcedLeftMtx.Lock()
+	delete(p.forcedLeft, name)
+	p.forcedLeftMtx.Unlock()
+}
+
+func (p *Peer) GetClusterStatus() *ClusterStatus {
+	cs := &ClusterStatus{
+		LocalName:       p.Name,
+		HealthScore:     p.List.GetHealthScore(),
+		ProtocolVersion: p.List.ProtocolVersion(),
+		NumAlive:        p.List.NumMembers(),
+		Members:         []MemberStatus{},
+	}
+	for _, n := range p.ListMembers() {
+		ms := MemberStatus{
+			Name:            n.Name,
+			Addr:            n.Addr.String(),
+			Port:            n.Port,
+			State:           stateString(n.State),
+			ProtocolVersion: n.PCur,
+			ProtocolMin:     n.PMin,
+			ProtocolMax:     n.PMax,
+			DelegateVersion: n.DCur,
+			Local:           n.Name == p.Name,
+		}
+		nm := &NodeMeta{}
+		if err := json.Unmarshal(n.Meta, nm); err == nil {
+			ms.Meta = nm
+		}
+		cs.Members = append(cs.Members, ms)
+	}
+	return cs
+}
+
+// ForceLeave removes a member which is no longer alive from this peer's view
+// of the cluster and tells the other peers to do the same. The member is
+// restored automatically if it rejoins.
+//
+// Only the views of the peers change: the member is hidden from the
+// members listed and the peers messages are replicated to, but memberlist
+// keeps it until it reaps it, and a peer which misses the broadcast, or
+// joins later, still sees it.
+func (p *Peer) ForceLeave(name string) error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "net",
+		"fn":   "ForceLeave",
+		"node": name,
+	})
+	l.Debug("forcing node to leave")
+	if name == p.Name {
+		return errors.New("cannot force leave local node")
+	}
+	var node *memberlist.Node
+	for _, n := range p.List.Members() {
+		if n.Name == name {
+			node = n
+			break
+		}
+	}
+	if node == nil {
+		return errors.New("node not found or already removed")
+	}
+	if node.State == memberlist.StateAlive {
+		return errors.New("node is alive")
+	}
+	p.markForcedLeft(name)
+	return p.BroadcastForceLeave(name)
+}
+
+func (p *Peer) markForcedLeft(name string) {
+	p.forcedLeftMtx.Lock()
+	p.forcedLeft[name] = true
+	p.forcedLeftMtx.Unlock()
+}
+
+// BroadcastForceLeave tells the other peers to force the member name to
+// leave. Every broadcast has its own ID, so that a member which rejoined
+// can be forced to leave again.
+func (p *Peer) BroadcastForceLeave(name string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "net",
+		"fn":  "BroadcastForceLeave",
+	})
+	l.Debugf("Broadcasting force leave for node: %s", name)
+	msg := &BroadcastMessage{
+		Type: "forceLeave",
+		ID:   uuid.New().String(),
+		Node: name,
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		l.Errorf("failed to marshal message: %v", err)
+		return err
+	}
+	bm := &broadcast{
+		msgType: "forceLeave",
+		msgID:   msg.ID,
+		msg:     b,
+		notify:  nil,
+	}
+	go p.Broadcast(bm)
+	p.storeNewMessage(msg.Type, msg.PubKeyID, msg.Channel, msg.ID)
+	return nil
+}
+
+func (p *Peer) handleForceLeave(name string) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "net",
+		"fn":   "handleForceLeave",
+		"node": name,
+	})
+	if name == p.Name {
+		l.Debug("ignoring force leave for local node")
+		return
+	}
+	for _, n := range p.List.Members() {
+		if n.Name == name && n.State == memberlist.StateAlive {
+			l.Debug("ignoring force leave for alive node")
+			return
+		}
+	}
+	p.markForcedLeft(name)
+}
+
+// SetPeerAddrs sets the addresses used to rejoin the cluster.
+func (p *Peer) SetPeerAddrs(addrs []string) {
+	p.peerAddrsMtx.Lock()
+	p.peerAddrs = addrs
+	p.peerAddrsMtx.Unlock()
+}
+
+func (p *Peer) GetPeerAddrs() []string {
+	p.peerAddrsMtx.RLock()
+	defer p.peerAddrsMtx.RUnlock()
+	return p.peerAddrs
+}
@@ -11,21 +11,50 @@ import (
 	"time"
 
 	"github.com/hashicorp/memberlist"
+	"github.com/robertlestak/centauri/internal/persist"
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	PeerName                  string
-	PeerAddr                  string
-	PeerKey                   []byte
-	PeerDataPort              int
-	Meta                      []byte
+// Peer is a single member of a Centauri cluster. It owns the memberlist
+// used for gossip and the data port used to transfer messages between peers.
+type Peer struct {
+	Name     string
+	Addr     string
+	Key      []byte
+	DataPort int
+	Store    *persist.Store
+	// Transport carries the gossip and data traffic. It must be set
+	// before ListenData and Create.
+	Transport Transport
+	// NotifyMessageEventHandler is called when a new message is received from another peer
 	NotifyMessageEventHandler func(data []byte) error
-	mtx                       sync.RWMutex
 	List                      *memberlist.Memberlist
 	Queue                     *memberlist.TransmitLimitedQueue
-	recentMessages            = map[string][]string{}
-)
+
+	meta             []byte
+	mtx              sync.RWMutex
+	recentMessages   map[string][]string
+	fetchingMtx      sync.RWMutex
+	fetchingMessages map[string]int
+	forcedLeftMtx    sync.RWMutex
+	forcedLeft       map[string]bool
+	peerAddrsMtx     sync.RWMutex
+	peerAddrs        []string
+	cidrsMtx         sync.RWMutex
+	allowedCidrs     []network.IPNet
+	dataListenerMtx  sync.Mutex
+	dataListener     network.Listener
+}
+
+func New(name string, store *persist.Store) *Peer {
+	return &Peer{
+		Name:             name,
+		Store:            store,
+		recentMessages:   map[string][]string{},
+		fetchingMessages: map[string]int{},
+		forcedLeft:       map[string]bool{},
+	}
+}
 
 type BroadcastMessage struct {
 	Type     string `json:"type"`
@@ -34,6 +63,8 @@ type BroadcastMessage struct {
 	ID       string `json:"id"`
 	PeerAddr string `json:"peerAddr"`
 	PeerPort int    `json:"peerPort"`
+	// Node is the member a forceLeave message is about.
+	Node string `json:"node,omitempty"`
 }
 
 type broadcast struct {
@@ -45,7 +76,9 @@ type broadcast struct {
 	notify   chan<- struct{}
 }
 
-type delegate struct{}
+type delegate struct {
+	peer *Peer
+}
 
 type NodeMeta struct {
 	PeerAddr string `json:"peerAddr"`
@@ -68,9 +101,9 @@ func GetLocalIP() string {
 	return ""
 }
 
-func createMeta() []byte {
+func (p *Peer) createMeta() []byte {
 	meta := &NodeMeta{}
-	meta.PeerAddr = PeerAddr
+	meta.PeerAddr = p.Addr
 	if meta.PeerAddr == "" {
 		// get local address
 		addr := GetLocalIP()
@@ -78,29 +111,29 @@ func createMeta() []byte {
 			meta.PeerAddr = addr
 		}
 	}
-	meta.PeerPort = PeerDataPort
+	meta.PeerPort = p.DataPort
 	var err error
-	Meta, err = json.Marshal(&meta)
+	p.meta, err = json.Marshal(&meta)
 	if err != nil {
 		log.Errorf("failed to marshal meta: %v", err)
 	}
-	return Meta
+	return p.meta
 }
 
 func (d *delegate) NodeMeta(limit int) []byte {
-	return Meta
+	return d.peer.meta
 }
 
-func GetRandomPeer() (*memberlist.Node, error) {
-	llen := len(List.Members())
-	if llen == 0 {
+func (p *Peer) GetRandomPeer() (*memberlist.Node, error) {
+	members := p.ListMembers()
+	if len(members) == 0 {
 		return nil, errors.New("no peers")
 	}
-	idx := rand.Intn(llen)
-	return List.Members()[idx], nil
+	idx := rand.Intn(len(members))
+	return members[idx], nil
 }
 
-func handleReceiveMessageData(b []byte) {
+func (p *Peer) handleReceiveMessageData(b []byte) {
 	l := log.WithFields(log.Fields{
 		"module": "net",
 		"method": "handleReceiveMessageData",
@@ -111,16 +144,26 @@ func handleReceiveMessageData(b []byte) {
 		l.Errorf("error unmarshalling message: %s", err)
 		return
 	}
-	if checkMessageHandled(msg.Type, msg.PubKeyID, msg.Channel, msg.ID) {
+	if p.checkMessageHandled(msg.Type, msg.PubKeyID, msg.Channel, msg.ID) {
 		return
 	}
 	l.Debugf("message not handled: %s", string(b))
-	if NotifyMessageEventHandler != nil {
-		if err := NotifyMessageEventHandler(b); err != nil {
+	if msg.Type == "forceLeave" {
+		node := msg.Node
+		if node == "" {
+			// sent by a peer which used the member name as the ID
+			node = msg.ID
+		}
+		p.handleForceLeave(node)
+		p.storeNewMessage(msg.Type, msg.PubKeyID, msg.Channel, msg.ID)
+		return
+	}
+	if p.NotifyMessageEventHandler != nil {
+		if err := p.NotifyMessageEventHandler(b); err != nil {
 			l.Errorf("error handling message: %s", err)
 		}
 	}
-	storeNewMessage(msg.Type, msg.PubKeyID, msg.Channel, msg.ID)
+	p.storeNewMessage(msg.Type, msg.PubKeyID, msg.Channel, msg.ID)
 	l.Debugf("message handled: %s", string(b))
 }
 
@@ -135,18 +178,17 @@ func (d *delegate) NotifyMsg(b []byte) {
 	if len(b) == 0 {
 		return
 	}
-	go handleReceiveMessageData(cp)
+	go d.peer.handleReceiveMessageData(cp)
 }
 
 func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte {
-	return Queue.GetBroadcasts(overhead, limit)
+	return d.peer.Queue.GetBroadcasts(overhead, limit)
 }
 
 func (d *delegate) LocalState(join bool) []byte {
-	mtx.RLock()
-	m := recentMessages
-	mtx.RUnlock()
-	b, _ := json.Marshal(m)
+	d.peer.mtx.RLock()
+	b, _ := json.Marshal(d.peer.recentMessages)
+	d.peer.mtx.RUnlock()
 	return b
 }
 
@@ -161,14 +203,16 @@ func (d *delegate) MergeRemoteState(buf []byte, join bool) {
 	if err := json.Unmarshal(buf, &m); err != nil {
 		return
 	}
-	mtx.Lock()
+	d.peer.mtx.Lock()
 	for k, v := range m {
-		recentMessages[k] = v
+		d.peer.recentMessages[k] = v
 	}
-	mtx.Unlock()
+	d.peer.mtx.Unlock()
 }
 
-type eventDelegate struct{}
+type eventDelegate struct {
+	peer *Peer
+}
 
 func (ed *eventDelegate) NotifyJoin(node *memberlist.Node) {
 	l := log.WithFields(log.Fields{
@@ -176,6 +220,7 @@ func (ed *eventDelegate) NotifyJoin(node *memberlist.Node) {
 		"fn":  "NotifyJoin",
 	})
 	l.Debugf("A node has joined: " + node.String())
+	ed.peer.clearForcedLeft(node.Name)
 }
 
 func (ed *eventDelegate) NotifyLeave(node *memberlist.Node) {
@@ -192,6 +237,9 @@ func (ed *eventDelegate) NotifyUpdate(node *memberlist.Node) {
 		"fn":  "NotifyUpdate",
 	})
 	l.Debugf("A node has updated: " + node.String())
+	if node.State == memberlist.StateAlive {
+		ed.peer.clearForcedLeft(node.Name)
+	}
 }
 
 func (b *broadcast) Invalidates(other memberlist.Broadcast) bool {
@@ -230,15 +278,19 @@ func (b *broadcast) Finished() {
 	}
 }
 
-func ListMembers() []*memberlist.Node {
-	// for _, member := range List.Members() {
-	// 	log.Printf("Member: %s %s\n", member.Name, member.Addr)
-	// }
-	return List.Members()
+func (p *Peer) ListMembers() []*memberlist.Node {
+	var members []*memberlist.Node
+	for _, member := range p.List.Members() {
+		if p.isForcedLeft(member.Name) {
+			continue
+		}
+		members = append(members, member)
+	}
+	return members
 }
 
-func PeerInList(peerName string) bool {
-	for _, member := range List.Members() {
+func (p *Peer) PeerInList(peerName string) bool {
+	for _, member := range p.ListMembers() {
 		if member.Name == peerName {
 			return true
 		}
@@ -246,15 +298,15 @@ func PeerInList(peerName string) bool {
 	return false
 }
 
-func NodeAddr() string {
-	return List.LocalNode().Addr.String()
+func (p *Peer) NodeAddr() string {
+	return p.List.LocalNode().Addr.String()
 }
 
-func AdvertiseAddr() string {
-	if PeerAddr != "" {
-		return PeerAddr
+func (p *Peer) AdvertiseAddr() string {
+	if p.Addr != "" {
+		return p.Addr
 	}
-	return NodeAddr()
+	return p.NodeAddr()
 }
 
 // resolveAddr will check if the given address is an IP
@@ -281,7 +333,7 @@ func resolveAddr(addr string) (string, error) {
 	return addr, nil
 }
 
-func Create(nodeName string, addr string, advPort int, bindPort int, connMode string, cidrsAllowed []network.IPNet) error {
+func (p *Peer) Create(nodeName string, addr string, advPort int, bindPort int, connMode string, cidrsAllowed []network.IPNet) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "Create",
@@ -294,10 +346,11 @@ func Create(nodeName string, addr string, advPort int, bindPort int, connMode st
 	} else {
 		cfg = memberlist.DefaultLocalConfig()
 	}
-	if len(PeerKey) > 0 {
-		cfg.SecretKey = PeerKey
+	if len(p.Key) > 0 {
+		cfg.SecretKey = p.Key
 	}
-	cfg.CIDRsAllowed = cidrsAllowed
+	// allowed networks are enforced by the transport so that they can be reloaded
+	p.SetAllowedCIDRs(cidrsAllowed)
 	cfg.BindPort = bindPort
 	cfg.AdvertisePort = advPort
 	raddr, err := resolveAddr(addr)
@@ -307,26 +360,36 @@ func Create(nodeName string, addr string, advPort int, bindPort int, connMode st
 	}
 	cfg.AdvertiseAddr = raddr
 	cfg.Name = nodeName
-	cfg.Events = &eventDelegate{}
-	cfg.Delegate = &delegate{}
-	createMeta()
+	cfg.Events = &eventDelegate{peer: p}
+	cfg.Delegate = &delegate{peer: p}
+	t, err := newCidrTransport(p, cfg.BindAddr, cfg.BindPort)
+	if err != nil {
+		l.Errorf("failed to create transport: %v", err)
+		return err
+	}
+	cfg.Transport = t
+	if advPort == 0 {
+		// advertise the port chosen by the system
+		cfg.AdvertisePort = t.boundPort()
+	}
+	p.createMeta()
 	list, err := memberlist.Create(cfg)
 	if err != nil {
 		l.Errorf("failed to create memberlist: %v", err)
 		return err
 	}
 	l.Debug("created memberlist")
-	List = list
+	p.List = list
 	return nil
 }
 
-func Join(addrs []string) error {
+func (p *Peer) Join(addrs []string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "Join",
 	})
 	var err error
-	_, err = List.Join(addrs)
+	_, err = p.List.Join(addrs)
 	if err != nil {
 		l.Errorf("failed to join memberlist: %v", err)
 		return err
@@ -335,20 +398,43 @@ func Join(addrs []string) error {
 	return nil
 }
 
-func CreateQueue() {
-	Queue = &memberlist.TransmitLimitedQueue{
+// Leave gracefully leaves the cluster, waiting up to timeout for the
+// leave intent to be broadcast, and then shuts down the memberlist.
+func (p *Peer) Leave(timeout time.Duration) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "net",
+		"fn":  "Leave",
+	})
+	l.Debug("leaving memberlist")
+	if p.List == nil {
+		return nil
+	}
+	if err := p.List.Leave(timeout); err != nil {
+		l.Errorf("failed to leave memberlist: %v", err)
+		return err
+	}
+	if err := p.List.Shutdown(); err != nil {
+		l.Errorf("failed to shutdown memberlist: %v", err)
+		return err
+	}
+	l.Debug("left memberlist")
+	return nil
+}
+
+func (p *Peer) CreateQueue() {
+	p.Queue = &memberlist.TransmitLimitedQueue{
 		NumNodes: func() int {
-			return List.NumMembers()
+			return p.List.NumMembers()
 		},
 		RetransmitMult: 3,
 	}
 }
 
-func Broadcast(b *broadcast) {
-	Queue.QueueBroadcast(b)
+func (p *Peer) Broadcast(b *broadcast) {
+	p.Queue.QueueBroadcast(b)
 }
 
-func BroadcastNewMessage(pubKeyID string, channel string, id string) error {
+func (p *Peer) BroadcastNewMessage(pubKeyID string, channel string, id string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "BroadcastNewMessage",
@@ -358,8 +444,8 @@ func BroadcastNewMessage(pubKeyID string, channel string, id string) error {
 		Type:     "newMessage",
 		Channel:  channel,
 		PubKeyID: pubKeyID,
-		PeerAddr: AdvertiseAddr(),
-		PeerPort: PeerDataPort,
+		PeerAddr: p.AdvertiseAddr(),
+		PeerPort: p.DataPort,
 		ID:       id,
 	}
 	b, err := json.Marshal(msg)
@@ -375,12 +461,12 @@ func BroadcastNewMessage(pubKeyID string, channel string, id string) error {
 		msg:      b,
 		notify:   nil,
 	}
-	go Broadcast(bm)
+	go p.Broadcast(bm)
 	l.Debug("broadcasted message")
 	return nil
 }
 
-func BroadcastDeleteMessage(pubKeyID string, channel string, id string) error {
+func (p *Peer) BroadcastDeleteMessage(pubKeyID string, channel string, id string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "BroadcastDeleteMessage",
@@ -405,36 +491,36 @@ func BroadcastDeleteMessage(pubKeyID string, channel string, id string) error {
 		msg:      b,
 		notify:   nil,
 	}
-	go Broadcast(bm)
+	go p.Broadcast(bm)
 	l.Debug("broadcasted message")
 	return nil
 }
 
-func storeNewMessage(mtype string, pubKeyID, channel, id string) {
+func (p *Peer) storeNewMessage(mtype string, pubKeyID, channel, id string) {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "storeNewMessage",
 	})
 	l.Debugf("Storing new message for pubKeyID: %s, channel: %s, id: %s", pubKeyID, channel, id)
-	mtx.Lock()
-	recentMessages[pubKeyID] = append(recentMessages[pubKeyID], mtype+"_"+channel+"_"+id)
-	mtx.Unlock()
+	p.mtx.Lock()
+	p.recentMessages[pubKeyID] = append(p.recentMessages[pubKeyID], mtype+"_"+channel+"_"+id)
+	p.mtx.Unlock()
 }
 
-func checkMessageHandled(mtype string, pubKeyID, channel, id string) bool {
+func (p *Peer) checkMessageHandled(mtype string, pubKeyID, channel, id string) bool {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "checkMessageHandled",
 	})
 	l.Debugf("Checking if message handled for pubKeyID: %s, channel: %s, id: %s", pubKeyID, channel, id)
-	mtx.RLock()
-	_, ok := recentMessages[pubKeyID]
-	mtx.RUnlock()
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	_, ok := p.recentMessages[pubKeyID]
 	if !ok {
 		l.Debug("pubkey not handled")
 		return false
 	}
-	for _, v := range recentMessages[pubKeyID] {
+	for _, v := range p.recentMessages[pubKeyID] {
 		if v == mtype+"_"+channel+"_"+id {
 			l.Debug("message handled")
 			return true
@@ -444,27 +530,32 @@ func checkMessageHandled(mtype string, pubKeyID, channel, id string) bool {
 	return false
 }
 
-func clearLocalCache() {
+func (p *Peer) clearLocalCache() {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "clearLocalCache",
 	})
 	l.Debug("Clearing local cache")
-	mtx.Lock()
-	recentMessages = map[string][]string{}
-	mtx.Unlock()
+	p.mtx.Lock()
+	p.recentMessages = map[string][]string{}
+	p.mtx.Unlock()
 }
 
-func CacheCleaner() {
+func (p *Peer) CacheCleaner(stop <-chan struct{}) {
 	l := log.WithFields(log.Fields{
 		"pkg": "net",
 		"fn":  "CacheCleaner",
 	})
 	l.Debug("Cache cleaner started")
 	for {
-		time.Sleep(time.Minute * 5)
+		select {
+		case <-stop:
+			l.Debug("Cache cleaner stopped")
+			return
+		case <-time.After(time.Minute * 5):
+		}
 		l.Debug("Cleaning local cache")
-		clearLocalCache()
+		p.clearLocalCache()
 		l.Debug("Local cache cleaned")
 	}
 }
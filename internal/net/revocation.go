@@ -0,0 +1,147 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// DataMessageRevocationRequest asks a peer for the revocation of the
+	// key PubKeyID.
+	DataMessageRevocationRequest = DataMessageType("revocation")
+	// DataMessageRevocationsRequest asks a peer for all its revocations,
+	// to sync the revocations of a peer which missed broadcasts.
+	DataMessageRevocationsRequest = DataMessageType("revocations")
+)
+
+// BroadcastRevocation tells the other peers that the key pubKeyID has
+// been revoked.
+func (p *Peer) BroadcastRevocation(pubKeyID string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "net",
+		"fn":  "BroadcastRevocation",
+	})
+	l.Debugf("Broadcasting revocation of pubKeyID: %s", pubKeyID)
+	msg := &BroadcastMessage{
+		Type:     "keyRevocation",
+		PubKeyID: pubKeyID,
+		PeerAddr: p.AdvertiseAddr(),
+		PeerPort: p.DataPort,
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		l.Errorf("failed to marshal message: %v", err)
+		return err
+	}
+	bm := &broadcast{
+		msgType:  "keyRevocation",
+		pubKeyID: pubKeyID,
+		msg:      b,
+		notify:   nil,
+	}
+	go p.Broadcast(bm)
+	p.storeNewMessage(msg.Type, msg.PubKeyID, msg.Channel, msg.ID)
+	return nil
+}
+
+// RequestRevocationFromPeer returns the revocation of the key pubKeyID
+// held by the peer.
+func (p *Peer) RequestRevocationFromPeer(peerAddr string, peerPort int, pubKeyID string) ([]byte, error) {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "RequestRevocationFromPeer",
+	})
+	l.Debugf("Requesting revocation from peer %s:%d", peerAddr, peerPort)
+	dataMsg, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+		Type:     DataMessageRevocationRequest,
+		PeerName: &p.Name,
+		PubKeyID: &pubKeyID,
+	})
+	if err != nil {
+		l.Errorf("failed to exchange message: %v", err)
+		return nil, err
+	}
+	if dataMsg.Data == nil {
+		l.Error("no data in message")
+		return nil, errors.New("no data in message")
+	}
+	return *dataMsg.Data, nil
+}
+
+// RequestRevocationsFromPeer returns all revocations held by the peer.
+func (p *Peer) RequestRevocationsFromPeer(peerAddr string, peerPort int) ([][]byte, error) {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "RequestRevocationsFromPeer",
+	})
+	l.Debugf("Requesting revocations from peer %s:%d", peerAddr, peerPort)
+	dataMsg, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+		Type:     DataMessageRevocationsRequest,
+		PeerName: &p.Name,
+	})
+	if err != nil {
+		l.Errorf("failed to exchange message: %v", err)
+		return nil, err
+	}
+	if dataMsg.Data == nil {
+		return nil, nil
+	}
+	var rs []json.RawMessage
+	if err := json.Unmarshal(*dataMsg.Data, &rs); err != nil {
+		l.Errorf("failed to unmarshal revocations: %v", err)
+		return nil, err
+	}
+	var revocations [][]byte
+	for _, r := range rs {
+		revocations = append(revocations, r)
+	}
+	return revocations, nil
+}
+
+func (p *Peer) handleRevocationRequest(dataMsg *DataMessage) *DataMessage {
+	res := &DataMessage{
+		Type:     DataMessageResponse,
+		PeerName: &p.Name,
+		PubKeyID: dataMsg.PubKeyID,
+	}
+	if dataMsg.PubKeyID == nil {
+		e := ErrorMissingFields
+		res.Error = &e
+		return res
+	}
+	data, err := p.Store.GetRevocation(*dataMsg.PubKeyID)
+	if err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	res.Data = &data
+	return res
+}
+
+func (p *Peer) handleRevocationsRequest(dataMsg *DataMessage) *DataMessage {
+	res := &DataMessage{
+		Type:     DataMessageResponse,
+		PeerName: &p.Name,
+	}
+	revocations, err := p.Store.ListRevocations()
+	if err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	rs := make([]json.RawMessage, 0, len(revocations))
+	for _, r := range revocations {
+		rs = append(rs, r)
+	}
+	data, err := json.Marshal(rs)
+	if err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	res.Data = &data
+	return res
+}
@@ -0,0 +1,97 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DataMessageRotationRequest asks a peer for the rotation statement of
+// the key PubKeyID. Statements are too large to be gossiped, so only the
+// notice of a rotation is broadcast and the statement is fetched from
+// the data port of the peer which sent it.
+var DataMessageRotationRequest = DataMessageType("rotation")
+
+// BroadcastRotation tells the other peers that the key pubKeyID has been
+// rotated to the key newKeyID.
+func (p *Peer) BroadcastRotation(pubKeyID string, newKeyID string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "net",
+		"fn":  "BroadcastRotation",
+	})
+	l.Debugf("Broadcasting rotation of pubKeyID: %s to %s", pubKeyID, newKeyID)
+	msg := &BroadcastMessage{
+		Type:     "keyRotation",
+		PubKeyID: pubKeyID,
+		ID:       newKeyID,
+		PeerAddr: p.AdvertiseAddr(),
+		PeerPort: p.DataPort,
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		l.Errorf("failed to marshal message: %v", err)
+		return err
+	}
+	bm := &broadcast{
+		msgType:  "keyRotation",
+		pubKeyID: pubKeyID,
+		msgID:    newKeyID,
+		msg:      b,
+		notify:   nil,
+	}
+	go p.Broadcast(bm)
+	p.storeNewMessage(msg.Type, msg.PubKeyID, msg.Channel, msg.ID)
+	return nil
+}
+
+// RequestRotationFromPeer returns the rotation statement of the key
+// pubKeyID held by the peer.
+func (p *Peer) RequestRotationFromPeer(peerAddr string, peerPort int, pubKeyID string) ([]byte, error) {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "RequestRotationFromPeer",
+	})
+	l.Debugf("Requesting rotation from peer %s:%d", peerAddr, peerPort)
+	dataMsg, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+		Type:     DataMessageRotationRequest,
+		PeerName: &p.Name,
+		PubKeyID: &pubKeyID,
+	})
+	if err != nil {
+		l.Errorf("failed to exchange message: %v", err)
+		return nil, err
+	}
+	if dataMsg.Data == nil {
+		l.Error("no data in message")
+		return nil, errors.New("no data in message")
+	}
+	return *dataMsg.Data, nil
+}
+
+func (p *Peer) handleRotationRequest(dataMsg *DataMessage) *DataMessage {
+	res := &DataMessage{
+		Type:     DataMessageResponse,
+		PeerName: &p.Name,
+		PubKeyID: dataMsg.PubKeyID,
+	}
+	if dataMsg.PubKeyID == nil {
+		e := ErrorMissingFields
+		res.Error = &e
+		return res
+	}
+	// the rotation of a revoked key is not followed
+	if _, err := p.Store.GetRevocation(*dataMsg.PubKeyID); err == nil {
+		e := ErrorKeyRevoked
+		res.Error = &e
+		return res
+	}
+	data, err := p.Store.GetRotation(*dataMsg.PubKeyID)
+	if err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	res.Data = &data
+	return res
+}
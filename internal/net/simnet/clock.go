@@ -0,0 +1,148 @@
+package simnet
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is the virtual time of a Network. It only moves when it is
+// advanced. The functions scheduled on it run in the order of their time,
+// functions of the same time in the order they were scheduled, so the
+// network takes the same decisions in the same order on every run,
+// however the goroutines of the process are scheduled.
+type Clock struct {
+	// adv serializes Advance
+	adv    sync.Mutex
+	mtx    sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers timerHeap
+}
+
+type timer struct {
+	at    time.Time
+	seq   uint64
+	f     func()
+	index int
+}
+
+// NewClock returns a clock which starts at start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the current virtual time.
+func (c *Clock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// AfterFunc runs f in the goroutine advancing the clock once d has
+// passed. f must not wait for the clock to advance. The returned function
+// cancels f and reports whether it had not run yet.
+func (c *Clock) AfterFunc(d time.Duration, f func()) (stop func() bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &timer{at: c.now.Add(d), seq: c.seq, f: f}
+	c.seq++
+	heap.Push(&c.timers, t)
+	return func() bool {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if t.index < 0 {
+			return false
+		}
+		heap.Remove(&c.timers, t.index)
+		return true
+	}
+}
+
+// Sleep blocks until the clock has advanced by d.
+func (c *Clock) Sleep(d time.Duration) {
+	done := make(chan struct{})
+	c.AfterFunc(d, func() { close(done) })
+	<-done
+}
+
+// Advance moves the clock forward by d and runs the functions which are
+// due, including those scheduled by them, each at its own time.
+func (c *Clock) Advance(d time.Duration) {
+	c.adv.Lock()
+	defer c.adv.Unlock()
+	c.mtx.Lock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].at.After(end) {
+		t := heap.Pop(&c.timers).(*timer)
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		c.mtx.Unlock()
+		t.f()
+		c.mtx.Lock()
+	}
+	c.now = end
+	c.mtx.Unlock()
+}
+
+// Drive advances the clock by tick on every tick of the wall clock until
+// stop is called, so that virtual time passes like real time for peers
+// whose own timeouts use the wall clock.
+func (c *Clock) Drive(tick time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(tick)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				c.Advance(tick)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// timerHeap orders timers by time and then by the order they were scheduled.
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x any) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,49 @@
+package simnet
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClockRunsInOrder(t *testing.T) {
+	c := NewClock(time.Unix(0, 0))
+	var got []int
+	c.AfterFunc(time.Millisecond*2, func() { got = append(got, 3) })
+	c.AfterFunc(time.Millisecond, func() {
+		got = append(got, 1)
+		c.AfterFunc(0, func() { got = append(got, 2) })
+	})
+	c.AfterFunc(time.Millisecond*2, func() { got = append(got, 4) })
+	stop := c.AfterFunc(time.Millisecond*2, func() { got = append(got, 5) })
+	if !stop() {
+		t.Fatal("stop of a pending function returned false")
+	}
+	c.Advance(time.Millisecond)
+	if want := []int{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after 1ms got %v, want %v", got, want)
+	}
+	c.Advance(time.Second)
+	if want := []int{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if d := c.Now().Sub(time.Unix(0, 0)); d != time.Second+time.Millisecond {
+		t.Fatalf("clock at %v, want %v", d, time.Second+time.Millisecond)
+	}
+}
+
+func TestClockSleep(t *testing.T) {
+	c := NewClock(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		c.Sleep(time.Millisecond * 100)
+		close(done)
+	}()
+	stop := c.Drive(time.Millisecond)
+	defer stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("sleep did not return")
+	}
+}
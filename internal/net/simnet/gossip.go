@@ -0,0 +1,149 @@
+package simnet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// gossipTransport is the memberlist transport of a host. Packets are
+// delivered after the link delay unless they are lost or the link is
+// partitioned, streams are in-memory pipes.
+type gossipTransport struct {
+	host     *Host
+	port     int
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+	// inbox holds the packets which arrived and were not read yet, so
+	// that the clock does not wait for memberlist to read them
+	inMtx    sync.Mutex
+	inbox    []*memberlist.Packet
+	wake     chan struct{}
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+func (t *gossipTransport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	advIP := t.host.IP
+	if ip != "" {
+		advIP = net.ParseIP(ip)
+		if advIP == nil {
+			return nil, 0, fmt.Errorf("simnet: failed to parse advertise address %q", ip)
+		}
+	}
+	if port == 0 {
+		port = t.port
+	}
+	return advIP, port, nil
+}
+
+func (t *gossipTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	now := time.Now()
+	to, port, err := t.host.net.lookup(addr)
+	if err != nil {
+		return now, err
+	}
+	reachable, lost, delay := t.host.net.fate(t.host, to)
+	if !reachable || lost {
+		// dropped packets are not an error for an unreliable transport
+		return now, nil
+	}
+	to.mtx.Lock()
+	dest := to.gossip[port]
+	to.mtx.Unlock()
+	if dest == nil {
+		return now, nil
+	}
+	p := &memberlist.Packet{
+		Buf:  append([]byte(nil), b...),
+		From: &net.UDPAddr{IP: t.host.IP, Port: t.port},
+	}
+	t.host.net.clock.AfterFunc(delay, func() {
+		if trace := t.host.net.cfg.Trace; trace != nil {
+			trace(t.host.net.clock.Now(), t.host.Name, to.Name, p.Buf)
+		}
+		dest.receive(p)
+	})
+	return now, nil
+}
+
+// receive puts p into the inbox of the transport.
+func (t *gossipTransport) receive(p *memberlist.Packet) {
+	// memberlist compares the timestamp with its own wall clock
+	p.Timestamp = time.Now()
+	t.inMtx.Lock()
+	t.inbox = append(t.inbox, p)
+	t.inMtx.Unlock()
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver passes the packets of the inbox to memberlist in the order they
+// arrived until the transport is shut down.
+func (t *gossipTransport) deliver() {
+	for {
+		t.inMtx.Lock()
+		if len(t.inbox) == 0 {
+			t.inMtx.Unlock()
+			select {
+			case <-t.wake:
+				continue
+			case <-t.shutdown:
+				return
+			}
+		}
+		p := t.inbox[0]
+		t.inbox[0] = nil
+		t.inbox = t.inbox[1:]
+		t.inMtx.Unlock()
+		select {
+		case t.packetCh <- p:
+		case <-t.shutdown:
+			return
+		}
+	}
+}
+
+func (t *gossipTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+func (t *gossipTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	to, port, err := t.host.net.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	to.mtx.Lock()
+	dest := to.gossip[port]
+	to.mtx.Unlock()
+	var accept chan<- net.Conn
+	var done <-chan struct{}
+	if dest != nil {
+		accept, done = dest.streamCh, dest.shutdown
+	}
+	return t.host.dial(to, port, accept, done, timeout)
+}
+
+func (t *gossipTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+func (t *gossipTransport) Shutdown() error {
+	t.once.Do(func() {
+		close(t.shutdown)
+		t.host.mtx.Lock()
+		delete(t.host.gossip, t.port)
+		t.host.mtx.Unlock()
+	})
+	return nil
+}
+
+// GetAutoBindPort returns the port the transport is bound to.
+func (t *gossipTransport) GetAutoBindPort() int {
+	return t.port
+}
@@ -0,0 +1,177 @@
+package simnet
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	cnet "github.com/robertlestak/centauri/internal/net"
+)
+
+var _ cnet.Transport = (*Host)(nil)
+
+// Host is a machine on a simulated Network. It is the net.Transport of
+// the peer running on it.
+type Host struct {
+	Name string
+	IP   net.IP
+
+	net      *Network
+	mtx      sync.Mutex
+	nextPort int
+	gossip   map[int]*gossipTransport
+	data     map[int]*listener
+}
+
+// allocPort returns port, or the next free port of the host if port is 0.
+// It must be called with h.mtx held.
+func (h *Host) allocPort(port int) int {
+	if port != 0 {
+		return port
+	}
+	for {
+		h.nextPort++
+		_, g := h.gossip[h.nextPort]
+		_, d := h.data[h.nextPort]
+		if !g && !d {
+			return h.nextPort
+		}
+	}
+}
+
+// Gossip returns the memberlist transport of the host. bindAddr is
+// ignored, the transport is always bound to the address of the host.
+func (h *Host) Gossip(bindAddr string, bindPort int) (memberlist.Transport, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	port := h.allocPort(bindPort)
+	if _, ok := h.gossip[port]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "sim", Err: errAddrInUse}
+	}
+	t := &gossipTransport{
+		host:     h,
+		port:     port,
+		packetCh: make(chan *memberlist.Packet),
+		streamCh: make(chan net.Conn),
+		wake:     make(chan struct{}, 1),
+		shutdown: make(chan struct{}),
+	}
+	h.gossip[port] = t
+	go t.deliver()
+	return t, nil
+}
+
+// ListenData opens the data listener of the host on port, or on the next
+// free port if port is 0.
+func (h *Host) ListenData(port int) (net.Listener, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	port = h.allocPort(port)
+	if _, ok := h.data[port]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "sim", Err: errAddrInUse}
+	}
+	ln := &listener{
+		host:  h,
+		port:  port,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	h.data[port] = ln
+	return ln, nil
+}
+
+// DialData connects to the data listener at addr.
+func (h *Host) DialData(addr string) (net.Conn, error) {
+	to, port, err := h.net.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	to.mtx.Lock()
+	ln := to.data[port]
+	to.mtx.Unlock()
+	var accept chan<- net.Conn
+	var done <-chan struct{}
+	if ln != nil {
+		accept, done = ln.conns, ln.done
+	}
+	return h.dial(to, port, accept, done, 0)
+}
+
+// dial connects to port on host to after the link delay. accept is the
+// channel of the listener on that port, nil if nothing listens on it.
+func (h *Host) dial(to *Host, port int, accept chan<- net.Conn, done <-chan struct{}, timeout time.Duration) (net.Conn, error) {
+	reachable, _, delay := h.net.fate(h, to)
+	if !reachable {
+		// a partitioned host does not answer until the dial times out
+		if timeout > 0 {
+			delay = timeout
+		}
+		h.net.clock.Sleep(delay)
+		return nil, &net.OpError{Op: "dial", Net: "sim", Addr: tcpAddr(to.IP, port), Err: ErrUnreachable}
+	}
+	h.net.clock.Sleep(delay)
+	if accept == nil {
+		return nil, &net.OpError{Op: "dial", Net: "sim", Addr: tcpAddr(to.IP, port), Err: ErrRefused}
+	}
+	h.mtx.Lock()
+	local := h.allocPort(0)
+	h.mtx.Unlock()
+	c1, c2 := net.Pipe()
+	client := &conn{Conn: c1, local: tcpAddr(h.IP, local), remote: tcpAddr(to.IP, port)}
+	server := &conn{Conn: c2, local: tcpAddr(to.IP, port), remote: tcpAddr(h.IP, local)}
+	select {
+	case accept <- server:
+		return client, nil
+	case <-done:
+		c1.Close()
+		c2.Close()
+		return nil, &net.OpError{Op: "dial", Net: "sim", Addr: tcpAddr(to.IP, port), Err: ErrRefused}
+	}
+}
+
+func tcpAddr(ip net.IP, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// conn is one end of an in-memory connection with the addresses of the
+// simulated hosts.
+type conn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+// listener accepts the connections dialed to a data port.
+type listener struct {
+	host  *Host
+	port  int
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.host.mtx.Lock()
+		delete(l.host.data, l.port)
+		l.host.mtx.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return tcpAddr(l.host.IP, l.port)
+}
@@ -0,0 +1,250 @@
+// Package simnet is an in-memory network for running Centauri peers in a
+// single process. Every host of a Network implements net.Transport, so
+// the gossip and data traffic of a peer can be delayed, dropped and
+// partitioned without touching real sockets.
+//
+// The delay and loss of a packet or connection are a function of the
+// network's seed, the sending and receiving hosts and the number of
+// packets sent on that link before it, so a scenario which sends the same
+// traffic over the same links sees the same faults on every run. Delays
+// and scheduled events run on the virtual Clock of the network.
+//
+// Runs of memberlist peers are not reproducible though: their probe and
+// gossip timers use the wall clock and pick random peers, so the traffic
+// on each link, and with it the faults, differs between runs. The seed
+// fixes the fault model, not the outcome of a run.
+package simnet
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnreachable is returned when dialing a host which is partitioned
+	// from the dialing host.
+	ErrUnreachable = errors.New("simnet: host unreachable")
+	// ErrRefused is returned when dialing an address nothing listens on.
+	ErrRefused = errors.New("simnet: connection refused")
+
+	errAddrInUse = errors.New("address already in use")
+)
+
+// Config sets the fault model of a Network.
+type Config struct {
+	// Seed selects the latency and loss of every link.
+	Seed int64
+	// Latency is the minimum one-way delay of packets and connections.
+	Latency time.Duration
+	// Jitter is the maximum random delay added to Latency.
+	Jitter time.Duration
+	// Loss is the probability between 0 and 1 that a gossip packet is dropped.
+	// Connections are not subject to loss.
+	Loss float64
+	// Trace is called with every gossip packet when it arrives, in the
+	// goroutine advancing the clock, if it is set.
+	Trace func(at time.Time, from, to string, b []byte)
+}
+
+// Network is a set of simulated hosts.
+type Network struct {
+	cfg      Config
+	clock    *Clock
+	mtx      sync.RWMutex
+	hosts    map[string]*Host
+	byName   map[string]*Host
+	groups   map[string]int
+	isolated map[string]bool
+	seqs     map[[2]string]uint64
+}
+
+// New returns an empty network with the fault model c.
+func New(c Config) *Network {
+	return &Network{
+		cfg:      c,
+		clock:    NewClock(time.Unix(0, 0).UTC()),
+		hosts:    map[string]*Host{},
+		byName:   map[string]*Host{},
+		isolated: map[string]bool{},
+		seqs:     map[[2]string]uint64{},
+	}
+}
+
+// Clock returns the virtual clock of the network. Nothing is delivered
+// while it does not advance, see Clock.Advance and Clock.Drive.
+func (n *Network) Clock() *Clock {
+	return n.clock
+}
+
+// Host returns the host named name, adding it to the network with the
+// next free address in 10.0.0.0/8 if it does not exist yet.
+func (n *Network) Host(name string) *Host {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if h, ok := n.byName[name]; ok {
+		return h
+	}
+	i := len(n.hosts) + 1
+	h := &Host{
+		Name:     name,
+		IP:       net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)),
+		net:      n,
+		nextPort: 1024,
+		gossip:   map[int]*gossipTransport{},
+		data:     map[int]*listener{},
+	}
+	n.hosts[h.IP.String()] = h
+	n.byName[name] = h
+	return h
+}
+
+// Partition splits the network so that hosts can only reach the hosts in
+// the same group. Hosts which are not in any group are isolated.
+func (n *Network) Partition(groups ...[]string) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.groups = map[string]int{}
+	for g, names := range groups {
+		for _, name := range names {
+			n.groups[name] = g
+		}
+	}
+}
+
+// Isolate cuts the named hosts off from every other host.
+func (n *Network) Isolate(names ...string) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	for _, name := range names {
+		n.isolated[name] = true
+	}
+}
+
+// Heal removes all partitions and isolations.
+func (n *Network) Heal() {
+	n.mtx.Lock()
+	n.groups = nil
+	n.isolated = map[string]bool{}
+	n.mtx.Unlock()
+}
+
+// Reachable reports whether host from can currently reach host to.
+func (n *Network) Reachable(from, to string) bool {
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+	return n.reachable(from, to)
+}
+
+func (n *Network) reachable(from, to string) bool {
+	if from == to {
+		return true
+	}
+	if n.isolated[from] || n.isolated[to] {
+		return false
+	}
+	if n.groups == nil {
+		return true
+	}
+	gf, ok := n.groups[from]
+	if !ok {
+		return false
+	}
+	gt, ok := n.groups[to]
+	return ok && gf == gt
+}
+
+// lookup returns the host and port of addr (host:port).
+func (n *Network) lookup(addr string) (*Host, int, error) {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil {
+		return nil, 0, err
+	}
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+	h, ok := n.hosts[host]
+	if !ok {
+		h, ok = n.byName[host]
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("simnet: unknown host %s", host)
+	}
+	return h, port, nil
+}
+
+// fate decides whether the next packet from one host can reach the other,
+// whether it is lost and how long it is delayed.
+func (n *Network) fate(from, to *Host) (reachable, lost bool, delay time.Duration) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if !n.reachable(from.Name, to.Name) {
+		return false, true, n.cfg.Latency
+	}
+	k := [2]string{from.Name, to.Name}
+	seq := n.seqs[k]
+	n.seqs[k]++
+	h := fnv.New64a()
+	h.Write([]byte(from.Name + ">" + to.Name))
+	base := h.Sum64() ^ uint64(n.cfg.Seed)
+	delay = n.cfg.Latency
+	if n.cfg.Jitter > 0 {
+		delay += time.Duration(unit(base+2*seq) * float64(n.cfg.Jitter))
+	}
+	return true, unit(base+2*seq+1) < n.cfg.Loss, delay
+}
+
+// unit maps x to a uniformly distributed number in [0, 1).
+func unit(x uint64) float64 {
+	// splitmix64
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
+
+// Event is a change to the network applied At an offset from Run. Apply
+// runs in the goroutine advancing the clock and must not wait for it.
+type Event struct {
+	At    time.Duration
+	Apply func(n *Network)
+}
+
+// PartitionAt returns an event which partitions the network into groups.
+func PartitionAt(at time.Duration, groups ...[]string) Event {
+	return Event{At: at, Apply: func(n *Network) { n.Partition(groups...) }}
+}
+
+// IsolateAt returns an event which isolates the named hosts.
+func IsolateAt(at time.Duration, names ...string) Event {
+	return Event{At: at, Apply: func(n *Network) { n.Isolate(names...) }}
+}
+
+// HealAt returns an event which removes all partitions and isolations.
+func HealAt(at time.Duration) Event {
+	return Event{At: at, Apply: func(n *Network) { n.Heal() }}
+}
+
+// Run applies the events of a schedule at their offsets from the current
+// time of the network's clock. The returned function cancels the events
+// which have not been applied yet.
+func (n *Network) Run(events ...Event) (stop func()) {
+	var stops []func() bool
+	for _, e := range events {
+		e := e
+		stops = append(stops, n.clock.AfterFunc(e.At, func() { e.Apply(n) }))
+	}
+	return func() {
+		for _, s := range stops {
+			s()
+		}
+	}
+}
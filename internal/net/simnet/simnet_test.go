@@ -0,0 +1,99 @@
+package simnet
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// delivery is a gossip packet as seen by Config.Trace.
+type delivery struct {
+	At       time.Duration
+	From, To string
+	Data     string
+}
+
+// scenario sends gossip between three hosts while c is partitioned from
+// a and b for a while, and returns the packets which arrived.
+func scenario(t *testing.T, seed int64) []delivery {
+	t.Helper()
+	start := time.Unix(0, 0).UTC()
+	var got []delivery
+	n := New(Config{
+		Seed:    seed,
+		Latency: time.Millisecond,
+		Jitter:  time.Millisecond * 10,
+		Loss:    0.2,
+		Trace: func(at time.Time, from, to string, b []byte) {
+			got = append(got, delivery{At: at.Sub(start), From: from, To: to, Data: string(b)})
+		},
+	})
+	names := []string{"a", "b", "c"}
+	var ts []memberlist.Transport
+	for _, name := range names {
+		gt, err := n.Host(name).Gossip("", 7946)
+		if err != nil {
+			t.Fatalf("gossip on %s: %v", name, err)
+		}
+		defer gt.Shutdown()
+		ts = append(ts, gt)
+	}
+	n.Run(
+		PartitionAt(time.Millisecond*30, []string{"a", "b"}, []string{"c"}),
+		HealAt(time.Millisecond*60),
+	)
+	for i := 0; i < 30; i++ {
+		for from, gt := range ts {
+			for _, to := range names {
+				if to == names[from] {
+					continue
+				}
+				if _, err := gt.WriteTo([]byte(fmt.Sprint(i)), to+":7946"); err != nil {
+					t.Fatalf("write from %s to %s: %v", names[from], to, err)
+				}
+			}
+		}
+		n.Clock().Advance(time.Millisecond * 3)
+	}
+	n.Clock().Advance(time.Second)
+	return got
+}
+
+func TestScenarioIsReproducible(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3} {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			first := scenario(t, seed)
+			if len(first) == 0 {
+				t.Fatal("no packet arrived")
+			}
+			if again := scenario(t, seed); !reflect.DeepEqual(first, again) {
+				t.Fatalf("runs with the same seed differ:\n%v\n%v", first, again)
+			}
+		})
+	}
+	if reflect.DeepEqual(scenario(t, 1), scenario(t, 2)) {
+		t.Fatal("runs with different seeds are the same")
+	}
+}
+
+func TestScenarioFaults(t *testing.T) {
+	got := scenario(t, 1)
+	// 30 rounds of 6 packets, of which some are lost or partitioned
+	if len(got) >= 30*6 {
+		t.Fatalf("%d packets arrived, want some lost", len(got))
+	}
+	for _, d := range got {
+		if d.At < time.Millisecond || d.At > time.Millisecond*100 {
+			t.Errorf("packet %v arrived outside the latency bounds", d)
+		}
+		// packets sent from 30ms to 60ms do not cross the partition, and
+		// those sent before it arrive within the 11ms of delay
+		crossing := d.From == "c" || d.To == "c"
+		if crossing && d.At >= time.Millisecond*41 && d.At < time.Millisecond*60 {
+			t.Errorf("packet %v crossed the partition", d)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/robertlestak/centauri/pkg/api"
+	log "github.com/sirupsen/logrus"
+)
+
+func fetchingKey(pubKeyID, channel, id string) string {
+	return pubKeyID + "_" + channel + "_" + id
+}
+
+func (p *Peer) startFetching(pubKeyID, channel, id string) {
+	p.fetchingMtx.Lock()
+	p.fetchingMessages[fetchingKey(pubKeyID, channel, id)]++
+	p.fetchingMtx.Unlock()
+}
+
+func (p *Peer) stopFetching(pubKeyID, channel, id string) {
+	k := fetchingKey(pubKeyID, channel, id)
+	p.fetchingMtx.Lock()
+	p.fetchingMessages[k]--
+	if p.fetchingMessages[k] <= 0 {
+		delete(p.fetchingMessages, k)
+	}
+	p.fetchingMtx.Unlock()
+}
+
+func (p *Peer) isFetching(pubKeyID, channel, id string) bool {
+	p.fetchingMtx.RLock()
+	defer p.fetchingMtx.RUnlock()
+	return p.fetchingMessages[fetchingKey(pubKeyID, channel, id)] > 0
+}
+
+// LocalMessageStatus returns the replication state of the message on this peer.
+func (p *Peer) LocalMessageStatus(pubKeyID, channel, id string) *api.PeerStatus {
+	return &api.PeerStatus{
+		PeerName:  p.Name,
+		Stored:    p.Store.MessageExists(pubKeyID, channel, id),
+		Fetching:  p.isFetching(pubKeyID, channel, id),
+		Tombstone: p.Store.TombstoneExists(pubKeyID, channel, id),
+	}
+}
+
+func (p *Peer) RequestStatusFromPeer(peerAddr string, peerPort int, pubKeyID string, channel string, id string) (*api.PeerStatus, error) {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "RequestStatusFromPeer",
+	})
+	l.Debugf("Requesting status from peer %s:%d", peerAddr, peerPort)
+	dataMsg, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+		Type:     DataMessageStatusRequest,
+		PeerName: &p.Name,
+		PubKeyID: &pubKeyID,
+		Channel:  &channel,
+		ID:       &id,
+	})
+	if err != nil {
+		l.Errorf("failed to exchange message: %v", err)
+		return nil, err
+	}
+	if dataMsg.Status == nil {
+		l.Error("no status in message")
+		return nil, errors.New("no status in message")
+	}
+	return dataMsg.Status, nil
+}
+
+// QueryMessageStatus asks every member of the cluster for its replication
+// state of the message. Peers which cannot be reached are returned with Error set.
+func (p *Peer) QueryMessageStatus(pubKeyID string, channel string, id string) []api.PeerStatus {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "QueryMessageStatus",
+	})
+	l.Debug("Querying message status")
+	members := p.ListMembers()
+	res := make([]api.PeerStatus, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		if m.Name == p.Name {
+			res[i] = *p.LocalMessageStatus(pubKeyID, channel, id)
+			continue
+		}
+		res[i] = api.PeerStatus{PeerName: m.Name}
+		if m.State != memberlist.StateAlive {
+			res[i].Error = "peer not alive"
+			continue
+		}
+		nm := &NodeMeta{}
+		if err := json.Unmarshal(m.Meta, nm); err != nil {
+			l.Errorf("failed to unmarshal meta: %v", err)
+			res[i].Error = err.Error()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, nm *NodeMeta) {
+			defer wg.Done()
+			st, err := p.RequestStatusFromPeer(nm.PeerAddr, nm.PeerPort, pubKeyID, channel, id)
+			if err != nil {
+				res[i].Error = err.Error()
+				return
+			}
+			st.PeerName = res[i].PeerName
+			res[i] = *st
+		}(i, nm)
+	}
+	wg.Wait()
+	return res
+}
+
+// DataMessageStatusesRequest asks a peer for its replication state of a
+// batch of messages, listed in Data.
+var DataMessageStatusesRequest = DataMessageType("statuses")
+
+// maxStatusBatch is the largest number of messages in a statuses request.
+const maxStatusBatch = 1000
+
+// StatusRef names a message of a batched status request.
+type StatusRef struct {
+	PubKeyID string `json:"pubKeyID"`
+	Channel  string `json:"channel"`
+	ID       string `json:"id"`
+}
+
+// RequestStatusesFromPeer returns the replication state of each message
+// of refs on the peer, in the order of refs.
+func (p *Peer) RequestStatusesFromPeer(peerAddr string, peerPort int, refs []StatusRef) ([]api.PeerStatus, error) {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "RequestStatusesFromPeer",
+	})
+	l.Debugf("Requesting %d statuses from peer %s:%d", len(refs), peerAddr, peerPort)
+	res := make([]api.PeerStatus, 0, len(refs))
+	for len(refs) > 0 {
+		batch := refs
+		if len(batch) > maxStatusBatch {
+			batch = batch[:maxStatusBatch]
+		}
+		refs = refs[len(batch):]
+		data, err := json.Marshal(batch)
+		if err != nil {
+			l.Errorf("failed to marshal refs: %v", err)
+			return nil, err
+		}
+		dataMsg, err := p.exchangeMessage(peerAddr, peerPort, &DataMessage{
+			Type:     DataMessageStatusesRequest,
+			PeerName: &p.Name,
+			Data:     &data,
+		})
+		if err != nil {
+			l.Errorf("failed to exchange message: %v", err)
+			return nil, err
+		}
+		if dataMsg.Data == nil {
+			l.Error("no data in message")
+			return nil, errors.New("no data in message")
+		}
+		var sts []api.PeerStatus
+		if err := json.Unmarshal(*dataMsg.Data, &sts); err != nil {
+			l.Errorf("failed to unmarshal statuses: %v", err)
+			return nil, err
+		}
+		if len(sts) != len(batch) {
+			l.Errorf("got %d statuses for %d messages", len(sts), len(batch))
+			return nil, errors.New("status count mismatch")
+		}
+		res = append(res, sts...)
+	}
+	return res, nil
+}
+
+func (p *Peer) handleStatusesRequest(dataMsg *DataMessage) *DataMessage {
+	res := &DataMessage{
+		Type:     DataMessageResponse,
+		PeerName: &p.Name,
+	}
+	if dataMsg.Data == nil {
+		e := ErrorMissingFields
+		res.Error = &e
+		return res
+	}
+	var refs []StatusRef
+	if err := json.Unmarshal(*dataMsg.Data, &refs); err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	if len(refs) > maxStatusBatch {
+		e := "too many messages"
+		res.Error = &e
+		return res
+	}
+	sts := make([]api.PeerStatus, len(refs))
+	for i, r := range refs {
+		sts[i] = *p.LocalMessageStatus(r.PubKeyID, r.Channel, r.ID)
+	}
+	data, err := json.Marshal(sts)
+	if err != nil {
+		e := err.Error()
+		res.Error = &e
+		return res
+	}
+	res.Data = &data
+	return res
+}
+
+// QueryMessageStatuses is QueryMessageStatus for a batch of messages,
+// which asks each member once for the whole batch. The result holds the
+// states of refs[i] at index i.
+func (p *Peer) QueryMessageStatuses(refs []StatusRef) [][]api.PeerStatus {
+	l := log.WithFields(log.Fields{
+		"module": "net",
+		"method": "QueryMessageStatuses",
+	})
+	l.Debugf("Querying status of %d messages", len(refs))
+	members := p.ListMembers()
+	res := make([][]api.PeerStatus, len(refs))
+	for i := range res {
+		res[i] = make([]api.PeerStatus, len(members))
+	}
+	setError := func(j int, name string, err string) {
+		for i := range refs {
+			res[i][j] = api.PeerStatus{PeerName: name, Error: err}
+		}
+	}
+	var wg sync.WaitGroup
+	for j, m := range members {
+		if m.Name == p.Name {
+			for i, r := range refs {
+				res[i][j] = *p.LocalMessageStatus(r.PubKeyID, r.Channel, r.ID)
+			}
+			continue
+		}
+		if m.State != memberlist.StateAlive {
+			setError(j, m.Name, "peer not alive")
+			continue
+		}
+		nm := &NodeMeta{}
+		if err := json.Unmarshal(m.Meta, nm); err != nil {
+			l.Errorf("failed to unmarshal meta: %v", err)
+			setError(j, m.Name, err.Error())
+			continue
+		}
+		wg.Add(1)
+		go func(j int, name string, nm *NodeMeta) {
+			defer wg.Done()
+			sts, err := p.RequestStatusesFromPeer(nm.PeerAddr, nm.PeerPort, refs)
+			if err != nil {
+				setError(j, name, err.Error())
+				return
+			}
+			for i := range refs {
+				sts[i].PeerName = name
+				res[i][j] = sts[i]
+			}
+		}(j, m.Name, nm)
+	}
+	wg.Wait()
+	return res
+}
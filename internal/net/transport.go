@@ -0,0 +1,201 @@
+package net
+
+import (
+	"fmt"
+	stdlog "log"
+	network "net"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+	log "github.com/sirupsen/logrus"
+)
+
+// Transport carries the gossip and data traffic of a Peer. A nil
+// Transport on the Peer uses SocketTransport.
+type Transport interface {
+	// Gossip returns the memberlist transport bound to bindAddr and bindPort.
+	Gossip(bindAddr string, bindPort int) (memberlist.Transport, error)
+	// ListenData opens the listener for the data port.
+	ListenData(port int) (network.Listener, error)
+	// DialData connects to the data port of another peer at addr (host:port).
+	DialData(addr string) (network.Conn, error)
+}
+
+// SocketTransport is the Transport which uses UDP and TCP sockets.
+type SocketTransport struct{}
+
+func (SocketTransport) Gossip(bindAddr string, bindPort int) (memberlist.Transport, error) {
+	return memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{bindAddr},
+		BindPort:  bindPort,
+		Logger:    stdlog.New(os.Stderr, "", stdlog.LstdFlags),
+	})
+}
+
+func (SocketTransport) ListenData(port int) (network.Listener, error) {
+	return network.Listen("tcp", fmt.Sprintf(":%d", port))
+}
+
+func (SocketTransport) DialData(addr string) (network.Conn, error) {
+	return network.Dial("tcp", addr)
+}
+
+func (p *Peer) transport() Transport {
+	if p.Transport == nil {
+		return SocketTransport{}
+	}
+	return p.Transport
+}
+
+// SetAllowedCIDRs replaces the networks which are allowed to connect to
+// the gossip and data ports. A nil or empty list allows all networks.
+func (p *Peer) SetAllowedCIDRs(cidrs []network.IPNet) {
+	p.cidrsMtx.Lock()
+	p.allowedCidrs = cidrs
+	p.cidrsMtx.Unlock()
+}
+
+func (p *Peer) addrAllowed(addr network.Addr) bool {
+	p.cidrsMtx.RLock()
+	defer p.cidrsMtx.RUnlock()
+	if len(p.allowedCidrs) == 0 {
+		return true
+	}
+	var ip network.IP
+	switch a := addr.(type) {
+	case *network.TCPAddr:
+		ip = a.IP
+	case *network.UDPAddr:
+		ip = a.IP
+	default:
+		host, _, err := network.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = network.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.allowedCidrs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// cidrTransport wraps the memberlist transport and drops packets
+// and streams from addresses outside of the allowed networks. Unlike
+// memberlist's own CIDRsAllowed, the allowed networks can be changed
+// while the transport is running.
+type cidrTransport struct {
+	memberlist.Transport
+	peer       *Peer
+	packetCh   chan *memberlist.Packet
+	streamCh   chan network.Conn
+	shutdownCh chan struct{}
+}
+
+func newCidrTransport(p *Peer, bindAddr string, bindPort int) (*cidrTransport, error) {
+	nt, err := p.transport().Gossip(bindAddr, bindPort)
+	if err != nil {
+		return nil, err
+	}
+	t := &cidrTransport{
+		Transport:  nt,
+		peer:       p,
+		packetCh:   make(chan *memberlist.Packet),
+		streamCh:   make(chan network.Conn),
+		shutdownCh: make(chan struct{}),
+	}
+	go t.filterPackets()
+	go t.filterStreams()
+	return t, nil
+}
+
+func (t *cidrTransport) filterPackets() {
+	l := log.WithFields(log.Fields{
+		"pkg": "net",
+		"fn":  "cidrTransport.filterPackets",
+	})
+	for {
+		select {
+		case pkt := <-t.Transport.PacketCh():
+			if !t.peer.addrAllowed(pkt.From) {
+				l.Debugf("dropping packet from %s", pkt.From)
+				continue
+			}
+			select {
+			case t.packetCh <- pkt:
+			case <-t.shutdownCh:
+				return
+			}
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+func (t *cidrTransport) filterStreams() {
+	l := log.WithFields(log.Fields{
+		"pkg": "net",
+		"fn":  "cidrTransport.filterStreams",
+	})
+	for {
+		select {
+		case c := <-t.Transport.StreamCh():
+			if !t.peer.addrAllowed(c.RemoteAddr()) {
+				l.Debugf("dropping stream from %s", c.RemoteAddr())
+				c.Close()
+				continue
+			}
+			select {
+			case t.streamCh <- c:
+			case <-t.shutdownCh:
+				c.Close()
+				return
+			}
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+func (t *cidrTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+func (t *cidrTransport) StreamCh() <-chan network.Conn {
+	return t.streamCh
+}
+
+func (t *cidrTransport) Shutdown() error {
+	close(t.shutdownCh)
+	// the listeners of the wrapped transport block on sending to its
+	// channels and it waits for them, so keep draining until it is down
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-t.Transport.PacketCh():
+			case c := <-t.Transport.StreamCh():
+				c.Close()
+			case <-done:
+				return
+			}
+		}
+	}()
+	err := t.Transport.Shutdown()
+	close(done)
+	return err
+}
+
+// boundPort returns the port the wrapped transport is bound to, or 0 if
+// it is not known.
+func (t *cidrTransport) boundPort() int {
+	if ab, ok := t.Transport.(interface{ GetAutoBindPort() int }); ok {
+		return ab.GetAutoBindPort()
+	}
+	return 0
+}
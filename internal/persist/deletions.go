@@ -0,0 +1,77 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Store) EnsureDeletionsDir() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "EnsureDeletionsDir",
+	})
+	l.Debug("ensuring deletions dir")
+	s.DeletionsDir = s.NodeDataDir + "/deletions"
+	return EnsureDir(s.DeletionsDir)
+}
+
+func (s *Store) deletionSetFile(setID string) string {
+	return filepath.Join(s.DeletionsDir, setID+".json")
+}
+
+// StoreDeletionSet stores the batch deletion setID, which the other
+// peers fetch to apply it.
+func (s *Store) StoreDeletionSet(setID string, data []byte) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "StoreDeletionSet",
+		"set": setID,
+	})
+	l.Debug("storing deletion set")
+	if !ValidName(setID) {
+		return os.ErrInvalid
+	}
+	if err := WriteFileAtomic(s.deletionSetFile(setID), data, 0644); err != nil {
+		l.Errorf("failed to store deletion set: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetDeletionSet returns the batch deletion setID. The error satisfies
+// os.IsNotExist if the set is unknown or has been cleaned up.
+func (s *Store) GetDeletionSet(setID string) ([]byte, error) {
+	if !ValidName(setID) {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.ReadFile(s.deletionSetFile(setID))
+}
+
+// cleanupOldDeletionSets removes the deletion sets older than dur. The
+// tombstones of their messages are kept.
+func (s *Store) cleanupOldDeletionSets(dur time.Duration) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "cleanupOldDeletionSets",
+	})
+	l.Debug("cleaning up old deletion sets")
+	if _, err := os.Stat(s.DeletionsDir); err != nil {
+		return nil
+	}
+	files, err := getFilesOlderThan(s.DeletionsDir, dur)
+	if err != nil {
+		l.Errorf("failed to get files older than: %v", err)
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			l.Errorf("failed to remove deletion set: %v", err)
+			return err
+		}
+	}
+	return nil
+}
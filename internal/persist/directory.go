@@ -0,0 +1,80 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Store) EnsureDirectoryDir() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "EnsureDirectoryDir",
+	})
+	l.Debug("ensuring directory dir")
+	s.DirectoryDir = s.NodeDataDir + "/directory"
+	return EnsureDir(s.DirectoryDir)
+}
+
+func (s *Store) keyRecordFile(keyID string) string {
+	return filepath.Join(s.DirectoryDir, keyID+".json")
+}
+
+// StoreKeyRecord stores the key directory record of the key keyID,
+// replacing the one stored before.
+func (s *Store) StoreKeyRecord(keyID string, data []byte) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "StoreKeyRecord",
+		"key": keyID,
+	})
+	l.Debug("storing key record")
+	if !ValidName(keyID) {
+		return os.ErrInvalid
+	}
+	if err := WriteFileAtomic(s.keyRecordFile(keyID), data, 0644); err != nil {
+		l.Errorf("failed to store key record: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetKeyRecord returns the key directory record of the key keyID. The
+// error satisfies os.IsNotExist if there is none.
+func (s *Store) GetKeyRecord(keyID string) ([]byte, error) {
+	if !ValidName(keyID) {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.ReadFile(s.keyRecordFile(keyID))
+}
+
+// ListKeyRecords returns all records of the key directory.
+func (s *Store) ListKeyRecords() ([][]byte, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "ListKeyRecords",
+	})
+	l.Debug("listing key records")
+	files, err := ioutil.ReadDir(s.DirectoryDir)
+	if err != nil {
+		l.Errorf("failed to read directory dir: %v", err)
+		return nil, err
+	}
+	var rs [][]byte
+	for _, f := range files {
+		// skip the temporary files of WriteFileAtomic
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.DirectoryDir, f.Name()))
+		if err != nil {
+			l.Errorf("failed to read key record %s: %v", f.Name(), err)
+			continue
+		}
+		rs = append(rs, data)
+	}
+	return rs, nil
+}
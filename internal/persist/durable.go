@@ -0,0 +1,129 @@
+package persist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// writeTemp writes data to a new temporary file next to file and syncs it
+// to disk. The name of the file is hidden and unique, so that concurrent
+// writers of the same file do not share it.
+func writeTemp(file string, data []byte, perm os.FileMode) (string, error) {
+	dir, name := filepath.Split(file)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	fail := func(err error) (string, error) {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return fail(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to file, syncs it
+// to disk and renames it to file, so that readers never see a partial
+// file and the file survives a crash once WriteFileAtomic returns.
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := writeTemp(file, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(file))
+	return nil
+}
+
+// WriteFileExclusive is like WriteFileAtomic but fails with an error
+// satisfying os.IsExist if file exists, also if another writer creates it
+// at the same time. The file is linked into place, so it fails on file
+// systems without hard links.
+func WriteFileExclusive(file string, data []byte, perm os.FileMode) error {
+	tmp, err := writeTemp(file, data, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, file); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(file))
+	return nil
+}
+
+// WriteFileUnique writes data to the file name in dir with
+// WriteFileExclusive and returns its path. If the name is taken a guid is
+// appended to it, so that files of the same name, also written at the same
+// time, never overwrite each other.
+func WriteFileUnique(dir string, name string, data []byte, perm os.FileMode) (string, error) {
+	file := filepath.Join(dir, name)
+	for {
+		err := WriteFileExclusive(file, data, perm)
+		if err == nil {
+			return file, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		file = filepath.Join(dir, name+"_"+uuid.New().String())
+	}
+}
+
+// WriteFileOnce writes data to file with WriteFileExclusive and returns
+// its path. If file is taken by other data, data is written to alt
+// instead, which only this data is written to, replacing it. Writing the
+// same data again, after a crash, returns the path written before.
+func WriteFileOnce(file string, alt string, data []byte, perm os.FileMode) (string, error) {
+	if _, err := os.Stat(alt); err == nil {
+		return alt, WriteFileAtomic(alt, data, perm)
+	}
+	err := WriteFileExclusive(file, data, perm)
+	if err == nil {
+		return file, nil
+	} else if !os.IsExist(err) {
+		return "", err
+	}
+	if cur, err := ioutil.ReadFile(file); err == nil && bytes.Equal(cur, data) {
+		return file, nil
+	}
+	return alt, WriteFileAtomic(alt, data, perm)
+}
+
+// syncDir syncs the directory dir so that a rename into it is durable.
+// Errors are ignored, directories cannot be synced on every system.
+func syncDir(dir string) {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
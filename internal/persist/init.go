@@ -6,77 +6,88 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func EnsureNodeDataDir(name string) error {
+func (s *Store) EnsureNodeDataDir(name string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "EnsureNodeDataDir",
 	})
 	l.Debug("ensuring node data dir")
-	NodeDataDir = RootDataDir + "/" + name
-	return EnsureDir(NodeDataDir)
+	s.NodeName = name
+	s.NodeDataDir = s.RootDataDir + "/" + name
+	return EnsureDir(s.NodeDataDir)
 }
 
-func EnsureAgentMessagesDir() error {
+func (s *Store) EnsureAgentMessagesDir() error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "EnsureAgentMessagesDir",
 	})
 	l.Debug("ensuring agent messages dir")
-	AgentMessagesDir = RootDataDir + "/" + "received/messages"
-	return EnsureDir(AgentMessagesDir)
+	s.AgentMessagesDir = s.RootDataDir + "/" + "received/messages"
+	return EnsureDir(s.AgentMessagesDir)
 }
 
-func EnsureAgentFilesDir() error {
+func (s *Store) EnsureAgentFilesDir() error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "EnsureAgentFilesDir",
 	})
 	l.Debug("ensuring agent files dir")
-	AgentFilesDir = RootDataDir + "/" + "received/files"
-	return EnsureDir(AgentFilesDir)
+	s.AgentFilesDir = s.RootDataDir + "/" + "received/files"
+	return EnsureDir(s.AgentFilesDir)
 }
 
-func EnsureAgentOutgoingDir() error {
+func (s *Store) EnsureAgentOutgoingDir() error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "EnsureAgentOutgoingDir",
 	})
 	l.Debug("ensuring agent messages dir")
-	AgentOutgoingDir = RootDataDir + "/" + "outgoing"
-	if err := EnsureDir(AgentOutgoingDir); err != nil {
+	s.AgentOutgoingDir = s.RootDataDir + "/" + "outgoing"
+	if err := EnsureDir(s.AgentOutgoingDir); err != nil {
 		l.Errorf("failed to create agent outgoing dir: %v", err)
 		return err
 	}
-	AgentOutgoingFilesDir = AgentOutgoingDir + "/files"
-	if err := EnsureDir(AgentOutgoingFilesDir); err != nil {
+	s.AgentOutgoingFilesDir = s.AgentOutgoingDir + "/files"
+	if err := EnsureDir(s.AgentOutgoingFilesDir); err != nil {
 		l.Errorf("failed to create agent outgoing files dir: %v", err)
 		return err
 	}
-	AgentOutgoingMessagesDir = AgentOutgoingDir + "/messages"
-	if err := EnsureDir(AgentOutgoingMessagesDir); err != nil {
+	s.AgentOutgoingMessagesDir = s.AgentOutgoingDir + "/messages"
+	if err := EnsureDir(s.AgentOutgoingMessagesDir); err != nil {
 		l.Errorf("failed to ensure agent outgoing messages dir: %v", err)
 		return err
 	}
 	return nil
 }
 
-func EnsureMessagesDir() error {
+func (s *Store) EnsureMessagesDir() error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "EnsureMessagesDir",
 	})
 	l.Debug("ensuring messages dir")
-	MessagesDir = NodeDataDir + "/messages"
-	return EnsureDir(MessagesDir)
+	s.MessagesDir = s.NodeDataDir + "/messages"
+	return EnsureDir(s.MessagesDir)
 }
 
-func EnsurePubKeyDir(pubKeyID string) (string, error) {
+func (s *Store) EnsureTombstonesDir() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "EnsureTombstonesDir",
+	})
+	l.Debug("ensuring tombstones dir")
+	s.TombstonesDir = s.NodeDataDir + "/tombstones"
+	return EnsureDir(s.TombstonesDir)
+}
+
+func (s *Store) EnsurePubKeyDir(pubKeyID string) (string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "EnsurePubKeyDir",
 	})
 	l.Debug("ensuring pub key dir")
-	dir := PubKeyMessageDir(pubKeyID)
+	dir := s.PubKeyMessageDir(pubKeyID)
 	return dir, EnsureDir(dir)
 }
 
@@ -98,24 +109,24 @@ func EnsureDir(dir string) error {
 	return nil
 }
 
-func EnsureAgentPubKeyChainDir() error {
+func (s *Store) EnsureAgentPubKeyChainDir() error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "EnsureAgentPubKeyChainDir",
 	})
 	l.Debug("ensuring pub key dir")
-	dir := RootDataDir + "/pubkeys"
-	AgentPubKeyChainDir = dir
-	return EnsureDir(AgentPubKeyChainDir)
+	dir := s.RootDataDir + "/pubkeys"
+	s.AgentPubKeyChainDir = dir
+	return EnsureDir(s.AgentPubKeyChainDir)
 }
 
-func EnsurePubKeyChainDir(pubKeyID string) (string, error) {
+func (s *Store) EnsurePubKeyChainDir(pubKeyID string) (string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "EnsurePubKeyChainDir",
 	})
 	l.Debug("ensuring pub key dir")
-	dir := PubKeyChainDir(pubKeyID)
+	dir := s.PubKeyChainDir(pubKeyID)
 	if _, err := os.Stat(dir); err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(dir, 0755); err != nil {
@@ -127,19 +138,19 @@ func EnsurePubKeyChainDir(pubKeyID string) (string, error) {
 	return dir, nil
 }
 
-func EnsurePubKeyChainOutgoingDir(pubKeyID string) (string, error) {
+func (s *Store) EnsurePubKeyChainOutgoingDir(pubKeyID string) (string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "EnsurePubKeyChainOutgoingDir",
 	})
 	l.Debug("ensuring pub key dir")
-	dir := AgentOutgoingFilesDir + "/" + pubKeyID
+	dir := s.AgentOutgoingFilesDir + "/" + pubKeyID
 	if err := EnsureDir(dir); err != nil {
 		l.Errorf("failed to create pub key dir: %v", err)
 		return dir, err
 	}
 	l.Debugf("outgoing files dir: %s", dir)
-	dir = AgentOutgoingMessagesDir + "/" + pubKeyID
+	dir = s.AgentOutgoingMessagesDir + "/" + pubKeyID
 	if err := EnsureDir(dir); err != nil {
 		l.Errorf("failed to create pub key dir: %v", err)
 		return dir, err
@@ -148,19 +159,19 @@ func EnsurePubKeyChainOutgoingDir(pubKeyID string) (string, error) {
 	return dir, nil
 }
 
-func RemovePubKeyChainOutgoingDir(pubKeyID string) (string, error) {
+func (s *Store) RemovePubKeyChainOutgoingDir(pubKeyID string) (string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "RemovePubKeyChainOutgoingDir",
 	})
 	l.Debug("removing pub key dir")
-	dir := AgentOutgoingFilesDir + "/" + pubKeyID
+	dir := s.AgentOutgoingFilesDir + "/" + pubKeyID
 	// delete the directory and all of its contents
 	if err := os.RemoveAll(dir); err != nil {
 		l.Errorf("failed to remove pub key dir: %v", err)
 		return dir, err
 	}
-	dir = AgentOutgoingMessagesDir + "/" + pubKeyID
+	dir = s.AgentOutgoingMessagesDir + "/" + pubKeyID
 	// delete the directory and all of its contents
 	if err := os.RemoveAll(dir); err != nil {
 		l.Errorf("failed to remove pub key dir: %v", err)
@@ -169,46 +180,80 @@ func RemovePubKeyChainOutgoingDir(pubKeyID string) (string, error) {
 	return dir, nil
 }
 
-func Init(rootDataDir, nodeName string) error {
+// New creates the store for a peer named nodeName under rootDataDir.
+func New(rootDataDir, nodeName string) (*Store, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
-		"fn":  "init",
+		"fn":  "New",
 	})
 	l.Debug("initializing")
-	RootDataDir = rootDataDir
-	if err := EnsureNodeDataDir(nodeName); err != nil {
+	s := &Store{
+		RootDataDir: rootDataDir,
+	}
+	if err := s.EnsureNodeDataDir(nodeName); err != nil {
 		l.Errorf("failed to ensure node data dir: %v", err)
-		return err
+		return nil, err
 	}
-	if err := EnsureMessagesDir(); err != nil {
+	if err := s.EnsureMessagesDir(); err != nil {
 		l.Errorf("failed to ensure messages dir: %v", err)
-		return err
+		return nil, err
 	}
-	return nil
+	if err := s.EnsureTombstonesDir(); err != nil {
+		l.Errorf("failed to ensure tombstones dir: %v", err)
+		return nil, err
+	}
+	if err := s.EnsureRotationsDir(); err != nil {
+		l.Errorf("failed to ensure rotations dir: %v", err)
+		return nil, err
+	}
+	if err := s.EnsureDirectoryDir(); err != nil {
+		l.Errorf("failed to ensure directory dir: %v", err)
+		return nil, err
+	}
+	if err := s.EnsureRevocationsDir(); err != nil {
+		l.Errorf("failed to ensure revocations dir: %v", err)
+		return nil, err
+	}
+	if err := s.EnsureDeletionsDir(); err != nil {
+		l.Errorf("failed to ensure deletions dir: %v", err)
+		return nil, err
+	}
+	return s, nil
 }
 
-func InitAgent(rootDataDir string) error {
+// NewAgent creates the store for an agent under rootDataDir.
+func NewAgent(rootDataDir string) (*Store, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
-		"fn":  "InitAgent",
+		"fn":  "NewAgent",
 	})
 	l.Debug("initializing")
-	RootDataDir = rootDataDir
-	if err := EnsureAgentMessagesDir(); err != nil {
+	s := &Store{
+		RootDataDir: rootDataDir,
+	}
+	if err := s.EnsureAgentMessagesDir(); err != nil {
 		l.Errorf("failed to ensure node data dir: %v", err)
-		return err
+		return nil, err
 	}
-	if err := EnsureAgentFilesDir(); err != nil {
+	if err := s.EnsureAgentFilesDir(); err != nil {
 		l.Errorf("failed to ensure node data dir: %v", err)
-		return err
+		return nil, err
 	}
-	if err := EnsureAgentOutgoingDir(); err != nil {
+	if err := s.EnsureAgentOutgoingDir(); err != nil {
 		l.Errorf("failed to ensure node data dir: %v", err)
-		return err
+		return nil, err
 	}
-	if err := EnsureAgentPubKeyChainDir(); err != nil {
+	if err := s.EnsureAgentPubKeyChainDir(); err != nil {
 		l.Errorf("failed to ensure node data dir: %v", err)
-		return err
+		return nil, err
 	}
-	return nil
+	if err := s.EnsureAgentQueueDirs(); err != nil {
+		l.Errorf("failed to ensure queue dirs: %v", err)
+		return nil, err
+	}
+	if err := s.EnsureAgentQuarantineDir(); err != nil {
+		l.Errorf("failed to ensure quarantine dir: %v", err)
+		return nil, err
+	}
+	return s, nil
 }
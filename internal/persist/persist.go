@@ -5,24 +5,43 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
-var (
+// Store is the on-disk message store of a single peer or agent.
+type Store struct {
+	// NodeName is the name of the peer of the store, set by
+	// EnsureNodeDataDir.
+	NodeName                 string
 	RootDataDir              string
 	NodeDataDir              string
 	MessagesDir              string
+	TombstonesDir            string
+	RotationsDir             string
+	DirectoryDir             string
+	RevocationsDir           string
+	DeletionsDir             string
 	AgentMessagesDir         string
 	AgentFilesDir            string
 	AgentPubKeyChainDir      string
 	AgentOutgoingDir         string
 	AgentOutgoingFilesDir    string
 	AgentOutgoingMessagesDir string
-)
+	AgentQueueDir            string
+	AgentSentDir             string
+	AgentFailedDir           string
+	AgentQuarantineDir       string
+
+	// receiptsMtx serializes writes to the receipt journal.
+	receiptsMtx sync.Mutex
+	// sentMtx serializes appends to the sent journal.
+	sentMtx sync.Mutex
+}
 
 type MessageMetaData struct {
 	ID        string    `json:"id"`
@@ -32,24 +51,28 @@ type MessageMetaData struct {
 	CreatedAt time.Time `json:"createdAt"`
 }
 
-func PubKeyMessageDir(pubKeyID string) string {
-	return MessagesDir + "/" + pubKeyID
+func (s *Store) PubKeyMessageDir(pubKeyID string) string {
+	return s.MessagesDir + "/" + pubKeyID
 }
 
-func PubKeyChainDir(pubKeyID string) string {
-	return AgentPubKeyChainDir + "/" + pubKeyID
+func (s *Store) PubKeyChainDir(pubKeyID string) string {
+	return s.AgentPubKeyChainDir + "/" + pubKeyID
 }
 
-func StoreMessage(pubKeyID string, channel string, id string, data []byte) error {
+func (s *Store) StoreMessage(pubKeyID string, channel string, id string, data []byte) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "StoreMessage",
 	})
 	l.Debug("storing message")
-	dir := PubKeyMessageDir(pubKeyID)
+	dir := s.PubKeyMessageDir(pubKeyID)
 	if channel == "" {
 		channel = "default"
 	}
+	if !ValidName(pubKeyID) || !ValidName(channel) || !ValidName(id) {
+		l.Errorf("invalid message name: %s/%s/%s", pubKeyID, channel, id)
+		return os.ErrInvalid
+	}
 	dir = dir + "/" + channel
 	if err := EnsureDir(dir); err != nil {
 		l.Errorf("failed to create dir: %v", err)
@@ -63,7 +86,7 @@ func StoreMessage(pubKeyID string, channel string, id string, data []byte) error
 	return nil
 }
 
-func ListMessageMetaForPubKeyID(pubKeyID string, channel string) ([]MessageMetaData, error) {
+func (s *Store) ListMessageMetaForPubKeyID(pubKeyID string, channel string) ([]MessageMetaData, error) {
 	l := log.WithFields(log.Fields{
 		"pkg":      "persist",
 		"fn":       "ListMessageMetaForPubKeyID",
@@ -72,7 +95,7 @@ func ListMessageMetaForPubKeyID(pubKeyID string, channel string) ([]MessageMetaD
 	})
 	l.Debug("listing messages for pub key id")
 	var md []MessageMetaData
-	dir := PubKeyMessageDir(pubKeyID)
+	dir := s.PubKeyMessageDir(pubKeyID)
 	// check if dir exists
 	if _, err := os.Stat(dir); err != nil {
 		if os.IsNotExist(err) {
@@ -113,16 +136,57 @@ func ListMessageMetaForPubKeyID(pubKeyID string, channel string) ([]MessageMetaD
 			})
 		}
 	}
+	// oldest first, the order of the glob is not meaningful
+	sort.Slice(md, func(i, j int) bool {
+		if !md[i].CreatedAt.Equal(md[j].CreatedAt) {
+			return md[i].CreatedAt.Before(md[j].CreatedAt)
+		}
+		return md[i].ID < md[j].ID
+	})
 	return md, nil
 }
 
-func GetMessageByID(pubKeyID string, channel string, id string) ([]byte, error) {
+// ListAllMessageMeta returns the metadata of every message stored on this node.
+func (s *Store) ListAllMessageMeta() ([]MessageMetaData, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "ListAllMessageMeta",
+	})
+	l.Debug("listing all messages")
+	var md []MessageMetaData
+	// s.MessagesDir/pubKeyID/channel/messageID
+	files, err := filepath.Glob(s.MessagesDir + "/*/*/*")
+	if err != nil {
+		l.Errorf("failed to glob dir: %v", err)
+		return nil, err
+	}
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			l.Errorf("failed to stat file: %v", err)
+			continue
+		}
+		if stat.IsDir() {
+			continue
+		}
+		md = append(md, MessageMetaData{
+			ID:        filepath.Base(file),
+			Channel:   filepath.Base(filepath.Dir(file)),
+			PubKeyID:  filepath.Base(filepath.Dir(filepath.Dir(file))),
+			Size:      stat.Size(),
+			CreatedAt: stat.ModTime(),
+		})
+	}
+	return md, nil
+}
+
+func (s *Store) GetMessageByID(pubKeyID string, channel string, id string) ([]byte, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "GetMessageByID",
 	})
 	l.Debug("getting message by id")
-	dir := PubKeyMessageDir(pubKeyID)
+	dir := s.PubKeyMessageDir(pubKeyID)
 	if _, err := os.Stat(dir); err != nil {
 		if os.IsNotExist(err) {
 			return nil, errors.New("message not found")
@@ -149,47 +213,77 @@ func GetMessageByID(pubKeyID string, channel string, id string) ([]byte, error)
 	return data, nil
 }
 
-func StoreAgentMessage(channel string, name string, mtype string, data []byte) error {
+// ValidName reports whether name can be used as a single element of a
+// path in the store, such as a channel or a file name.
+func ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// AgentMessageFile returns the path a received message named name of type
+// mtype in channel is written to, received/<messages|files>/<channel>/<name>,
+// or dir/<name> if dir is not empty.
+func (s *Store) AgentMessageFile(dir string, channel string, name string, mtype string) (string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
-		"fn":  "StoreAgentMessage",
+		"fn":  "AgentMessageFile",
 	})
-	l.Debug("storing agent file")
-	var dir string
+	if !ValidName(name) {
+		l.Errorf("invalid name %q", name)
+		return "", errors.New("invalid name")
+	}
+	if dir != "" {
+		return filepath.Join(dir, name), nil
+	}
+	if !ValidName(channel) {
+		l.Errorf("invalid channel %q", channel)
+		return "", errors.New("invalid channel or name")
+	}
 	switch mtype {
 	case "bytes":
-		dir = AgentMessagesDir
+		dir = s.AgentMessagesDir
 	case "file":
-		dir = AgentFilesDir
+		dir = s.AgentFilesDir
 	default:
 		l.Errorf("invalid message type: %v", mtype)
-		return errors.New("invalid message type")
+		return "", errors.New("invalid message type")
 	}
-	cdir := dir + "/" + channel
-	if err := EnsureDir(cdir); err != nil {
-		l.Errorf("failed to ensure dir: %v", err)
-		return err
+	return filepath.Join(dir, channel, name), nil
+}
+
+// StoreAgentMessage durably writes the received message id to file, a path
+// returned by AgentMessageFile, and returns the path of the file. If file
+// is taken by another message, the message is written to file_<id>
+// instead. Storing the message again reuses the file written before.
+func (s *Store) StoreAgentMessage(file string, id string, data []byte) (string, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "persist",
+		"fn":   "StoreAgentMessage",
+		"file": file,
+	})
+	l.Debug("storing agent file")
+	if !ValidName(id) {
+		l.Errorf("invalid message id %q", id)
+		return "", errors.New("invalid message id")
 	}
-	file := cdir + "/" + name
-	// if file exists, append guid to new file name
-	if _, err := os.Stat(file); err == nil {
-		guid := uuid.New().String()
-		file = file + "_" + guid
+	if err := EnsureDir(filepath.Dir(file)); err != nil {
+		l.Errorf("failed to ensure dir: %v", err)
+		return "", err
 	}
-	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+	file, err := WriteFileOnce(file, file+"_"+id, data, 0644)
+	if err != nil {
 		l.Errorf("failed to write file: %v", err)
-		return err
+		return "", err
 	}
-	return nil
+	return file, nil
 }
 
-func DeleteMessageByID(pubKeyID string, channel string, id string) error {
+func (s *Store) DeleteMessageByID(pubKeyID string, channel string, id string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "DeleteMessageByID",
 	})
 	l.Debug("deleting message by id")
-	mdir := PubKeyMessageDir(pubKeyID)
+	mdir := s.PubKeyMessageDir(pubKeyID)
 	if _, err := os.Stat(mdir); err != nil {
 		if os.IsNotExist(err) {
 			return errors.New("message not found")
@@ -211,12 +305,12 @@ func DeleteMessageByID(pubKeyID string, channel string, id string) error {
 		l.Errorf("failed to delete file: %v", err)
 		return err
 	}
-	return DeleteDirIfEmpty(mdir + "/" + channel)
+	return s.DeleteDirIfEmpty(mdir + "/" + channel)
 }
 
 //  DeleteDirIfEmpty deletes the specified directory if it is empty.
 // If the directory is deleted, check the parent directory and delete it if empty.
-func DeleteDirIfEmpty(dir string) error {
+func (s *Store) DeleteDirIfEmpty(dir string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "DeleteDirIfEmpty",
@@ -247,10 +341,10 @@ func DeleteDirIfEmpty(dir string) error {
 	}
 	// check if parent dir is empty
 	parent := filepath.Dir(dir)
-	if parent == MessagesDir || parent == RootDataDir {
+	if parent == s.MessagesDir || parent == s.RootDataDir {
 		return nil
 	}
-	if err := DeleteDirIfEmpty(parent); err != nil {
+	if err := s.DeleteDirIfEmpty(parent); err != nil {
 		l.Errorf("failed to delete parent dir: %v", err)
 		return err
 	}
@@ -285,13 +379,13 @@ func getFilesOlderThan(dir string, dur time.Duration) ([]string, error) {
 	return files, nil
 }
 
-func cleanupOldFiles(dur time.Duration) error {
+func (s *Store) cleanupOldFiles(dur time.Duration) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "cleanupOldFiles",
 	})
 	l.Debug("cleaning up old files")
-	// loop through MessagesDir recursivevely
+	// loop through s.MessagesDir recursivevely
 	// the directory name is the pubKeyID and the file name is the messageID
 	// if the file is older than dur, delete it
 	type Deletion struct {
@@ -301,17 +395,17 @@ func cleanupOldFiles(dur time.Duration) error {
 	}
 	deletions := []Deletion{}
 	// walk file tree
-	deleteFiles, err := getFilesOlderThan(MessagesDir, dur)
+	deleteFiles, err := getFilesOlderThan(s.MessagesDir, dur)
 	if err != nil {
 		l.Errorf("failed to get files older than: %v", err)
 		return err
 	}
 	for _, file := range deleteFiles {
 		// file path in format:
-		// MessagesDir/pubKeyID/channel/messageID
+		// s.MessagesDir/pubKeyID/channel/messageID
 		// split on / to get pubKeyID, channel, and messageID
-		// first, remove MessagesDir from path
-		file = strings.Replace(file, MessagesDir, "", 1)
+		// first, remove s.MessagesDir from path
+		file = strings.Replace(file, s.MessagesDir, "", 1)
 		// split on / to get pubKeyID, channel, and messageID
 		parts := strings.Split(file, "/")
 		if len(parts) != 3 {
@@ -326,7 +420,7 @@ func cleanupOldFiles(dur time.Duration) error {
 	}
 	// delete files
 	for _, deletion := range deletions {
-		err := DeleteMessageByID(deletion.PubKeyID, deletion.Channel, deletion.ID)
+		err := s.DeleteMessageByID(deletion.PubKeyID, deletion.Channel, deletion.ID)
 		if err != nil {
 			l.Errorf("failed to delete message: %v", err)
 			return err
@@ -335,17 +429,30 @@ func cleanupOldFiles(dur time.Duration) error {
 	return nil
 }
 
-func TimeoutCleaner() {
+// TimeoutCleaner removes expired messages and tombstones once a day
+// until stop is closed.
+func (s *Store) TimeoutCleaner(stop <-chan struct{}) {
 	l := log.WithFields(log.Fields{
 		"pkg": "persist",
 		"fn":  "TimeoutCleaner",
 	})
 	l.Debug("timeout cleaner started")
 	for {
-		time.Sleep(time.Hour * 24)
+		select {
+		case <-stop:
+			l.Debug("timeout cleaner stopped")
+			return
+		case <-time.After(time.Hour * 24):
+		}
 		l.Debug("cleaning")
-		if err := cleanupOldFiles(time.Hour * 24 * 90); err != nil {
+		if err := s.cleanupOldFiles(time.Hour * 24 * 90); err != nil {
 			l.Errorf("failed to clean: %v", err)
 		}
+		if err := s.cleanupOldTombstones(time.Hour * 24 * 90); err != nil {
+			l.Errorf("failed to clean tombstones: %v", err)
+		}
+		if err := s.cleanupOldDeletionSets(time.Hour * 24 * 7); err != nil {
+			l.Errorf("failed to clean deletion sets: %v", err)
+		}
 	}
 }
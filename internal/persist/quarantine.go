@@ -0,0 +1,73 @@
+package persist
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QuarantineInfo describes a received message whose hook kept failing.
+type QuarantineInfo struct {
+	ID            string    `json:"id"`
+	Channel       string    `json:"channel"`
+	File          string    `json:"file"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"lastError"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+func (s *Store) EnsureAgentQuarantineDir() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "EnsureAgentQuarantineDir",
+	})
+	l.Debug("ensuring quarantine dir")
+	s.AgentQuarantineDir = s.RootDataDir + "/quarantine"
+	return EnsureDir(s.AgentQuarantineDir)
+}
+
+// QuarantineAgentMessage moves the received file to the quarantine
+// directory of its channel, next to a <name>.error.json file with info,
+// and returns its new path.
+func (s *Store) QuarantineAgentMessage(file string, info *QuarantineInfo) (string, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "persist",
+		"fn":   "QuarantineAgentMessage",
+		"id":   info.ID,
+		"file": file,
+	})
+	l.Debug("quarantining message")
+	dir := s.AgentQuarantineDir + "/" + info.Channel
+	if err := EnsureDir(dir); err != nil {
+		l.Errorf("failed to create dir: %v", err)
+		return "", err
+	}
+	name := filepath.Base(file)
+	dst := dir + "/" + name
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = dir + "/" + name + "." + strconv.Itoa(i)
+	}
+	info.File = dst
+	info.QuarantinedAt = time.Now()
+	jd, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		l.Errorf("failed to marshal quarantine info: %v", err)
+		return "", err
+	}
+	if err := WriteFileAtomic(dst+".error.json", jd, 0644); err != nil {
+		l.Errorf("failed to write error file: %v", err)
+		return "", err
+	}
+	if err := os.Rename(file, dst); err != nil {
+		l.Errorf("failed to move file: %v", err)
+		return "", err
+	}
+	return dst, nil
+}
@@ -0,0 +1,219 @@
+package persist
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// SortCreated orders messages by the time they were stored on the peer.
+	SortCreated = "created"
+	// SortSize orders messages by their size.
+	SortSize = "size"
+)
+
+// ErrInvalidCursor is returned by QueryMessageMeta for a cursor which was
+// not returned by a listing with the same channel, filters and order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrCursorPeer is returned by QueryMessageMeta for a cursor which was
+// returned by another peer. The positions of cursors depend on the times
+// the messages were stored, which differ between the peers.
+var ErrCursorPeer = errors.New("cursor of another peer")
+
+// MessageQuery selects, orders and pages the messages of a key. The zero
+// value lists all messages, oldest first.
+type MessageQuery struct {
+	// Channel selects a channel, all channels if empty.
+	Channel string
+	// CreatedAfter and CreatedBefore select the messages stored within
+	// the interval, they are ignored if zero.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// MinSize and MaxSize select the messages of at least and at most
+	// this many bytes, they are ignored if 0.
+	MinSize int64
+	MaxSize int64
+	// Sort is SortCreated or SortSize, SortCreated if empty. Messages
+	// with the same sort key are ordered by ID.
+	Sort string
+	// Desc reverses the order.
+	Desc bool
+	// Limit is the most messages returned, all if 0.
+	Limit int
+	// Cursor continues a listing after the last message of the previous
+	// page, see MessagePage.NextCursor.
+	Cursor string
+}
+
+// MessagePage is a page of a message listing.
+type MessagePage struct {
+	Messages []MessageMetaData `json:"messages"`
+	// Total is the number of messages matching the query on all pages.
+	Total int `json:"total"`
+	// NextCursor continues the listing, empty on the last page. Cursors
+	// name a position in the order of a peer, are only valid on that peer
+	// with the same query but Limit, and stay valid when messages are
+	// added or deleted.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Validate checks the sort key and the cursor of the query.
+func (q MessageQuery) Validate() error {
+	switch q.Sort {
+	case "", SortCreated, SortSize:
+	default:
+		return fmt.Errorf("invalid sort: %q", q.Sort)
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("invalid limit: %d", q.Limit)
+	}
+	if q.Cursor != "" {
+		if _, err := q.decodeCursor(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q MessageQuery) sortKey() string {
+	if q.Sort == "" {
+		return SortCreated
+	}
+	return q.Sort
+}
+
+func (q MessageQuery) keyOf(m MessageMetaData) int64 {
+	if q.sortKey() == SortSize {
+		return m.Size
+	}
+	return m.CreatedAt.UnixNano()
+}
+
+func (q MessageQuery) matches(m MessageMetaData) bool {
+	if !q.CreatedAfter.IsZero() && !m.CreatedAt.After(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !m.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	if q.MinSize > 0 && m.Size < q.MinSize {
+		return false
+	}
+	if q.MaxSize > 0 && m.Size > q.MaxSize {
+		return false
+	}
+	return true
+}
+
+// less reports whether a comes before b in the order of the query.
+func (q MessageQuery) less(aKey int64, aID string, bKey int64, bID string) bool {
+	if aKey != bKey {
+		if q.Desc {
+			return aKey > bKey
+		}
+		return aKey < bKey
+	}
+	if q.Desc {
+		return aID > bID
+	}
+	return aID < bID
+}
+
+// cursor is a position in the order of the listings of a peer.
+type cursor struct {
+	Peer   string `json:"p"`
+	Sort   string `json:"s"`
+	Desc   bool   `json:"d,omitempty"`
+	Filter string `json:"f"`
+	Key    int64  `json:"k"`
+	ID     string `json:"i"`
+}
+
+// filterHash identifies the messages selected by the query, so that a
+// cursor is not used to page another selection.
+func (q MessageQuery) filterHash() string {
+	var after, before int64
+	if !q.CreatedAfter.IsZero() {
+		after = q.CreatedAfter.UnixNano()
+	}
+	if !q.CreatedBefore.IsZero() {
+		before = q.CreatedBefore.UnixNano()
+	}
+	h := sha256.Sum256([]byte(fmt.Sprintf("%q %d %d %d %d", q.Channel, after, before, q.MinSize, q.MaxSize)))
+	return base64.RawURLEncoding.EncodeToString(h[:8])
+}
+
+// encodeCursor returns the cursor of the position after m on the peer.
+func (q MessageQuery) encodeCursor(peer string, m MessageMetaData) string {
+	jd, _ := json.Marshal(cursor{
+		Peer:   peer,
+		Sort:   q.sortKey(),
+		Desc:   q.Desc,
+		Filter: q.filterHash(),
+		Key:    q.keyOf(m),
+		ID:     m.ID,
+	})
+	return base64.RawURLEncoding.EncodeToString(jd)
+}
+
+func (q MessageQuery) decodeCursor() (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != q.sortKey() || c.Desc != q.Desc || c.Filter != q.filterHash() {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// QueryMessageMeta returns the page of the messages of the key pubKeyID
+// selected by q.
+func (s *Store) QueryMessageMeta(pubKeyID string, q MessageQuery) (*MessagePage, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	var cur *cursor
+	if q.Cursor != "" {
+		cur, _ = q.decodeCursor()
+		if cur.Peer != s.NodeName {
+			return nil, ErrCursorPeer
+		}
+	}
+	all, err := s.ListMessageMetaForPubKeyID(pubKeyID, q.Channel)
+	if err != nil {
+		return nil, err
+	}
+	var md []MessageMetaData
+	for _, m := range all {
+		if q.matches(m) {
+			md = append(md, m)
+		}
+	}
+	sort.Slice(md, func(i, j int) bool {
+		return q.less(q.keyOf(md[i]), md[i].ID, q.keyOf(md[j]), md[j].ID)
+	})
+	page := &MessagePage{Total: len(md)}
+	if cur != nil {
+		i := sort.Search(len(md), func(i int) bool {
+			return q.less(cur.Key, cur.ID, q.keyOf(md[i]), md[i].ID)
+		})
+		md = md[i:]
+	}
+	if q.Limit > 0 && len(md) > q.Limit {
+		md = md[:q.Limit]
+		page.NextCursor = q.encodeCursor(s.NodeName, md[len(md)-1])
+	}
+	page.Messages = md
+	return page, nil
+}
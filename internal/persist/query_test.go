@@ -0,0 +1,218 @@
+package persist
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPubKeyID = "key"
+
+// testMessage is a message stored by storeTestMessages.
+type testMessage struct {
+	id      string
+	channel string
+	size    int
+	age     time.Duration
+}
+
+// queryTestMessages are stored with distinct times and sizes, m3 and m4
+// share their size to test the order by ID.
+var queryTestMessages = []testMessage{
+	{"m1", "default", 10, time.Minute * 5},
+	{"m2", "default", 40, time.Minute * 4},
+	{"m3", "ops", 20, time.Minute * 3},
+	{"m4", "default", 20, time.Minute * 2},
+	{"m5", "ops", 30, time.Minute},
+}
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := New(t.TempDir(), "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// storeTestMessages stores the messages with their modification times
+// set to their ages before now, and returns now.
+func storeTestMessages(t *testing.T, s *Store, ms []testMessage) time.Time {
+	t.Helper()
+	now := time.Now().Truncate(time.Second)
+	for _, m := range ms {
+		if err := s.StoreMessage(testPubKeyID, m.channel, m.id, []byte(strings.Repeat("x", m.size))); err != nil {
+			t.Fatal(err)
+		}
+		at := now.Add(-m.age)
+		file := s.PubKeyMessageDir(testPubKeyID) + "/" + m.channel + "/" + m.id
+		if err := os.Chtimes(file, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return now
+}
+
+func pageIDs(p *MessagePage) []string {
+	ids := []string{}
+	for _, m := range p.Messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+// queryAll pages through the listing of q and returns the IDs of all pages.
+func queryAll(t *testing.T, s *Store, q MessageQuery) []string {
+	t.Helper()
+	ids := []string{}
+	for i := 0; ; i++ {
+		if i > len(queryTestMessages) {
+			t.Fatal("listing does not end")
+		}
+		p, err := s.QueryMessageMeta(testPubKeyID, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, pageIDs(p)...)
+		if p.NextCursor == "" {
+			return ids
+		}
+		q.Cursor = p.NextCursor
+	}
+}
+
+func TestQueryMessageMetaOrder(t *testing.T) {
+	s := newTestStore(t)
+	storeTestMessages(t, s, queryTestMessages)
+	tests := []struct {
+		name string
+		q    MessageQuery
+		want []string
+	}{
+		{"created", MessageQuery{}, []string{"m1", "m2", "m3", "m4", "m5"}},
+		{"created desc", MessageQuery{Desc: true}, []string{"m5", "m4", "m3", "m2", "m1"}},
+		{"size", MessageQuery{Sort: SortSize}, []string{"m1", "m3", "m4", "m5", "m2"}},
+		{"size desc", MessageQuery{Sort: SortSize, Desc: true}, []string{"m2", "m5", "m4", "m3", "m1"}},
+		{"channel", MessageQuery{Channel: "ops"}, []string{"m3", "m5"}},
+		{"size range", MessageQuery{MinSize: 20, MaxSize: 30}, []string{"m3", "m4", "m5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := s.QueryMessageMeta(testPubKeyID, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pageIDs(p); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if p.Total != len(tt.want) || p.NextCursor != "" {
+				t.Errorf("got total %d and cursor %q, want %d and none", p.Total, p.NextCursor, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestQueryMessageMetaCreatedInterval(t *testing.T) {
+	s := newTestStore(t)
+	now := storeTestMessages(t, s, queryTestMessages)
+	q := MessageQuery{
+		CreatedAfter:  now.Add(-time.Minute * 5),
+		CreatedBefore: now.Add(-time.Minute),
+	}
+	p, err := s.QueryMessageMeta(testPubKeyID, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both bounds are exclusive
+	if got, want := pageIDs(p), []string{"m2", "m3", "m4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQueryMessageMetaPages(t *testing.T) {
+	s := newTestStore(t)
+	storeTestMessages(t, s, queryTestMessages)
+	for _, q := range []MessageQuery{
+		{},
+		{Desc: true},
+		{Sort: SortSize},
+		{Sort: SortSize, Desc: true},
+	} {
+		all, err := s.QueryMessageMeta(testPubKeyID, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for limit := 1; limit <= len(queryTestMessages); limit++ {
+			q.Limit = limit
+			if got := queryAll(t, s, q); !reflect.DeepEqual(got, pageIDs(all)) {
+				t.Errorf("sort %q desc %v limit %d: got %v, want %v", q.Sort, q.Desc, limit, got, pageIDs(all))
+			}
+		}
+	}
+}
+
+func TestQueryMessageMetaCursorSurvivesChanges(t *testing.T) {
+	s := newTestStore(t)
+	storeTestMessages(t, s, queryTestMessages)
+	p, err := s.QueryMessageMeta(testPubKeyID, MessageQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last message of the page and the next one are deleted, and a
+	// message is added at the end
+	for _, m := range queryTestMessages[1:3] {
+		if err := s.DeleteMessageByID(testPubKeyID, m.channel, m.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeTestMessages(t, s, []testMessage{{"m6", "default", 10, 0}})
+	p, err = s.QueryMessageMeta(testPubKeyID, MessageQuery{Limit: 10, Cursor: p.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pageIDs(p), []string{"m4", "m5", "m6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQueryMessageMetaInvalidCursor(t *testing.T) {
+	s := newTestStore(t)
+	storeTestMessages(t, s, queryTestMessages)
+	q := MessageQuery{Channel: "default", MinSize: 5, Limit: 1}
+	p, err := s.QueryMessageMeta(testPubKeyID, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]func(q *MessageQuery){
+		"garbage":        func(q *MessageQuery) { q.Cursor = "not a cursor" },
+		"sort":           func(q *MessageQuery) { q.Sort = SortSize },
+		"desc":           func(q *MessageQuery) { q.Desc = true },
+		"channel":        func(q *MessageQuery) { q.Channel = "" },
+		"min size":       func(q *MessageQuery) { q.MinSize = 6 },
+		"max size":       func(q *MessageQuery) { q.MaxSize = 100 },
+		"created after":  func(q *MessageQuery) { q.CreatedAfter = time.Now().Add(-time.Hour) },
+		"created before": func(q *MessageQuery) { q.CreatedBefore = time.Now() },
+	}
+	for name, change := range tests {
+		next := q
+		next.Cursor = p.NextCursor
+		change(&next)
+		if _, err := s.QueryMessageMeta(testPubKeyID, next); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrInvalidCursor)
+		}
+	}
+	// the limit may change between pages
+	next := q
+	next.Cursor = p.NextCursor
+	next.Limit = 10
+	if _, err := s.QueryMessageMeta(testPubKeyID, next); err != nil {
+		t.Errorf("limit: got %v", err)
+	}
+	other := &Store{NodeName: "n2", MessagesDir: s.MessagesDir}
+	if _, err := other.QueryMessageMeta(testPubKeyID, next); !errors.Is(err, ErrCursorPeer) {
+		t.Errorf("other peer: got %v, want %v", err, ErrCursorPeer)
+	}
+}
@@ -0,0 +1,224 @@
+package persist
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// QueueItem is an outgoing message in the agent's queue. The data of the
+// message is kept next to its state until it is sent or given up on.
+type QueueItem struct {
+	ID string `json:"id"`
+	// Type is "bytes" or "file".
+	Type string `json:"type"`
+	// Name is the name of the file the message was dropped as.
+	Name        string    `json:"name"`
+	PubKeyID    string    `json:"pubKeyID"`
+	Channel     string    `json:"channel"`
+	QueuedAt    time.Time `json:"queuedAt"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+	// MessageID and SentAt are set once the message has been accepted by a peer.
+	MessageID string     `json:"messageID,omitempty"`
+	SentAt    *time.Time `json:"sentAt,omitempty"`
+}
+
+func (s *Store) EnsureAgentQueueDirs() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "EnsureAgentQueueDirs",
+	})
+	l.Debug("ensuring queue dirs")
+	s.AgentQueueDir = s.RootDataDir + "/outgoing/queue"
+	s.AgentSentDir = s.RootDataDir + "/outgoing/sent"
+	s.AgentFailedDir = s.RootDataDir + "/outgoing/failed"
+	for _, d := range []string{s.AgentQueueDir, s.AgentSentDir, s.AgentFailedDir} {
+		if err := EnsureDir(d); err != nil {
+			l.Errorf("failed to create dir: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) queueItemDir(id string) string {
+	return s.AgentQueueDir + "/" + id
+}
+
+// QueueItemData returns the path of the data of the queued item.
+func (s *Store) QueueItemData(id string) string {
+	return s.queueItemDir(id) + "/data"
+}
+
+// Enqueue moves the file src into the outgoing queue as a new item.
+func (s *Store) Enqueue(src string, it *QueueItem) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "Enqueue",
+		"src": src,
+	})
+	l.Debug("enqueueing outgoing message")
+	it.ID = uuid.New().String()
+	it.QueuedAt = time.Now()
+	it.NextAttempt = it.QueuedAt
+	dir := s.queueItemDir(it.ID)
+	if err := EnsureDir(dir); err != nil {
+		l.Errorf("failed to create dir: %v", err)
+		return err
+	}
+	// the state is written first, an item without data is discarded on load
+	if err := s.UpdateQueueItem(it); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := os.Rename(src, s.QueueItemData(it.ID)); err != nil {
+		l.Errorf("failed to move file into queue: %v", err)
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// UpdateQueueItem saves the state of a queued item.
+func (s *Store) UpdateQueueItem(it *QueueItem) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "UpdateQueueItem",
+		"id":  it.ID,
+	})
+	jd, err := json.Marshal(it)
+	if err != nil {
+		l.Errorf("failed to marshal queue item: %v", err)
+		return err
+	}
+	if err := WriteFileAtomic(s.queueItemDir(it.ID)+"/state.json", jd, 0644); err != nil {
+		l.Errorf("failed to write queue item: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ListQueue returns the items in the outgoing queue, oldest first.
+func (s *Store) ListQueue() ([]*QueueItem, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "ListQueue",
+	})
+	files, err := filepath.Glob(s.AgentQueueDir + "/*/state.json")
+	if err != nil {
+		l.Errorf("failed to glob queue: %v", err)
+		return nil, err
+	}
+	var items []*QueueItem
+	for _, f := range files {
+		bd, err := ioutil.ReadFile(f)
+		if err != nil {
+			l.Errorf("failed to read queue item: %v", err)
+			continue
+		}
+		it := &QueueItem{}
+		if err := json.Unmarshal(bd, it); err != nil {
+			l.Errorf("failed to decode queue item %s: %v", f, err)
+			continue
+		}
+		if _, err := os.Stat(s.QueueItemData(it.ID)); os.IsNotExist(err) {
+			l.Debugf("discarding queue item %s without data", it.ID)
+			os.RemoveAll(filepath.Dir(f))
+			continue
+		}
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].QueuedAt.Before(items[j].QueuedAt)
+	})
+	return items, nil
+}
+
+// CompleteQueueItem appends the sent item to the journal of the day in
+// the sent directory and removes it from the queue.
+func (s *Store) CompleteQueueItem(it *QueueItem) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "CompleteQueueItem",
+		"id":  it.ID,
+	})
+	l.Debug("completing queue item")
+	if it.SentAt == nil {
+		now := time.Now()
+		it.SentAt = &now
+	}
+	jd, err := json.Marshal(it)
+	if err != nil {
+		l.Errorf("failed to marshal queue item: %v", err)
+		return err
+	}
+	journal := s.AgentSentDir + "/" + it.SentAt.UTC().Format("2006-01-02") + ".log"
+	s.sentMtx.Lock()
+	f, err := os.OpenFile(journal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = f.Write(append(jd, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	s.sentMtx.Unlock()
+	if err != nil {
+		l.Errorf("failed to write sent journal: %v", err)
+		return err
+	}
+	if err := os.RemoveAll(s.queueItemDir(it.ID)); err != nil {
+		l.Errorf("failed to remove queue item: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FailQueueItem moves the data of the item to the failed directory of its
+// public key, next to a <name>.error.json file with its final state.
+func (s *Store) FailQueueItem(it *QueueItem) (string, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "FailQueueItem",
+		"id":  it.ID,
+	})
+	l.Debug("failing queue item")
+	dir := s.AgentFailedDir + "/" + it.PubKeyID
+	if err := EnsureDir(dir); err != nil {
+		l.Errorf("failed to create dir: %v", err)
+		return "", err
+	}
+	dst := dir + "/" + it.Name
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = dir + "/" + it.Name + "." + strconv.Itoa(i)
+	}
+	jd, err := json.MarshalIndent(it, "", "  ")
+	if err != nil {
+		l.Errorf("failed to marshal queue item: %v", err)
+		return "", err
+	}
+	if err := WriteFileAtomic(dst+".error.json", jd, 0644); err != nil {
+		l.Errorf("failed to write error file: %v", err)
+		return "", err
+	}
+	if err := os.Rename(s.QueueItemData(it.ID), dst); err != nil {
+		l.Errorf("failed to move data: %v", err)
+		return "", err
+	}
+	if err := os.RemoveAll(s.queueItemDir(it.ID)); err != nil {
+		l.Errorf("failed to remove queue item: %v", err)
+		return "", err
+	}
+	return dst, nil
+}
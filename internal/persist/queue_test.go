@@ -0,0 +1,162 @@
+package persist
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestAgentStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := NewAgent(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// enqueueTestFile drops a file with data into the outgoing directory and
+// enqueues it as name.
+func enqueueTestFile(t *testing.T, s *Store, name string, data string) *QueueItem {
+	t.Helper()
+	src := filepath.Join(s.AgentOutgoingMessagesDir, name)
+	if err := ioutil.WriteFile(src, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	it := &QueueItem{Type: "bytes", Name: name, PubKeyID: testPubKeyID, Channel: "default"}
+	if err := s.Enqueue(src, it); err != nil {
+		t.Fatal(err)
+	}
+	return it
+}
+
+func TestEnqueue(t *testing.T) {
+	s := newTestAgentStore(t)
+	it := enqueueTestFile(t, s, "m1", "hello")
+	if it.ID == "" || it.QueuedAt.IsZero() || !it.NextAttempt.Equal(it.QueuedAt) {
+		t.Errorf("enqueued item not initialized: %+v", it)
+	}
+	if _, err := os.Stat(filepath.Join(s.AgentOutgoingMessagesDir, "m1")); !os.IsNotExist(err) {
+		t.Errorf("dropped file still exists: %v", err)
+	}
+	data, err := ioutil.ReadFile(s.QueueItemData(it.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("got data %q, want %q", data, "hello")
+	}
+}
+
+func TestListQueue(t *testing.T) {
+	s := newTestAgentStore(t)
+	first := enqueueTestFile(t, s, "m1", "1")
+	second := enqueueTestFile(t, s, "m2", "2")
+	second.Attempts = 2
+	second.LastError = "unreachable"
+	if err := s.UpdateQueueItem(second); err != nil {
+		t.Fatal(err)
+	}
+	// the state of an item whose data was never moved into the queue
+	lost := enqueueTestFile(t, s, "m3", "3")
+	if err := os.Remove(s.QueueItemData(lost.ID)); err != nil {
+		t.Fatal(err)
+	}
+	items, err := s.ListQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].ID != first.ID || items[1].ID != second.ID {
+		t.Fatalf("got %+v, want %s and %s", items, first.ID, second.ID)
+	}
+	if items[1].Attempts != 2 || items[1].LastError != "unreachable" {
+		t.Errorf("state not updated: %+v", items[1])
+	}
+	if _, err := os.Stat(s.queueItemDir(lost.ID)); !os.IsNotExist(err) {
+		t.Errorf("item without data not discarded: %v", err)
+	}
+}
+
+func TestCompleteQueueItem(t *testing.T) {
+	s := newTestAgentStore(t)
+	var sent []*QueueItem
+	for _, name := range []string{"m1", "m2"} {
+		it := enqueueTestFile(t, s, name, name)
+		it.MessageID = "id-" + name
+		if err := s.CompleteQueueItem(it); err != nil {
+			t.Fatal(err)
+		}
+		if it.SentAt == nil {
+			t.Fatal("SentAt not set")
+		}
+		if _, err := os.Stat(s.queueItemDir(it.ID)); !os.IsNotExist(err) {
+			t.Errorf("completed item still queued: %v", err)
+		}
+		sent = append(sent, it)
+	}
+	f, err := os.Open(filepath.Join(s.AgentSentDir, sent[0].SentAt.UTC().Format("2006-01-02")+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		it := &QueueItem{}
+		if err := json.Unmarshal(sc.Bytes(), it); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, it.MessageID)
+	}
+	if len(got) != 2 || got[0] != "id-m1" || got[1] != "id-m2" {
+		t.Errorf("got journal %v, want [id-m1 id-m2]", got)
+	}
+}
+
+func TestFailQueueItem(t *testing.T) {
+	s := newTestAgentStore(t)
+	var dsts []string
+	for i := 0; i < 2; i++ {
+		it := enqueueTestFile(t, s, "m1", "data")
+		it.Attempts = 3
+		it.LastError = "rejected"
+		it.NextAttempt = time.Time{}
+		dst, err := s.FailQueueItem(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(s.queueItemDir(it.ID)); !os.IsNotExist(err) {
+			t.Errorf("failed item still queued: %v", err)
+		}
+		dsts = append(dsts, dst)
+	}
+	dir := filepath.Join(s.AgentFailedDir, testPubKeyID)
+	// a second failure of the same name does not overwrite the first
+	if want := []string{dir + "/m1", dir + "/m1.1"}; dsts[0] != want[0] || dsts[1] != want[1] {
+		t.Errorf("got %v, want %v", dsts, want)
+	}
+	for _, dst := range dsts {
+		data, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "data" {
+			t.Errorf("%s: got data %q, want %q", dst, data, "data")
+		}
+		jd, err := ioutil.ReadFile(dst + ".error.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		it := &QueueItem{}
+		if err := json.Unmarshal(jd, it); err != nil {
+			t.Fatal(err)
+		}
+		if it.Attempts != 3 || it.LastError != "rejected" {
+			t.Errorf("%s: got state %+v", dst, it)
+		}
+	}
+}
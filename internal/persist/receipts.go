@@ -0,0 +1,155 @@
+package persist
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The states of a received message in the receipt journal, in the order
+// they are reached.
+const (
+	// ReceiptReceiving is recorded before the message is written, with
+	// the path it is written to, so that a message received again after
+	// a crash reuses the file.
+	ReceiptReceiving = "receiving"
+	// ReceiptStored is recorded once the message is durably written.
+	ReceiptStored = "stored"
+	// ReceiptDone is recorded once the hook of the message succeeded, or
+	// right after ReceiptStored if there is no hook.
+	ReceiptDone = "done"
+	// ReceiptQuarantined is recorded if the hook of the message failed.
+	ReceiptQuarantined = "quarantined"
+	// ReceiptConfirmed is recorded once the message has been confirmed.
+	ReceiptConfirmed = "confirmed"
+)
+
+// receiptRetention is how long confirmed receipts are kept, so that
+// messages still listed by peers which have not seen the confirmation
+// yet are not received again.
+const receiptRetention = time.Hour * 24 * 7
+
+// Receipt is an entry of the receipt journal of the agent.
+type Receipt struct {
+	ID      string `json:"id"`
+	Channel string `json:"channel"`
+	State   string `json:"state"`
+	// Type and FileName are the type and file name of the message, and
+	// File the path it was stored at, or is to be stored at while it is
+	// received.
+	Type     string    `json:"type,omitempty"`
+	FileName string    `json:"fileName,omitempty"`
+	File     string    `json:"file,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Key returns the key of the message of the receipt in LoadReceipts.
+func (r *Receipt) Key() string {
+	return ReceiptKey(r.Channel, r.ID)
+}
+
+// ReceiptKey returns the key of the message id in channel in LoadReceipts.
+func ReceiptKey(channel, id string) string {
+	return channel + "/" + id
+}
+
+func (s *Store) receiptsFile() string {
+	return s.RootDataDir + "/receipts.log"
+}
+
+// LoadReceipts reads the receipt journal and returns the last receipt of
+// every message by ReceiptKey. The journal is compacted on the way, which
+// drops all but the last receipt of a message and confirmed receipts
+// older than a week.
+func (s *Store) LoadReceipts() (map[string]*Receipt, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "LoadReceipts",
+	})
+	l.Debug("loading receipts")
+	s.receiptsMtx.Lock()
+	defer s.receiptsMtx.Unlock()
+	rs := map[string]*Receipt{}
+	f, err := os.Open(s.receiptsFile())
+	if os.IsNotExist(err) {
+		return rs, nil
+	} else if err != nil {
+		l.Errorf("failed to open receipts: %v", err)
+		return nil, err
+	}
+	defer f.Close()
+	var order []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		r := &Receipt{}
+		if err := json.Unmarshal(sc.Bytes(), r); err != nil {
+			// a torn write at the end of the journal
+			l.Errorf("skipping invalid receipt: %v", err)
+			continue
+		}
+		if _, ok := rs[r.Key()]; !ok {
+			order = append(order, r.Key())
+		}
+		rs[r.Key()] = r
+	}
+	if err := sc.Err(); err != nil {
+		l.Errorf("failed to read receipts: %v", err)
+		return nil, err
+	}
+	var data []byte
+	for _, k := range order {
+		r := rs[k]
+		if r.State == ReceiptConfirmed && time.Since(r.At) > receiptRetention {
+			delete(rs, k)
+			continue
+		}
+		jd, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, jd...), '\n')
+	}
+	if err := WriteFileAtomic(s.receiptsFile(), data, 0644); err != nil {
+		l.Errorf("failed to compact receipts: %v", err)
+		return nil, err
+	}
+	return rs, nil
+}
+
+// AppendReceipt durably appends r to the receipt journal.
+func (s *Store) AppendReceipt(r *Receipt) error {
+	l := log.WithFields(log.Fields{
+		"pkg":   "persist",
+		"fn":    "AppendReceipt",
+		"id":    r.ID,
+		"state": r.State,
+	})
+	if r.At.IsZero() {
+		r.At = time.Now()
+	}
+	jd, err := json.Marshal(r)
+	if err != nil {
+		l.Errorf("failed to marshal receipt: %v", err)
+		return err
+	}
+	s.receiptsMtx.Lock()
+	defer s.receiptsMtx.Unlock()
+	f, err := os.OpenFile(s.receiptsFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		l.Errorf("failed to open receipts: %v", err)
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(jd, '\n')); err != nil {
+		l.Errorf("failed to write receipt: %v", err)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		l.Errorf("failed to sync receipts: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package persist
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"time"
+)
+
+func appendTestReceipts(t *testing.T, s *Store, rs ...*Receipt) {
+	t.Helper()
+	for _, r := range rs {
+		if err := s.AppendReceipt(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func receiptLines(t *testing.T, s *Store) int {
+	t.Helper()
+	f, err := os.Open(s.receiptsFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var n int
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestLoadReceiptsWithoutJournal(t *testing.T) {
+	s := newTestAgentStore(t)
+	rs, err := s.LoadReceipts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 0 {
+		t.Errorf("got %d receipts, want none", len(rs))
+	}
+}
+
+func TestLoadReceiptsKeepsLastState(t *testing.T) {
+	s := newTestAgentStore(t)
+	appendTestReceipts(t, s,
+		&Receipt{ID: "m1", Channel: "default", State: ReceiptReceiving, File: "/tmp/m1"},
+		&Receipt{ID: "m2", Channel: "default", State: ReceiptReceiving},
+		&Receipt{ID: "m1", Channel: "default", State: ReceiptStored, File: "/tmp/m1"},
+		// the same id in another channel is another message
+		&Receipt{ID: "m1", Channel: "ops", State: ReceiptDone},
+		&Receipt{ID: "m1", Channel: "default", State: ReceiptDone, File: "/tmp/m1"},
+	)
+	rs, err := s.LoadReceipts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		ReceiptKey("default", "m1"): ReceiptDone,
+		ReceiptKey("default", "m2"): ReceiptReceiving,
+		ReceiptKey("ops", "m1"):     ReceiptDone,
+	}
+	if len(rs) != len(want) {
+		t.Errorf("got %d receipts, want %d", len(rs), len(want))
+	}
+	for k, state := range want {
+		if r := rs[k]; r == nil || r.State != state {
+			t.Errorf("%s: got %+v, want state %s", k, r, state)
+		}
+	}
+	if r := rs[ReceiptKey("default", "m1")]; r != nil && (r.File != "/tmp/m1" || r.At.IsZero()) {
+		t.Errorf("got %+v, want file and time", r)
+	}
+	// compacted to the last receipt of each message
+	if n := receiptLines(t, s); n != len(want) {
+		t.Errorf("got %d lines after compaction, want %d", n, len(want))
+	}
+}
+
+func TestLoadReceiptsDropsOldConfirmations(t *testing.T) {
+	s := newTestAgentStore(t)
+	old := time.Now().Add(-receiptRetention - time.Hour)
+	appendTestReceipts(t, s,
+		&Receipt{ID: "old", Channel: "default", State: ReceiptConfirmed, At: old},
+		&Receipt{ID: "recent", Channel: "default", State: ReceiptConfirmed},
+		// only confirmed receipts expire
+		&Receipt{ID: "stuck", Channel: "default", State: ReceiptQuarantined, At: old},
+	)
+	rs, err := s.LoadReceipts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rs[ReceiptKey("default", "old")]; ok {
+		t.Error("old confirmation kept")
+	}
+	for _, id := range []string{"recent", "stuck"} {
+		if _, ok := rs[ReceiptKey("default", id)]; !ok {
+			t.Errorf("%s dropped", id)
+		}
+	}
+	if n := receiptLines(t, s); n != 2 {
+		t.Errorf("got %d lines after compaction, want 2", n)
+	}
+}
+
+func TestLoadReceiptsSkipsTornWrite(t *testing.T) {
+	s := newTestAgentStore(t)
+	appendTestReceipts(t, s, &Receipt{ID: "m1", Channel: "default", State: ReceiptStored})
+	f, err := os.OpenFile(s.receiptsFile(), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(`{"id":"m1","chan`)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	rs, err := s.LoadReceipts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rs[ReceiptKey("default", "m1")]; r == nil || r.State != ReceiptStored {
+		t.Errorf("got %+v, want state %s", r, ReceiptStored)
+	}
+	// the next receipt starts on a line of its own
+	appendTestReceipts(t, s, &Receipt{ID: "m1", Channel: "default", State: ReceiptDone})
+	rs, err = s.LoadReceipts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rs[ReceiptKey("default", "m1")]; r == nil || r.State != ReceiptDone {
+		t.Errorf("got %+v, want state %s", r, ReceiptDone)
+	}
+}
@@ -0,0 +1,79 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Store) EnsureRevocationsDir() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "EnsureRevocationsDir",
+	})
+	l.Debug("ensuring revocations dir")
+	s.RevocationsDir = s.NodeDataDir + "/revocations"
+	return EnsureDir(s.RevocationsDir)
+}
+
+func (s *Store) revocationFile(keyID string) string {
+	return filepath.Join(s.RevocationsDir, keyID+".json")
+}
+
+// StoreRevocation stores the revocation of the key keyID.
+func (s *Store) StoreRevocation(keyID string, data []byte) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "StoreRevocation",
+		"key": keyID,
+	})
+	l.Debug("storing revocation")
+	if !ValidName(keyID) {
+		return os.ErrInvalid
+	}
+	if err := WriteFileAtomic(s.revocationFile(keyID), data, 0644); err != nil {
+		l.Errorf("failed to store revocation: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetRevocation returns the revocation of the key keyID. The error
+// satisfies os.IsNotExist if the key has not been revoked.
+func (s *Store) GetRevocation(keyID string) ([]byte, error) {
+	if !ValidName(keyID) {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.ReadFile(s.revocationFile(keyID))
+}
+
+// ListRevocations returns all stored revocations.
+func (s *Store) ListRevocations() ([][]byte, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "ListRevocations",
+	})
+	l.Debug("listing revocations")
+	files, err := ioutil.ReadDir(s.RevocationsDir)
+	if err != nil {
+		l.Errorf("failed to read revocations dir: %v", err)
+		return nil, err
+	}
+	var rs [][]byte
+	for _, f := range files {
+		// skip the temporary files of WriteFileAtomic
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.RevocationsDir, f.Name()))
+		if err != nil {
+			l.Errorf("failed to read revocation %s: %v", f.Name(), err)
+			continue
+		}
+		rs = append(rs, data)
+	}
+	return rs, nil
+}
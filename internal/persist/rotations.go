@@ -0,0 +1,70 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Store) EnsureRotationsDir() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "EnsureRotationsDir",
+	})
+	l.Debug("ensuring rotations dir")
+	s.RotationsDir = s.NodeDataDir + "/rotations"
+	return EnsureDir(s.RotationsDir)
+}
+
+func (s *Store) rotationFile(oldKeyID string) string {
+	return filepath.Join(s.RotationsDir, oldKeyID+".json")
+}
+
+// StoreRotation stores the rotation statement of the key oldKeyID,
+// replacing the one stored before.
+func (s *Store) StoreRotation(oldKeyID string, data []byte) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "StoreRotation",
+		"key": oldKeyID,
+	})
+	l.Debug("storing rotation")
+	if !ValidName(oldKeyID) {
+		return os.ErrInvalid
+	}
+	if err := WriteFileAtomic(s.rotationFile(oldKeyID), data, 0644); err != nil {
+		l.Errorf("failed to store rotation: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetRotation returns the rotation statement of the key oldKeyID. The
+// error satisfies os.IsNotExist if the key has not been rotated.
+func (s *Store) GetRotation(oldKeyID string) ([]byte, error) {
+	if !ValidName(oldKeyID) {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.ReadFile(s.rotationFile(oldKeyID))
+}
+
+// DeleteRotation removes the rotation statement of the key oldKeyID, if
+// there is one.
+func (s *Store) DeleteRotation(oldKeyID string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "DeleteRotation",
+		"key": oldKeyID,
+	})
+	l.Debug("deleting rotation")
+	if !ValidName(oldKeyID) {
+		return os.ErrInvalid
+	}
+	if err := os.Remove(s.rotationFile(oldKeyID)); err != nil && !os.IsNotExist(err) {
+		l.Errorf("failed to delete rotation: %v", err)
+		return err
+	}
+	return nil
+}
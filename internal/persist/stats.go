@@ -0,0 +1,80 @@
+package persist
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type StorageStats struct {
+	DataDir       string         `json:"dataDir"`
+	PubKeyIDs     int            `json:"pubKeyIDs"`
+	Messages      int            `json:"messages"`
+	Bytes         int64          `json:"bytes"`
+	Tombstones    int            `json:"tombstones"`
+	Channels      map[string]int `json:"channels"`
+	OldestMessage *time.Time     `json:"oldestMessage,omitempty"`
+}
+
+// GetStorageStats walks the node's message and tombstone directories
+// and summarizes what is currently stored on disk.
+func (s *Store) GetStorageStats() (*StorageStats, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "GetStorageStats",
+	})
+	l.Debug("getting storage stats")
+	st := &StorageStats{
+		DataDir:  s.NodeDataDir,
+		Channels: map[string]int{},
+	}
+	keyIDs := map[string]bool{}
+	err := filepath.Walk(s.MessagesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		// s.MessagesDir/pubKeyID/channel/messageID
+		rel, err := filepath.Rel(s.MessagesDir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		keyIDs[parts[0]] = true
+		st.Channels[parts[1]]++
+		st.Messages++
+		st.Bytes += info.Size()
+		mt := info.ModTime()
+		if st.OldestMessage == nil || mt.Before(*st.OldestMessage) {
+			st.OldestMessage = &mt
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		l.Errorf("failed to walk messages dir: %v", err)
+		return nil, err
+	}
+	st.PubKeyIDs = len(keyIDs)
+	err = filepath.Walk(s.TombstonesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			st.Tombstones++
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		l.Errorf("failed to walk tombstones dir: %v", err)
+		return nil, err
+	}
+	return st, nil
+}
@@ -0,0 +1,96 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TombstonePath returns the path of the tombstone recorded when the
+// specified message was deleted.
+func (s *Store) TombstonePath(pubKeyID string, channel string, id string) string {
+	return s.TombstonesDir + "/" + pubKeyID + "/" + channelOrDefault(channel) + "/" + id
+}
+
+func (s *Store) StoreTombstone(pubKeyID string, channel string, id string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "StoreTombstone",
+	})
+	l.Debug("storing tombstone")
+	if !validMessagePath(pubKeyID, channel, id) {
+		return os.ErrInvalid
+	}
+	file := s.TombstonePath(pubKeyID, channel, id)
+	if err := EnsureDir(filepath.Dir(file)); err != nil {
+		l.Errorf("failed to create dir: %v", err)
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := ioutil.WriteFile(file, []byte(ts), 0644); err != nil {
+		l.Errorf("failed to write tombstone: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (s *Store) TombstoneExists(pubKeyID string, channel string, id string) bool {
+	if !validMessagePath(pubKeyID, channel, id) {
+		return false
+	}
+	if _, err := os.Stat(s.TombstonePath(pubKeyID, channel, id)); err != nil {
+		return false
+	}
+	return true
+}
+
+func (s *Store) MessageExists(pubKeyID string, channel string, id string) bool {
+	if !validMessagePath(pubKeyID, channel, id) {
+		return false
+	}
+	file := s.PubKeyMessageDir(pubKeyID) + "/" + channelOrDefault(channel) + "/" + id
+	if _, err := os.Stat(file); err != nil {
+		return false
+	}
+	return true
+}
+
+// validMessagePath reports whether the key, channel and id of a message
+// are valid path elements, as they may come from other peers.
+func validMessagePath(pubKeyID string, channel string, id string) bool {
+	return ValidName(pubKeyID) && ValidName(channelOrDefault(channel)) && ValidName(id)
+}
+
+func channelOrDefault(channel string) string {
+	if channel == "" {
+		return "default"
+	}
+	return channel
+}
+
+func (s *Store) cleanupOldTombstones(dur time.Duration) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "persist",
+		"fn":  "cleanupOldTombstones",
+	})
+	l.Debug("cleaning up old tombstones")
+	if _, err := os.Stat(s.TombstonesDir); err != nil {
+		return nil
+	}
+	files, err := getFilesOlderThan(s.TombstonesDir, dur)
+	if err != nil {
+		l.Errorf("failed to get files older than: %v", err)
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			l.Errorf("failed to remove tombstone: %v", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+type rejoinRequest struct {
+	Addrs []string `json:"addrs"`
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "writeJSON",
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		l.Errorf("error encoding response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) adminAuth() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			adminToken := s.getAdminToken()
+			if adminToken == "" {
+				http.Error(w, "admin api disabled", http.StatusNotFound)
+				return
+			}
+			t := r.Header.Get("X-Admin-Token")
+			if subtle.ConstantTimeCompare([]byte(t), []byte(adminToken)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) HandleAdminListMembers(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleAdminListMembers",
+	})
+	l.Debug("listing members")
+	writeJSON(w, s.Peer.GetClusterStatus())
+}
+
+func (s *Server) HandleAdminForceLeave(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleAdminForceLeave",
+	})
+	name := mux.Vars(r)["name"]
+	l.Debugf("forcing %s to leave", name)
+	if err := s.Peer.ForceLeave(name); err != nil {
+		l.Errorf("error forcing leave: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) HandleAdminRejoin(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleAdminRejoin",
+	})
+	l.Debug("rejoining cluster")
+	rr := &rejoinRequest{}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(rr); err != nil {
+			l.Errorf("error decoding request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(rr.Addrs) == 0 {
+		rr.Addrs = s.Peer.GetPeerAddrs()
+	}
+	if len(rr.Addrs) == 0 {
+		l.Error("no peer addresses to join")
+		http.Error(w, "no peer addresses to join", http.StatusBadRequest)
+		return
+	}
+	if err := s.Peer.Join(rr.Addrs); err != nil {
+		l.Errorf("error joining: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, s.Peer.GetClusterStatus())
+}
+
+func (s *Server) HandleAdminStorage(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleAdminStorage",
+	})
+	l.Debug("getting storage stats")
+	st, err := s.Store.GetStorageStats()
+	if err != nil {
+		l.Errorf("error getting storage stats: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, st)
+}
+
+func (s *Server) HandleAdminReload(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleAdminReload",
+	})
+	l.Debug("reloading config")
+	if s.ReloadHandler == nil {
+		http.Error(w, "reload not supported", http.StatusNotImplemented)
+		return
+	}
+	res, err := s.ReloadHandler()
+	if err != nil {
+		l.Errorf("error reloading config: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) adminRoutes(r *mux.Router) {
+	ar := r.PathPrefix("/admin").Subrouter()
+	ar.Use(s.adminAuth())
+	ar.HandleFunc("/members", s.HandleAdminListMembers).Methods("GET")
+	ar.HandleFunc("/members/{name}/leave", s.HandleAdminForceLeave).Methods("POST")
+	ar.HandleFunc("/rejoin", s.HandleAdminRejoin).Methods("POST")
+	ar.HandleFunc("/storage", s.HandleAdminStorage).Methods("GET")
+	ar.HandleFunc("/reload", s.HandleAdminReload).Methods("POST")
+}
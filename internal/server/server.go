@@ -1,69 +1,306 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	network "net"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/robertlestak/centauri/internal/cfg"
+	"github.com/robertlestak/centauri/internal/net"
+	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/pkg/api"
 	"github.com/robertlestak/centauri/pkg/keys"
 	"github.com/robertlestak/centauri/pkg/message"
 	"github.com/robertlestak/centauri/pkg/sign"
-	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 )
 
-func HandleCreateMessage(w http.ResponseWriter, r *http.Request) {
+// Server is the HTTP API of a single peer.
+type Server struct {
+	Messages *message.Manager
+	Peer     *net.Peer
+	Store    *persist.Store
+	// ReloadHandler is called by the admin reload endpoint to re-read
+	// the configuration and apply it to the running peer.
+	ReloadHandler func() (*cfg.ReloadResult, error)
+
+	live     settings
+	srv      *http.Server
+	srvMtx   sync.Mutex
+	draining int32
+	// stopWaits is closed on shutdown to end the waiting listings
+	stopWaits chan struct{}
+	stopOnce  sync.Once
+}
+
+func New(messages *message.Manager, peer *net.Peer, store *persist.Store) *Server {
+	s := &Server{
+		Messages:  messages,
+		Peer:      peer,
+		Store:     store,
+		stopWaits: make(chan struct{}),
+	}
+	r := mux.NewRouter()
+	r.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t := s.getAuthToken(); t != "" && r.Header.Get("X-Token") != t {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	r.HandleFunc("/message", s.HandleCreateMessage).Methods("POST")
+	r.HandleFunc("/messages", s.HandleListMesageMetaForPublicKey).Methods("GET")
+	r.HandleFunc("/messages/delete", s.HandleDeleteMessages).Methods("POST")
+	r.HandleFunc("/message/{keyID}/{channel}/{id}", s.HandleGetMessageByID).Methods("GET")
+	r.HandleFunc("/message/{keyID}/{channel}/{id}", s.HandleDeleteMessageByID).Methods("DELETE")
+	r.HandleFunc("/message/{keyID}/{channel}/{id}/status", s.HandleGetMessageStatus).Methods("GET")
+	r.HandleFunc("/rotation", s.HandleCreateRotation).Methods("POST")
+	r.HandleFunc("/rotation/{keyID}", s.HandleGetRotation).Methods("GET")
+	r.HandleFunc("/revocation", s.HandleCreateRevocation).Methods("POST")
+	r.HandleFunc("/revocation/{keyID}", s.HandleGetRevocation).Methods("GET")
+	r.HandleFunc("/directory", s.HandlePublishKeyRecord).Methods("POST")
+	r.HandleFunc("/directory", s.HandleFindKeyRecords).Methods("GET")
+	r.HandleFunc("/directory/{keyID}", s.HandleGetKeyRecord).Methods("GET")
+	r.HandleFunc("/statusz", s.handleHealthcheck).Methods("GET")
+	s.adminRoutes(r)
+	s.live.router = r
+	s.live.buildHandler()
+	return s
+}
+
+// SetDraining toggles whether the server rejects new messages.
+func (s *Server) SetDraining(d bool) {
+	var v int32
+	if d {
+		v = 1
+	}
+	atomic.StoreInt32(&s.draining, v)
+}
+
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Handler returns the http handler serving the API.
+func (s *Server) Handler() http.Handler {
+	return &s.live
+}
+
+func (s *Server) HandleCreateMessage(w http.ResponseWriter, r *http.Request) {
 	l := log.WithFields(log.Fields{
 		"pkg": "server",
 		"fn":  "HandleCreateMessage",
 	})
 	l.Debug("creating message")
-	mr := message.Message{}
+	if s.Draining() {
+		l.Debug("server is draining, rejecting message")
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	mr := api.Message{}
 	if err := json.NewDecoder(r.Body).Decode(&mr); err != nil {
 		l.Errorf("error decoding message: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err := mr.Create()
-	if err != nil {
+	m, err := s.Messages.Create(&mr)
+	if errors.Is(err, message.ErrKeyRetired) || errors.Is(err, message.ErrKeyRevoked) {
+		l.Errorf("error creating message: %v", err)
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
 		l.Errorf("error creating message: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
+	md := persist.MessageMetaData{
+		ID:        m.ID,
+		Channel:   m.Channel,
+		PubKeyID:  m.PublicKeyID,
+		Size:      int64(len(m.Data)),
+		CreatedAt: time.Now(),
+	}
+	if err := json.NewEncoder(w).Encode(md); err != nil {
+		l.Errorf("error encoding message meta: %v", err)
+	}
 }
 
-func HandleListMesageMetaForPublicKey(w http.ResponseWriter, r *http.Request) {
+// HandleListMesageMetaForPublicKey lists the messages of the key which
+// signed the request, selected, ordered and paged by the parameters of
+// messageQuery. The number of matching messages on all pages is sent in
+// the X-Total-Count header and the cursor of the next page in
+// X-Next-Cursor. A cursor of another peer is answered with 421
+// Misdirected Request, so that clients try their other servers. With the
+// wait parameter, a number of seconds up to message.MaxListWait, the
+// listing waits until it differs from the one named by the known
+// parameter, a api.ListingDigest which defaults to the empty listing.
+func (s *Server) HandleListMesageMetaForPublicKey(w http.ResponseWriter, r *http.Request) {
 	l := log.WithFields(log.Fields{
 		"pkg": "server",
 		"fn":  "HandleListMessageMetaForPublicKey",
 	})
 	l.Debug("listing message meta for public key")
-	channel := message.CleanString(r.URL.Query().Get("channel"))
-	pubKeyID, err := ValidateSignedRequest(r)
+	pubKeyID, err := s.ValidateSignedRequest(r)
 	if err != nil {
 		l.Errorf("error validating signed request: %v", err)
+		http.Error(w, err.Error(), signedRequestStatus(err))
+		return
+	}
+	q, err := messageQuery(r)
+	if err != nil {
+		l.Errorf("error parsing query: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	l.Debugf("listing message meta for public key: %v", pubKeyID)
-	messages, err := message.ListMessageMetaForPubKeyID(pubKeyID, channel)
+	wait, err := listWait(r)
 	if err != nil {
-		l.Errorf("error listing message meta for public key: %v", err)
+		l.Errorf("error parsing wait: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := json.NewEncoder(w).Encode(messages); err != nil {
+	known := r.URL.Query().Get("known")
+	if known == "" {
+		known = api.ListingDigest(nil)
+	}
+	l.Debugf("listing message meta for public key: %v", pubKeyID)
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	var page *persist.MessagePage
+	for {
+		// the channel is taken before listing so that no message stored
+		// in between is missed
+		stored := s.Messages.MessageStored(pubKeyID)
+		page, err = s.Messages.QueryMessageMeta(pubKeyID, q)
+		if errors.Is(err, persist.ErrCursorPeer) {
+			l.Debugf("cursor of another peer")
+			http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+			return
+		} else if err != nil {
+			l.Errorf("error listing message meta for public key: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if wait == 0 || listingDigest(page.Messages) != known {
+			break
+		}
+		select {
+		case <-stored:
+			continue
+		case <-r.Context().Done():
+			return
+		case <-t.C:
+		case <-s.stopWaits:
+		}
+		break
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	if err := json.NewEncoder(w).Encode(page.Messages); err != nil {
 		l.Errorf("error encoding message meta for public key: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func HandleGetMessageByID(w http.ResponseWriter, r *http.Request) {
+// messageQuery returns the query of a listing given by the parameters
+// channel, createdAfter and createdBefore (RFC 3339), minSize and maxSize
+// (bytes), sort (created or size), order (asc or desc), limit and cursor.
+func messageQuery(r *http.Request) (persist.MessageQuery, error) {
+	v := r.URL.Query()
+	q := persist.MessageQuery{
+		Channel: api.CleanString(v.Get("channel")),
+		Sort:    v.Get("sort"),
+		Cursor:  v.Get("cursor"),
+	}
+	var err error
+	if q.CreatedAfter, err = queryTime(v.Get("createdAfter")); err != nil {
+		return q, fmt.Errorf("invalid createdAfter: %v", err)
+	}
+	if q.CreatedBefore, err = queryTime(v.Get("createdBefore")); err != nil {
+		return q, fmt.Errorf("invalid createdBefore: %v", err)
+	}
+	if q.MinSize, err = queryInt(v.Get("minSize")); err != nil {
+		return q, fmt.Errorf("invalid minSize: %v", err)
+	}
+	if q.MaxSize, err = queryInt(v.Get("maxSize")); err != nil {
+		return q, fmt.Errorf("invalid maxSize: %v", err)
+	}
+	limit, err := queryInt(v.Get("limit"))
+	if err != nil {
+		return q, fmt.Errorf("invalid limit: %v", err)
+	}
+	q.Limit = int(limit)
+	switch v.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("invalid order: %q", v.Get("order"))
+	}
+	return q, q.Validate()
+}
+
+func queryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func queryInt(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative number", v)
+	}
+	return n, nil
+}
+
+// listWait returns the wait parameter of a listing.
+func listWait(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid wait: %q", v)
+	}
+	wait := time.Duration(n) * time.Second
+	if wait > message.MaxListWait {
+		wait = message.MaxListWait
+	}
+	return wait, nil
+}
+
+func listingDigest(messages []persist.MessageMetaData) string {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return api.ListingDigest(ids)
+}
+
+func (s *Server) HandleGetMessageByID(w http.ResponseWriter, r *http.Request) {
 	l := log.WithFields(log.Fields{
 		"pkg": "server",
 		"fn":  "HandleGetMessageByID",
@@ -71,12 +308,12 @@ func HandleGetMessageByID(w http.ResponseWriter, r *http.Request) {
 	l.Debug("getting message by id")
 	vars := mux.Vars(r)
 	id := vars["id"]
-	channel := message.CleanString(vars["channel"])
+	channel := api.CleanString(vars["channel"])
 	keyID := vars["keyID"]
-	pubKeyID, err := ValidateSignedRequest(r)
+	pubKeyID, err := s.ValidateSignedRequest(r)
 	if err != nil {
 		l.Errorf("error validating signed request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), signedRequestStatus(err))
 		return
 	}
 	if keyID != pubKeyID {
@@ -84,7 +321,7 @@ func HandleGetMessageByID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "key id mismatch", http.StatusBadRequest)
 		return
 	}
-	m, err := message.GetMessageByID(keyID, channel, id)
+	m, err := s.Messages.GetMessageByID(keyID, channel, id)
 	if err != nil {
 		l.Errorf("error getting message by id: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -93,7 +330,41 @@ func HandleGetMessageByID(w http.ResponseWriter, r *http.Request) {
 	w.Write(m.Data)
 }
 
-func HandleDeleteMessageByID(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HandleGetMessageStatus(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleGetMessageStatus",
+	})
+	l.Debug("getting message status")
+	vars := mux.Vars(r)
+	id := vars["id"]
+	channel := api.CleanString(vars["channel"])
+	keyID := vars["keyID"]
+	pubKeyID, err := s.ValidateSignedRequest(r)
+	if err != nil {
+		l.Errorf("error validating signed request: %v", err)
+		http.Error(w, err.Error(), signedRequestStatus(err))
+		return
+	}
+	if keyID != pubKeyID {
+		l.Errorf("key id mismatch: %v != %v", keyID, pubKeyID)
+		http.Error(w, "key id mismatch", http.StatusBadRequest)
+		return
+	}
+	st, err := s.Messages.GetMessageStatus(keyID, channel, id)
+	if err != nil {
+		l.Errorf("error getting message status: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		l.Errorf("error encoding message status: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) HandleDeleteMessageByID(w http.ResponseWriter, r *http.Request) {
 	l := log.WithFields(log.Fields{
 		"pkg": "server",
 		"fn":  "HandleDeleteMessageByID",
@@ -102,11 +373,11 @@ func HandleDeleteMessageByID(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	keyID := vars["keyID"]
-	channel := message.CleanString(vars["channel"])
-	pubKeyID, err := ValidateSignedRequest(r)
+	channel := api.CleanString(vars["channel"])
+	pubKeyID, err := s.ValidateSignedRequest(r)
 	if err != nil {
 		l.Errorf("error validating signed request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), signedRequestStatus(err))
 		return
 	}
 	if keyID != pubKeyID {
@@ -114,14 +385,262 @@ func HandleDeleteMessageByID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "key id mismatch", http.StatusBadRequest)
 		return
 	}
-	if err := message.DeleteMessageByID(keyID, channel, id, false); err != nil {
+	if err := s.Messages.DeleteMessageByID(keyID, channel, id, false); err != nil {
 		l.Errorf("error deleting message by id: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 }
 
-func ValidateSignedRequest(r *http.Request) (string, error) {
+// maxDeleteRequestSize is the largest body of a batch deletion, which
+// fits api.MaxDeletionSet messages with names of the longest file names.
+const maxDeleteRequestSize = 8 << 20
+
+// HandleDeleteMessages deletes a batch of messages of the key which
+// signed the request, see message.Manager.DeleteMessages.
+func (s *Server) HandleDeleteMessages(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleDeleteMessages",
+	})
+	l.Debug("deleting messages")
+	pubKeyID, err := s.ValidateSignedRequest(r)
+	if err != nil {
+		l.Errorf("error validating signed request: %v", err)
+		http.Error(w, err.Error(), signedRequestStatus(err))
+		return
+	}
+	dr := api.DeleteRequest{}
+	r.Body = http.MaxBytesReader(w, r.Body, maxDeleteRequestSize)
+	if err := json.NewDecoder(r.Body).Decode(&dr); err != nil {
+		l.Errorf("error decoding delete request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.Messages.DeleteMessages(pubKeyID, dr.Messages)
+	if errors.Is(err, message.ErrInvalidDeletionSet) {
+		l.Errorf("error deleting messages: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		l.Errorf("error deleting messages: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		l.Errorf("error encoding delete result: %v", err)
+	}
+}
+
+// HandleCreateRotation stores a key rotation statement. The statement is
+// signed by the rotated key, so the request itself is not.
+func (s *Server) HandleCreateRotation(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleCreateRotation",
+	})
+	l.Debug("creating rotation")
+	rot := sign.Rotation{}
+	if err := json.NewDecoder(r.Body).Decode(&rot); err != nil {
+		l.Errorf("error decoding rotation: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Messages.Rotate(&rot); errors.Is(err, message.ErrKeyRevoked) {
+		l.Errorf("error creating rotation: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if errors.Is(err, message.ErrStaleRotation) {
+		l.Errorf("error creating rotation: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		l.Errorf("error creating rotation: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rot); err != nil {
+		l.Errorf("error encoding rotation: %v", err)
+	}
+}
+
+// HandleGetRotation returns the rotation statement of a key, or 410 if
+// the key was revoked.
+func (s *Server) HandleGetRotation(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleGetRotation",
+	})
+	l.Debug("getting rotation")
+	keyID := mux.Vars(r)["keyID"]
+	if !persist.ValidName(keyID) {
+		http.Error(w, "invalid key id", http.StatusBadRequest)
+		return
+	}
+	rot, err := s.Messages.GetRotation(keyID)
+	if errors.Is(err, message.ErrNotRotated) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, message.ErrKeyRevoked) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		l.Errorf("error getting rotation: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rot); err != nil {
+		l.Errorf("error encoding rotation: %v", err)
+	}
+}
+
+// HandleCreateRevocation stores the revocation of a key. The revocation
+// is signed by the revoked key, so the request itself is not.
+func (s *Server) HandleCreateRevocation(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleCreateRevocation",
+	})
+	l.Debug("creating revocation")
+	rev := sign.Revocation{}
+	if err := json.NewDecoder(r.Body).Decode(&rev); err != nil {
+		l.Errorf("error decoding revocation: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Messages.Revoke(&rev); err != nil {
+		l.Errorf("error creating revocation: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rev); err != nil {
+		l.Errorf("error encoding revocation: %v", err)
+	}
+}
+
+// HandleGetRevocation returns the revocation of a key.
+func (s *Server) HandleGetRevocation(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleGetRevocation",
+	})
+	l.Debug("getting revocation")
+	keyID := mux.Vars(r)["keyID"]
+	if !persist.ValidName(keyID) {
+		http.Error(w, "invalid key id", http.StatusBadRequest)
+		return
+	}
+	rev, err := s.Messages.GetRevocation(keyID)
+	if errors.Is(err, message.ErrNotRevoked) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		l.Errorf("error getting revocation: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rev); err != nil {
+		l.Errorf("error encoding revocation: %v", err)
+	}
+}
+
+// HandlePublishKeyRecord stores a key directory record. The record is
+// signed by its key, so the request itself is not.
+func (s *Server) HandlePublishKeyRecord(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandlePublishKeyRecord",
+	})
+	l.Debug("publishing key record")
+	kr := sign.KeyRecord{}
+	if err := json.NewDecoder(r.Body).Decode(&kr); err != nil {
+		l.Errorf("error decoding key record: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Messages.PublishKeyRecord(&kr); errors.Is(err, message.ErrKeyRevoked) {
+		l.Errorf("error publishing key record: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if errors.Is(err, message.ErrStaleKeyRecord) {
+		l.Errorf("error publishing key record: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		l.Errorf("error publishing key record: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(kr); err != nil {
+		l.Errorf("error encoding key record: %v", err)
+	}
+}
+
+// HandleGetKeyRecord returns the key directory record of a key.
+func (s *Server) HandleGetKeyRecord(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleGetKeyRecord",
+	})
+	l.Debug("getting key record")
+	keyID := mux.Vars(r)["keyID"]
+	if !persist.ValidName(keyID) {
+		http.Error(w, "invalid key id", http.StatusBadRequest)
+		return
+	}
+	kr, err := s.Messages.GetKeyRecord(keyID)
+	if errors.Is(err, message.ErrKeyRecordNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		l.Errorf("error getting key record: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(kr); err != nil {
+		l.Errorf("error encoding key record: %v", err)
+	}
+}
+
+// HandleFindKeyRecords returns the key directory records with the name
+// given by the name query parameter.
+func (s *Server) HandleFindKeyRecords(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "HandleFindKeyRecords",
+	})
+	l.Debug("finding key records")
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	krs, err := s.Messages.FindKeyRecords(name)
+	if err != nil {
+		l.Errorf("error finding key records: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if krs == nil {
+		krs = []*sign.KeyRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(krs); err != nil {
+		l.Errorf("error encoding key records: %v", err)
+	}
+}
+
+// ValidateSignedRequest verifies the X-Signature header of r and returns
+// the ID of the key which signed it. Requests signed by a revoked key are
+// refused with an error matching message.ErrKeyRevoked.
+func (s *Server) ValidateSignedRequest(r *http.Request) (string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "server",
 		"fn":  "ValidateSignedRequest",
@@ -151,59 +670,111 @@ func ValidateSignedRequest(r *http.Request) (string, error) {
 		return pubKeyID, err
 	}
 	pubKeyID = keys.PubKeyID(sr.PublicKey)
+	if err := s.Messages.CheckRevoked(pubKeyID); err != nil {
+		l.Errorf("refusing signed request: %v", err)
+		return "", err
+	}
 	return pubKeyID, nil
 }
 
-func handleHealthcheck(w http.ResponseWriter, r *http.Request) {
+// signedRequestStatus returns the status code of the error of
+// ValidateSignedRequest.
+func signedRequestStatus(err error) int {
+	if errors.Is(err, message.ErrKeyRevoked) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func (s *Server) handleHealthcheck(w http.ResponseWriter, r *http.Request) {
 	l := log.WithFields(log.Fields{
 		"pkg": "server",
 		"fn":  "handleHealthcheck",
 	})
 	l.Debug("healthcheck")
+	// a draining server reports itself unhealthy so that clients move on
+	if s.Draining() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	w.Write([]byte("OK"))
 }
 
-func Server(port int, authToken string, corsList []string, tlsCrtPath string, tlsKeyPath string) error {
+// ListenAndServe serves the API on port until Shutdown is called.
+func (s *Server) ListenAndServe(port int, tlsCrtPath string, tlsKeyPath string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "server",
-		"fn":  "Server",
+		"fn":  "ListenAndServe",
 	})
-	l.Debug("starting server")
-	r := mux.NewRouter()
-	if authToken != "" {
-		r.Use(func(h http.Handler) http.Handler {
-			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if r.Header.Get("X-Token") != authToken {
-					http.Error(w, "unauthorized", http.StatusUnauthorized)
-					return
-				}
-				h.ServeHTTP(w, r)
-			})
-		})
+	ln, err := network.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		l.Errorf("failed to listen: %v", err)
+		return err
 	}
+	return s.Serve(ln, tlsCrtPath, tlsKeyPath)
+}
 
-	r.HandleFunc("/message", HandleCreateMessage).Methods("POST")
-	r.HandleFunc("/messages", HandleListMesageMetaForPublicKey).Methods("GET")
-	r.HandleFunc("/message/{keyID}/{channel}/{id}", HandleGetMessageByID).Methods("GET")
-	r.HandleFunc("/message/{keyID}/{channel}/{id}", HandleDeleteMessageByID).Methods("DELETE")
-	r.HandleFunc("/statusz", handleHealthcheck).Methods("GET")
-	sPort := fmt.Sprintf(":%d", port)
-	if len(corsList) == 0 {
-		corsList = []string{"*"}
-	}
-	c := cors.New(cors.Options{
-		AllowedOrigins:   corsList,
-		AllowedMethods:   []string{"GET", "POST", "DELETE", "PUT"},
-		AllowedHeaders:   []string{"X-Token", "X-Signature", "Content-Type"},
-		AllowCredentials: true,
-		Debug:            false,
+// Serve serves the API on the listener until Shutdown is called.
+func (s *Server) Serve(ln network.Listener, tlsCrtPath string, tlsKeyPath string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "Serve",
 	})
-	h := c.Handler(r)
+	l.Debug("starting server")
+	hs := &http.Server{
+		Handler: &s.live,
+	}
+	s.srvMtx.Lock()
+	s.srv = hs
+	s.srvMtx.Unlock()
 	if tlsCrtPath != "" && tlsKeyPath != "" {
 		l.Debug("starting server with TLS")
-		return http.ListenAndServeTLS(sPort, tlsCrtPath, tlsKeyPath, h)
+		if err := s.LoadTLSCert(tlsCrtPath, tlsKeyPath); err != nil {
+			return err
+		}
+		hs.TLSConfig = &tls.Config{
+			GetCertificate: s.getCertificate,
+		}
+		return hs.ServeTLS(ln, "", "")
 	} else {
 		l.Debug("starting server without TLS")
-		return http.ListenAndServe(sPort, h)
+		return hs.Serve(ln)
+	}
+}
+
+// Shutdown gracefully stops the server, waiting for in-flight requests
+// until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "Shutdown",
+	})
+	l.Debug("shutting down server")
+	s.endWaits()
+	s.srvMtx.Lock()
+	hs := s.srv
+	s.srvMtx.Unlock()
+	if hs == nil {
+		return nil
 	}
+	return hs.Shutdown(ctx)
+}
+
+// Close immediately closes the server and all of its connections.
+func (s *Server) Close() error {
+	s.endWaits()
+	s.srvMtx.Lock()
+	hs := s.srv
+	s.srvMtx.Unlock()
+	if hs == nil {
+		return nil
+	}
+	return hs.Close()
+}
+
+// endWaits ends the listings waiting for messages.
+func (s *Server) endWaits() {
+	s.stopOnce.Do(func() {
+		close(s.stopWaits)
+	})
 }
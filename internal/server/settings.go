@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/rs/cors"
+	log "github.com/sirupsen/logrus"
+)
+
+// settings holds the server configuration which can be changed
+// while the server is running.
+type settings struct {
+	mtx        sync.RWMutex
+	authToken  string
+	adminToken string
+	corsList   []string
+	handler    http.Handler
+	router     http.Handler
+	tlsCert    *tls.Certificate
+}
+
+func (s *Server) SetAuthToken(t string) {
+	s.live.mtx.Lock()
+	s.live.authToken = t
+	s.live.mtx.Unlock()
+}
+
+func (s *Server) getAuthToken() string {
+	s.live.mtx.RLock()
+	defer s.live.mtx.RUnlock()
+	return s.live.authToken
+}
+
+func (s *Server) SetAdminToken(t string) {
+	s.live.mtx.Lock()
+	s.live.adminToken = t
+	s.live.mtx.Unlock()
+}
+
+func (s *Server) getAdminToken() string {
+	s.live.mtx.RLock()
+	defer s.live.mtx.RUnlock()
+	return s.live.adminToken
+}
+
+// SetCors replaces the allowed CORS origins.
+func (s *Server) SetCors(corsList []string) {
+	s.live.mtx.Lock()
+	defer s.live.mtx.Unlock()
+	s.live.corsList = corsList
+	s.live.buildHandler()
+}
+
+func (s *settings) buildHandler() {
+	if s.router == nil {
+		return
+	}
+	corsList := s.corsList
+	if len(corsList) == 0 {
+		corsList = []string{"*"}
+	}
+	c := cors.New(cors.Options{
+		AllowedOrigins:   corsList,
+		AllowedMethods:   []string{"GET", "POST", "DELETE", "PUT"},
+		AllowedHeaders:   []string{"X-Token", "X-Admin-Token", "X-Signature", "Content-Type"},
+		AllowCredentials: true,
+		Debug:            false,
+	})
+	s.handler = c.Handler(s.router)
+}
+
+func (s *settings) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.RLock()
+	h := s.handler
+	s.mtx.RUnlock()
+	h.ServeHTTP(w, r)
+}
+
+// LoadTLSCert reads the TLS certificate and key from disk. New connections
+// will use the loaded certificate.
+func (s *Server) LoadTLSCert(tlsCrtPath string, tlsKeyPath string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "server",
+		"fn":  "LoadTLSCert",
+	})
+	l.Debug("loading tls cert")
+	if tlsCrtPath == "" || tlsKeyPath == "" {
+		return errors.New("tls cert and key paths are required")
+	}
+	c, err := tls.LoadX509KeyPair(tlsCrtPath, tlsKeyPath)
+	if err != nil {
+		l.Errorf("failed to load tls cert: %v", err)
+		return err
+	}
+	s.live.mtx.Lock()
+	s.live.tlsCert = &c
+	s.live.mtx.Unlock()
+	return nil
+}
+
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.live.mtx.RLock()
+	defer s.live.mtx.RUnlock()
+	if s.live.tlsCert == nil {
+		return nil, errors.New("no tls certificate loaded")
+	}
+	return s.live.tlsCert, nil
+}
@@ -0,0 +1,515 @@
+// Package centauri embeds a Centauri peer in a Go program.
+package centauri
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	network "net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/memberlist"
+	"github.com/robertlestak/centauri/internal/cfg"
+	"github.com/robertlestak/centauri/internal/events"
+	"github.com/robertlestak/centauri/internal/net"
+	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/internal/server"
+	"github.com/robertlestak/centauri/pkg/message"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config is the configuration of a Node.
+type Config = cfg.PeerConfig
+
+// ReloadResult reports which settings a Reload applied.
+type ReloadResult = cfg.ReloadResult
+
+// Node is a single Centauri peer. It owns its message store, cluster
+// membership, event bus and HTTP server, so several nodes can run in
+// the same process.
+type Node struct {
+	// Config is the configuration of the node, with the ports chosen by
+	// the system once it is started.
+	Config   Config
+	Store    *persist.Store
+	Events   *events.Bus
+	Peer     *net.Peer
+	Messages *message.Manager
+	Server   *server.Server
+
+	// configured is the configuration as given, which Reload compares
+	// the next configuration with.
+	configured   Config
+	mtx          sync.Mutex
+	stop         chan struct{}
+	stopOnce     sync.Once
+	httpListener network.Listener
+}
+
+// defaultShutdownTimeout is the ShutdownTimeout of a config which sets none.
+const defaultShutdownTimeout = time.Second * 30
+
+// New creates the node and its data directories. Call Start to join the cluster.
+func New(c Config) (*Node, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "centauri",
+		"fn":  "New",
+	})
+	l.Debug("creating node")
+	if c.Name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			l.Errorf("failed to get hostname: %v", err)
+			return nil, err
+		}
+		c.Name = hostname + "-" + uuid.New().String()
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	store, err := persist.New(c.DataDir, c.Name)
+	if err != nil {
+		l.Errorf("failed to init persist: %v", err)
+		return nil, err
+	}
+	n := &Node{
+		Config:     c,
+		Store:      store,
+		Events:     events.New(),
+		Peer:       net.New(c.Name, store),
+		configured: c,
+		stop:       make(chan struct{}),
+	}
+	if c.PeerKey != "" {
+		bd, err := hex.DecodeString(c.PeerKey)
+		if err != nil {
+			l.Errorf("failed to decode secret key: %v", err)
+			return nil, err
+		}
+		n.Peer.Key = bd
+	}
+	n.Peer.Addr = c.AdvertiseAddr
+	n.Peer.SetPeerAddrs(c.PeerAddrs)
+	n.Messages = message.NewManager(store, n.Events, n.Peer)
+	n.Server = server.New(n.Messages, n.Peer, store)
+	n.Server.SetAuthToken(c.ServerAuthToken)
+	n.Server.SetAdminToken(c.AdminToken)
+	n.Server.SetCors(c.ServerCors)
+	// DeletionHandlers are called when a file is deleted on this peer
+	// these will notify other peers to delete the file locally
+	n.Events.DeletionHandlers = append(n.Events.DeletionHandlers, n.Peer.BroadcastDeleteMessage)
+	// NewMessageHandlers are called when a new message is sent to this peer
+	// these will notify other peers to retrieve the message and store it locally
+	n.Events.NewMessageHandlers = append(n.Events.NewMessageHandlers, n.Peer.BroadcastNewMessage)
+	// ReceivedDeletionHandlers are called when a file is deleted on another peer
+	// these will notify this peer to delete the file locally
+	n.Events.ReceivedDeletionHandlers = append(n.Events.ReceivedDeletionHandlers, n.Messages.DeleteMessageByID)
+	// ReceivedMessageHandlers are called when a new message is received from another peer
+	// these will notify this peer to retrieve the message from the other peer and store it locally
+	n.Events.ReceivedMessageHandlers = append(n.Events.ReceivedMessageHandlers, n.Messages.GetMessageFromPeer)
+	// RotationHandlers are called when a key is rotated on this peer
+	// these will notify other peers to retrieve the rotation statement
+	n.Events.RotationHandlers = append(n.Events.RotationHandlers, n.Peer.BroadcastRotation)
+	// ReceivedRotationHandlers are called when a key is rotated on another peer
+	// these will retrieve the rotation statement from the other peer and store it locally
+	n.Events.ReceivedRotationHandlers = append(n.Events.ReceivedRotationHandlers, n.Messages.GetRotationFromPeer)
+	// KeyRecordHandlers are called when a key directory record is published on this peer
+	// these will notify other peers to retrieve the record
+	n.Events.KeyRecordHandlers = append(n.Events.KeyRecordHandlers, n.Peer.BroadcastKeyRecord)
+	// ReceivedKeyRecordHandlers are called when a key directory record is published on another peer
+	// these will retrieve the record from the other peer and store it locally
+	n.Events.ReceivedKeyRecordHandlers = append(n.Events.ReceivedKeyRecordHandlers, n.Messages.GetKeyRecordFromPeer)
+	// RevocationHandlers are called when a key is revoked on this peer
+	// these will notify other peers to retrieve the revocation
+	n.Events.RevocationHandlers = append(n.Events.RevocationHandlers, n.Peer.BroadcastRevocation)
+	// ReceivedRevocationHandlers are called when a key is revoked on another peer
+	// these will retrieve the revocation from the other peer and store it locally
+	n.Events.ReceivedRevocationHandlers = append(n.Events.ReceivedRevocationHandlers, n.Messages.GetRevocationFromPeer)
+	// DeletionSetHandlers are called when a batch of messages is deleted on this peer
+	// these will notify other peers to retrieve the deletion set
+	n.Events.DeletionSetHandlers = append(n.Events.DeletionSetHandlers, n.Peer.BroadcastDeletionSet)
+	// ReceivedDeletionSetHandlers are called when a batch of messages is deleted on another peer
+	// these will retrieve the deletion set from the other peer and delete its messages locally
+	n.Events.ReceivedDeletionSetHandlers = append(n.Events.ReceivedDeletionSetHandlers, n.Messages.GetDeletionSetFromPeer)
+	// NotifyMessageEventHandler is called when a new message is received from another peer
+	// this will inspect the message and call the appropriate event handler
+	n.Peer.NotifyMessageEventHandler = n.Events.ReceiveMessage
+	return n, nil
+}
+
+func parseCidrs(cidrList []string) ([]network.IPNet, error) {
+	var cidrs []network.IPNet
+	for _, cidr := range cidrList {
+		if strings.TrimSpace(cidr) == "" {
+			continue
+		}
+		_, ipnet, err := network.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, *ipnet)
+	}
+	if len(cidrs) == 0 {
+		cidrs = nil
+	}
+	return cidrs, nil
+}
+
+// Start opens the data and HTTP ports, joins the cluster and starts
+// serving. Ports which are 0 in the config are chosen by the system and
+// written back to the config.
+func (n *Node) Start() error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "centauri",
+		"fn":   "Start",
+		"node": n.Config.Name,
+	})
+	l.Debug("starting")
+	cidrs, err := parseCidrs(n.Config.AllowedCidrs)
+	if err != nil {
+		l.Errorf("failed to parse cidr: %v", err)
+		return err
+	}
+	dataPort, err := n.Peer.ListenData(n.Config.DataBindPort)
+	if err != nil {
+		l.Errorf("failed to listen for data: %v", err)
+		return err
+	}
+	n.Config.DataBindPort = dataPort
+	if n.Config.DataAdvertisePort == 0 {
+		n.Config.DataAdvertisePort = dataPort
+	}
+	n.Peer.DataPort = n.Config.DataAdvertisePort
+	ln, err := network.Listen("tcp", fmt.Sprintf(":%d", n.Config.ServerPort))
+	if err != nil {
+		l.Errorf("failed to listen for http: %v", err)
+		n.Peer.StopDataServer()
+		return err
+	}
+	n.httpListener = ln
+	n.Config.ServerPort = ln.Addr().(*network.TCPAddr).Port
+	err = n.Peer.Create(
+		n.Config.Name,
+		n.Config.AdvertiseAddr,
+		n.Config.GossipAdvertisePort,
+		n.Config.GossipBindPort,
+		n.Config.ConnectionMode,
+		cidrs,
+	)
+	if err != nil {
+		l.Errorf("failed to create peer: %v", err)
+		ln.Close()
+		n.Peer.StopDataServer()
+		return err
+	}
+	if n.Config.GossipBindPort == 0 {
+		n.Config.GossipBindPort = int(n.Peer.List.LocalNode().Port)
+	}
+	if n.Config.GossipAdvertisePort == 0 {
+		n.Config.GossipAdvertisePort = int(n.Peer.List.LocalNode().Port)
+	}
+	n.Peer.CreateQueue()
+	if len(n.Config.PeerAddrs) > 0 {
+		if err := n.Peer.Join(n.Config.PeerAddrs); err != nil {
+			l.Errorf("failed to join: %v", err)
+			n.Peer.List.Shutdown()
+			ln.Close()
+			n.Peer.StopDataServer()
+			return err
+		}
+	}
+	go n.Peer.DataServer()
+	go n.Peer.CacheCleaner(n.stop)
+	go n.peerWatcher()
+	go n.keySyncer()
+	go n.Store.TimeoutCleaner(n.stop)
+	go n.serve()
+	return nil
+}
+
+func (n *Node) serve() {
+	l := log.WithFields(log.Fields{
+		"pkg":  "centauri",
+		"fn":   "serve",
+		"node": n.Config.Name,
+	})
+	l.Debug("starting")
+	if err := n.Server.Serve(
+		n.httpListener,
+		n.Config.ServerTLSCertPath,
+		n.Config.ServerTLSKeyPath,
+	); err != nil {
+		if errors.Is(err, http.ErrServerClosed) {
+			l.Debug("server closed")
+			return
+		}
+		l.Errorf("failed to serve: %v", err)
+	}
+}
+
+func (n *Node) peerWatcher() {
+	l := log.WithFields(log.Fields{
+		"pkg":  "centauri",
+		"fn":   "peerWatcher",
+		"node": n.Config.Name,
+	})
+	l.Debug("starting")
+	for {
+		select {
+		case <-n.stop:
+			l.Debug("stopping")
+			return
+		case <-time.After(time.Second * 30):
+		}
+		l.Debug("checking for peers")
+		var err error
+		var liveNodes int
+		for _, m := range n.Peer.ListMembers() {
+			if m.Name == n.Peer.Name {
+				continue
+			}
+			if m.State == memberlist.StateAlive {
+				liveNodes++
+			}
+		}
+		peerAddrs := n.Peer.GetPeerAddrs()
+		if liveNodes == 0 && len(peerAddrs) > 0 {
+			l.Debug("no peers, trying to join")
+			err = n.Peer.Join(peerAddrs)
+			if err != nil {
+				l.Errorf("failed: %v", err)
+			}
+		}
+	}
+}
+
+// keySyncer syncs the key directory and the revocations from a random
+// peer after the node starts and every five minutes, for the records
+// whose announcements the node missed while it was down or not yet part
+// of the cluster.
+func (n *Node) keySyncer() {
+	l := log.WithFields(log.Fields{
+		"pkg":  "centauri",
+		"fn":   "keySyncer",
+		"node": n.Config.Name,
+	})
+	l.Debug("starting")
+	wait := time.Second * 5
+	for {
+		select {
+		case <-n.stop:
+			l.Debug("stopping")
+			return
+		case <-time.After(wait):
+		}
+		wait = time.Minute * 5
+		var peers []*net.NodeMeta
+		for _, m := range n.Peer.ListMembers() {
+			if m.Name == n.Peer.Name || m.State != memberlist.StateAlive {
+				continue
+			}
+			nm := &net.NodeMeta{}
+			if err := json.Unmarshal(m.Meta, nm); err != nil {
+				l.Errorf("failed to unmarshal meta: %v", err)
+				continue
+			}
+			peers = append(peers, nm)
+		}
+		if len(peers) == 0 {
+			continue
+		}
+		nm := peers[rand.Intn(len(peers))]
+		if err := n.Messages.SyncRevocationsFromPeer(nm.PeerAddr, nm.PeerPort); err != nil {
+			l.Errorf("failed to sync revocations: %v", err)
+		}
+		if err := n.Messages.SyncDirectoryFromPeer(nm.PeerAddr, nm.PeerPort); err != nil {
+			l.Errorf("failed to sync directory: %v", err)
+		}
+	}
+}
+
+// HTTPAddr returns the local address of the HTTP API.
+func (n *Node) HTTPAddr() string {
+	if n.httpListener == nil {
+		return ""
+	}
+	return n.httpListener.Addr().String()
+}
+
+// Reload applies the settings of next which can be changed while the
+// node is running and reports those which require a restart.
+func (n *Node) Reload(next Config) (*ReloadResult, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "centauri",
+		"fn":   "Reload",
+		"node": n.Config.Name,
+	})
+	l.Debug("reloading config")
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if next.Name == "" {
+		next.Name = n.configured.Name
+	}
+	if next.ShutdownTimeout == 0 {
+		next.ShutdownTimeout = defaultShutdownTimeout
+	}
+	cidrs, err := parseCidrs(next.AllowedCidrs)
+	if err != nil {
+		l.Errorf("failed to parse cidr: %v", err)
+		return nil, err
+	}
+	// the ports chosen by the system are only in n.Config, so that a
+	// port left at 0 is not reported as changed
+	res := cfg.DiffPeerConfig(n.configured, next)
+	tlsEnabled := n.configured.ServerTLSCertPath != "" && n.Config.ServerTLSKeyPath != ""
+	tlsRestart := false
+	for _, r := range res.RequiresRestart {
+		if r == "serverTLSCertPath" || r == "serverTLSKeyPath" {
+			tlsRestart = true
+		}
+	}
+	if tlsEnabled && !tlsRestart {
+		// always re-read the certificate so renewed certs at the same path are picked up
+		if err := n.Server.LoadTLSCert(next.ServerTLSCertPath, next.ServerTLSKeyPath); err != nil {
+			l.Errorf("failed to load tls cert: %v", err)
+			return nil, err
+		}
+		for _, c := range []*Config{&n.Config, &n.configured} {
+			c.ServerTLSCertPath = next.ServerTLSCertPath
+			c.ServerTLSKeyPath = next.ServerTLSKeyPath
+		}
+	}
+	n.Server.SetAuthToken(next.ServerAuthToken)
+	n.Server.SetAdminToken(next.AdminToken)
+	n.Server.SetCors(next.ServerCors)
+	n.Peer.SetAllowedCIDRs(cidrs)
+	n.Peer.SetPeerAddrs(next.PeerAddrs)
+	for _, c := range []*Config{&n.Config, &n.configured} {
+		c.ServerAuthToken = next.ServerAuthToken
+		c.AdminToken = next.AdminToken
+		c.ServerCors = next.ServerCors
+		c.AllowedCidrs = next.AllowedCidrs
+		c.PeerAddrs = next.PeerAddrs
+		c.DrainHandoff = next.DrainHandoff
+		c.ShutdownTimeout = next.ShutdownTimeout
+	}
+	l.Infof("config reloaded, applied: %v, requires restart: %v", res.Applied, res.RequiresRestart)
+	return res, nil
+}
+
+// leaveTimeout is the most time Shutdown waits for the other peers to
+// learn that the node leaves the cluster.
+const leaveTimeout = time.Second * 10
+
+// Shutdown stops accepting new messages, optionally hands off messages
+// only this node holds, leaves the cluster and stops the data and HTTP
+// servers. If ctx has no deadline, the configured ShutdownTimeout is used.
+func (n *Node) Shutdown(ctx context.Context) error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "centauri",
+		"fn":   "Shutdown",
+		"node": n.Config.Name,
+	})
+	l.Info("shutting down")
+	n.stopOnce.Do(func() {
+		close(n.stop)
+	})
+	n.mtx.Lock()
+	timeout := n.Config.ShutdownTimeout
+	handoff := n.Config.DrainHandoff
+	n.mtx.Unlock()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	n.Server.SetDraining(true)
+	if handoff {
+		// keep time to leave the cluster: the handoff ends leaveTimeout
+		// before the deadline, or halfway to it if less time is left
+		dl, _ := ctx.Deadline()
+		reserve := leaveTimeout
+		if half := time.Until(dl) / 2; half < reserve {
+			reserve = half
+		}
+		hctx, cancel := context.WithDeadline(ctx, dl.Add(-reserve))
+		l.Info("handing off messages to other peers")
+		if err := n.Messages.HandoffUniqueMessages(hctx); err != nil {
+			l.Errorf("failed to hand off messages: %v", err)
+		}
+		cancel()
+	}
+	leave := leaveTimeout
+	if dl, ok := ctx.Deadline(); ok && time.Until(dl) < leave {
+		leave = time.Until(dl)
+	}
+	var firstErr error
+	if err := n.Peer.Leave(leave); err != nil {
+		l.Errorf("failed to leave cluster: %v", err)
+		firstErr = err
+	}
+	if err := n.Peer.StopDataServer(); err != nil {
+		l.Errorf("failed to stop data server: %v", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := n.Server.Shutdown(ctx); err != nil {
+		l.Errorf("failed to shutdown server: %v", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if n.httpListener != nil {
+		// the listener is already closed if the server was serving
+		n.httpListener.Close()
+	}
+	l.Info("shutdown complete")
+	return firstErr
+}
+
+// Close stops the node immediately, without draining or leaving the
+// cluster. The other peers will see it fail.
+func (n *Node) Close() error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "centauri",
+		"fn":   "Close",
+		"node": n.Config.Name,
+	})
+	l.Debug("closing")
+	n.stopOnce.Do(func() {
+		close(n.stop)
+	})
+	var firstErr error
+	if n.Peer.List != nil {
+		if err := n.Peer.List.Shutdown(); err != nil {
+			l.Errorf("failed to shutdown memberlist: %v", err)
+			firstErr = err
+		}
+	}
+	if err := n.Peer.StopDataServer(); err != nil {
+		l.Errorf("failed to stop data server: %v", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := n.Server.Close(); err != nil {
+		l.Errorf("failed to close server: %v", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if n.httpListener != nil {
+		// the listener is already closed if the server was serving
+		n.httpListener.Close()
+	}
+	return firstErr
+}
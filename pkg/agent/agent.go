@@ -1,215 +1,399 @@
 package agent
 
 import (
+	"context"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/json"
-	"encoding/pem"
-	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
-	"net/http"
-	"os"
-	"strings"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/pkg/api"
+	"github.com/robertlestak/centauri/pkg/client"
+	"github.com/robertlestak/centauri/pkg/contacts"
 	"github.com/robertlestak/centauri/pkg/keys"
-	"github.com/robertlestak/centauri/pkg/message"
-	"github.com/robertlestak/centauri/pkg/sign"
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	ServerAddrs              []string
-	ServerAuthToken          string
-	DefaultChannel           string = "default"
-	PrivateKey               *rsa.PrivateKey
-	Output                   string
-	OutputFormat             string = "json"
-	ClientMessageID          string
-	ClientRecipientPublicKey []byte
-	ClientMessageInput       string
-	ClientMessageType        string
-	ClientMessageFileName    string
-)
+// Agent receives the messages addressed to its private key from the
+// configured servers and sends the messages placed in its outgoing directories.
+type Agent struct {
+	ServerAddrs     []string
+	ServerAuthToken string
+	DefaultChannel  string
+	PrivateKey      *rsa.PrivateKey
+	// PreviousKeys are the keys PrivateKey was rotated from, whose
+	// messages are received until they are retired.
+	PreviousKeys []*rsa.PrivateKey
+	PublicKeys   *keys.Chain
+	Store        *persist.Store
+	// DataDir holds the key chain of cent, which has no store.
+	DataDir string
+	// PassphraseFD is the file descriptor the passphrase of an encrypted
+	// private key is read from, -1 for none, see passphrase.
+	PassphraseFD int
+	// QueueMaxAttempts is the number of times an outgoing message is tried
+	// before it is moved to the failed directory.
+	QueueMaxAttempts int
+	// QueueMinBackoff is the wait before the first retry of an outgoing
+	// message. It doubles on every further retry up to QueueMaxBackoff.
+	QueueMinBackoff time.Duration
+	QueueMaxBackoff time.Duration
+	// Subscriptions are the channels messages are received from. Only
+	// DefaultChannel is received if there are none.
+	Subscriptions []Subscription
 
-type MessageMeta struct {
-	ID        string    `json:"id"`
-	Channel   string    `json:"channel"`
-	Size      int64     `json:"size"`
-	CreatedAt time.Time `json:"createdAt"`
+	apiOnce   sync.Once
+	api       *client.Client
+	queueWake chan struct{}
+	// receipts are the last receipts of the receipt journal by message
+	receiptsMtx sync.Mutex
+	receipts    map[string]*persist.Receipt
+	contactsMtx sync.Mutex
+	book        *contacts.Book
+	// keyPassphrase is the passphrase once read by passphrase
+	keyPassphrase []byte
+	// rotations and revocations are the keys looked up by currentKey
+	// and checkRevoked
+	rotationsMtx sync.Mutex
+	rotations    map[string]rotationEntry
+	revocations  map[string]revocationEntry
+	// previousAPIs are the clients of PreviousKeys by key ID
+	previousMtx  sync.Mutex
+	previousAPIs map[string]*client.Client
+	retiredKeys  map[string]bool
 }
 
+func New() *Agent {
+	return &Agent{
+		DefaultChannel:   "default",
+		PassphraseFD:     -1,
+		PublicKeys:       keys.NewChain(),
+		QueueMaxAttempts: 10,
+		QueueMinBackoff:  time.Second * 10,
+		QueueMaxBackoff:  time.Minute * 10,
+		queueWake:        make(chan struct{}, 1),
+	}
+}
+
+type (
+	MessageMeta       = client.MessageMeta
+	PeerMessageStatus = client.PeerMessageStatus
+	MessageStatus     = client.MessageStatus
+)
+
+// GetJob is a message to receive. KeyID is the previous key it was sent
+// to, empty for the private key.
 type GetJob struct {
+	KeyID   string
 	Channel string
 	ID      string
 }
 
-func getMessageData(channel, id string) (*message.Message, string, error) {
+func (a *Agent) getMessageData(keyID, channel, id string) (*api.Message, string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "getMessageData",
 	})
 	l.Debugf("getting message %s", id)
-	m, err := GetMessage(channel, id)
+	cm, err := a.clientFor(keyID).Get(context.Background(), channel, id)
 	if err != nil {
 		l.Errorf("error getting message %s: %v", id, err)
 		return nil, "", err
 	}
-	if m == nil {
-		l.Errorf("message %s not found", id)
-		return nil, "", fmt.Errorf("message %s not found", id)
-	}
-	m, err = DecryptMessageData(m)
-	if err != nil {
-		l.Errorf("error getting message %s: %v", id, err)
-		return nil, "", err
+	m := &api.Message{
+		Type:    cm.Type,
+		Channel: cm.Channel,
+		ID:      cm.ID,
+		Data:    cm.Data,
 	}
 	fn := id
-	// check if data has optional file metadata prefix
-	// format:
-	// file:<filename>|<[]byte of file data>
-	// get first 4 bytes of data to check if it is a file
-	var firstFileByte int
-	var mtype string
-	mtype = "bytes"
-	if len(m.Data) > 4 {
-		ff := m.Data[:4]
-		if string(ff) == "file" {
-			var nfn string
-			// get value between "file:" and "|"
-			for i := 5; i < len(m.Data); i++ {
-				if m.Data[i] == '|' {
-					nfn = string(m.Data[5:i])
-					firstFileByte = i + 1
-					m.Data = m.Data[firstFileByte:]
-					break
-				}
-			}
-			if nfn != "" {
-				fn = nfn
-				mtype = "file"
-			}
-		}
+	if cm.FileName != "" {
+		fn = cm.FileName
 	}
-	m.Type = mtype
 	return m, fn, nil
 }
 
-func getMessageWorker(jobs chan GetJob, res chan error) {
+func (a *Agent) getMessageWorker(sub Subscription, jobs chan GetJob, res chan error) {
+	for job := range jobs {
+		res <- a.receiveMessage(sub, job)
+	}
+}
+
+// receiveMessage takes the message of job through the states of the
+// receipt journal, starting after the last state recorded for it. Every
+// state is recorded durably before the next step is taken, so a message
+// is only confirmed once it is safely stored and its hook succeeded.
+func (a *Agent) receiveMessage(sub Subscription, job GetJob) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
-		"fn":  "getMessageWorker",
+		"fn":  "receiveMessage",
+		"sub": sub.Channel,
+		"id":  job.ID,
 	})
-	for job := range jobs {
-		l.Debugf("getting message %s", job.ID)
-		m, fn, err := getMessageData(job.Channel, job.ID)
+	r := a.receipt(job)
+	if r == nil || r.State == persist.ReceiptReceiving {
+		l.Debug("getting message")
+		m, fn, err := a.getMessageData(job.KeyID, job.Channel, job.ID)
 		if err != nil {
-			l.Errorf("error getting message %s: %v", job.ID, err)
-			res <- err
-			continue
+			l.Errorf("error getting message: %v", err)
+			return err
 		}
-		if err := persist.StoreAgentMessage(job.Channel, fn, m.Type, m.Data); err != nil {
-			l.Errorf("error storing message %s: %v", job.ID, err)
-			res <- err
-			continue
+		if r == nil {
+			file, err := a.Store.AgentMessageFile(sub.OutputDir, job.Channel, fn, m.Type)
+			if err != nil {
+				l.Errorf("error storing message: %v", err)
+				return err
+			}
+			if abs, err := filepath.Abs(file); err == nil {
+				file = abs
+			}
+			r = &persist.Receipt{
+				ID:       job.ID,
+				Channel:  job.Channel,
+				Type:     m.Type,
+				FileName: fn,
+				File:     file,
+			}
+			// the path is recorded first, so that the message is written
+			// to the same file if it is received again after a crash
+			if r, err = a.recordReceipt(r, persist.ReceiptReceiving); err != nil {
+				return err
+			}
 		}
-		if err := ConfirmMessageReceive(job.Channel, m.ID); err != nil {
-			l.Errorf("error confirming message %s: %v", job.ID, err)
-			res <- err
-			continue
+		file, err := a.Store.StoreAgentMessage(r.File, job.ID, m.Data)
+		if err != nil {
+			l.Errorf("error storing message: %v", err)
+			return err
+		}
+		sr := *r
+		sr.File = file
+		if r, err = a.recordReceipt(&sr, persist.ReceiptStored); err != nil {
+			return err
+		}
+	}
+	if r.State == persist.ReceiptStored {
+		if sub.Hook != nil {
+			if err := a.runHook(sub.Hook, r); err != nil {
+				return err
+			}
+		}
+		var err error
+		if r, err = a.recordReceipt(r, persist.ReceiptDone); err != nil {
+			return err
+		}
+	}
+	if r.State != persist.ReceiptDone || sub.Action == ActionKeep {
+		return nil
+	}
+	if err := a.clientFor(job.KeyID).Confirm(context.Background(), job.Channel, job.ID); err != nil {
+		l.Errorf("error confirming message: %v", err)
+		return err
+	}
+	_, err := a.recordReceipt(r, persist.ReceiptConfirmed)
+	return err
+}
+
+// loadReceipts loads the receipt journal of the store.
+func (a *Agent) loadReceipts() error {
+	rs, err := a.Store.LoadReceipts()
+	if err != nil {
+		return err
+	}
+	a.receiptsMtx.Lock()
+	defer a.receiptsMtx.Unlock()
+	a.receipts = rs
+	return nil
+}
+
+// receipt returns the last receipt of the message of job, nil if there is none.
+func (a *Agent) receipt(job GetJob) *persist.Receipt {
+	a.receiptsMtx.Lock()
+	defer a.receiptsMtx.Unlock()
+	return a.receipts[persist.ReceiptKey(job.Channel, job.ID)]
+}
+
+// recordReceipt appends a copy of r in state to the receipt journal and
+// returns it.
+func (a *Agent) recordReceipt(r *persist.Receipt, state string) (*persist.Receipt, error) {
+	nr := *r
+	nr.State = state
+	nr.At = time.Now()
+	if err := a.Store.AppendReceipt(&nr); err != nil {
+		return nil, err
+	}
+	a.receiptsMtx.Lock()
+	defer a.receiptsMtx.Unlock()
+	if a.receipts == nil {
+		a.receipts = map[string]*persist.Receipt{}
+	}
+	a.receipts[nr.Key()] = &nr
+	return &nr, nil
+}
+
+// received reports whether the message of job needs no more work by sub.
+func (a *Agent) received(sub Subscription, job GetJob) bool {
+	r := a.receipt(job)
+	if r == nil {
+		return false
+	}
+	switch r.State {
+	case persist.ReceiptQuarantined, persist.ReceiptConfirmed:
+		return true
+	case persist.ReceiptDone:
+		return sub.Action == ActionKeep
+	}
+	return false
+}
+
+// receive gets the messages of the subscription with sub.Concurrency workers.
+func (a *Agent) receive(sub Subscription, js []GetJob) {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "receive",
+		"sub": sub.Channel,
+	})
+	jobs := make(chan GetJob, len(js))
+	res := make(chan error, len(js))
+	for i := 0; i < sub.concurrency() && i < len(js); i++ {
+		go a.getMessageWorker(sub, jobs, res)
+	}
+	for _, j := range js {
+		jobs <- j
+	}
+	close(jobs)
+	for i := 0; i < len(js); i++ {
+		if err := <-res; err != nil {
+			l.Errorf("error getting message: %v", err)
 		}
-		res <- nil
 	}
 }
 
-func Agent() error {
+// Run receives pending messages until the process exits.
+func (a *Agent) Run() error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
-		"fn":  "agent",
+		"fn":  "Run",
 	})
 	l.Debug("agent")
-	if err := persist.EnsureDir(persist.RootDataDir + "/pubkeys"); err != nil {
+	subs := a.subscriptions()
+	for _, sub := range subs {
+		if err := sub.validate(); err != nil {
+			l.Errorf("invalid subscription: %v", err)
+			return err
+		}
+	}
+	if err := persist.EnsureDir(a.Store.RootDataDir + "/pubkeys"); err != nil {
 		l.Errorf("error ensuring pubkeys dir: %v", err)
 		return err
 	}
-	go EnsureWatcher()
+	if err := a.loadReceipts(); err != nil {
+		l.Errorf("error loading receipts: %v", err)
+		return err
+	}
+	if err := a.loadContacts(); err != nil {
+		l.Errorf("error loading contacts: %v", err)
+		return err
+	}
+	a.PublicKeys.OnLoad = a.ensureOutgoingDirs
+	go a.PublicKeys.Loader(a.Store.RootDataDir+"/pubkeys", nil)
+	go a.EnsureWatcher()
+	if len(a.ServerAddrs) > 0 {
+		go a.client().CheckHealthEvery(context.Background(), time.Second*30)
+	}
 	for {
-		if len(ServerAddrs) == 0 {
+		if len(a.ServerAddrs) == 0 {
 			l.Error("no server addresses")
 			time.Sleep(time.Second * 10)
 			continue
 		}
-		msgs, err := CheckPendingMessages(DefaultChannel)
+		msgs, err := a.CheckPendingMessages(listChannel(subs))
 		if err != nil {
 			l.Errorf("error checking pending messages: %v", err)
 			time.Sleep(time.Second * 10)
 			continue
 		}
-		if len(msgs) == 0 {
-			l.Debug("no pending messages")
-			time.Sleep(time.Second * 10)
-			continue
-		}
-		l.Debugf("pending messages: %v", msgs)
-		jobs := make(chan GetJob, len(msgs))
-		res := make(chan error, len(msgs))
-		for i := 0; i < 10; i++ {
-			go getMessageWorker(jobs, res)
-		}
+		var js []GetJob
 		for _, m := range msgs {
-			j := GetJob{
+			js = append(js, GetJob{
 				Channel: m.Channel,
 				ID:      m.ID,
+			})
+		}
+		js = append(js, a.previousJobs(listChannel(subs))...)
+		jobs := make([][]GetJob, len(subs))
+		var pending int
+		for _, j := range js {
+			i := subscriptionFor(subs, j.Channel)
+			if i < 0 || a.received(subs[i], j) {
+				continue
 			}
-			jobs <- j
+			jobs[i] = append(jobs[i], j)
+			pending++
 		}
-		for i := 0; i < len(msgs); i++ {
-			err := <-res
-			if err != nil {
-				l.Errorf("error getting message: %v", err)
+		if pending == 0 {
+			l.Debug("no pending messages")
+			time.Sleep(time.Second * 10)
+			continue
+		}
+		l.Debugf("pending messages: %d", pending)
+		var wg sync.WaitGroup
+		for i, sub := range subs {
+			if len(jobs[i]) == 0 {
 				continue
 			}
+			wg.Add(1)
+			go func(sub Subscription, js []GetJob) {
+				defer wg.Done()
+				a.receive(sub, js)
+			}(sub, jobs[i])
 		}
+		wg.Wait()
 		l.Debug("got all messages")
 		time.Sleep(time.Second * 10)
 	}
 }
 
-func Client() error {
+// Client runs the single client action of cent with the options o
+// against the configured servers.
+func (a *Agent) Client(action string, o *ClientOptions) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "Client",
 	})
 	l.Debug("client")
-	if len(ServerAddrs) == 0 {
+	if len(a.ServerAddrs) == 0 {
 		l.Error("no server addresses")
 		return fmt.Errorf("no server addresses")
 	}
-	var action string
-	// get action from command line
-	// second arg is action
-	if len(os.Args) > 1 {
-		action = os.Args[1]
-	}
 	l.Debugf("action: %s", action)
 	switch action {
 	case "confirm":
-		return ConfirmMessageReceive(DefaultChannel, ClientMessageID)
+		if o.IDsFile != "" {
+			return a.confirmMessages(a.DefaultChannel, o.IDsFile)
+		}
+		return a.ConfirmMessageReceive(a.DefaultChannel, o.MessageID)
+	case "delete":
+		return a.deleteMessages(a.DefaultChannel, o.AllChannels, o.Filter, o.IDsFile, false, o.DryRun, o.OutputFormat, o.Output)
+	case "purge":
+		return a.deleteMessages(a.DefaultChannel, o.AllChannels, o.Filter, o.IDsFile, true, o.DryRun, o.OutputFormat, o.Output)
 	case "get":
-		return getMessage(DefaultChannel, ClientMessageID, Output)
+		return a.getMessage(a.DefaultChannel, o.MessageID, o.Output)
 	case "get-next":
-		_, err := getNextMessage(DefaultChannel, Output)
+		_, err := a.getNextMessage(a.DefaultChannel, o.Output)
 		return err
 	case "consume-next":
-		return consumeNextMessage(DefaultChannel, Output)
+		return a.consumeNextMessage(a.DefaultChannel, o.Output)
 	case "list":
-		return listMessages(DefaultChannel, OutputFormat, Output)
+		return a.listMessages(a.DefaultChannel, o)
 	case "send":
-		return sendMessageFromInput()
+		return a.sendMessageFromInput(o)
+	case "status":
+		return a.messageStatus(a.DefaultChannel, o.MessageID, o.OutputFormat, o.Output)
+	case "watch":
+		return a.watch(a.DefaultChannel, o.OutputFormat, o.Output, o.Confirm)
 	default:
 		return fmt.Errorf("unknown action: %s", action)
 	}
@@ -222,7 +406,13 @@ Usage:
 
 Actions:
   confirm
-	confirm that message has been received
+	confirm that message has been received, or the messages whose
+	ids are read from -ids
+  delete
+	delete the messages matching -older-than, -min-size, -max-size
+	and -ids, only list them with -dry-run
+  purge
+	delete all messages of the channel, or of all channels with -all
   get
 	get message
   get-next
@@ -230,28 +420,53 @@ Actions:
   consume-next
 	get next message and confirm it has been received
   list
-	list messages
+	list messages, filtered with -created-after, -created-before,
+	-min-size and -max-size, ordered with -sort and -desc and paged
+	with -limit and -cursor
   send
 	send message
+  status
+	show which peers hold a message
+  watch
+	write new messages as they arrive until interrupted, as json lines
+	with -format json, confirming them with -confirm
+  keys
+	manage keys, see cent keys
+  contacts
+	manage the address book, see cent contacts
 `
 }
 
-func LoadPrivateKey(key []byte) error {
+// LoadPrivateKey loads the PEM private key. Encrypted keys are decrypted
+// with the passphrase, see passphrase.
+func (a *Agent) LoadPrivateKey(key []byte) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "LoadPrivateKey",
 	})
 	l.Debug("loading private key")
-	k, err := keys.BytesToPrivKey(key)
+	k, err := a.parsePrivateKey(key)
 	if err != nil {
 		l.Errorf("error loading private key: %v", err)
 		return err
 	}
-	PrivateKey = k
+	a.PrivateKey = k
 	return nil
 }
 
-func LoadPrivateKeyFromFile(file string) error {
+// parsePrivateKey parses the PEM private key, decrypting it if needed.
+func (a *Agent) parsePrivateKey(key []byte) (*rsa.PrivateKey, error) {
+	if !keys.IsEncryptedPrivateKey(key) {
+		return keys.BytesToPrivKey(key)
+	}
+	p, err := a.passphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	return keys.DecryptPrivateKey(key, p)
+}
+
+func (a *Agent) LoadPrivateKeyFromFile(file string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "LoadPrivateKeyFromFile",
@@ -262,232 +477,55 @@ func LoadPrivateKeyFromFile(file string) error {
 		l.Errorf("error loading private key from file: %v", err)
 		return err
 	}
-	return LoadPrivateKey(fd)
+	return a.LoadPrivateKey(fd)
 }
 
-func GetAgentServer() string {
-	return ServerAddrs[rand.Intn(len(ServerAddrs))]
+// client returns the API client for the configured servers and keys. It
+// is created on first use, so that it keeps track of the health of the
+// servers across calls.
+func (a *Agent) client() *client.Client {
+	a.apiOnce.Do(func() {
+		a.api = client.New(a.ServerAddrs...)
+		a.api.AuthToken = a.ServerAuthToken
+		a.api.PrivateKey = a.PrivateKey
+	})
+	return a.api
 }
 
-func CreateSignature() (string, string, error) {
-	l := log.WithFields(log.Fields{
-		"pkg": "agent",
-		"fn":  "CreateSignature",
-	})
-	l.Debug("creating signature")
-	ts := time.Now().Unix()
-	var td struct {
-		Timestamp int64 `json:"timestamp"`
-	}
-	var sigReq struct {
-		PublicKey []byte `json:"public_key"`
-		Data      []byte `json:"data"`
-		Signature []byte `json:"signature"`
-	}
-	td.Timestamp = ts
-	jd, err := json.Marshal(td)
-	if err != nil {
-		l.Errorf("error marshalling timestamp: %v", err)
-		return "", "", err
-	}
-	l.Debugf("timestamp: %s", string(jd))
-	if PrivateKey == nil {
-		l.Error("no private key")
-		return "", "", errors.New("no private key")
-	}
-	sig, err := sign.Sign(jd, PrivateKey)
-	if err != nil {
-		l.Errorf("error creating signature: %v", err)
-		return "", "", err
-	}
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&PrivateKey.PublicKey)
-	if err != nil {
-		fmt.Printf("error when dumping publickey: %s \n", err)
-		os.Exit(1)
-	}
-	publicKeyBlock := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyBytes,
-	}
-	publicKeyPem := pem.EncodeToMemory(publicKeyBlock)
-	sigReq.PublicKey = publicKeyPem
-	//log.Printf("public key: %s", publicKeyBlock)
-	sigReq.Data = jd
-	sigReq.Signature = sig
-	j, err := json.Marshal(sigReq)
-	if err != nil {
-		l.Errorf("error marshalling signature request: %v", err)
-		return "", "", err
-	}
-	keyID := keys.PubKeyID(publicKeyPem)
-	l.Debugf("key ID: %s", keyID)
-	return base64.StdEncoding.EncodeToString(j), keyID, nil
+// CreateSignature returns the X-Signature header value for the agent's
+// private key and the ID of its public key.
+func (a *Agent) CreateSignature() (string, string, error) {
+	return a.client().Signature()
 }
 
-func CheckPendingMessages(channel string) ([]MessageMeta, error) {
-	l := log.WithFields(log.Fields{
-		"pkg": "agent",
-		"fn":  "CheckPendingMessages",
-		"ch":  channel,
-	})
-	l.Debug("checking pending messages")
-	var msgs []MessageMeta
-	saddr := GetAgentServer()
-	c := &http.Client{}
-	sig, _, err := CreateSignature()
-	if err != nil {
-		l.Errorf("error creating signature: %v", err)
-		return msgs, err
-	}
-	addr := saddr + "/messages"
-	if channel != "" {
-		addr = addr + "?channel=" + channel
-	}
-	req, err := http.NewRequest("GET", addr, nil)
-	if err != nil {
-		l.Errorf("error creating request: %v", err)
-		return msgs, err
-	}
-	req.Header.Set("X-Signature", sig)
-	if ServerAuthToken != "" {
-		req.Header.Set("X-Token", ServerAuthToken)
-	}
-	resp, err := c.Do(req)
-	if err != nil {
-		l.Errorf("error sending request: %v", err)
-		return msgs, err
-	}
-	defer resp.Body.Close()
-	bd, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		l.Errorf("error reading response: %v", err)
-		return msgs, err
-	}
-	if resp.StatusCode != 200 {
-		l.Errorf("error checking pending messages: %v", resp.StatusCode)
-		l.Debugf("response: %s", string(bd))
-		return msgs, err
-	}
+func (a *Agent) CheckPendingMessages(channel string) ([]MessageMeta, error) {
+	return a.client().List(context.Background(), channel)
+}
 
-	err = json.Unmarshal(bd, &msgs)
-	if err != nil {
-		l.Errorf("error unmarshalling response: %v", err)
-		return msgs, err
-	}
-	return msgs, nil
+// GetMessage returns the encrypted message.
+func (a *Agent) GetMessage(channel, id string) (*api.Message, error) {
+	return a.client().GetEncrypted(context.Background(), channel, id)
 }
 
-func GetMessage(channel, id string) (*message.Message, error) {
-	l := log.WithFields(log.Fields{
-		"pkg": "agent",
-		"fn":  "GetMessage",
-		"id":  id,
-		"ch":  channel,
-	})
-	l.Debug("getting message")
-	if channel == "" || id == "" {
-		l.Error("missing channel or id")
-		return nil, errors.New("missing channel or id")
-	}
-	saddr := GetAgentServer()
-	c := &http.Client{}
-	sig, keyID, err := CreateSignature()
-	if err != nil {
-		l.Errorf("error creating signature: %v", err)
-		return nil, err
-	}
-	addr := saddr + "/message/" + keyID + "/" + channel + "/" + id
-	req, err := http.NewRequest("GET", addr, nil)
-	if err != nil {
-		l.Errorf("error creating request: %v", err)
-		return nil, err
-	}
-	req.Header.Set("X-Signature", sig)
-	if ServerAuthToken != "" {
-		req.Header.Set("X-Token", ServerAuthToken)
-	}
-	resp, err := c.Do(req)
-	if err != nil {
-		l.Errorf("error sending request: %v", err)
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		l.Errorf("error getting message: %v", resp.StatusCode)
-		return nil, err
-	}
-	bd, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		l.Errorf("error reading response: %v", err)
-		return nil, err
-	}
-	m := &message.Message{
-		ID:          id,
-		Channel:     channel,
-		PublicKeyID: keyID,
-		Data:        bd,
-	}
-	return m, nil
+func (a *Agent) GetMessageStatus(channel, id string) (*MessageStatus, error) {
+	return a.client().Status(context.Background(), channel, id)
 }
 
-func ConfirmMessageReceive(channel, id string) error {
-	l := log.WithFields(log.Fields{
-		"pkg": "agent",
-		"fn":  "ConfirmMessageReceive",
-	})
-	l.Debug("confirming message receive")
-	saddr := GetAgentServer()
-	c := &http.Client{}
-	sig, keyID, err := CreateSignature()
-	if err != nil {
-		l.Errorf("error creating signature: %v", err)
-		return err
-	}
-	if channel == "" || id == "" {
-		l.Errorf("error: channel or id is empty")
-		return errors.New("error: channel or id is empty")
-	}
-	addr := saddr + "/message/" + keyID + "/" + channel + "/" + id
-	req, err := http.NewRequest("DELETE", addr, nil)
-	if err != nil {
-		l.Errorf("error creating request: %v", err)
-		return err
-	}
-	req.Header.Set("X-Signature", sig)
-	if ServerAuthToken != "" {
-		req.Header.Set("X-Token", ServerAuthToken)
-	}
-	resp, err := c.Do(req)
-	if err != nil {
-		l.Errorf("error sending request: %v", err)
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		l.Errorf("error confirming message receive: %v", resp.StatusCode)
-		return err
-	}
-	return nil
+func (a *Agent) ConfirmMessageReceive(channel, id string) error {
+	return a.client().Confirm(context.Background(), channel, id)
 }
 
-func DecryptMessageData(m *message.Message) (*message.Message, error) {
+func (a *Agent) DecryptMessageData(m *api.Message) (*api.Message, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "DecryptMessageData",
 	})
 	l.Debug("decrypting message data")
-	priv := x509.MarshalPKCS1PrivateKey(PrivateKey)
-	kb := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: priv,
-	}
-	kbp := pem.EncodeToMemory(kb)
-	decrypted, err := keys.DecryptMessage(kbp, strings.TrimSpace(string(m.Data)))
+	decrypted, err := a.client().Decrypt(m.Data)
 	if err != nil {
 		l.Errorf("error decrypting message data: %v", err)
 		return m, err
 	}
 	m.Data = decrypted
-	l.Debugf("decrypted message data: %s", m.Data)
 	return m, nil
 }
@@ -2,6 +2,7 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,13 +11,68 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
+	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/pkg/client"
 	"github.com/robertlestak/centauri/pkg/keys"
 	log "github.com/sirupsen/logrus"
 )
 
+// ClientOptions are the options of the commands of cent, set from its
+// flags and passed to Client, Keys and Contacts.
+type ClientOptions struct {
+	// Output is the file the result of a command is written to, - for
+	// stdout, and OutputFormat its format, json or text.
+	Output       string
+	OutputFormat string
+	// MessageID is the message of cent get, status and confirm.
+	MessageID string
+	// MessageInput is the file cent send reads the message from, - for
+	// stdin, and MessageType and MessageFileName its type and file name.
+	MessageInput    string
+	MessageType     string
+	MessageFileName string
+	// RecipientPublicKey and Recipients are the recipients of cent send,
+	// see resolveRecipient.
+	RecipientPublicKey []byte
+	Recipients         []string
+	// Confirm makes cent watch confirm the messages it has written.
+	Confirm bool
+	// IDsFile is the file of the message IDs, one per line, of cent
+	// delete and cent confirm, - for stdin.
+	IDsFile string
+	// Filter selects the messages of cent delete.
+	Filter MessageFilter
+	// List selects, orders and pages the messages of cent list.
+	// CreatedAfter and CreatedBefore (RFC 3339 or 2006-01-02) set its
+	// interval and Filter its sizes.
+	List          client.ListQuery
+	CreatedAfter  string
+	CreatedBefore string
+	// AllChannels makes cent list, delete and purge act on all channels.
+	AllChannels bool
+	// DryRun makes cent delete and purge only list the messages.
+	DryRun bool
+	// KeyBits is the size of the keys created by keys generate.
+	KeyBits int
+	// KeyEncrypt makes keys generate encrypt the new private key.
+	KeyEncrypt bool
+	// KeyFile is the file of the private key, which keys rotate replaces.
+	KeyFile string
+	// KeyOverlap is how long keys rotate keeps the old key in use.
+	KeyOverlap time.Duration
+	// KeyExpires is the expiry of the record published by keys publish.
+	KeyExpires string
+	// RevokeReason is the reason given by keys revoke and keys revoke-cert.
+	RevokeReason string
+	// ContactNote and ContactExpires are set on contacts by contacts add.
+	ContactNote    string
+	ContactExpires string
+}
+
 func sendOutput(data []byte, out string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
@@ -41,44 +97,122 @@ func sendOutput(data []byte, out string) error {
 }
 
 func messageListTable(msgs []MessageMeta) string {
-	var tbl string
 	var wr bytes.Buffer
 	w := tabwriter.NewWriter(&wr, 1, 1, 1, ' ', 0)
 	fmt.Fprintf(w, "id\tchannel\tsize\tcreated at\n")
 	for _, msg := range msgs {
 		strTime := msg.CreatedAt.Format(time.RFC3339)
-		tbl += msg.ID + "\t" + msg.Channel + "\t" + strconv.Itoa(int(msg.Size)) + "\t" + strTime
-		fmt.Fprintf(w, "%s\n", tbl)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", msg.ID, msg.Channel, strconv.Itoa(int(msg.Size)), strTime)
 	}
 	w.Flush()
 	return wr.String()
 }
 
-func listMessages(channel string, format string, out string) error {
+func messageStatusTable(st *MessageStatus) string {
+	var wr bytes.Buffer
+	w := tabwriter.NewWriter(&wr, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "peer\tstored\tfetching\ttombstone\terror\n")
+	for _, p := range st.Peers {
+		fmt.Fprintf(w, "%s\t%t\t%t\t%t\t%s\n", p.PeerName, p.Stored, p.Fetching, p.Tombstone, p.Error)
+	}
+	w.Flush()
+	return wr.String()
+}
+
+func (a *Agent) messageStatus(channel string, id string, format string, out string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "messageStatus",
+	})
+	l.Debug("getting message status")
+	st, err := a.GetMessageStatus(channel, id)
+	if err != nil {
+		l.Errorf("error getting message status: %v", err)
+		return err
+	}
+	var data []byte
+	if format == "" {
+		format = "json"
+	}
+	switch format {
+	case "json":
+		data, err = json.Marshal(st)
+	case "text":
+		data = []byte(messageStatusTable(st))
+	default:
+		l.Errorf("unknown format: %v", format)
+		return errors.New("unknown format")
+	}
+	if err != nil {
+		l.Errorf("error marshalling status: %v", err)
+		return err
+	}
+	return sendOutput(data, out)
+}
+
+// listMessages writes the messages of channel selected by o.List,
+// o.CreatedAfter, o.CreatedBefore and the sizes of o.Filter to o.Output.
+// A page of the listing is written as a MessagePage in the json format;
+// in the text format the total and the next cursor are written to
+// stderr.
+func (a *Agent) listMessages(channel string, o *ClientOptions) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "listMessages",
 	})
 	l.Debug("listing messages")
-	msgs, err := CheckPendingMessages(channel)
+	format, out := o.OutputFormat, o.Output
+	q := o.List
+	q.Channel = channel
+	if o.AllChannels {
+		q.Channel = ""
+	}
+	q.MinSize = o.Filter.MinSize
+	q.MaxSize = o.Filter.MaxSize
+	var err error
+	if o.CreatedAfter != "" {
+		if q.CreatedAfter, err = parseTime("created after", o.CreatedAfter); err != nil {
+			return err
+		}
+	}
+	if o.CreatedBefore != "" {
+		if q.CreatedBefore, err = parseTime("created before", o.CreatedBefore); err != nil {
+			return err
+		}
+	}
+	page, err := a.client().ListPage(context.Background(), q)
 	if err != nil {
-		l.Errorf("error checking pending messages: %v", err)
+		l.Errorf("error listing messages: %v", err)
 		return err
 	}
-	if len(msgs) == 0 {
+	paged := q.Limit > 0 || q.Cursor != ""
+	if len(page.Messages) == 0 && !paged {
 		l.Debug("no pending messages")
 		return nil
 	}
-	l.Debugf("pending messages: %v", msgs)
+	l.Debugf("pending messages: %v", page.Messages)
 	var data []byte
 	if format == "" {
 		format = "json"
 	}
 	switch format {
 	case "json":
-		data, err = json.Marshal(msgs)
+		if paged {
+			if page.Messages == nil {
+				page.Messages = []MessageMeta{}
+			}
+			data, err = json.Marshal(page)
+		} else {
+			data, err = json.Marshal(page.Messages)
+		}
 	case "text":
-		data = []byte(messageListTable(msgs))
+		data = []byte(messageListTable(page.Messages))
+		if paged {
+			fmt.Fprintf(os.Stderr, "%d of %d messages\n", len(page.Messages), page.Total)
+			if page.NextCursor != "" {
+				fmt.Fprintf(os.Stderr, "next page: -cursor %s\n", page.NextCursor)
+			}
+		}
 	default:
 		l.Errorf("unknown format: %v", format)
 		return errors.New("unknown format")
@@ -90,13 +224,13 @@ func listMessages(channel string, format string, out string) error {
 	return sendOutput(data, out)
 }
 
-func getMessage(channel string, id string, out string) error {
+func (a *Agent) getMessage(channel string, id string, out string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "getMessage",
 	})
 	l.Debug("getting message")
-	msg, fn, err := getMessageData(channel, id)
+	msg, fn, err := a.getMessageData("", channel, id)
 	if err != nil {
 		l.Errorf("error getting message: %v", err)
 		return err
@@ -104,46 +238,42 @@ func getMessage(channel string, id string, out string) error {
 	l.Debugf("message: %v", msg)
 	// if out is "-" or empty, then write to stdout
 	if out == "-" || out == "" {
-		_, err := os.Stdout.Write(msg.Data)
-		if err != nil {
+		if _, err := os.Stdout.Write(msg.Data); err != nil {
 			l.Errorf("failed to write to stdout: %v", err)
 			return err
 		}
+		// pipes and terminals cannot be synced
+		if err := os.Stdout.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+			l.Errorf("failed to sync stdout: %v", err)
+			return err
+		}
 		return nil
 	}
 	// if out is a directory, then write to filename in that directory if message
 	// has a file name, otherwise, write to filename with message id
 	if stat, err := os.Stat(out); err == nil && stat.IsDir() {
-		if fn != "" {
-			if err := ioutil.WriteFile(out+"/"+fn, msg.Data, 0644); err != nil {
-				l.Errorf("failed to write to file: %v", err)
-				return err
-			}
-		} else {
-			if err := ioutil.WriteFile(out+"/"+msg.ID, msg.Data, 0644); err != nil {
-				l.Errorf("failed to write to file: %v", err)
-				return err
-			}
-		}
-		return nil
-	} else {
-		// if out is not a directory, then write to out file
-		if err := ioutil.WriteFile(out, msg.Data, 0644); err != nil {
-			l.Errorf("failed to write to file: %v", err)
-			return err
+		if fn == "" {
+			fn = msg.ID
 		}
+		out = out + "/" + fn
+	}
+	// the file is synced before returning, as consume-next confirms the
+	// message right after
+	if err := persist.WriteFileAtomic(out, msg.Data, 0644); err != nil {
+		l.Errorf("failed to write to file: %v", err)
+		return err
 	}
 	return nil
 }
 
-func getNextMessage(channel string, out string) (string, error) {
+func (a *Agent) getNextMessage(channel string, out string) (string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "getNextMessage",
 	})
 	l.Debug("getting next message")
 	// list messages, sort by created at, get first message
-	msgs, err := CheckPendingMessages(channel)
+	msgs, err := a.CheckPendingMessages(channel)
 	if err != nil {
 		l.Errorf("error checking pending messages: %v", err)
 		return "", err
@@ -162,17 +292,17 @@ func getNextMessage(channel string, out string) (string, error) {
 	// get message data
 	// print message id to stderr
 	fmt.Fprintf(os.Stderr, "id: %v\n", msg.ID)
-	return msg.ID, getMessage(channel, msg.ID, out)
+	return msg.ID, a.getMessage(channel, msg.ID, out)
 }
 
-func consumeNextMessage(channel string, out string) error {
+func (a *Agent) consumeNextMessage(channel string, out string) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "consumeNextMessage",
 	})
 	l.Debug("consuming next message")
 	// get next message
-	id, err := getNextMessage(channel, out)
+	id, err := a.getNextMessage(channel, out)
 	if err != nil {
 		l.Errorf("error getting next message: %v", err)
 		return err
@@ -182,7 +312,7 @@ func consumeNextMessage(channel string, out string) error {
 		return nil
 	}
 	// delete message
-	err = ConfirmMessageReceive(channel, id)
+	err = a.ConfirmMessageReceive(channel, id)
 	if err != nil {
 		l.Errorf("error deleting message: %v", err)
 		return err
@@ -190,40 +320,158 @@ func consumeNextMessage(channel string, out string) error {
 	return nil
 }
 
-func sendMessageFromInput() error {
+func (a *Agent) sendMessageFromInput(o *ClientOptions) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "sendMessageFromInput",
 	})
 	l.Debug("sending message from input")
-	var recipID string
-	for id := range keys.PublicKeyChain {
-		recipID = id
-		break
+	recipIDs, err := a.resolveRecipients(o.RecipientPublicKey, o.Recipients)
+	if err != nil {
+		l.Errorf("error resolving recipients: %v", err)
+		return err
 	}
 	var in io.ReadCloser
-	if ClientMessageInput == "-" || ClientMessageInput == "" {
+	if o.MessageInput == "-" || o.MessageInput == "" {
 		l.Debug("reading from stdin")
 		in = os.Stdin
 	} else {
-		l.Debugf("reading from file: %v", ClientMessageInput)
+		l.Debugf("reading from file: %v", o.MessageInput)
 		var err error
-		in, err = os.Open(ClientMessageInput)
+		in, err = os.Open(o.MessageInput)
 		if err != nil {
 			l.Errorf("failed to open input file: %v", err)
 			return err
 		}
 		defer in.Close()
 	}
-	if err := sendMessage(
-		DefaultChannel,
-		recipID,
-		ClientMessageType,
-		ClientMessageFileName,
-		in,
-	); err != nil {
-		l.Errorf("error sending message: %v", err)
+	// the input is read once and encrypted for every recipient
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		l.Errorf("failed to read input: %v", err)
 		return err
 	}
+	for _, id := range recipIDs {
+		m, err := a.createMessage(
+			o.MessageType,
+			o.MessageFileName,
+			a.DefaultChannel,
+			id,
+			ioutil.NopCloser(bytes.NewReader(data)),
+		)
+		if err != nil {
+			l.Errorf("error creating message for %s: %v", id, err)
+			return err
+		}
+		if m.PublicKeyID != id {
+			fmt.Fprintf(os.Stderr, "key %s was rotated to %s, sending to the new key\n", keys.ShortID(id), keys.ShortID(m.PublicKeyID))
+			id = m.PublicKeyID
+		}
+		meta, err := a.client().SendMessage(context.Background(), m)
+		if err != nil {
+			l.Errorf("error sending message to %s: %v", id, err)
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "sent %s to %s\n", meta.ID, keys.ShortID(id))
+	}
 	return nil
 }
+
+// resolveRecipients returns the key IDs of the recipients of cent send,
+// given by the public key pub and the references refs. There must be at
+// least one and every one must match exactly one key.
+func (a *Agent) resolveRecipients(pub []byte, refs []string) ([]string, error) {
+	if err := a.loadPublicKeys(); err != nil {
+		return nil, err
+	}
+	var ids []string
+	seen := map[string]bool{}
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(pub) > 0 {
+		if _, err := keys.BytesToPubKey(pub); err != nil {
+			return nil, fmt.Errorf("invalid recipient public key: %v", err)
+		}
+		add(a.PublicKeys.Add(pub))
+	}
+	if len(refs) > 0 {
+		if err := a.loadContacts(); err != nil {
+			return nil, err
+		}
+	}
+	for _, ref := range refs {
+		rids, err := a.resolveRecipient(ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range rids {
+			add(id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no recipient, set -to")
+	}
+	return ids, nil
+}
+
+// resolveRecipient returns the key IDs of the recipient ref, which is a
+// contact or group of the address book, a public key file or the ID, a
+// unique ID prefix or the file name of a key in the public key chain.
+func (a *Agent) resolveRecipient(ref string) ([]string, error) {
+	keyID, kerr := a.PublicKeys.Resolve(ref)
+	if errors.Is(kerr, keys.ErrAmbiguousKey) {
+		return nil, fmt.Errorf("recipient %s: %w", ref, kerr)
+	}
+	if b := a.contacts(); b.Has(ref) {
+		if kerr == nil || fileExists(ref) {
+			return nil, fmt.Errorf("recipient %s is ambiguous: it is a contact and a key", ref)
+		}
+		ids, err := b.Resolve(ref)
+		if err != nil {
+			return nil, fmt.Errorf("recipient %s: %w", ref, err)
+		}
+		for _, id := range ids {
+			if _, ok := a.PublicKeys.Get(id); !ok {
+				return nil, fmt.Errorf("recipient %s: %w: %s", ref, keys.ErrKeyNotFound, id)
+			}
+		}
+		return ids, nil
+	}
+	if fileExists(ref) {
+		pub, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := keys.BytesToPubKey(pub); err != nil {
+			return nil, fmt.Errorf("%s is not a public key: %v", ref, err)
+		}
+		id := a.PublicKeys.Add(pub)
+		if kerr == nil && a.realKeyID(keyID) != id {
+			return nil, fmt.Errorf("recipient %s is ambiguous: it is the file of key %s and matches key %s", ref, keys.ShortID(id), keys.ShortID(keyID))
+		}
+		return []string{id}, nil
+	}
+	if kerr != nil {
+		return nil, fmt.Errorf("recipient %s: %w", ref, kerr)
+	}
+	id := a.realKeyID(keyID)
+	if id != keyID {
+		// a key installed under another name
+		pub, _ := a.PublicKeys.Get(keyID)
+		a.PublicKeys.Add(pub)
+	}
+	return []string{id}, nil
+}
+
+// realKeyID returns the ID computed from the key named name in the chain.
+func (a *Agent) realKeyID(name string) string {
+	pub, ok := a.PublicKeys.Get(name)
+	if !ok {
+		return name
+	}
+	return keys.PubKeyID(pub)
+}
@@ -0,0 +1,235 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/contacts"
+	"github.com/robertlestak/centauri/pkg/keys"
+	log "github.com/sirupsen/logrus"
+)
+
+func ContactsHelp() string {
+	return `
+Usage:
+  cent contacts [command] [args]
+
+Commands:
+  add [name] [key]
+	name a key of the public key chain or a public key file, which is
+	imported. -note and -expires (RFC 3339 or 2006-01-02) are kept with it
+  remove [name]
+	remove a contact or a group
+  group [name] [contact...]
+	set the members of a group
+  list
+	list the contacts and groups
+
+Contacts and groups can be given to cent send -to, and contacts are
+accepted as the names of outgoing directories.
+`
+}
+
+// ContactsFile returns the path of the address book.
+func (a *Agent) ContactsFile() string {
+	return filepath.Join(a.dataDir(), contacts.FileName)
+}
+
+// loadContacts reads the address book.
+func (a *Agent) loadContacts() error {
+	b, err := contacts.Load(a.ContactsFile())
+	if err != nil {
+		return err
+	}
+	a.contactsMtx.Lock()
+	defer a.contactsMtx.Unlock()
+	a.book = b
+	return nil
+}
+
+// contacts returns the address book as last loaded.
+func (a *Agent) contacts() *contacts.Book {
+	a.contactsMtx.Lock()
+	defer a.contactsMtx.Unlock()
+	if a.book == nil {
+		return contacts.New()
+	}
+	return a.book
+}
+
+// contactKeyID returns the key ID of the contact name, used for the
+// outgoing directories named after contacts.
+func (a *Agent) contactKeyID(name string) (string, bool, error) {
+	b := a.contacts()
+	if _, ok := b.Contacts[name]; !ok {
+		return "", false, nil
+	}
+	ids, err := b.Resolve(name)
+	if err != nil {
+		return "", true, err
+	}
+	return ids[0], true, nil
+}
+
+// ensureContactDirs creates the outgoing directories of the contacts
+// whose keys are in the chain and which have not expired.
+func (a *Agent) ensureContactDirs(keyIDs []string) error {
+	have := map[string]bool{}
+	for _, id := range keyIDs {
+		have[id] = true
+	}
+	b := a.contacts()
+	now := time.Now()
+	for _, name := range b.Names() {
+		if c := b.Contacts[name]; !have[c.KeyID] || c.Expired(now) {
+			continue
+		}
+		if _, err := a.Store.EnsurePubKeyChainOutgoingDir(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Contacts runs the contacts command cmd with the arguments args and the
+// options o.
+func (a *Agent) Contacts(cmd string, args []string, o *ClientOptions) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "Contacts",
+		"cmd": cmd,
+	})
+	l.Debug("contacts")
+	if err := a.loadContacts(); err != nil {
+		return err
+	}
+	b := a.contacts()
+	switch cmd {
+	case "add":
+		if len(args) != 2 {
+			return errors.New("usage: cent contacts add [name] [key]")
+		}
+		if err := a.addContact(b, args[0], args[1], o.ContactNote, o.ContactExpires); err != nil {
+			return err
+		}
+	case "remove":
+		if len(args) != 1 {
+			return errors.New("usage: cent contacts remove [name]")
+		}
+		if err := b.Remove(args[0]); err != nil {
+			return err
+		}
+	case "group":
+		if len(args) < 1 {
+			return errors.New("usage: cent contacts group [name] [contact...]")
+		}
+		if err := b.SetGroup(args[0], args[1:]); err != nil {
+			return err
+		}
+	case "list":
+		return a.listContacts(b, o.OutputFormat, o.Output)
+	default:
+		return fmt.Errorf("unknown contacts command: %q", cmd)
+	}
+	return b.Save(a.ContactsFile())
+}
+
+func (a *Agent) addContact(b *contacts.Book, name string, ref string, note string, expires string) error {
+	if err := a.loadPublicKeys(); err != nil {
+		return err
+	}
+	c := &contacts.Contact{Note: note}
+	if expires != "" {
+		t, err := parseExpiry(expires)
+		if err != nil {
+			return err
+		}
+		c.Expires = &t
+	}
+	if fileExists(ref) {
+		pub, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return err
+		}
+		if c.KeyID, err = keys.InstallPublicKey(a.PublicKeysDir(), pub); err != nil {
+			return err
+		}
+	} else {
+		id, err := a.PublicKeys.Resolve(ref)
+		if err != nil {
+			return err
+		}
+		c.KeyID = a.realKeyID(id)
+	}
+	if err := b.Add(name, c); err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", name, c.KeyID)
+	return nil
+}
+
+func parseExpiry(s string) (time.Time, error) {
+	return parseTime("expiry", s)
+}
+
+// parseTime parses the time s given as RFC 3339 or 2006-01-02.
+func parseTime(what string, s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q, use RFC 3339 or 2006-01-02", what, s)
+	}
+	return t, nil
+}
+
+func (a *Agent) listContacts(b *contacts.Book, format string, out string) error {
+	var data []byte
+	switch format {
+	case "json":
+		jd, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		data = append(jd, '\n')
+	default:
+		var buf bytes.Buffer
+		w := tabwriter.NewWriter(&buf, 1, 1, 1, ' ', 0)
+		fmt.Fprintln(w, "NAME\tKEY\tEXPIRES\tNOTE")
+		now := time.Now()
+		for _, n := range b.Names() {
+			c := b.Contacts[n]
+			var exp string
+			if c.Expires != nil {
+				exp = c.Expires.Format("2006-01-02")
+				if c.Expired(now) {
+					exp += " (expired)"
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", n, keys.ShortID(c.KeyID), exp, c.Note)
+		}
+		var groups []string
+		for g := range b.Groups {
+			groups = append(groups, g)
+		}
+		if len(groups) > 0 {
+			fmt.Fprintln(w, "\nGROUP\tMEMBERS\t\t")
+			sort.Strings(groups)
+			for _, g := range groups {
+				fmt.Fprintf(w, "%s\t%s\t\t\n", g, strings.Join(b.Groups[g], ", "))
+			}
+		}
+		w.Flush()
+		data = buf.Bytes()
+	}
+	return sendOutput(data, out)
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageFilter selects the messages deleted by cent delete. A message
+// matches if it matches every condition which is set.
+type MessageFilter struct {
+	// OlderThan matches the messages created longer ago.
+	OlderThan time.Duration
+	// MinSize and MaxSize match the messages of at least and at most
+	// this many bytes.
+	MinSize int64
+	MaxSize int64
+	// IDs are the IDs of the messages to match.
+	IDs []string
+}
+
+func (f MessageFilter) empty() bool {
+	return f.OlderThan <= 0 && f.MinSize <= 0 && f.MaxSize <= 0 && len(f.IDs) == 0
+}
+
+// matches reports whether m matches the filter, whose IDs are given as
+// the set ids.
+func (f MessageFilter) matches(m MessageMeta, now time.Time, ids map[string]bool) bool {
+	if f.OlderThan > 0 && !m.CreatedAt.Before(now.Add(-f.OlderThan)) {
+		return false
+	}
+	if f.MinSize > 0 && m.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && m.Size > f.MaxSize {
+		return false
+	}
+	if len(ids) > 0 && !ids[m.ID] {
+		return false
+	}
+	return true
+}
+
+// readIDs reads message IDs, one per line, from file, stdin if it is "-".
+func readIDs(file string) ([]string, error) {
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		fd, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		in = fd
+	}
+	var ids []string
+	sc := bufio.NewScanner(in)
+	for sc.Scan() {
+		if id := strings.TrimSpace(sc.Text()); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, sc.Err()
+}
+
+// deleteMessages deletes the messages of channel, or of all channels if
+// all is set, which match filter and, if idsFile is set, whose IDs are
+// read from it. Every message is deleted if purge is set, an empty filter
+// is refused otherwise. With dryRun the messages are only listed.
+func (a *Agent) deleteMessages(channel string, all bool, filter MessageFilter, idsFile string, purge bool, dryRun bool, format string, out string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "deleteMessages",
+	})
+	l.Debug("deleting messages")
+	if idsFile != "" {
+		ids, err := readIDs(idsFile)
+		if err != nil {
+			l.Errorf("error reading ids: %v", err)
+			return err
+		}
+		if len(ids) == 0 {
+			return errors.New("no message ids given")
+		}
+		filter.IDs = append(filter.IDs, ids...)
+	}
+	if purge && !filter.empty() {
+		return errors.New("purge deletes all messages, use delete to filter them")
+	}
+	if !purge && filter.empty() {
+		return errors.New("no filter, use purge to delete all messages")
+	}
+	if all {
+		channel = ""
+	}
+	msgs, err := a.CheckPendingMessages(channel)
+	if err != nil {
+		l.Errorf("error checking pending messages: %v", err)
+		return err
+	}
+	ids := map[string]bool{}
+	for _, id := range filter.IDs {
+		ids[id] = true
+	}
+	now := time.Now()
+	var matched []MessageMeta
+	found := map[string]bool{}
+	for _, m := range msgs {
+		if filter.matches(m, now, ids) {
+			matched = append(matched, m)
+			found[m.ID] = true
+		}
+	}
+	for _, id := range filter.IDs {
+		if !found[id] {
+			fmt.Fprintf(os.Stderr, "not found: %s\n", id)
+		}
+	}
+	if dryRun {
+		return a.writeMessageList(matched, format, out)
+	}
+	if len(matched) == 0 {
+		fmt.Fprintln(os.Stderr, "no messages to delete")
+		return nil
+	}
+	refs := make([]api.MessageRef, len(matched))
+	for i, m := range matched {
+		refs[i] = api.MessageRef{Channel: m.Channel, ID: m.ID}
+	}
+	n, err := a.client().DeleteMessages(context.Background(), refs)
+	if err != nil {
+		l.Errorf("error deleting messages: %v", err)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "deleted %d of %d messages\n", n, len(matched))
+	return nil
+}
+
+// confirmMessages confirms the messages of channel whose IDs are read
+// from the file idsFile at once.
+func (a *Agent) confirmMessages(channel string, idsFile string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "confirmMessages",
+	})
+	l.Debug("confirming messages")
+	ids, err := readIDs(idsFile)
+	if err != nil {
+		l.Errorf("error reading ids: %v", err)
+		return err
+	}
+	if len(ids) == 0 {
+		return errors.New("no message ids given")
+	}
+	refs := make([]api.MessageRef, len(ids))
+	for i, id := range ids {
+		refs[i] = api.MessageRef{Channel: channel, ID: id}
+	}
+	if _, err := a.client().DeleteMessages(context.Background(), refs); err != nil {
+		l.Errorf("error confirming messages: %v", err)
+		return err
+	}
+	return nil
+}
+
+// writeMessageList writes msgs to out in format.
+func (a *Agent) writeMessageList(msgs []MessageMeta, format string, out string) error {
+	var data []byte
+	var err error
+	switch format {
+	case "", "json":
+		if msgs == nil {
+			msgs = []MessageMeta{}
+		}
+		data, err = json.Marshal(msgs)
+	case "text":
+		data = []byte(messageListTable(msgs))
+	default:
+		return errors.New("unknown format")
+	}
+	if err != nil {
+		return err
+	}
+	return sendOutput(data, out)
+}
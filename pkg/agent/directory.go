@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/pkg/client"
+	"github.com/robertlestak/centauri/pkg/contacts"
+	"github.com/robertlestak/centauri/pkg/keys"
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultRecordTTL is how long a published key record is valid if no
+// expiry is given.
+const defaultRecordTTL = time.Hour * 24 * 365
+
+// publishKey publishes the record of the private key to the key
+// directory under the display name name, valid until expiry if it is set.
+func (a *Agent) publishKey(name string, expiry string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "publishKey",
+	})
+	if a.PrivateKey == nil {
+		return errors.New("no private key, set -key")
+	}
+	if !sign.ValidKeyRecordName(name) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	expires := time.Now().Add(defaultRecordTTL)
+	if expiry != "" {
+		var err error
+		if expires, err = parseExpiry(expiry); err != nil {
+			return err
+		}
+	}
+	r, err := sign.NewKeyRecord(a.PrivateKey, name, expires)
+	if err != nil {
+		l.Errorf("error creating key record: %v", err)
+		return err
+	}
+	if err := a.client().PublishKeyRecord(context.Background(), r); err != nil {
+		l.Errorf("error publishing key record: %v", err)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "published %s as %q until %s\n", keys.ShortID(r.ID), r.Name, r.ExpiresAt.Local().Format(time.RFC3339))
+	fmt.Printf("%s\n", r.ID)
+	return nil
+}
+
+// fetchKey looks the key ref, a key ID or a display name, up in the key
+// directory and installs it into the public key chain. The key is added
+// to the address book under its display name if the name is free.
+func (a *Agent) fetchKey(ref string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "fetchKey",
+		"ref": ref,
+	})
+	if ref == "" {
+		return errors.New("no key ID or name given")
+	}
+	var r *sign.KeyRecord
+	if isKeyID(ref) {
+		var err error
+		if r, err = a.client().KeyRecord(context.Background(), ref); errors.Is(err, client.ErrNotFound) {
+			return fmt.Errorf("%s is not in the key directory", ref)
+		} else if err != nil {
+			return err
+		}
+	} else {
+		rs, err := a.client().FindKeyRecords(context.Background(), ref)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(rs) == 0:
+			return fmt.Errorf("%s is not in the key directory", ref)
+		case len(rs) > 1:
+			var ids []string
+			for _, r := range rs {
+				ids = append(ids, r.ID)
+			}
+			return fmt.Errorf("%s is the name of several keys, fetch one by its ID: %s", ref, strings.Join(ids, ", "))
+		}
+		r = rs[0]
+	}
+	id, err := keys.InstallPublicKey(a.PublicKeysDir(), r.Key)
+	if err != nil {
+		l.Errorf("error installing public key: %v", err)
+		return err
+	}
+	if err := a.addDirectoryContact(r); err != nil {
+		l.Errorf("error adding contact: %v", err)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "fetched %q, valid until %s\n", r.Name, r.ExpiresAt.Local().Format(time.RFC3339))
+	fmt.Printf("%s\n", id)
+	return nil
+}
+
+// addDirectoryContact adds the key of r to the address book under its
+// display name, unless the name is taken or cannot be a contact name.
+func (a *Agent) addDirectoryContact(r *sign.KeyRecord) error {
+	if !persist.ValidName(r.Name) {
+		return nil
+	}
+	if err := a.loadContacts(); err != nil {
+		return err
+	}
+	b := a.contacts()
+	if c, ok := b.Contacts[r.Name]; ok {
+		if c.KeyID != r.ID {
+			fmt.Fprintf(os.Stderr, "contact %s is another key, not adding it\n", r.Name)
+		}
+		return nil
+	}
+	if _, ok := b.Groups[r.Name]; ok {
+		fmt.Fprintf(os.Stderr, "%s is a group, not adding the contact\n", r.Name)
+		return nil
+	}
+	expires := r.ExpiresAt
+	if err := b.Add(r.Name, &contacts.Contact{
+		KeyID:   r.ID,
+		Note:    "key directory",
+		Expires: &expires,
+	}); err != nil {
+		return err
+	}
+	return b.Save(a.ContactsFile())
+}
+
+// isKeyID reports whether s is a full key ID.
+func isKeyID(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
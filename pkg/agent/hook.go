@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/centauri/internal/persist"
+	log "github.com/sirupsen/logrus"
+)
+
+// Hook is a command run for every message of a subscription after it
+// has been stored. The message is only confirmed once the hook succeeds.
+//
+// The command gets the metadata of the message in the environment:
+//
+//	CENTAURI_MESSAGE_ID
+//	CENTAURI_CHANNEL
+//	CENTAURI_MESSAGE_TYPE   bytes or file
+//	CENTAURI_FILE_NAME      name of the file as sent
+//	CENTAURI_FILE           path of the stored file
+type Hook struct {
+	// Command is the program and its arguments, it is not run in a shell.
+	Command []string
+	// Stdin streams the stored file to the standard input of the command.
+	Stdin bool
+	// Timeout kills the command, and the processes it started, if it runs
+	// longer, 1m if 0.
+	Timeout time.Duration
+	// MaxAttempts is the number of times the command is run before the
+	// message is quarantined, 3 if 0.
+	MaxAttempts int
+	// RetryBackoff is the wait before the first retry. It doubles on
+	// every further retry, 5s if 0.
+	RetryBackoff time.Duration
+}
+
+func (h *Hook) validate() error {
+	if len(h.Command) == 0 || h.Command[0] == "" {
+		return errors.New("hook without command")
+	}
+	return nil
+}
+
+func (h *Hook) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return time.Minute
+	}
+	return h.Timeout
+}
+
+func (h *Hook) maxAttempts() int {
+	if h.MaxAttempts <= 0 {
+		return 3
+	}
+	return h.MaxAttempts
+}
+
+func (h *Hook) retryBackoff() time.Duration {
+	if h.RetryBackoff <= 0 {
+		return time.Second * 5
+	}
+	return h.RetryBackoff
+}
+
+// maxHookOutput is the amount of the output of a failed hook kept in its error.
+const maxHookOutput = 4096
+
+// hookKillWait is the most time run waits for the output of a killed
+// hook to be closed.
+const hookKillWait = time.Second * 5
+
+// run runs the hook once for the stored message of the receipt r.
+func (h *Hook) run(r *persist.Receipt) error {
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	setProcessGroup(cmd)
+	cmd.Env = append(os.Environ(),
+		"CENTAURI_MESSAGE_ID="+r.ID,
+		"CENTAURI_CHANNEL="+r.Channel,
+		"CENTAURI_MESSAGE_TYPE="+r.Type,
+		"CENTAURI_FILE_NAME="+r.FileName,
+		"CENTAURI_FILE="+r.File,
+	)
+	if h.Stdin {
+		f, err := os.Open(r.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cmd.Stdin = f
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Wait returns once the output is closed, which the processes
+	// started by the command may keep open after it exited
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(h.timeout())
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-done:
+	case <-timer.C:
+		killProcessGroup(cmd)
+		select {
+		case <-done:
+		case <-time.After(hookKillWait):
+		}
+		return fmt.Errorf("hook timed out after %s", h.timeout())
+	}
+	if err != nil {
+		o := strings.TrimSpace(out.String())
+		if len(o) > maxHookOutput {
+			o = o[len(o)-maxHookOutput:]
+		}
+		if o != "" {
+			return fmt.Errorf("%v: %s", err, o)
+		}
+		return err
+	}
+	return nil
+}
+
+// runHook runs the hook of the subscription for the stored message of
+// the receipt r until it succeeds or runs out of attempts, in which case
+// the file is moved to the quarantine directory, the message is recorded
+// as quarantined and an error is returned.
+func (a *Agent) runHook(h *Hook, r *persist.Receipt) error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "agent",
+		"fn":   "runHook",
+		"id":   r.ID,
+		"file": r.File,
+	})
+	backoff := h.retryBackoff()
+	var err error
+	for attempt := 1; attempt <= h.maxAttempts(); attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = h.run(r); err == nil {
+			l.Debugf("hook succeeded in attempt %d", attempt)
+			return nil
+		}
+		l.Errorf("hook failed in attempt %d: %v", attempt, err)
+	}
+	dst, qerr := a.Store.QuarantineAgentMessage(r.File, &persist.QuarantineInfo{
+		ID:        r.ID,
+		Channel:   r.Channel,
+		Attempts:  h.maxAttempts(),
+		LastError: err.Error(),
+	})
+	if qerr != nil {
+		l.Errorf("error quarantining message: %v", qerr)
+		return qerr
+	}
+	l.Errorf("quarantined message as %s", dst)
+	q := *r
+	q.File = dst
+	if _, qerr := a.recordReceipt(&q, persist.ReceiptQuarantined); qerr != nil {
+		return qerr
+	}
+	return fmt.Errorf("hook failed, quarantined as %s: %v", dst, err)
+}
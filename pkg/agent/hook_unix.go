@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in a process group of its own, so
+// that the processes it starts are killed with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the started command and every process of its
+// process group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
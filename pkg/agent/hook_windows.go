@@ -0,0 +1,20 @@
+package agent
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// setProcessGroup does nothing, killProcessGroup finds the processes
+// started by the command by their parent.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the started command and the processes it
+// started.
+func killProcessGroup(cmd *exec.Cmd) error {
+	err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	if err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
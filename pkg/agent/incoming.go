@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/pkg/api"
+	"github.com/robertlestak/centauri/pkg/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchWait is the time a listing of cent watch waits on the server for
+// new messages.
+const watchWait = time.Second * 30
+
+// watchedMessage is a line of the json output of cent watch. Data is
+// only set if the message is written to stdout, File otherwise.
+type watchedMessage struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	Type      string    `json:"type"`
+	FileName  string    `json:"fileName,omitempty"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	Confirmed bool      `json:"confirmed"`
+	File      string    `json:"file,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+}
+
+// watch runs watchMessages until the process is interrupted or terminated.
+func (a *Agent) watch(channel string, format string, out string, confirm bool) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return a.watchMessages(ctx, channel, format, out, confirm)
+}
+
+// watchMessages writes every new message of channel to out, stdout if it
+// is "-" or empty or else a directory, as it arrives, confirming it if
+// confirm is set. Messages which are not confirmed are written once. It
+// returns nil when ctx is done, a message being written is finished first.
+func (a *Agent) watchMessages(ctx context.Context, channel string, format string, out string, confirm bool) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "watchMessages",
+		"ch":  channel,
+	})
+	l.Debug("watching messages")
+	switch format {
+	case "", "text", "json":
+	default:
+		l.Errorf("unknown format: %v", format)
+		return errors.New("unknown format")
+	}
+	toStdout := out == "-" || out == ""
+	if !toStdout {
+		if st, err := os.Stat(out); err != nil || !st.IsDir() {
+			return fmt.Errorf("watch output %s is not a directory", out)
+		}
+	}
+	// written are the messages written and not confirmed, known the IDs
+	// of the listing the server waits to change
+	written := map[string]bool{}
+	var known []string
+	for {
+		start := time.Now()
+		msgs, err := a.client().ListWait(ctx, channel, known, watchWait)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if !client.Temporary(err) {
+				l.Errorf("error listing messages: %v", err)
+				return err
+			}
+			l.Errorf("error listing messages, retrying: %v", err)
+			if !sleepCtx(ctx, time.Second*10) {
+				return nil
+			}
+			continue
+		}
+		sort.Slice(msgs, func(i, j int) bool {
+			return msgs[i].CreatedAt.Before(msgs[j].CreatedAt)
+		})
+		ids := make([]string, 0, len(msgs))
+		for _, md := range msgs {
+			ids = append(ids, md.ID)
+		}
+		unchanged := api.ListingDigest(ids) == api.ListingDigest(known)
+		next := map[string]bool{}
+		known = known[:0]
+		for _, md := range msgs {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !written[md.ID] {
+				if err := a.watchedMessage(md, format, out, confirm); err != nil {
+					l.Errorf("error writing message %s: %v", md.ID, err)
+					known = append(known, md.ID)
+					continue
+				}
+				if confirm {
+					continue
+				}
+			}
+			next[md.ID] = true
+			known = append(known, md.ID)
+		}
+		written = next
+		// a server which does not wait answers at once
+		if unchanged && time.Since(start) < time.Second {
+			if !sleepCtx(ctx, time.Second*10) {
+				return nil
+			}
+		}
+	}
+}
+
+// watchedMessage gets the message md and writes it to out in format.
+func (a *Agent) watchedMessage(md MessageMeta, format string, out string, confirm bool) error {
+	m, fn, err := a.getMessageData("", md.Channel, md.ID)
+	if err != nil {
+		return err
+	}
+	wm := watchedMessage{
+		ID:        md.ID,
+		Channel:   md.Channel,
+		Type:      m.Type,
+		Size:      int64(len(m.Data)),
+		CreatedAt: md.CreatedAt,
+	}
+	if m.Type == "file" {
+		wm.FileName = fn
+	}
+	if out == "-" || out == "" {
+		if format == "json" {
+			wm.Data = m.Data
+		} else if _, err := os.Stdout.Write(m.Data); err != nil {
+			return err
+		}
+	} else {
+		// the file name is chosen by the sender
+		if wm.File, err = persist.WriteFileUnique(out, filepath.Base(fn), m.Data, 0644); err != nil {
+			return err
+		}
+	}
+	if confirm {
+		if err := a.ConfirmMessageReceive(md.Channel, md.ID); err != nil {
+			return err
+		}
+		wm.Confirmed = true
+	}
+	if format != "json" {
+		fmt.Fprintf(os.Stderr, "id: %v\n", md.ID)
+		return nil
+	}
+	jd, err := json.Marshal(wm)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(jd, '\n'))
+	return err
+}
+
+// sleepCtx waits for d and reports whether ctx is still running.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,506 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/pkg/keys"
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+// KeyInfo describes a public key of the key chain.
+type KeyInfo struct {
+	ID   string `json:"id"`
+	File string `json:"file"`
+	Bits int    `json:"bits"`
+	// Names are the contacts of the key in the address book.
+	Names []string `json:"names,omitempty"`
+}
+
+func KeysHelp() string {
+	return `
+Usage:
+  cent keys [command] [args]
+
+Commands:
+  generate
+	create a new private key, -out sets its path (default <data>/key.pem)
+	and -encrypt encrypts it with a passphrase
+  encrypt [file]
+	encrypt a private key with a passphrase (default <data>/key.pem)
+  decrypt [file]
+	remove the passphrase of a private key (default <data>/key.pem)
+  rotate
+	replace the private key with a new key and publish a rotation
+	statement signed by the old key; senders switch to the new key and
+	the old key is kept as key-<id>.pem, for the agent's -previous-keys,
+	until it is retired after -overlap
+  import [file|-]
+	install a public key into the public key chain
+  revoke [file]
+	revoke the private key, or publish the revocation in file, so that
+	the cluster refuses requests signed by the key and messages to it;
+	-reason is kept with it
+  revoke-cert
+	print the revocation of the private key without publishing it, to
+	keep it offline for when the private key is lost or stolen
+  publish [name]
+	publish the public key to the key directory of the cluster under a
+	display name, signed by the private key; -expires sets its expiry
+	(default a year)
+  fetch [name|id]
+	install a key of the key directory after verifying its signature,
+	and add it to the contacts under its display name
+  export [id]
+	print the public key of the private key, or of a key of the chain
+  list
+	list the keys of the public key chain
+  remove [id]
+	remove a key from the public key chain
+  fingerprint [file|id]
+	print the key ID of a public key, or of the private key
+
+Keys of the chain can be given by a unique prefix of their ID.
+
+The passphrase of encrypted private keys is read from the
+CENTAURI_KEY_PASSPHRASE environment variable, from the file descriptor
+given by -passphrase-fd, or is prompted for on the terminal.
+`
+}
+
+// dataDir returns the data directory of the agent, or of cent.
+func (a *Agent) dataDir() string {
+	if a.Store != nil {
+		return a.Store.RootDataDir
+	}
+	return a.DataDir
+}
+
+// PublicKeysDir returns the directory of the public key chain.
+func (a *Agent) PublicKeysDir() string {
+	return filepath.Join(a.dataDir(), "pubkeys")
+}
+
+// DefaultPrivateKeyPath returns the path keys generate writes to if no
+// other path is given.
+func (a *Agent) DefaultPrivateKeyPath() string {
+	return filepath.Join(a.DataDir, "key.pem")
+}
+
+// Keys runs the keys command cmd with the arguments args and the options o.
+func (a *Agent) Keys(cmd string, args []string, o *ClientOptions) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "Keys",
+		"cmd": cmd,
+	})
+	l.Debug("keys")
+	arg := func() string {
+		if len(args) > 0 {
+			return args[0]
+		}
+		return ""
+	}
+	switch cmd {
+	case "generate":
+		return a.generateKey(o.KeyBits, o.KeyEncrypt, o.Output)
+	case "encrypt":
+		return a.encryptKey(arg(), true)
+	case "decrypt":
+		return a.encryptKey(arg(), false)
+	case "rotate":
+		return a.rotateKey(o)
+	case "revoke":
+		return a.revokeKey(arg(), o.RevokeReason)
+	case "revoke-cert":
+		return a.revocationCert(o.RevokeReason, o.Output)
+	case "publish":
+		return a.publishKey(arg(), o.KeyExpires)
+	case "fetch":
+		return a.fetchKey(arg())
+	case "import":
+		return a.importKey(arg())
+	case "export":
+		return a.exportKey(arg(), o.Output)
+	case "list":
+		return a.listKeys(o.OutputFormat, o.Output)
+	case "remove":
+		return a.removeKey(arg())
+	case "fingerprint":
+		return a.fingerprint(arg())
+	default:
+		return fmt.Errorf("unknown keys command: %q", cmd)
+	}
+}
+
+// loadPublicKeys loads the public key chain from its directory.
+func (a *Agent) loadPublicKeys() error {
+	d := a.PublicKeysDir()
+	if _, err := os.Stat(d); os.IsNotExist(err) {
+		return nil
+	}
+	return a.PublicKeys.LoadFromDirectory(d)
+}
+
+// ownPublicKey returns the public key of the loaded private key.
+func (a *Agent) ownPublicKey() ([]byte, error) {
+	if a.PrivateKey == nil {
+		return nil, errors.New("no private key, set -key")
+	}
+	return keys.MarshalPublicKey(&a.PrivateKey.PublicKey)
+}
+
+func (a *Agent) generateKey(bits int, encrypt bool, out string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "generateKey",
+	})
+	if out == "" || out == "-" {
+		out = a.DefaultPrivateKeyPath()
+	}
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("%s exists, not overwriting it", out)
+	}
+	l.Debugf("generating %d bit key", bits)
+	k, err := keys.GenerateKey(bits)
+	if err != nil {
+		l.Errorf("error generating key: %v", err)
+		return err
+	}
+	pub, err := keys.MarshalPublicKey(&k.PublicKey)
+	if err != nil {
+		l.Errorf("error encoding public key: %v", err)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0700); err != nil {
+		l.Errorf("error creating directory: %v", err)
+		return err
+	}
+	priv := keys.MarshalPrivateKey(k)
+	if encrypt {
+		p, err := a.passphrase(true)
+		if err != nil {
+			return err
+		}
+		if priv, err = keys.EncryptPrivateKey(k, p); err != nil {
+			l.Errorf("error encrypting private key: %v", err)
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(out, priv, 0600); err != nil {
+		l.Errorf("error writing private key: %v", err)
+		return err
+	}
+	if err := ioutil.WriteFile(out+".pub", pub, 0644); err != nil {
+		l.Errorf("error writing public key: %v", err)
+		return err
+	}
+	id := keys.PubKeyID(pub)
+	fmt.Fprintf(os.Stderr, "private key: %s\npublic key:  %s.pub\n", out, out)
+	fmt.Printf("%s\n", id)
+	return nil
+}
+
+// encryptKey encrypts the private key file in place with a passphrase if
+// encrypt is set, and decrypts it otherwise.
+func (a *Agent) encryptKey(file string, encrypt bool) error {
+	l := log.WithFields(log.Fields{
+		"pkg":     "agent",
+		"fn":      "encryptKey",
+		"encrypt": encrypt,
+	})
+	if file == "" {
+		file = a.DefaultPrivateKeyPath()
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		l.Errorf("error reading private key: %v", err)
+		return err
+	}
+	if keys.IsEncryptedPrivateKey(data) == encrypt {
+		if encrypt {
+			return fmt.Errorf("%s is already encrypted", file)
+		}
+		return fmt.Errorf("%s is not encrypted", file)
+	}
+	var out []byte
+	if encrypt {
+		k, err := keys.BytesToPrivKey(data)
+		if err != nil {
+			return err
+		}
+		p, err := a.passphrase(true)
+		if err != nil {
+			return err
+		}
+		if out, err = keys.EncryptPrivateKey(k, p); err != nil {
+			l.Errorf("error encrypting private key: %v", err)
+			return err
+		}
+	} else {
+		p, err := a.passphrase(false)
+		if err != nil {
+			return err
+		}
+		k, err := keys.DecryptPrivateKey(data, p)
+		if err != nil {
+			return err
+		}
+		out = keys.MarshalPrivateKey(k)
+	}
+	if err := persist.WriteFileAtomic(file, out, 0600); err != nil {
+		l.Errorf("error writing private key: %v", err)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", file)
+	return nil
+}
+
+func (a *Agent) importKey(file string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "importKey",
+	})
+	var pub []byte
+	var err error
+	switch file {
+	case "":
+		return errors.New("no public key file given")
+	case "-":
+		pub, err = ioutil.ReadAll(os.Stdin)
+	default:
+		pub, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		l.Errorf("error reading public key: %v", err)
+		return err
+	}
+	id, err := keys.InstallPublicKey(a.PublicKeysDir(), pub)
+	if err != nil {
+		l.Errorf("error installing public key: %v", err)
+		return err
+	}
+	fmt.Printf("%s\n", id)
+	return nil
+}
+
+func (a *Agent) exportKey(ref string, out string) error {
+	var pub []byte
+	if ref == "" {
+		var err error
+		if pub, err = a.ownPublicKey(); err != nil {
+			return err
+		}
+	} else {
+		if err := a.loadPublicKeys(); err != nil {
+			return err
+		}
+		id, err := a.PublicKeys.Resolve(ref)
+		if err != nil {
+			return err
+		}
+		pub, _ = a.PublicKeys.Get(id)
+	}
+	return sendOutput(pub, out)
+}
+
+func (a *Agent) listKeys(format string, out string) error {
+	if err := a.loadPublicKeys(); err != nil {
+		return err
+	}
+	if err := a.loadContacts(); err != nil {
+		return err
+	}
+	var ks []KeyInfo
+	for _, id := range a.PublicKeys.IDs() {
+		ki := KeyInfo{
+			ID:    id,
+			File:  filepath.Join(a.PublicKeysDir(), id),
+			Names: a.contacts().NameOf(a.realKeyID(id)),
+		}
+		pub, _ := a.PublicKeys.Get(id)
+		if k, err := keys.BytesToPubKey(pub); err == nil {
+			ki.Bits = k.N.BitLen()
+		}
+		ks = append(ks, ki)
+	}
+	var data []byte
+	switch format {
+	case "json":
+		jd, err := json.Marshal(ks)
+		if err != nil {
+			return err
+		}
+		data = append(jd, '\n')
+	default:
+		var buf bytes.Buffer
+		w := tabwriter.NewWriter(&buf, 1, 1, 1, ' ', 0)
+		fmt.Fprintln(w, "ID\tBITS\tNAMES\tFINGERPRINT")
+		for _, k := range ks {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", keys.ShortID(k.ID), k.Bits, strings.Join(k.Names, ","), keys.FormatID(k.ID))
+		}
+		w.Flush()
+		data = buf.Bytes()
+	}
+	return sendOutput(data, out)
+}
+
+func (a *Agent) removeKey(ref string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "removeKey",
+	})
+	if err := a.loadPublicKeys(); err != nil {
+		return err
+	}
+	id, err := a.PublicKeys.Resolve(ref)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(a.PublicKeysDir(), id)); err != nil {
+		l.Errorf("error removing key: %v", err)
+		return err
+	}
+	fmt.Printf("%s\n", id)
+	return nil
+}
+
+func (a *Agent) fingerprint(ref string) error {
+	var id string
+	switch {
+	case ref == "":
+		pub, err := a.ownPublicKey()
+		if err != nil {
+			return err
+		}
+		id = keys.PubKeyID(pub)
+	case fileExists(ref):
+		pub, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return err
+		}
+		if _, err := keys.BytesToPubKey(pub); err != nil {
+			return fmt.Errorf("%s is not a public key: %v", ref, err)
+		}
+		id = keys.PubKeyID(pub)
+	default:
+		if err := a.loadPublicKeys(); err != nil {
+			return err
+		}
+		var err error
+		if id, err = a.PublicKeys.Resolve(ref); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s\n%s\n", id, keys.FormatID(id))
+	return nil
+}
+
+func fileExists(f string) bool {
+	fi, err := os.Stat(f)
+	return err == nil && !fi.IsDir()
+}
+
+// rotateKey replaces the private key in o.KeyFile with a new key. The
+// old key signs the rotation statement, which is published before the new
+// key replaces it, and is kept next to it for the agent to receive the
+// messages still sent to it.
+func (a *Agent) rotateKey(o *ClientOptions) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "rotateKey",
+	})
+	if a.PrivateKey == nil {
+		return errors.New("no private key, set -key")
+	}
+	file := o.KeyFile
+	if file == "" {
+		file = a.DefaultPrivateKeyPath()
+	}
+	old, err := ioutil.ReadFile(file)
+	if err != nil {
+		l.Errorf("error reading private key: %v", err)
+		return err
+	}
+	oldPub, err := a.ownPublicKey()
+	if err != nil {
+		return err
+	}
+	oldID := keys.PubKeyID(oldPub)
+	prev := filepath.Join(filepath.Dir(file), "key-"+keys.ShortID(oldID)+".pem")
+	if _, err := os.Stat(prev); err == nil {
+		return fmt.Errorf("%s exists, not overwriting it", prev)
+	}
+	l.Debugf("generating %d bit key", o.KeyBits)
+	k, err := keys.GenerateKey(o.KeyBits)
+	if err != nil {
+		l.Errorf("error generating key: %v", err)
+		return err
+	}
+	pub, err := keys.MarshalPublicKey(&k.PublicKey)
+	if err != nil {
+		l.Errorf("error encoding public key: %v", err)
+		return err
+	}
+	priv := keys.MarshalPrivateKey(k)
+	// the new key is encrypted like the old one, with the same passphrase
+	if o.KeyEncrypt || keys.IsEncryptedPrivateKey(old) {
+		p, err := a.passphrase(true)
+		if err != nil {
+			return err
+		}
+		if priv, err = keys.EncryptPrivateKey(k, p); err != nil {
+			l.Errorf("error encrypting private key: %v", err)
+			return err
+		}
+	}
+	r, err := sign.NewRotation(a.PrivateKey, pub, o.KeyOverlap)
+	if err != nil {
+		l.Errorf("error creating rotation: %v", err)
+		return err
+	}
+	// both keys are on disk before the rotation is published, so that
+	// neither can be lost
+	if err := persist.WriteFileAtomic(prev, old, 0600); err != nil {
+		l.Errorf("error writing previous key: %v", err)
+		return err
+	}
+	if err := ioutil.WriteFile(prev+".pub", oldPub, 0644); err != nil {
+		l.Errorf("error writing previous public key: %v", err)
+		return err
+	}
+	next := file + ".next"
+	if err := persist.WriteFileAtomic(next, priv, 0600); err != nil {
+		l.Errorf("error writing private key: %v", err)
+		return err
+	}
+	if err := a.client().PublishRotation(context.Background(), r); err != nil {
+		l.Errorf("error publishing rotation: %v", err)
+		os.Remove(next)
+		os.Remove(prev)
+		os.Remove(prev + ".pub")
+		return err
+	}
+	if err := os.Rename(next, file); err != nil {
+		l.Errorf("error replacing private key: %v", err)
+		return fmt.Errorf("the rotation is published, but the new key could not be moved from %s to %s: %v", next, file, err)
+	}
+	if err := ioutil.WriteFile(file+".pub", pub, 0644); err != nil {
+		l.Errorf("error writing public key: %v", err)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "private key:  %s\npublic key:   %s.pub\nprevious key: %s, retired at %s\n", file, file, prev, r.RetireAt.Local().Format(time.RFC3339))
+	fmt.Printf("%s\n", keys.PubKeyID(pub))
+	return nil
+}
@@ -1,27 +1,67 @@
 package agent
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/robertlestak/centauri/internal/persist"
-	"github.com/robertlestak/centauri/pkg/message"
+	"github.com/robertlestak/centauri/pkg/api"
+	"github.com/robertlestak/centauri/pkg/client"
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	// PendingOutgoingMessages is a map of pending outgoing messages with the time the file last changed on system
-	// this is a poor-man's way of ensuring a larger file is not picked up mid-copy.
-	PendingOutgoingMessages []string
-	PendingOutgoingFiles    []string
-)
+// ensureOutgoingDirs creates the outgoing directories of newly loaded
+// public keys and of their contacts, and removes those of keys which are
+// no longer present.
+func (a *Agent) ensureOutgoingDirs(keyIDs []string, removed []string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "ensureOutgoingDirs",
+	})
+	l.Debug("Ensuring directories")
+	for _, k := range keyIDs {
+		if _, err := a.Store.EnsurePubKeyChainOutgoingDir(k); err != nil {
+			l.Error("Error ensuring outgoing directory")
+			return err
+		}
+	}
+	for _, keyID := range removed {
+		if _, err := a.Store.RemovePubKeyChainOutgoingDir(keyID); err != nil {
+			l.Error("Error ensuring outgoing directory")
+			return err
+		}
+	}
+	// the address book is reloaded along with the keys
+	if err := a.loadContacts(); err != nil {
+		l.Errorf("Error loading contacts: %v", err)
+		return err
+	}
+	if err := a.ensureContactDirs(keyIDs); err != nil {
+		l.Errorf("Error ensuring contact directory: %v", err)
+		return err
+	}
+	return nil
+}
 
-func GetOutgoingMessages() ([]string, error) {
+// createMessage encrypts the data for the public key with the given ID
+// from the agent's public key chain, or for the key it was rotated to.
+// Revoked keys are refused.
+func (a *Agent) createMessage(mType string, fileName string, channel string, pubKeyID string, data io.ReadCloser) (*api.Message, error) {
+	pubKeyID = a.currentKey(pubKeyID)
+	if err := a.checkRevoked(pubKeyID); err != nil {
+		return nil, err
+	}
+	pubKey, ok := a.PublicKeys.Get(pubKeyID)
+	if !ok {
+		return nil, errors.New("public key not found")
+	}
+	return api.CreateMessage(mType, fileName, channel, pubKeyID, pubKey, data)
+}
+func (a *Agent) GetOutgoingMessages() ([]string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "GetOutgoingMessages",
@@ -29,15 +69,21 @@ func GetOutgoingMessages() ([]string, error) {
 	l.Debug("getting outgoing messages")
 	// get all files in dataDir + outgoing/messages
 	// return the file paths as a slice
-	files, err := filepath.Glob(filepath.Join(persist.RootDataDir, "outgoing", "messages", "*/*"))
+	files, err := filepath.Glob(filepath.Join(a.Store.RootDataDir, "outgoing", "messages", "*/*"))
+	if err != nil {
+		l.Errorf("error getting outgoing messages: %v", err)
+		return nil, err
+	}
+	// files in the channel directories of the public keys
+	cfiles, err := filepath.Glob(filepath.Join(a.Store.RootDataDir, "outgoing", "messages", "*/*/*"))
 	if err != nil {
 		l.Errorf("error getting outgoing messages: %v", err)
 		return nil, err
 	}
-	return files, nil
+	return append(files, cfiles...), nil
 }
 
-func GetOutgoingFiles() ([]string, error) {
+func (a *Agent) GetOutgoingFiles() ([]string, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "GetOutgoingFies",
@@ -45,21 +91,29 @@ func GetOutgoingFiles() ([]string, error) {
 	l.Debug("getting outgoing files")
 	// get all files in dataDir + outgoing/files
 	// return the file paths as a slice
-	files, err := filepath.Glob(filepath.Join(persist.RootDataDir, "outgoing", "files", "*/*"))
+	files, err := filepath.Glob(filepath.Join(a.Store.RootDataDir, "outgoing", "files", "*/*"))
 	if err != nil {
 		l.Errorf("error getting outgoing files: %v", err)
 		return nil, err
 	}
-	return files, nil
+	// files in the channel directories of the public keys
+	cfiles, err := filepath.Glob(filepath.Join(a.Store.RootDataDir, "outgoing", "files", "*/*/*"))
+	if err != nil {
+		l.Errorf("error getting outgoing files: %v", err)
+		return nil, err
+	}
+	return append(files, cfiles...), nil
 }
 
-func StartWatcher() error {
+// StartWatcher moves the files in the outgoing directories which have not
+// changed for the settle time of their type into the outgoing queue.
+func (a *Agent) StartWatcher() error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "StartWatcher",
 	})
 	l.Debug("starting watcher")
-	outMsg, err := GetOutgoingMessages()
+	outMsg, err := a.GetOutgoingMessages()
 	if err != nil {
 		l.Errorf("error getting outgoing messages: %v", err)
 		return err
@@ -67,7 +121,7 @@ func StartWatcher() error {
 	if len(outMsg) == 0 {
 		l.Debug("no outgoing messages")
 	}
-	outFile, err := GetOutgoingFiles()
+	outFile, err := a.GetOutgoingFiles()
 	if err != nil {
 		l.Errorf("error getting outgoing files: %v", err)
 		return err
@@ -75,248 +129,187 @@ func StartWatcher() error {
 	if len(outFile) == 0 {
 		l.Debug("no outgoing files")
 	}
-	if err := handleOutgoingMessages(outMsg); err != nil {
+	if err := a.enqueueSettled(outMsg, "bytes", time.Second*10); err != nil {
 		l.Errorf("error handling outgoing messages: %v", err)
 		return err
 	}
-	if err := handleOutgoingFiles(outFile); err != nil {
+	if err := a.enqueueSettled(outFile, "file", time.Second*60); err != nil {
 		l.Errorf("error handling outgoing files: %v", err)
 		return err
 	}
 	return nil
 }
 
-func handleOutgoingFile(fp string, channel, pubKeyID, id string) error {
-	l := log.WithFields(log.Fields{
-		"pkg": "agent",
-		"fn":  "handleOutgoingFile",
-		"fp":  fp,
-		"key": pubKeyID,
-		"id":  id,
-	})
-	l.Debug("handling outgoing file")
-	f, err := os.Open(fp)
-	if err != nil {
-		l.Errorf("error opening file: %v", err)
-		return err
-	}
-	m, err := message.CreateMessage("file", id, channel, pubKeyID, f)
-	if err != nil {
-		l.Errorf("error creating message: %v", err)
-		return err
-	}
-	if err := SendMessageThroughPeer(m); err != nil {
-		l.Errorf("error sending message: %v", err)
-		return err
-	}
-	// delete file
-	if err := os.Remove(fp); err != nil {
-		l.Errorf("error removing file: %v", err)
-		return err
-	}
-	return nil
-}
-
-func handleOutgoingFiles(files []string) error {
+// enqueueSettled queues the files which have not been modified for settle.
+// This is a poor-man's way of ensuring a larger file is not picked up
+// mid-copy when the outgoing directories cannot be watched.
+func (a *Agent) enqueueSettled(files []string, mType string, settle time.Duration) error {
 	l := log.WithFields(log.Fields{
-		"pkg": "agent",
-		"fn":  "handleOutgoingFiles",
+		"pkg":  "agent",
+		"fn":   "enqueueSettled",
+		"type": mType,
 	})
-	l.Debug("handling outgoing files")
-
-	for _, file := range files {
-		for _, fp := range PendingOutgoingFiles {
-			if fp == file {
-				return nil
-			}
+	for _, fp := range files {
+		fi, err := os.Stat(fp)
+		if err != nil {
+			l.Errorf("error getting file info: %v", err)
+			continue
+		}
+		if fi.IsDir() || time.Since(fi.ModTime()) < settle {
+			continue
+		}
+		if err := a.enqueueOutgoing(fp, mType); err != nil {
+			return err
 		}
-		PendingOutgoingFiles = append(PendingOutgoingFiles, file)
 	}
 	return nil
 }
 
-func removeFromSlice(s []string, s2 string) []string {
-	for i, v := range s {
-		if v == s2 {
-			return append(s[:i], s[i+1:]...)
-		}
+// queueBackoff returns the wait before the next attempt of an item which
+// has failed attempts times.
+func (a *Agent) queueBackoff(attempts int) time.Duration {
+	d := a.QueueMinBackoff
+	for i := 1; i < attempts && d < a.QueueMaxBackoff; i++ {
+		d *= 2
 	}
-	return s
+	if d > a.QueueMaxBackoff {
+		d = a.QueueMaxBackoff
+	}
+	return d
 }
 
-func outgoingFileWorker() {
+// processQueue sends the queued items which are due.
+func (a *Agent) processQueue() error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
-		"fn":  "outgoingFileWorker",
+		"fn":  "processQueue",
 	})
-	l.Debug("starting outgoing file worker")
-	for {
-		if len(PendingOutgoingFiles) == 0 {
-			l.Debug("no pending outgoing files")
-			time.Sleep(time.Second * 10)
+	items, err := a.Store.ListQueue()
+	if err != nil {
+		l.Errorf("error listing queue: %v", err)
+		return err
+	}
+	for _, it := range items {
+		if time.Now().Before(it.NextAttempt) {
 			continue
 		}
-		l.Debugf("pending outgoing files: %v", PendingOutgoingFiles)
-		for _, fp := range PendingOutgoingFiles {
-			// check time file modified
-			fi, err := os.Stat(fp)
-			if err != nil {
-				l.Errorf("error getting file info: %v", err)
-				continue
-			}
-			if time.Since(fi.ModTime()) > time.Second*60 {
-				l.Debugf("file %s has not changed, uploading", fp)
-				dir, fn := filepath.Split(fp)
-				key := filepath.Base(dir)
-				l.Debugf("handling file %s for key %s", fn, key)
-				if err := handleOutgoingFile(fp, DefaultChannel, key, fn); err != nil {
-					l.Errorf("error handling outgoing file: %v", err)
-					continue
-				}
-				// remove from pending array
-				PendingOutgoingFiles = removeFromSlice(PendingOutgoingFiles, fp)
-			}
-		}
-		time.Sleep(time.Second * 10)
+		a.sendQueued(it)
 	}
+	return nil
 }
 
-func outgoingMessageWorker() {
+// sendQueued makes one attempt to send the item. A sent item is recorded
+// in the sent journal; an item which failed with a permanent error or too
+// many times is moved to the failed directory, any other item is retried
+// after a backoff.
+func (a *Agent) sendQueued(it *persist.QueueItem) {
 	l := log.WithFields(log.Fields{
-		"pkg": "agent",
-		"fn":  "outgoingMessageWorker",
+		"pkg":  "agent",
+		"fn":   "sendQueued",
+		"id":   it.ID,
+		"key":  it.PubKeyID,
+		"name": it.Name,
 	})
-	l.Debug("starting outgoing message worker")
-	for {
-		if len(PendingOutgoingMessages) == 0 {
-			l.Debug("no pending outgoing messages")
-			time.Sleep(time.Second * 1)
-			continue
+	l.Debug("sending queued message")
+	md, err := a.sendQueuedData(it)
+	if err == nil {
+		it.MessageID = md.ID
+		now := time.Now()
+		it.SentAt = &now
+		it.LastError = ""
+		if err := a.Store.CompleteQueueItem(it); err != nil {
+			l.Errorf("error completing queue item: %v", err)
 		}
-		l.Debugf("pending outgoing messages: %v", PendingOutgoingMessages)
-		for _, fp := range PendingOutgoingMessages {
-			// check time file modified
-			fi, err := os.Stat(fp)
-			if err != nil {
-				l.Errorf("error getting file info: %v", err)
-				continue
-			}
-			if time.Since(fi.ModTime()) > time.Second*10 {
-				l.Debugf("file %s has not changed, uploading", fp)
-				dir, fn := filepath.Split(fp)
-				key := filepath.Base(dir)
-				l.Debugf("handling file %s for key %s", fn, key)
-				if err := handleOutgoingMessage(fp, key, fn); err != nil {
-					l.Errorf("error handling outgoing file: %v", err)
-					continue
-				}
-				// remove from pending array
-				PendingOutgoingMessages = removeFromSlice(PendingOutgoingMessages, fp)
-			}
+		return
+	}
+	it.Attempts++
+	it.LastError = err.Error()
+	if !client.Temporary(err) || errors.Is(err, ErrRecipientRevoked) || it.Attempts >= a.QueueMaxAttempts {
+		dst, ferr := a.Store.FailQueueItem(it)
+		if ferr != nil {
+			l.Errorf("error moving failed message: %v", ferr)
+			return
 		}
-		time.Sleep(time.Second * 1)
+		l.Errorf("giving up on message after %d attempts, moved to %s: %v", it.Attempts, dst, err)
+		return
+	}
+	it.NextAttempt = time.Now().Add(a.queueBackoff(it.Attempts))
+	l.Errorf("error sending message, attempt %d, retrying at %s: %v", it.Attempts, it.NextAttempt.Format(time.RFC3339), err)
+	if err := a.Store.UpdateQueueItem(it); err != nil {
+		l.Errorf("error updating queue item: %v", err)
 	}
 }
 
-func handleOutgoingMessage(fp, pubKeyID, id string) error {
-	l := log.WithFields(log.Fields{
-		"pkg": "agent",
-		"fn":  "handleOutgoingMessage",
-		"fp":  fp,
-		"key": pubKeyID,
-		"id":  id,
-	})
-	l.Debug("handling outgoing message")
-	f, err := os.Open(fp)
-	if err != nil {
-		l.Errorf("error opening file: %v", err)
-		return err
-	}
-	m, err := message.CreateMessage("bytes", "", DefaultChannel, pubKeyID, f)
+func (a *Agent) sendQueuedData(it *persist.QueueItem) (*client.MessageMeta, error) {
+	f, err := os.Open(a.Store.QueueItemData(it.ID))
 	if err != nil {
-		l.Errorf("error creating message: %v", err)
-		return err
+		return nil, err
 	}
-	if err := SendMessageThroughPeer(m); err != nil {
-		l.Errorf("error sending message: %v", err)
-		return err
+	fileName := ""
+	if it.Type == "file" {
+		fileName = it.Name
 	}
-	// delete file
-	if err := os.Remove(fp); err != nil {
-		l.Errorf("error removing file: %v", err)
-		return err
+	m, err := a.createMessage(it.Type, fileName, it.Channel, it.PubKeyID, f)
+	f.Close()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return a.client().SendMessage(context.Background(), m)
 }
 
-func handleOutgoingMessages(msgs []string) error {
+// queueWorker sends the queued messages until the process exits.
+func (a *Agent) queueWorker() {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
-		"fn":  "handleOutgoingMessages",
+		"fn":  "queueWorker",
 	})
-	l.Debug("handling outgoing messages")
-	for _, m := range msgs {
-		for _, mp := range PendingOutgoingMessages {
-			if mp == m {
-				return nil
-			}
+	l.Debug("starting queue worker")
+	for {
+		if err := a.processQueue(); err != nil {
+			l.Errorf("error processing queue: %v", err)
+		}
+		select {
+		case <-a.queueWake:
+		case <-time.After(time.Second * 1):
 		}
-		PendingOutgoingMessages = append(PendingOutgoingMessages, m)
 	}
-	return nil
 }
 
-func EnsureWatcher() error {
+// EnsureWatcher sends the files dropped into the outgoing directories
+// until the process exits. The directories are watched where the system
+// supports it and scanned every second otherwise.
+func (a *Agent) EnsureWatcher() error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "EnsureWatcher",
 	})
 	l.Debug("ensuring outgoing watcher")
-	go outgoingFileWorker()
-	go outgoingMessageWorker()
-	for {
-		err := StartWatcher()
-		if err != nil {
-			l.Errorf("failed to start watcher: %v", err)
-		}
-		time.Sleep(time.Second * 10)
+	go a.queueWorker()
+	err := a.watchOutgoing()
+	if errors.Is(err, errWatchUnsupported) {
+		l.Debug("watching is not supported, polling outgoing directories")
+	} else {
+		l.Errorf("failed to watch outgoing directories, polling instead: %v", err)
 	}
+	a.pollOutgoing()
+	return nil
 }
 
-func SendMessageThroughPeer(msg *message.Message) error {
+func (a *Agent) SendMessageThroughPeer(msg *api.Message) error {
 	l := log.WithFields(log.Fields{
 		"pkg":           "agent",
 		"fn":            "SendMessageThroughPeer",
 		"m.PublicKeyID": msg.PublicKeyID,
 	})
 	l.Debug("sending message through peer")
-	saddr := GetAgentServer()
-	c := &http.Client{}
-	jd, err := json.Marshal(msg)
-	if err != nil {
-		l.Errorf("error marshalling message: %v", err)
-		return err
-	}
-	addr := saddr + "/message"
-	req, err := http.NewRequest("POST", addr, bytes.NewReader(jd))
-	if err != nil {
-		l.Errorf("error creating request: %v", err)
-		return err
-	}
-	resp, err := c.Do(req)
-	if err != nil {
-		l.Errorf("error sending request: %v", err)
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusAccepted {
-		l.Errorf("error confirming message receive: %v", resp.StatusCode)
+	if _, err := a.client().SendMessage(context.Background(), msg); err != nil {
+		l.Errorf("error sending message: %v", err)
 		return err
 	}
 	return nil
 }
 
-func sendMessage(channel, pubKeyID, mType, fn string, data io.ReadCloser) error {
+func (a *Agent) sendMessage(channel, pubKeyID, mType, fn string, data io.ReadCloser) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "agent",
 		"fn":  "sendMessage",
@@ -324,12 +317,12 @@ func sendMessage(channel, pubKeyID, mType, fn string, data io.ReadCloser) error
 		"id":  fn,
 	})
 	l.Debug("sending message")
-	m, err := message.CreateMessage(mType, fn, channel, pubKeyID, data)
+	m, err := a.createMessage(mType, fn, channel, pubKeyID, data)
 	if err != nil {
 		l.Errorf("error creating message: %v", err)
 		return err
 	}
-	if err := SendMessageThroughPeer(m); err != nil {
+	if err := a.SendMessageThroughPeer(m); err != nil {
 		l.Errorf("error sending message: %v", err)
 		return err
 	}
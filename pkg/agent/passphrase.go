@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/robertlestak/centauri/pkg/keys"
+)
+
+// PassphraseEnv is the environment variable the passphrase of an
+// encrypted private key is read from.
+const PassphraseEnv = "CENTAURI_KEY_PASSPHRASE"
+
+// passphrase returns the passphrase of the private key. It is read from
+// PassphraseEnv, then from PassphraseFD if set, and is prompted for on the
+// terminal otherwise. With confirm, a prompted passphrase is asked for
+// twice, for keys about to be encrypted.
+func (a *Agent) passphrase(confirm bool) ([]byte, error) {
+	if a.keyPassphrase != nil {
+		return a.keyPassphrase, nil
+	}
+	var p []byte
+	var err error
+	if v, ok := os.LookupEnv(PassphraseEnv); ok {
+		p = []byte(v)
+	} else if a.PassphraseFD >= 0 {
+		p, err = readPassphraseFD(a.PassphraseFD)
+	} else {
+		p, err = promptPassphrase(confirm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	// a file descriptor can only be read once
+	a.keyPassphrase = p
+	return p, nil
+}
+
+// readPassphraseFD reads the first line of the file descriptor fd.
+func readPassphraseFD(fd int) ([]byte, error) {
+	f := os.NewFile(uintptr(fd), "passphrase")
+	if f == nil {
+		return nil, fmt.Errorf("invalid passphrase file descriptor %d", fd)
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading passphrase from file descriptor %d: %v", fd, err)
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// promptPassphrase reads the passphrase from the terminal, which is stdin
+// or, if stdin is redirected, the controlling terminal.
+func promptPassphrase(confirm bool) ([]byte, error) {
+	tty := os.Stdin
+	if !isTerminal(tty.Fd()) {
+		f, err := os.Open(ttyPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: set %s or -passphrase-fd", keys.ErrPassphraseRequired, PassphraseEnv)
+		}
+		defer f.Close()
+		if !isTerminal(f.Fd()) {
+			return nil, fmt.Errorf("%w: set %s or -passphrase-fd", keys.ErrPassphraseRequired, PassphraseEnv)
+		}
+		tty = f
+	}
+	fmt.Fprint(os.Stderr, "Passphrase for private key: ")
+	p, err := readPassword(tty.Fd())
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !confirm {
+		return p, nil
+	}
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	again, err := readPassword(tty.Fd())
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p, again) {
+		return nil, errors.New("passphrases do not match")
+	}
+	return p, nil
+}
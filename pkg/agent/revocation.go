@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/client"
+	"github.com/robertlestak/centauri/pkg/keys"
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrRecipientRevoked is returned when a message is to be encrypted for
+// a revoked key.
+var ErrRecipientRevoked = errors.New("recipient key revoked")
+
+type revocationEntry struct {
+	revocation *sign.Revocation
+	at         time.Time
+}
+
+// checkRevoked returns an error matching ErrRecipientRevoked if the key
+// keyID was revoked. If the revocation cannot be looked up the key is
+// used, as the server refuses messages to revoked keys.
+func (a *Agent) checkRevoked(keyID string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "checkRevoked",
+		"key": keyID,
+	})
+	a.rotationsMtx.Lock()
+	e, ok := a.revocations[keyID]
+	a.rotationsMtx.Unlock()
+	if !ok || time.Since(e.at) >= keyLookupTTL {
+		r, err := a.client().Revocation(context.Background(), keyID)
+		if err != nil && !errors.Is(err, client.ErrNotFound) {
+			l.Errorf("error looking up revocation: %v", err)
+			return nil
+		}
+		e = revocationEntry{revocation: r, at: time.Now()}
+		a.rotationsMtx.Lock()
+		if a.revocations == nil {
+			a.revocations = map[string]revocationEntry{}
+		}
+		a.revocations[keyID] = e
+		a.rotationsMtx.Unlock()
+	}
+	if e.revocation == nil {
+		return nil
+	}
+	err := fmt.Errorf("%w: %s was revoked at %s", ErrRecipientRevoked, keys.ShortID(keyID), e.revocation.RevokedAt.Local().Format(time.RFC3339))
+	if e.revocation.Reason != "" {
+		err = fmt.Errorf("%w: %s", err, e.revocation.Reason)
+	}
+	return err
+}
+
+// revokeKey publishes the revocation in the file, or revokes the private
+// key for reason if no file is given.
+func (a *Agent) revokeKey(file string, reason string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "revokeKey",
+	})
+	var r *sign.Revocation
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			l.Errorf("error reading revocation: %v", err)
+			return err
+		}
+		r = &sign.Revocation{}
+		if err := json.Unmarshal(data, r); err != nil {
+			return fmt.Errorf("%s is not a revocation: %v", file, err)
+		}
+		if err := r.Verify(); err != nil {
+			return fmt.Errorf("%s is not a valid revocation: %v", file, err)
+		}
+	} else {
+		var err error
+		if r, err = a.newRevocation(reason); err != nil {
+			return err
+		}
+	}
+	if err := a.client().PublishRevocation(context.Background(), r); err != nil {
+		l.Errorf("error publishing revocation: %v", err)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "revoked %s\n", keys.ShortID(r.KeyID()))
+	fmt.Printf("%s\n", r.KeyID())
+	return nil
+}
+
+// revocationCert writes the revocation of the private key for reason to
+// out without publishing it, to be kept offline and published with keys
+// revoke if the private key is lost or stolen.
+func (a *Agent) revocationCert(reason string, out string) error {
+	r, err := a.newRevocation(reason)
+	if err != nil {
+		return err
+	}
+	jd, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return sendOutput(append(jd, '\n'), out)
+}
+
+func (a *Agent) newRevocation(reason string) (*sign.Revocation, error) {
+	if a.PrivateKey == nil {
+		return nil, errors.New("no private key, set -key")
+	}
+	return sign.NewRevocation(a.PrivateKey, reason)
+}
@@ -0,0 +1,211 @@
+package agent
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/client"
+	"github.com/robertlestak/centauri/pkg/keys"
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+// keyLookupTTL is how long the rotation or revocation looked up for a
+// key is used before it is looked up again.
+const keyLookupTTL = time.Minute * 5
+
+type rotationEntry struct {
+	// chain is the key looked up and the keys it was rotated to, the
+	// last being the current key
+	chain []string
+	at    time.Time
+}
+
+// currentKey returns the key messages to the key keyID are to be sent
+// to, following the rotation statements published for it. The keys
+// rotated to are added to the public key chain. Rotations are not
+// followed past a revoked key, which is returned for the caller to
+// refuse. If the statements cannot be looked up, keyID is returned and
+// the server refuses messages to a retired key.
+func (a *Agent) currentKey(keyID string) string {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "currentKey",
+		"key": keyID,
+	})
+	a.rotationsMtx.Lock()
+	e, ok := a.rotations[keyID]
+	a.rotationsMtx.Unlock()
+	if ok && time.Since(e.at) < keyLookupTTL {
+		// a key of the chain may have been revoked since
+		for _, id := range e.chain {
+			if a.checkRevoked(id) != nil {
+				return id
+			}
+		}
+		return e.chain[len(e.chain)-1]
+	}
+	id := keyID
+	chain := []string{id}
+	seen := map[string]bool{id: true}
+	for i := 0; i < sign.MaxRotationHops; i++ {
+		// the rotation of a revoked key may have been made by whoever
+		// holds the key now
+		if err := a.checkRevoked(id); err != nil {
+			l.Debugf("not following rotations of %s: %v", keys.ShortID(id), err)
+			break
+		}
+		r, err := a.client().Rotation(context.Background(), id)
+		if errors.Is(err, client.ErrNotFound) || errors.Is(err, client.ErrGone) {
+			break
+		} else if err != nil {
+			// not cached, so that it is looked up again next time
+			l.Errorf("error looking up rotation of %s: %v", id, err)
+			return id
+		}
+		if seen[r.NewKeyID()] {
+			l.Errorf("rotation of %s loops back to %s", id, r.NewKeyID())
+			break
+		}
+		l.Debugf("key %s was rotated to %s", keys.ShortID(id), keys.ShortID(r.NewKeyID()))
+		id = a.addRotatedKey(r.NewKey)
+		chain = append(chain, id)
+		seen[id] = true
+	}
+	a.rotationsMtx.Lock()
+	if a.rotations == nil {
+		a.rotations = map[string]rotationEntry{}
+	}
+	a.rotations[keyID] = rotationEntry{chain: chain, at: time.Now()}
+	a.rotationsMtx.Unlock()
+	return id
+}
+
+// addRotatedKey adds the key pub, which a key of the chain was rotated
+// to, to the chain and installs it into the chain directory.
+func (a *Agent) addRotatedKey(pub []byte) string {
+	id := a.PublicKeys.Add(pub)
+	if _, err := os.Stat(a.PublicKeysDir()); err != nil {
+		return id
+	}
+	if _, err := keys.InstallPublicKey(a.PublicKeysDir(), pub); err != nil {
+		log.WithFields(log.Fields{
+			"pkg": "agent",
+			"fn":  "addRotatedKey",
+		}).Errorf("error installing public key %s: %v", id, err)
+	}
+	return id
+}
+
+// LoadPreviousKey loads the PEM private key of a key the agent's key was
+// rotated from. The messages to it are received until it is retired.
+func (a *Agent) LoadPreviousKey(key []byte) error {
+	k, err := a.parsePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	a.PreviousKeys = append(a.PreviousKeys, k)
+	return nil
+}
+
+func (a *Agent) LoadPreviousKeyFromFile(file string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "LoadPreviousKeyFromFile",
+	})
+	l.Debug("loading previous key from file")
+	fd, err := ioutil.ReadFile(file)
+	if err != nil {
+		l.Errorf("error loading previous key from file: %v", err)
+		return err
+	}
+	return a.LoadPreviousKey(fd)
+}
+
+// clientFor returns the API client of the previous key keyID, or of the
+// private key if keyID is empty.
+func (a *Agent) clientFor(keyID string) *client.Client {
+	if keyID == "" {
+		return a.client()
+	}
+	a.previousMtx.Lock()
+	defer a.previousMtx.Unlock()
+	if c, ok := a.previousAPIs[keyID]; ok {
+		return c
+	}
+	for _, k := range a.PreviousKeys {
+		if previousKeyID(k) != keyID {
+			continue
+		}
+		c := client.New(a.ServerAddrs...)
+		c.AuthToken = a.ServerAuthToken
+		c.PrivateKey = k
+		if a.previousAPIs == nil {
+			a.previousAPIs = map[string]*client.Client{}
+		}
+		a.previousAPIs[keyID] = c
+		return c
+	}
+	// not a previous key, which the server refuses
+	return a.client()
+}
+
+func previousKeyID(k *rsa.PrivateKey) string {
+	pub, err := keys.MarshalPublicKey(&k.PublicKey)
+	if err != nil {
+		return ""
+	}
+	return keys.PubKeyID(pub)
+}
+
+// previousJobs returns the pending messages in channel of the previous
+// keys which are not retired. A key is retired once its rotation is past
+// its overlap period and no message to it is left.
+func (a *Agent) previousJobs(channel string) []GetJob {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "previousJobs",
+	})
+	var js []GetJob
+	for _, k := range a.PreviousKeys {
+		id := previousKeyID(k)
+		a.previousMtx.Lock()
+		retired := a.retiredKeys[id]
+		a.previousMtx.Unlock()
+		if id == "" || retired {
+			continue
+		}
+		msgs, err := a.clientFor(id).List(context.Background(), channel)
+		if err != nil {
+			l.Errorf("error checking pending messages of previous key %s: %v", keys.ShortID(id), err)
+			continue
+		}
+		for _, m := range msgs {
+			js = append(js, GetJob{KeyID: id, Channel: m.Channel, ID: m.ID})
+		}
+		if len(msgs) == 0 && a.keyRetired(id) {
+			l.Infof("previous key %s is retired, no longer receiving its messages", keys.ShortID(id))
+			a.previousMtx.Lock()
+			if a.retiredKeys == nil {
+				a.retiredKeys = map[string]bool{}
+			}
+			a.retiredKeys[id] = true
+			a.previousMtx.Unlock()
+		}
+	}
+	return js
+}
+
+// keyRetired reports whether the overlap period of the rotation of the
+// key keyID is over.
+func (a *Agent) keyRetired(keyID string) bool {
+	r, err := a.client().Rotation(context.Background(), keyID)
+	if err != nil {
+		return false
+	}
+	return r.Retired(time.Now())
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// ActionConfirm confirms a message once it has been stored, which
+	// deletes it from the cluster.
+	ActionConfirm = "confirm"
+	// ActionKeep leaves a stored message in the cluster, for example for
+	// other agents with the same key. The agent does not fetch it again
+	// until it is restarted.
+	ActionKeep = "keep"
+)
+
+// Subscription selects channels the agent receives messages from and
+// what is done with the messages.
+type Subscription struct {
+	// Channel is a channel name or a pattern as used by path.Match, for
+	// example "ops-*".
+	Channel string
+	// OutputDir is the directory the messages are written to. If empty
+	// they are written to the received directories of the store.
+	OutputDir string
+	// Concurrency is the number of messages fetched at once, 10 if 0.
+	Concurrency int
+	// Action is done after a message has been stored, ActionConfirm if empty.
+	Action string
+	// Hook is run for every stored message before Action.
+	Hook *Hook
+}
+
+// validate checks the pattern, action and hook of the subscription.
+func (s Subscription) validate() error {
+	if s.Channel == "" {
+		return errors.New("subscription without channel")
+	}
+	if _, err := path.Match(s.Channel, ""); err != nil {
+		return fmt.Errorf("invalid channel pattern %q: %v", s.Channel, err)
+	}
+	switch s.Action {
+	case "", ActionConfirm, ActionKeep:
+	default:
+		return fmt.Errorf("invalid action %q for channel %q", s.Action, s.Channel)
+	}
+	if s.Hook != nil {
+		if err := s.Hook.validate(); err != nil {
+			return fmt.Errorf("invalid hook for channel %q: %v", s.Channel, err)
+		}
+	}
+	return nil
+}
+
+func (s Subscription) isPattern() bool {
+	return strings.ContainsAny(s.Channel, `*?[\`)
+}
+
+func (s Subscription) matches(channel string) bool {
+	ok, _ := path.Match(s.Channel, channel)
+	return ok
+}
+
+func (s Subscription) concurrency() int {
+	if s.Concurrency <= 0 {
+		return 10
+	}
+	return s.Concurrency
+}
+
+// subscriptions returns the subscriptions of the agent, or one for the
+// default channel if none are configured.
+func (a *Agent) subscriptions() []Subscription {
+	if len(a.Subscriptions) == 0 {
+		return []Subscription{{Channel: a.DefaultChannel}}
+	}
+	return a.Subscriptions
+}
+
+// listChannel returns the channel the pending messages of the
+// subscriptions are listed for, all channels if it is empty.
+func listChannel(subs []Subscription) string {
+	if len(subs) == 1 && !subs[0].isPattern() {
+		return subs[0].Channel
+	}
+	return ""
+}
+
+// subscriptionFor returns the index of the first subscription matching
+// channel, or -1 if the channel is not subscribed.
+func subscriptionFor(subs []Subscription, channel string) int {
+	for i, s := range subs {
+		if s.matches(channel) {
+			return i
+		}
+	}
+	return -1
+}
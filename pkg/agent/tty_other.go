@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import "golang.org/x/crypto/ssh/terminal"
+
+// ttyPath is the controlling terminal.
+const ttyPath = "/dev/tty"
+
+func isTerminal(fd uintptr) bool {
+	return terminal.IsTerminal(int(fd))
+}
+
+// readPassword reads a line from the terminal fd without echoing it.
+func readPassword(fd uintptr) ([]byte, error) {
+	return terminal.ReadPassword(int(fd))
+}
@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/windows"
+)
+
+// ttyPath is the console input.
+const ttyPath = "CONIN$"
+
+func isTerminal(fd uintptr) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(fd), &mode) == nil
+}
+
+// readPassword reads a line from the console fd without echoing it.
+func readPassword(fd uintptr) ([]byte, error) {
+	h := windows.Handle(fd)
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return nil, err
+	}
+	if err := windows.SetConsoleMode(h, (mode&^windows.ENABLE_ECHO_INPUT)|windows.ENABLE_PROCESSED_INPUT|windows.ENABLE_LINE_INPUT); err != nil {
+		return nil, err
+	}
+	defer windows.SetConsoleMode(h, mode)
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		var n uint32
+		if err := windows.ReadFile(h, b, &n, nil); err != nil {
+			return nil, err
+		}
+		if n == 0 || b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	return bytes.TrimRight(line, "\r"), nil
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/centauri/internal/persist"
+	log "github.com/sirupsen/logrus"
+)
+
+// PartialSuffix marks an outgoing file which is still being written.
+// Outgoing files are sent once they are closed after writing or renamed
+// into place, but hidden files and files ending in PartialSuffix are
+// skipped, so that writers which cannot write a file in one go can write
+// it under a temporary name and rename it when they are done.
+const PartialSuffix = ".partial"
+
+// errWatchUnsupported is returned by watchOutgoing on systems without
+// file system notifications.
+var errWatchUnsupported = errors.New("watching is not supported on this system")
+
+// ignoredOutgoing reports whether the file name marks an incomplete file.
+func ignoredOutgoing(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, PartialSuffix)
+}
+
+// outgoingRoots returns the outgoing directories and the message type of
+// the files dropped below them.
+func (a *Agent) outgoingRoots() map[string]string {
+	return map[string]string{
+		a.Store.AgentOutgoingMessagesDir: "bytes",
+		a.Store.AgentOutgoingFilesDir:    "file",
+	}
+}
+
+// outgoingTarget returns the public key and channel an outgoing file is
+// sent to. Files are dropped as <root>/<pubKeyID>/<name>, which sends them
+// on the default channel, or as <root>/<pubKeyID>/<channel>/<name>.
+func (a *Agent) outgoingTarget(fp string) (pubKeyID string, channel string, ok bool) {
+	for root := range a.outgoingRoots() {
+		rel, err := filepath.Rel(root, fp)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		switch len(parts) {
+		case 2:
+			return parts[0], a.DefaultChannel, true
+		case 3:
+			if ignoredOutgoing(parts[1]) {
+				return "", "", false
+			}
+			return parts[0], parts[1], true
+		}
+	}
+	return "", "", false
+}
+
+// enqueueOutgoing queues the complete file fp of the outgoing tree.
+func (a *Agent) enqueueOutgoing(fp string, mType string) error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "agent",
+		"fn":   "enqueueOutgoing",
+		"fp":   fp,
+		"type": mType,
+	})
+	fn := filepath.Base(fp)
+	if ignoredOutgoing(fn) {
+		return nil
+	}
+	pubKeyID, channel, ok := a.outgoingTarget(fp)
+	if !ok {
+		l.Debug("not an outgoing file")
+		return nil
+	}
+	// directories may be named after contacts instead of key IDs
+	if id, isContact, err := a.contactKeyID(pubKeyID); err != nil {
+		l.Errorf("not sending: %v", err)
+		return nil
+	} else if isContact {
+		pubKeyID = id
+	}
+	it := &persist.QueueItem{
+		Type:     mType,
+		Name:     fn,
+		PubKeyID: pubKeyID,
+		Channel:  channel,
+	}
+	if err := a.Store.Enqueue(fp, it); err != nil {
+		if os.IsNotExist(err) {
+			// picked up by an earlier event or scan
+			return nil
+		}
+		l.Errorf("error queueing file: %v", err)
+		return err
+	}
+	l.Debugf("queued as %s", it.ID)
+	a.wakeQueue()
+	return nil
+}
+
+// wakeQueue makes the queue worker process the queue without waiting for
+// its next round.
+func (a *Agent) wakeQueue() {
+	select {
+	case a.queueWake <- struct{}{}:
+	default:
+	}
+}
+
+// pollOutgoing scans the outgoing directories every second, for systems
+// on which they cannot be watched.
+func (a *Agent) pollOutgoing() {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "pollOutgoing",
+	})
+	l.Debug("polling outgoing directories")
+	for {
+		if err := a.StartWatcher(); err != nil {
+			l.Errorf("failed to scan outgoing directories: %v", err)
+		}
+		time.Sleep(time.Second * 1)
+	}
+}
@@ -0,0 +1,199 @@
+//go:build linux
+
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// dirEvents are the events of a watched directory which are handled.
+	dirEvents = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE |
+		unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+)
+
+// watchedDir is a directory of the outgoing tree: a root, the directory
+// of a public key below it or a channel directory of a public key.
+type watchedDir struct {
+	path  string
+	mType string
+	depth int
+}
+
+const (
+	rootDepth = iota
+	keyDepth
+	channelDepth
+)
+
+// inotifyWatcher watches the directories of the outgoing tree.
+type inotifyWatcher struct {
+	// fd is kept apart from f, as f.Fd would put f into blocking mode
+	fd   int
+	f    *os.File
+	dirs map[int32]watchedDir
+}
+
+// watchOutgoing watches the outgoing directories with inotify and queues
+// every file which is closed after writing or moved into them. Files
+// which were dropped before the watch was set up are picked up by a scan.
+// It only returns if watching fails.
+func (a *Agent) watchOutgoing() error {
+	l := log.WithFields(log.Fields{
+		"pkg": "agent",
+		"fn":  "watchOutgoing",
+	})
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		l.Errorf("failed to init inotify: %v", err)
+		return err
+	}
+	w := &inotifyWatcher{
+		fd:   fd,
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		dirs: map[int32]watchedDir{},
+	}
+	defer w.f.Close()
+	for root, mType := range a.outgoingRoots() {
+		if err := w.addTree(root, mType, rootDepth); err != nil {
+			l.Errorf("failed to watch %s: %v", root, err)
+			return err
+		}
+	}
+	if err := a.StartWatcher(); err != nil {
+		l.Errorf("failed to scan outgoing directories: %v", err)
+	}
+	// files which were completed shortly before the watch was set up are
+	// not settled yet and are picked up by a second scan
+	time.AfterFunc(time.Minute, func() {
+		if err := a.StartWatcher(); err != nil {
+			l.Errorf("failed to scan outgoing directories: %v", err)
+		}
+	})
+	l.Debug("watching outgoing directories")
+	buf := make([]byte, unix.SizeofInotifyEvent*4096)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			l.Errorf("failed to read inotify events: %v", err)
+			return err
+		}
+		if n < unix.SizeofInotifyEvent {
+			return errors.New("short inotify read")
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+			a.handleInotifyEvent(w, ev, string(bytes.TrimRight(name, "\x00")))
+		}
+	}
+}
+
+func (a *Agent) handleInotifyEvent(w *inotifyWatcher, ev *unix.InotifyEvent, name string) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "agent",
+		"fn":   "handleInotifyEvent",
+		"mask": ev.Mask,
+		"name": name,
+	})
+	if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+		// events were lost, fall back to a scan
+		l.Error("inotify queue overflowed, scanning outgoing directories")
+		if err := a.StartWatcher(); err != nil {
+			l.Errorf("failed to scan outgoing directories: %v", err)
+		}
+		return
+	}
+	if ev.Mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, ev.Wd)
+		return
+	}
+	dir, ok := w.dirs[ev.Wd]
+	if !ok || name == "" {
+		return
+	}
+	fp := filepath.Join(dir.path, name)
+	switch {
+	case ev.Mask&unix.IN_ISDIR != 0:
+		if dir.depth == channelDepth || ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) == 0 {
+			return
+		}
+		// a new public key or channel directory
+		if err := w.addTree(fp, dir.mType, dir.depth+1); err != nil {
+			l.Errorf("failed to watch %s: %v", fp, err)
+			return
+		}
+		// files written before the watch was added
+		if err := a.enqueueTree(fp, dir.mType, dir.depth+1); err != nil {
+			l.Errorf("failed to scan %s: %v", fp, err)
+		}
+	case dir.depth == rootDepth:
+	case ev.Mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0:
+		l.Debug("outgoing file is complete")
+		if err := a.enqueueOutgoing(fp, dir.mType); err != nil {
+			l.Errorf("failed to queue %s: %v", fp, err)
+		}
+	}
+}
+
+// addTree watches the directory path at depth of the outgoing tree and
+// the directories below it.
+func (w *inotifyWatcher) addTree(path string, mType string, depth int) error {
+	wd, err := unix.InotifyAddWatch(w.fd, path, dirEvents)
+	if err != nil {
+		return err
+	}
+	w.dirs[int32(wd)] = watchedDir{path: path, mType: mType, depth: depth}
+	if depth == channelDepth {
+		return nil
+	}
+	ds, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		if !d.IsDir() {
+			continue
+		}
+		if err := w.addTree(filepath.Join(path, d.Name()), mType, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueTree queues the complete files in the directory dir at depth of
+// the outgoing tree and the directories below it.
+func (a *Agent) enqueueTree(dir string, mType string, depth int) error {
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range fs {
+		fp := filepath.Join(dir, f.Name())
+		switch {
+		case f.IsDir() && depth < channelDepth:
+			if err := a.enqueueTree(fp, mType, depth+1); err != nil {
+				return err
+			}
+		case f.Mode().IsRegular() && depth > rootDepth:
+			if err := a.enqueueOutgoing(fp, mType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
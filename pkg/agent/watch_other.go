@@ -0,0 +1,9 @@
+//go:build !linux
+
+package agent
+
+// watchOutgoing returns errWatchUnsupported, the outgoing directories are
+// polled instead.
+func (a *Agent) watchOutgoing() error {
+	return errWatchUnsupported
+}
@@ -0,0 +1,22 @@
+package api
+
+// MaxDeletionSet is the largest number of messages deleted at once.
+const MaxDeletionSet = 10000
+
+// MessageRef names a message of a key.
+type MessageRef struct {
+	Channel string `json:"channel"`
+	ID      string `json:"id"`
+}
+
+// DeleteRequest is the body of a batch deletion.
+type DeleteRequest struct {
+	Messages []MessageRef `json:"messages"`
+}
+
+// DeleteResult is the outcome of a batch deletion. Deleted is the number
+// of the messages which were stored on the peer which deleted them.
+type DeleteResult struct {
+	SetID   string `json:"setID"`
+	Deleted int    `json:"deleted"`
+}
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// ListingDigest returns the digest of a listing with the message IDs ids,
+// which clients send with a waiting listing to name the messages they
+// already know.
+func ListingDigest(ids []string) string {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	h := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(h[:16])
+}
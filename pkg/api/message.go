@@ -0,0 +1,82 @@
+// Package api defines the messages and statuses exchanged between Centauri
+// peers and their clients. It imports no internal package, so that
+// clients can use it without pulling in the peer.
+package api
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/robertlestak/centauri/pkg/keys"
+	log "github.com/sirupsen/logrus"
+)
+
+type Message struct {
+	Type        string `json:"type"`
+	Channel     string `json:"channel"`
+	ID          string `json:"id"`
+	PublicKeyID string `json:"pubKeyID,omitempty"`
+	Data        []byte `json:"data"`
+}
+
+// CleanString will clean the string to [a-zA-Z0-9_]
+func CleanString(s string) string {
+	// given input s, replace all characters that are not a-zA-Z0-9_ with _
+	var ns string
+	for _, r := range s {
+		rx := regexp.MustCompile(`[^a-zA-Z0-9\-]`)
+		if !rx.MatchString(string(r)) {
+			ns += string(r)
+		} else {
+			ns += "-"
+		}
+	}
+	return ns
+}
+
+// CreateMessage encrypts the data read from rawDataReader with pubKey and
+// returns a message addressed to pubKeyID.
+func CreateMessage(mType string, fileName string, channel string, pubKeyID string, pubKey []byte, rawDataReader io.ReadCloser) (*Message, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":     "api",
+		"fn":      "CreateMessage",
+		"type":    mType,
+		"file":    fileName,
+		"channel": channel,
+		"pubkey":  pubKeyID,
+	})
+	l.Debug("creating message")
+	channel = CleanString(channel)
+	if len(pubKey) == 0 {
+		l.Errorf("public key not found: %s", pubKeyID)
+		return nil, errors.New("public key not found")
+	}
+	var rawData []byte
+	// read rawData from rawDataReader
+	if rawDataReader != nil {
+		var err error
+		rawData, err = ioutil.ReadAll(rawDataReader)
+		if err != nil {
+			l.Errorf("error reading raw data: %v", err)
+			return nil, err
+		}
+	}
+	if mType == "file" && fileName != "" {
+		// add file:<filename>| prefix to rawData
+		rawData = append([]byte("file:"+fileName+"|"), rawData...)
+	}
+	enc, err := keys.EncryptMessage(pubKey, rawData)
+	if err != nil {
+		l.Errorf("error encrypting data: %v", err)
+		return nil, err
+	}
+	m := &Message{
+		Type:        mType,
+		Channel:     channel,
+		PublicKeyID: pubKeyID,
+		Data:        []byte(*enc),
+	}
+	return m, nil
+}
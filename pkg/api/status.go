@@ -0,0 +1,23 @@
+package api
+
+// Status is the replication state of a message across the cluster.
+type Status struct {
+	ID          string       `json:"id"`
+	Channel     string       `json:"channel"`
+	PublicKeyID string       `json:"pubKeyID"`
+	Stored      []string     `json:"stored"`
+	Fetching    []string     `json:"fetching"`
+	Tombstoned  bool         `json:"tombstoned"`
+	Unreachable []string     `json:"unreachable"`
+	Peers       []PeerStatus `json:"peers"`
+}
+
+// PeerStatus is the replication state of a message on a single peer, as
+// reported by the peer.
+type PeerStatus struct {
+	PeerName  string `json:"peerName"`
+	Stored    bool   `json:"stored"`
+	Fetching  bool   `json:"fetching"`
+	Tombstone bool   `json:"tombstone"`
+	Error     string `json:"error,omitempty"`
+}
@@ -0,0 +1,444 @@
+// Package centauritest runs Centauri clusters inside a single process
+// for tests. Every node keeps its data in a temporary directory. The
+// nodes of a cluster created with New listen on loopback with ports
+// chosen by the system, the nodes of a cluster created with NewSimulated
+// gossip and exchange messages over a simulated Network with seeded
+// faults.
+package centauritest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/robertlestak/centauri"
+	"github.com/robertlestak/centauri/internal/net/simnet"
+	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/pkg/agent"
+	"github.com/robertlestak/centauri/pkg/api"
+	"github.com/robertlestak/centauri/pkg/keys"
+)
+
+// ConfigFunc changes the config of the i-th node before it is started.
+type ConfigFunc func(i int, c *centauri.Config)
+
+// Cluster is a set of nodes running in this process. Messages sent with
+// the cluster helpers are encrypted for the cluster's key pair.
+type Cluster struct {
+	Nodes      []*centauri.Node
+	PrivateKey *rsa.PrivateKey
+	PublicKey  []byte
+	PubKeyID   string
+	// Net is the simulated network of the nodes, nil if they use sockets.
+	Net *Network
+
+	t       testing.TB
+	dir     string
+	configs []ConfigFunc
+	mtx     sync.RWMutex
+	addrs   map[string]int
+	groups  map[int]int
+	down    map[int]bool
+	closed  bool
+	// rejoins are the rejoins of scheduled heals in flight
+	rejoins sync.WaitGroup
+}
+
+// New starts a cluster of n nodes, waits until every node sees all of the
+// others and stops the nodes when the test finishes.
+func New(t testing.TB, n int, configs ...ConfigFunc) *Cluster {
+	t.Helper()
+	return start(t, nil, n, configs)
+}
+
+// NewSimulated is like New but connects the gossip and data ports of the
+// nodes through the simulated network sim, whose clock advances until the
+// test finishes. The HTTP API of every node still listens on loopback.
+func NewSimulated(t testing.TB, sim *Network, n int, configs ...ConfigFunc) *Cluster {
+	t.Helper()
+	return start(t, sim, n, configs)
+}
+
+func start(t testing.TB, sim *Network, n int, configs []ConfigFunc) *Cluster {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("centauritest: failed to generate key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("centauritest: failed to marshal public key: %v", err)
+	}
+	c := &Cluster{
+		PrivateKey: key,
+		PublicKey:  pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}),
+		Net:        sim,
+		t:          t,
+		dir:        t.TempDir(),
+		configs:    configs,
+		addrs:      map[string]int{},
+		down:       map[int]bool{},
+	}
+	c.PubKeyID = keys.PubKeyID(c.PublicKey)
+	if sim != nil {
+		// registered first so that the clock runs until the nodes are closed
+		t.Cleanup(sim.attach())
+	}
+	t.Cleanup(c.Close)
+	for i := 0; i < n; i++ {
+		c.AddNode()
+	}
+	c.WaitConverged(time.Second * 10)
+	return c
+}
+
+// AddNode starts a new node which joins the first live node of the cluster.
+func (c *Cluster) AddNode() *centauri.Node {
+	c.t.Helper()
+	i := len(c.Nodes)
+	name := hostName(i)
+	cfg := centauri.Config{
+		Name:           name,
+		DataDir:        filepath.Join(c.dir, name),
+		ConnectionMode: "local",
+		AdvertiseAddr:  "127.0.0.1",
+		ServerCors:     []string{"*"},
+	}
+	var host *simnet.Host
+	if c.Net != nil {
+		host = c.Net.sim.Host(name)
+		cfg.AdvertiseAddr = host.IP.String()
+	}
+	for j, n := range c.Nodes {
+		if c.isDown(j) {
+			continue
+		}
+		cfg.PeerAddrs = []string{gossipAddr(n)}
+		break
+	}
+	for _, f := range c.configs {
+		f(i, &cfg)
+	}
+	n, err := centauri.New(cfg)
+	if err != nil {
+		c.t.Fatalf("centauritest: failed to create %s: %v", name, err)
+	}
+	if host != nil {
+		n.Peer.Transport = host
+	} else {
+		n.Peer.Transport = &faultTransport{c: c, idx: i}
+	}
+	if err := n.Start(); err != nil {
+		c.t.Fatalf("centauritest: failed to start %s: %v", name, err)
+	}
+	c.mtx.Lock()
+	c.Nodes = append(c.Nodes, n)
+	c.addrs[gossipAddr(n)] = i
+	c.addrs[dataAddr(n)] = i
+	c.mtx.Unlock()
+	return n
+}
+
+// hostName is the name of node i, also of its host on a simulated network.
+func hostName(i int) string {
+	return "node-" + strconv.Itoa(i)
+}
+
+func gossipAddr(n *centauri.Node) string {
+	return fmt.Sprintf("%s:%d", n.Config.AdvertiseAddr, n.Config.GossipAdvertisePort)
+}
+
+func dataAddr(n *centauri.Node) string {
+	return fmt.Sprintf("%s:%d", n.Config.AdvertiseAddr, n.Config.DataAdvertisePort)
+}
+
+// URL returns the base URL of the HTTP API of node i.
+func (c *Cluster) URL(i int) string {
+	return "http://" + c.Nodes[i].HTTPAddr()
+}
+
+func (c *Cluster) isDown(i int) bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.down[i]
+}
+
+// Live returns the indexes of the nodes which have not been killed or stopped.
+func (c *Cluster) Live() []int {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	var live []int
+	for i := range c.Nodes {
+		if !c.down[i] {
+			live = append(live, i)
+		}
+	}
+	return live
+}
+
+// reachable reports whether node from may send to addr.
+func (c *Cluster) reachable(from int, addr string) bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	to, ok := c.addrs[addr]
+	if !ok || c.groups == nil {
+		return true
+	}
+	return c.groupOf(from) == c.groupOf(to)
+}
+
+func (c *Cluster) groupOf(i int) int {
+	if g, ok := c.groups[i]; ok {
+		return g
+	}
+	// nodes which are not in any group are isolated
+	return -1 - i
+}
+
+// Partition splits the cluster so that nodes can only reach the nodes in
+// the same group. Nodes which are not in any group are isolated.
+func (c *Cluster) Partition(groups ...[]int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.groups = map[int]int{}
+	names := make([][]string, len(groups))
+	for g, nodes := range groups {
+		for _, i := range nodes {
+			c.groups[i] = g
+			names[g] = append(names[g], c.Nodes[i].Config.Name)
+		}
+	}
+	if c.Net != nil {
+		c.Net.sim.Partition(names...)
+	}
+}
+
+// Heal removes all partitions and rejoins the live nodes, since members
+// which were declared dead are not probed again.
+func (c *Cluster) Heal() {
+	c.t.Helper()
+	c.heal()
+	c.rejoin()
+}
+
+func (c *Cluster) heal() {
+	c.mtx.Lock()
+	c.groups = nil
+	c.mtx.Unlock()
+	if c.Net != nil {
+		c.Net.sim.Heal()
+	}
+}
+
+func (c *Cluster) rejoin() {
+	live := c.Live()
+	var addrs []string
+	for _, i := range live {
+		addrs = append(addrs, gossipAddr(c.Nodes[i]))
+	}
+	for _, i := range live {
+		if err := c.Nodes[i].Peer.Join(addrs); err != nil {
+			c.t.Logf("centauritest: failed to rejoin %s: %v", c.Nodes[i].Config.Name, err)
+		}
+	}
+}
+
+// Kill stops node i immediately, without draining or leaving the cluster.
+func (c *Cluster) Kill(i int) {
+	c.t.Helper()
+	c.mtx.Lock()
+	c.down[i] = true
+	c.mtx.Unlock()
+	if err := c.Nodes[i].Close(); err != nil {
+		c.t.Logf("centauritest: failed to close %s: %v", c.Nodes[i].Config.Name, err)
+	}
+}
+
+// Stop shuts node i down gracefully.
+func (c *Cluster) Stop(i int) {
+	c.t.Helper()
+	c.mtx.Lock()
+	c.down[i] = true
+	c.mtx.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err := c.Nodes[i].Shutdown(ctx); err != nil {
+		c.t.Logf("centauritest: failed to shutdown %s: %v", c.Nodes[i].Config.Name, err)
+	}
+}
+
+// Close kills every live node. It is called when the test finishes.
+func (c *Cluster) Close() {
+	c.mtx.Lock()
+	c.closed = true
+	c.mtx.Unlock()
+	c.rejoins.Wait()
+	for _, i := range c.Live() {
+		c.Kill(i)
+	}
+}
+
+// Eventually polls cond until it returns true, failing the test if it
+// does not within timeout.
+func (c *Cluster) Eventually(timeout time.Duration, cond func() bool, format string, args ...any) {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("centauritest: timed out after %s: %s", timeout, fmt.Sprintf(format, args...))
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// WaitConverged waits until every live node sees exactly the live nodes
+// it can reach as alive members.
+func (c *Cluster) WaitConverged(timeout time.Duration) {
+	c.t.Helper()
+	c.Eventually(timeout, c.converged, "cluster did not converge")
+}
+
+func (c *Cluster) converged() bool {
+	live := c.Live()
+	for _, i := range live {
+		want := map[string]bool{}
+		for _, j := range live {
+			c.mtx.RLock()
+			same := c.groups == nil || c.groupOf(i) == c.groupOf(j)
+			c.mtx.RUnlock()
+			if same {
+				want[c.Nodes[j].Config.Name] = true
+			}
+		}
+		got := 0
+		for _, m := range c.Nodes[i].Peer.ListMembers() {
+			if m.State != memberlist.StateAlive {
+				continue
+			}
+			if !want[m.Name] {
+				return false
+			}
+			got++
+		}
+		if got != len(want) {
+			return false
+		}
+	}
+	return true
+}
+
+// Send creates a message on node i through its HTTP API and returns its ID.
+func (c *Cluster) Send(i int, channel string, data []byte) string {
+	c.t.Helper()
+	m, err := api.CreateMessage("bytes", "", channel, c.PubKeyID, c.PublicKey, ioutil.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		c.t.Fatalf("centauritest: failed to create message: %v", err)
+	}
+	jd, err := json.Marshal(m)
+	if err != nil {
+		c.t.Fatalf("centauritest: failed to marshal message: %v", err)
+	}
+	req, err := http.NewRequest("POST", c.URL(i)+"/message", bytes.NewReader(jd))
+	if err != nil {
+		c.t.Fatalf("centauritest: failed to create request: %v", err)
+	}
+	if t := c.Nodes[i].Config.ServerAuthToken; t != "" {
+		req.Header.Set("X-Token", t)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("centauritest: failed to send message: %v", err)
+	}
+	defer resp.Body.Close()
+	bd, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		c.t.Fatalf("centauritest: failed to send message: %d %s", resp.StatusCode, bd)
+	}
+	md := persist.MessageMetaData{}
+	if err := json.Unmarshal(bd, &md); err != nil {
+		c.t.Fatalf("centauritest: failed to decode response: %v", err)
+	}
+	return md.ID
+}
+
+// Agent returns an agent which talks to node i with the cluster's key pair.
+func (c *Cluster) Agent(i int) *agent.Agent {
+	a := agent.New()
+	a.PrivateKey = c.PrivateKey
+	a.ServerAddrs = []string{c.URL(i)}
+	a.ServerAuthToken = c.Nodes[i].Config.ServerAuthToken
+	return a
+}
+
+// Get reads and decrypts the message from node i through its HTTP API.
+func (c *Cluster) Get(i int, channel string, id string) []byte {
+	c.t.Helper()
+	a := c.Agent(i)
+	m, err := a.GetMessage(api.CleanString(channel), id)
+	if err != nil || m == nil {
+		c.t.Fatalf("centauritest: failed to get message %s from node %d: %v", id, i, err)
+	}
+	m, err = a.DecryptMessageData(m)
+	if err != nil {
+		c.t.Fatalf("centauritest: failed to decrypt message %s: %v", id, err)
+	}
+	return m.Data
+}
+
+// Confirm confirms receipt of the message on node i, deleting it from the cluster.
+func (c *Cluster) Confirm(i int, channel string, id string) {
+	c.t.Helper()
+	if err := c.Agent(i).ConfirmMessageReceive(api.CleanString(channel), id); err != nil {
+		c.t.Fatalf("centauritest: failed to confirm message %s on node %d: %v", id, i, err)
+	}
+}
+
+// Stored reports whether node i holds the message.
+func (c *Cluster) Stored(i int, channel string, id string) bool {
+	return c.Nodes[i].Store.MessageExists(c.PubKeyID, api.CleanString(channel), id)
+}
+
+// Tombstoned reports whether node i holds a tombstone for the message.
+func (c *Cluster) Tombstoned(i int, channel string, id string) bool {
+	return c.Nodes[i].Store.TombstoneExists(c.PubKeyID, api.CleanString(channel), id)
+}
+
+// WaitReplicated waits until every live node holds the message.
+func (c *Cluster) WaitReplicated(channel string, id string, timeout time.Duration) {
+	c.t.Helper()
+	c.Eventually(timeout, func() bool {
+		for _, i := range c.Live() {
+			if !c.Stored(i, channel, id) {
+				return false
+			}
+		}
+		return true
+	}, "message %s was not replicated to every live node", id)
+}
+
+// WaitDeleted waits until every live node holds a tombstone for the
+// message and no longer holds the message itself.
+func (c *Cluster) WaitDeleted(channel string, id string, timeout time.Duration) {
+	c.t.Helper()
+	c.Eventually(timeout, func() bool {
+		for _, i := range c.Live() {
+			if c.Stored(i, channel, id) || !c.Tombstoned(i, channel, id) {
+				return false
+			}
+		}
+		return true
+	}, "message %s was not deleted on every live node", id)
+}
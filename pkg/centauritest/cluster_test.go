@@ -0,0 +1,92 @@
+package centauritest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/centauritest"
+)
+
+func TestReplicatesToAllNodes(t *testing.T) {
+	c := centauritest.New(t, 3)
+	id := c.Send(0, "default", []byte("hello"))
+	c.WaitReplicated("default", id, time.Second*10)
+	for i := range c.Nodes {
+		if got := string(c.Get(i, "default", id)); got != "hello" {
+			t.Errorf("node %d: got %q, want %q", i, got, "hello")
+		}
+	}
+}
+
+func TestDeleteConverges(t *testing.T) {
+	c := centauritest.New(t, 3)
+	id := c.Send(0, "default", []byte("hello"))
+	c.WaitReplicated("default", id, time.Second*10)
+	c.Confirm(1, "default", id)
+	c.WaitDeleted("default", id, time.Second*10)
+}
+
+func TestDeliversAfterPartitionHeals(t *testing.T) {
+	c := centauritest.New(t, 3)
+	c.Partition([]int{0, 1}, []int{2})
+	c.WaitConverged(time.Second * 30)
+	during := c.Send(0, "default", []byte("during"))
+	c.Eventually(time.Second*10, func() bool {
+		return c.Stored(1, "default", during)
+	}, "message %s was not replicated within the partition", during)
+	if c.Stored(2, "default", during) {
+		t.Fatalf("message %s crossed the partition", during)
+	}
+	c.Heal()
+	c.WaitConverged(time.Second * 30)
+	after := c.Send(2, "default", []byte("after"))
+	c.WaitReplicated("default", after, time.Second*10)
+	for i := range c.Nodes {
+		if got := string(c.Get(i, "default", after)); got != "after" {
+			t.Errorf("node %d: got %q, want %q", i, got, "after")
+		}
+	}
+	c.Confirm(0, "default", after)
+	c.WaitDeleted("default", after, time.Second*10)
+}
+
+func TestDeletionStaysInPartition(t *testing.T) {
+	c := centauritest.New(t, 3)
+	id := c.Send(0, "default", []byte("hello"))
+	c.WaitReplicated("default", id, time.Second*10)
+	c.Partition([]int{0, 1}, []int{2})
+	c.WaitConverged(time.Second * 30)
+	c.Confirm(0, "default", id)
+	c.Eventually(time.Second*10, func() bool {
+		return c.Tombstoned(1, "default", id) && !c.Stored(1, "default", id)
+	}, "message %s was not deleted within the partition", id)
+	if !c.Stored(2, "default", id) || c.Tombstoned(2, "default", id) {
+		t.Fatalf("deletion of %s crossed the partition", id)
+	}
+}
+
+func TestReloadKeepsSystemChosenPorts(t *testing.T) {
+	c := centauritest.New(t, 1)
+	n := c.Nodes[0]
+	// the config the node was created with, which leaves every port to the system
+	next := n.Config
+	next.DataBindPort = 0
+	next.DataAdvertisePort = 0
+	next.GossipBindPort = 0
+	next.GossipAdvertisePort = 0
+	next.ServerPort = 0
+	next.ServerAuthToken = "token"
+	res, err := n.Reload(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.RequiresRestart) != 0 {
+		t.Errorf("requires restart: %v", res.RequiresRestart)
+	}
+	if len(res.Applied) != 1 || res.Applied[0] != "serverAuthToken" {
+		t.Errorf("applied: %v, want [serverAuthToken]", res.Applied)
+	}
+	if n.Config.ServerPort == 0 || n.Config.ServerAuthToken != "token" {
+		t.Errorf("config after reload: server port %d, auth token %q", n.Config.ServerPort, n.Config.ServerAuthToken)
+	}
+}
@@ -0,0 +1,96 @@
+package centauritest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robertlestak/centauri/internal/net/simnet"
+)
+
+// driveTick is the step in which the clock of a network advances while
+// a cluster runs on it.
+const driveTick = time.Millisecond
+
+// NetworkConfig is the fault model of a simulated network.
+type NetworkConfig struct {
+	// Seed selects the latency and loss of every link.
+	Seed int64
+	// Latency is the minimum one-way delay of packets and connections.
+	Latency time.Duration
+	// Jitter is the maximum random delay added to Latency.
+	Jitter time.Duration
+	// Loss is the probability between 0 and 1 that a gossip packet is
+	// dropped. Connections are not subject to loss.
+	Loss float64
+}
+
+// Network is a simulated network for the nodes of clusters created with
+// NewSimulated. The delay and loss of a packet follow from the seed and
+// the traffic sent before it on its link, and delays and scheduled events
+// run on a virtual clock in a fixed order. The clock advances with the
+// wall clock while a cluster runs on the network, since the timeouts of
+// the nodes use the wall clock. Those timers also decide the traffic of
+// the nodes, so two runs with the same seed share the fault model but not
+// the faults.
+type Network struct {
+	sim   *simnet.Network
+	seed  int64
+	start time.Time
+
+	mtx   sync.Mutex
+	users int
+	stop  func()
+}
+
+// NewNetwork returns a simulated network with the fault model c.
+func NewNetwork(c NetworkConfig) *Network {
+	sim := simnet.New(simnet.Config{
+		Seed:    c.Seed,
+		Latency: c.Latency,
+		Jitter:  c.Jitter,
+		Loss:    c.Loss,
+	})
+	return &Network{
+		sim:   sim,
+		seed:  c.Seed,
+		start: sim.Clock().Now(),
+	}
+}
+
+// Seed returns the seed of the network, to rerun a test with the same
+// fault model.
+func (n *Network) Seed() int64 {
+	return n.seed
+}
+
+// Elapsed returns the virtual time since the network was created.
+func (n *Network) Elapsed() time.Duration {
+	return n.sim.Clock().Now().Sub(n.start)
+}
+
+// Reachable reports whether node from can currently reach node to.
+func (n *Network) Reachable(from, to int) bool {
+	return n.sim.Reachable(hostName(from), hostName(to))
+}
+
+// attach advances the clock while the cluster calling it runs. The
+// returned function stops the clock once no cluster uses the network.
+func (n *Network) attach() (detach func()) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.users == 0 {
+		n.stop = n.sim.Clock().Drive(driveTick)
+	}
+	n.users++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			n.mtx.Lock()
+			defer n.mtx.Unlock()
+			n.users--
+			if n.users == 0 {
+				n.stop()
+			}
+		})
+	}
+}
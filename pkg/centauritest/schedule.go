@@ -0,0 +1,56 @@
+package centauritest
+
+import "time"
+
+// Event is a change to a cluster applied At an offset from Schedule.
+type Event struct {
+	At    time.Duration
+	apply func(c *Cluster)
+}
+
+// PartitionAt returns an event which partitions the cluster into groups
+// of nodes, see Cluster.Partition.
+func PartitionAt(at time.Duration, groups ...[]int) Event {
+	return Event{At: at, apply: func(c *Cluster) { c.Partition(groups...) }}
+}
+
+// HealAt returns an event which removes all partitions and rejoins the
+// live nodes, see Cluster.Heal.
+func HealAt(at time.Duration) Event {
+	return Event{At: at, apply: func(c *Cluster) {
+		c.heal()
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if c.closed {
+			return
+		}
+		// joining waits for the network, whose clock applies the event
+		c.rejoins.Add(1)
+		go func() {
+			defer c.rejoins.Done()
+			c.rejoin()
+		}()
+	}}
+}
+
+// Schedule applies the events at their offsets from now. On a simulated
+// network they run on its virtual clock, in a fixed order with the
+// traffic of the nodes. The returned function cancels the events which
+// have not been applied yet.
+func (c *Cluster) Schedule(events ...Event) (stop func()) {
+	var stops []func() bool
+	for _, e := range events {
+		e := e
+		f := func() { e.apply(c) }
+		if c.Net != nil {
+			stops = append(stops, c.Net.sim.Clock().AfterFunc(e.At, f))
+		} else {
+			stops = append(stops, time.AfterFunc(e.At, f).Stop)
+		}
+	}
+	return func() {
+		for _, s := range stops {
+			s()
+		}
+	}
+}
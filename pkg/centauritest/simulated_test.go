@@ -0,0 +1,76 @@
+package centauritest_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/centauritest"
+)
+
+var seeds = []int64{1, 2, 3}
+
+func TestSimulatedReplicationUnderLoss(t *testing.T) {
+	for _, seed := range seeds {
+		seed := seed
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			t.Parallel()
+			sim := centauritest.NewNetwork(centauritest.NetworkConfig{
+				Seed:    seed,
+				Latency: time.Millisecond,
+				Jitter:  time.Millisecond * 4,
+				Loss:    0.05,
+			})
+			c := centauritest.NewSimulated(t, sim, 3)
+			id := c.Send(0, "default", []byte("hello"))
+			c.WaitReplicated("default", id, time.Second*20)
+			if got := string(c.Get(2, "default", id)); got != "hello" {
+				t.Errorf("node 2: got %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestSimulatedScheduledPartition(t *testing.T) {
+	for _, seed := range seeds {
+		seed := seed
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			t.Parallel()
+			sim := centauritest.NewNetwork(centauritest.NetworkConfig{
+				Seed:    seed,
+				Latency: time.Millisecond,
+				Jitter:  time.Millisecond * 4,
+			})
+			c := centauritest.NewSimulated(t, sim, 3)
+			id := c.Send(0, "default", []byte("hello"))
+			c.WaitReplicated("default", id, time.Second*10)
+			c.Schedule(centauritest.PartitionAt(0, []int{0, 1}, []int{2}))
+			c.Eventually(time.Second*5, func() bool {
+				return !sim.Reachable(0, 2)
+			}, "partition was not applied")
+			c.WaitConverged(time.Second * 30)
+			// the deletion stays within the partition
+			c.Confirm(1, "default", id)
+			c.Eventually(time.Second*10, func() bool {
+				return c.Tombstoned(0, "default", id) && !c.Stored(0, "default", id)
+			}, "message %s was not deleted within the partition", id)
+			if !c.Stored(2, "default", id) {
+				t.Fatalf("deletion of %s crossed the partition", id)
+			}
+			at := sim.Elapsed() + time.Second
+			c.Schedule(centauritest.HealAt(time.Second))
+			c.Eventually(time.Second*10, func() bool {
+				return sim.Reachable(0, 2)
+			}, "heal was not applied")
+			if sim.Elapsed() < at {
+				t.Fatalf("heal applied at %v, before %v", sim.Elapsed(), at)
+			}
+			c.WaitConverged(time.Second * 30)
+			// deletions reach the healed node again
+			after := c.Send(2, "default", []byte("after"))
+			c.WaitReplicated("default", after, time.Second*10)
+			c.Confirm(0, "default", after)
+			c.WaitDeleted("default", after, time.Second*10)
+		})
+	}
+}
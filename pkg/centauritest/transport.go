@@ -0,0 +1,62 @@
+package centauritest
+
+import (
+	"errors"
+	network "net"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/robertlestak/centauri/internal/net"
+)
+
+var errPartitioned = errors.New("centauritest: peer is partitioned")
+
+// faultTransport wraps the socket transport of a node and drops the
+// traffic the cluster's partitions do not allow.
+type faultTransport struct {
+	net.SocketTransport
+	c   *Cluster
+	idx int
+}
+
+func (t *faultTransport) Gossip(bindAddr string, bindPort int) (memberlist.Transport, error) {
+	mt, err := t.SocketTransport.Gossip(bindAddr, bindPort)
+	if err != nil {
+		return nil, err
+	}
+	return &faultGossip{Transport: mt, t: t}, nil
+}
+
+func (t *faultTransport) DialData(addr string) (network.Conn, error) {
+	if !t.c.reachable(t.idx, addr) {
+		return nil, errPartitioned
+	}
+	return t.SocketTransport.DialData(addr)
+}
+
+type faultGossip struct {
+	memberlist.Transport
+	t *faultTransport
+}
+
+func (g *faultGossip) WriteTo(b []byte, addr string) (time.Time, error) {
+	if !g.t.c.reachable(g.t.idx, addr) {
+		// dropped packets are not an error for an unreliable transport
+		return time.Now(), nil
+	}
+	return g.Transport.WriteTo(b, addr)
+}
+
+func (g *faultGossip) DialTimeout(addr string, timeout time.Duration) (network.Conn, error) {
+	if !g.t.c.reachable(g.t.idx, addr) {
+		return nil, errPartitioned
+	}
+	return g.Transport.DialTimeout(addr, timeout)
+}
+
+func (g *faultGossip) GetAutoBindPort() int {
+	if ab, ok := g.Transport.(interface{ GetAutoBindPort() int }); ok {
+		return ab.GetAutoBindPort()
+	}
+	return 0
+}
@@ -0,0 +1,317 @@
+// Package client is a Go client for the HTTP API of Centauri peers.
+//
+//	c := client.New("https://peer-1:5666", "https://peer-2:5666")
+//	c.PrivateKey = key
+//	msgs, err := c.List(ctx, "default")
+//
+// Requests go to the healthiest of the configured servers and are retried
+// on other servers according to the Retry policy of the client. Sending a
+// message is only retried if no server processed it, so that a message is
+// never stored twice. The health of the servers is learned from the
+// outcome of requests and from CheckHealth.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/keys"
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryPolicy decides how often and how fast a failed request is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is tried, 1 or less
+	// disables retries.
+	MaxAttempts int
+	// MinBackoff is the wait before the first retry. It doubles on every
+	// further retry up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retryable reports whether a failed attempt is retried. Temporary is
+	// used if it is nil.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy tries a request up to three times.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	MinBackoff:  time.Millisecond * 200,
+	MaxBackoff:  time.Second * 5,
+}
+
+// NoRetry tries every request once.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// Client talks to the HTTP API of one or more peers of a cluster.
+// The fields must not be changed while requests are in flight.
+type Client struct {
+	// Servers are the base URLs of the peers, for example https://peer:5666.
+	Servers []string
+	// AuthToken is sent in the X-Token header if set.
+	AuthToken string
+	// PrivateKey signs the requests which read or delete the messages of
+	// its public key.
+	PrivateKey *rsa.PrivateKey
+	// HTTPClient sends the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+	Retry      RetryPolicy
+	// PollInterval is the time between two listings in Subscribe.
+	PollInterval time.Duration
+	// HealthTimeout is the timeout of a health check, 2s if 0.
+	HealthTimeout time.Duration
+
+	mtx    sync.Mutex
+	next   int
+	health map[string]*serverState
+}
+
+// New returns a client for the peers at servers with the default retry policy.
+func New(servers ...string) *Client {
+	c := &Client{
+		Retry:        DefaultRetryPolicy,
+		PollInterval: time.Second * 10,
+	}
+	for _, s := range servers {
+		if s = strings.TrimSpace(s); s != "" {
+			c.Servers = append(c.Servers, strings.TrimRight(s, "/"))
+		}
+	}
+	if len(c.Servers) > 0 {
+		c.next = rand.Intn(len(c.Servers))
+	}
+	return c
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// PublicKeyID returns the ID of the public key of the client's private key.
+func (c *Client) PublicKeyID() (string, error) {
+	pub, err := c.publicKey()
+	if err != nil {
+		return "", err
+	}
+	return keys.PubKeyID(pub), nil
+}
+
+func (c *Client) publicKey() ([]byte, error) {
+	if c.PrivateKey == nil {
+		return nil, ErrNoPrivateKey
+	}
+	return keys.MarshalPublicKey(&c.PrivateKey.PublicKey)
+}
+
+// Signature returns the value of the X-Signature header which proves
+// ownership of the client's private key, and the ID of its public key.
+// A signature is only accepted by the servers for a short time.
+func (c *Client) Signature() (string, string, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "Signature",
+	})
+	l.Debug("creating signature")
+	pub, err := c.publicKey()
+	if err != nil {
+		l.Errorf("error getting public key: %v", err)
+		return "", "", err
+	}
+	jd, err := json.Marshal(sign.SignedMessageData{Timestamp: time.Now().Unix()})
+	if err != nil {
+		l.Errorf("error marshalling timestamp: %v", err)
+		return "", "", err
+	}
+	sig, err := sign.Sign(jd, c.PrivateKey)
+	if err != nil {
+		l.Errorf("error creating signature: %v", err)
+		return "", "", err
+	}
+	j, err := json.Marshal(sign.SignedRequest{
+		PublicKey: pub,
+		Data:      jd,
+		Signature: sig,
+	})
+	if err != nil {
+		l.Errorf("error marshalling signature request: %v", err)
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(j), keys.PubKeyID(pub), nil
+}
+
+// request describes an API call. body is sent again on every attempt.
+type request struct {
+	method string
+	path   string
+	body   []byte
+	signed bool
+	// status is the expected status code, 200 if 0
+	status int
+	// header receives the headers of the response if it is not nil
+	header http.Header
+	// idempotent is set for POST requests which can be repeated without
+	// effect, like the publishing of a signed statement
+	idempotent bool
+}
+
+// repeatable reports whether req may be sent again after it may have
+// been processed by a server.
+func (req request) repeatable() bool {
+	switch req.method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return req.idempotent
+}
+
+// do sends req, retrying it according to the retry policy, and returns
+// the body of the response. Every attempt goes to the next server in the
+// order of their health, and servers which fail are marked as down.
+// Requests which are not repeatable, like sending a message, are only
+// retried if the server did not process them, so that they are never
+// processed twice. A misdirected request goes on to the next server without counting as
+// an attempt, until every server was tried.
+func (c *Client) do(ctx context.Context, req request) ([]byte, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":    "client",
+		"fn":     "do",
+		"method": req.method,
+		"path":   req.path,
+	})
+	retryable := c.Retry.Retryable
+	if retryable == nil {
+		retryable = Temporary
+	}
+	if len(c.Servers) == 0 {
+		return nil, ErrNoServers
+	}
+	servers := c.order()
+	next := 0
+	for attempt := 1; ; attempt++ {
+		saddr := servers[next%len(servers)]
+		next++
+		var sig string
+		if req.signed {
+			var err error
+			if sig, _, err = c.Signature(); err != nil {
+				return nil, err
+			}
+		}
+		bd, err := c.try(ctx, saddr, req, sig)
+		if err == nil {
+			c.markUp(saddr)
+			return bd, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, ErrMisdirected) && next < len(servers) {
+			c.markUp(saddr)
+			attempt--
+			continue
+		}
+		if isServerFailure(err) {
+			c.markDown(saddr, err)
+		} else {
+			c.markUp(saddr)
+		}
+		if attempt >= c.Retry.MaxAttempts || !retryable(err) || (!req.repeatable() && !notProcessed(err)) {
+			if isServerFailure(err) && c.allDown() {
+				return nil, &allDownError{last: err}
+			}
+			return nil, err
+		}
+		l.Debugf("attempt %d failed, retrying: %v", attempt, err)
+		t := time.NewTimer(c.Retry.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// try sends req to the server saddr with the signature sig.
+func (c *Client) try(ctx context.Context, saddr string, req request, sig string) ([]byte, error) {
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	hr, err := http.NewRequestWithContext(ctx, req.method, saddr+req.path, body)
+	if err != nil {
+		return nil, err
+	}
+	if req.body != nil {
+		hr.Header.Set("Content-Type", "application/json")
+	}
+	if sig != "" {
+		hr.Header.Set("X-Signature", sig)
+	}
+	if c.AuthToken != "" {
+		hr.Header.Set("X-Token", c.AuthToken)
+	}
+	resp, err := c.httpClient().Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bd, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	want := req.status
+	if want == 0 {
+		want = http.StatusOK
+	}
+	if resp.StatusCode != want {
+		return nil, &Error{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(bd)),
+		}
+	}
+	if req.header != nil {
+		for k, v := range resp.Header {
+			req.header[k] = v
+		}
+	}
+	return bd, nil
+}
+
+// getJSON sends req and decodes the response into v.
+func (c *Client) getJSON(ctx context.Context, req request, v interface{}) error {
+	bd, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(bd, v); err != nil {
+		return errors.New("centauri: invalid response: " + err.Error())
+	}
+	return nil
+}
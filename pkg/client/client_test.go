@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer answers the requests with the status codes of statuses in
+// turn, 200 once they are used up, and counts the requests.
+type testServer struct {
+	*httptest.Server
+	mtx      sync.Mutex
+	statuses []int
+	calls    int
+}
+
+func newTestServer(t *testing.T, statuses ...int) *testServer {
+	t.Helper()
+	ts := &testServer{statuses: statuses}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mtx.Lock()
+		status := http.StatusOK
+		if ts.calls < len(ts.statuses) {
+			status = ts.statuses[ts.calls]
+		}
+		ts.calls++
+		ts.mtx.Unlock()
+		w.WriteHeader(status)
+		fmt.Fprint(w, http.StatusText(status))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *testServer) Calls() int {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	return ts.calls
+}
+
+// closedServer returns the URL of a server which refuses connections.
+func closedServer(t *testing.T) string {
+	t.Helper()
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	return ts.URL
+}
+
+// newTestClient returns a client which tries the servers in the given
+// order and retries without waiting.
+func newTestClient(maxAttempts int, servers ...string) *Client {
+	c := New(servers...)
+	c.next = 0
+	c.Retry = RetryPolicy{MaxAttempts: maxAttempts, MinBackoff: time.Millisecond}
+	return c
+}
+
+func dialError() error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+}
+
+func TestTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrServer, true},
+		{ErrUnavailable, true},
+		{ErrTooMany, true},
+		{&Error{StatusCode: http.StatusBadGateway}, true},
+		{dialError(), true},
+		{ErrBadRequest, false},
+		{ErrNotFound, false},
+		{ErrConflict, false},
+		{ErrNoServers, false},
+		{ErrNoPrivateKey, false},
+	}
+	for _, tt := range tests {
+		if got := Temporary(tt.err); got != tt.want {
+			t.Errorf("Temporary(%v): got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNotProcessed(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrUnavailable, true},
+		{ErrTooMany, true},
+		{dialError(), true},
+		{fmt.Errorf("post: %w", dialError()), true},
+		// the server may have stored the message before it failed
+		{ErrServer, false},
+		{&Error{StatusCode: http.StatusBadGateway}, false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}, false},
+		{errors.New("unexpected EOF"), false},
+		{ErrBadRequest, false},
+	}
+	for _, tt := range tests {
+		if got := notProcessed(tt.err); got != tt.want {
+			t.Errorf("notProcessed(%v): got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: time.Second, MaxBackoff: time.Second * 5}
+	for i, want := range []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5} {
+		if got := p.backoff(i + 1); got != want {
+			t.Errorf("backoff(%d): got %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestDoRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       request
+		statuses  []int
+		wantCalls int
+		wantErr   error
+	}{
+		{"get after server error", request{method: "GET", path: "/"}, []int{500}, 2, nil},
+		{"get until attempts run out", request{method: "GET", path: "/"}, []int{500, 500, 500, 500}, 3, ErrServer},
+		{"get after client error", request{method: "GET", path: "/"}, []int{400}, 1, ErrBadRequest},
+		{"post after unavailable", request{method: "POST", path: "/"}, []int{503}, 2, nil},
+		{"post after rate limit", request{method: "POST", path: "/"}, []int{429}, 2, nil},
+		{"post after server error", request{method: "POST", path: "/"}, []int{500}, 1, ErrServer},
+		{"idempotent post after server error", request{method: "POST", path: "/", idempotent: true}, []int{500}, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, tt.statuses...)
+			c := newTestClient(3, ts.URL)
+			_, err := c.do(context.Background(), tt.req)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("got error %v", err)
+			} else if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got := ts.Calls(); got != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDoRetriesPostOnNextServerAfterDialError(t *testing.T) {
+	ts := newTestServer(t)
+	c := newTestClient(2, closedServer(t), ts.URL)
+	if _, err := c.do(context.Background(), request{method: "POST", path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.Calls(); got != 1 {
+		t.Errorf("got %d calls, want 1", got)
+	}
+}
+
+func TestDoMisdirectedDoesNotCountAsAttempt(t *testing.T) {
+	misdirected := newTestServer(t, http.StatusMisdirectedRequest)
+	ts := newTestServer(t)
+	c := newTestClient(1, misdirected.URL, ts.URL)
+	if _, err := c.do(context.Background(), request{method: "POST", path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if misdirected.Calls() != 1 || ts.Calls() != 1 {
+		t.Errorf("got %d and %d calls, want 1 and 1", misdirected.Calls(), ts.Calls())
+	}
+}
+
+func TestDoAllServersDown(t *testing.T) {
+	c := newTestClient(3, closedServer(t), closedServer(t))
+	_, err := c.do(context.Background(), request{method: "GET", path: "/"})
+	if !errors.Is(err, ErrAllServersDown) {
+		t.Errorf("got %v, want %v", err, ErrAllServersDown)
+	}
+	if _, err := New().do(context.Background(), request{method: "GET", path: "/"}); !errors.Is(err, ErrNoServers) {
+		t.Errorf("without servers: got %v, want %v", err, ErrNoServers)
+	}
+}
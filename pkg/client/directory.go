@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+// PublishKeyRecord publishes the key record r to the key directory of
+// the cluster.
+func (c *Client) PublishKeyRecord(ctx context.Context, r *sign.KeyRecord) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "PublishKeyRecord",
+	})
+	l.Debug("publishing key record")
+	jd, err := json.Marshal(r)
+	if err != nil {
+		l.Errorf("error marshalling key record: %v", err)
+		return err
+	}
+	if _, err := c.do(ctx, request{method: "POST", path: "/directory", body: jd, idempotent: true}); err != nil {
+		l.Errorf("error publishing key record: %v", err)
+		return err
+	}
+	return nil
+}
+
+// KeyRecord returns the verified key directory record of the key keyID,
+// or an error matching ErrNotFound if there is none.
+func (c *Client) KeyRecord(ctx context.Context, keyID string) (*sign.KeyRecord, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "KeyRecord",
+		"key": keyID,
+	})
+	l.Debug("getting key record")
+	r := &sign.KeyRecord{}
+	if err := c.getJSON(ctx, request{method: "GET", path: "/directory/" + url.PathEscape(keyID)}, r); err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			l.Errorf("error getting key record: %v", err)
+		}
+		return nil, err
+	}
+	if err := verifyKeyRecord(r); err != nil {
+		l.Errorf("invalid key record: %v", err)
+		return nil, err
+	}
+	if r.ID != keyID {
+		return nil, errors.New("centauri: record of another key returned")
+	}
+	return r, nil
+}
+
+// FindKeyRecords returns the verified key directory records whose name
+// is name, ignoring case, newest first. Records which fail verification
+// are left out.
+func (c *Client) FindKeyRecords(ctx context.Context, name string) ([]*sign.KeyRecord, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "client",
+		"fn":   "FindKeyRecords",
+		"name": name,
+	})
+	l.Debug("finding key records")
+	var rs []*sign.KeyRecord
+	if err := c.getJSON(ctx, request{method: "GET", path: "/directory?name=" + url.QueryEscape(name)}, &rs); err != nil {
+		l.Errorf("error finding key records: %v", err)
+		return nil, err
+	}
+	var valid []*sign.KeyRecord
+	for _, r := range rs {
+		if err := verifyKeyRecord(r); err != nil {
+			l.Errorf("invalid key record %s: %v", r.ID, err)
+			continue
+		}
+		valid = append(valid, r)
+	}
+	return valid, nil
+}
+
+// verifyKeyRecord checks the self-signature of a record returned by a
+// server, which is not trusted because of the server it came from.
+func verifyKeyRecord(r *sign.KeyRecord) error {
+	if err := r.Verify(); err != nil {
+		return err
+	}
+	if r.Expired(time.Now()) {
+		return errors.New("centauri: key record expired")
+	}
+	return nil
+}
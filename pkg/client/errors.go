@@ -0,0 +1,74 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Error is returned when a server responds with an unexpected status code.
+// Compare it with the Err* values using errors.Is to check the kind of
+// failure, or use errors.As to read the message of the server.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("centauri: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("centauri: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is reports whether target is an *Error with the same status code and
+// either no message or the same message.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.StatusCode == e.StatusCode && (t.Message == "" || t.Message == e.Message)
+}
+
+var (
+	ErrBadRequest   = &Error{StatusCode: http.StatusBadRequest}
+	ErrUnauthorized = &Error{StatusCode: http.StatusUnauthorized}
+	ErrForbidden    = &Error{StatusCode: http.StatusForbidden}
+	ErrNotFound     = &Error{StatusCode: http.StatusNotFound}
+	ErrConflict     = &Error{StatusCode: http.StatusConflict}
+	ErrGone         = &Error{StatusCode: http.StatusGone}
+	ErrMisdirected  = &Error{StatusCode: http.StatusMisdirectedRequest}
+	ErrTooMany      = &Error{StatusCode: http.StatusTooManyRequests}
+	ErrServer       = &Error{StatusCode: http.StatusInternalServerError}
+	ErrUnavailable  = &Error{StatusCode: http.StatusServiceUnavailable}
+
+	// ErrNoServers is returned when the client has no server addresses.
+	ErrNoServers = errors.New("centauri: no server addresses")
+	// ErrNoPrivateKey is returned by the methods which must sign their
+	// request when the client has no private key.
+	ErrNoPrivateKey = errors.New("centauri: no private key")
+)
+
+// Temporary reports whether err is worth retrying: a failure to reach
+// the server, a server error or a rate limit.
+func Temporary(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, ErrNoServers) && !errors.Is(err, ErrNoPrivateKey)
+}
+
+// notProcessed reports whether the failed request err was certainly not
+// processed by the server: the connection failed or the server refused
+// the request because it is shutting down or rate limited.
+func notProcessed(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusTooManyRequests
+	}
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrAllServersDown is matched by the error returned when a request failed
+// and none of the servers of the client is healthy.
+var ErrAllServersDown = errors.New("centauri: all servers are down")
+
+type allDownError struct {
+	last error
+}
+
+func (e *allDownError) Error() string {
+	return ErrAllServersDown.Error() + ": " + e.last.Error()
+}
+
+func (e *allDownError) Is(target error) bool {
+	return target == ErrAllServersDown
+}
+
+func (e *allDownError) Unwrap() error {
+	return e.last
+}
+
+// ServerHealth is the last known state of a server.
+type ServerHealth struct {
+	Server  string `json:"server"`
+	Healthy bool   `json:"healthy"`
+	// Latency is the moving average of the round trip time of the health
+	// checks, 0 if the server has not been checked.
+	Latency   time.Duration `json:"latency"`
+	CheckedAt time.Time     `json:"checkedAt,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type serverState struct {
+	down      bool
+	latency   time.Duration
+	checkedAt time.Time
+	err       error
+}
+
+// state returns the state of server s. It must be called with c.mtx held.
+func (c *Client) state(s string) *serverState {
+	if c.health == nil {
+		c.health = map[string]*serverState{}
+	}
+	st, ok := c.health[s]
+	if !ok {
+		st = &serverState{}
+		c.health[s] = st
+	}
+	return st
+}
+
+// markUp records a successful call to server s.
+func (c *Client) markUp(s string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	st := c.state(s)
+	st.down = false
+	st.err = nil
+}
+
+// markDown records a failed call to server s.
+func (c *Client) markDown(s string, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	st := c.state(s)
+	st.down = true
+	st.err = err
+}
+
+// allDown reports whether every server is marked as down.
+func (c *Client) allDown() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, s := range c.Servers {
+		if !c.state(s).down {
+			return false
+		}
+	}
+	return true
+}
+
+// order returns the servers in the order a request tries them: healthy
+// servers by ascending latency, then servers which have not been checked
+// yet and last the servers which are down. Servers of the same rank are
+// rotated in round-robin order between requests.
+func (c *Client) order() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	n := len(c.Servers)
+	servers := make([]string, n)
+	for i := range servers {
+		servers[i] = c.Servers[(c.next+i)%n]
+	}
+	c.next++
+	rank := func(s string) int {
+		st := c.state(s)
+		switch {
+		case st.down:
+			return 2
+		case st.latency == 0:
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		ri, rj := rank(servers[i]), rank(servers[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return ri == 0 && c.state(servers[i]).latency < c.state(servers[j]).latency
+	})
+	return servers
+}
+
+// Health returns the last known state of every server.
+func (c *Client) Health() []ServerHealth {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var hs []ServerHealth
+	for _, s := range c.Servers {
+		st := c.state(s)
+		h := ServerHealth{
+			Server:    s,
+			Healthy:   !st.down,
+			Latency:   st.latency,
+			CheckedAt: st.checkedAt,
+		}
+		if st.err != nil {
+			h.Error = st.err.Error()
+		}
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+// CheckHealth requests /statusz from every server and records whether it
+// answered and how long it took. It returns an error matching
+// ErrAllServersDown if no server is healthy.
+func (c *Client) CheckHealth(ctx context.Context) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "CheckHealth",
+	})
+	l.Debug("checking server health")
+	if len(c.Servers) == 0 {
+		return ErrNoServers
+	}
+	timeout := c.HealthTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 2
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(c.Servers))
+	for i, s := range c.Servers {
+		wg.Add(1)
+		go func(i int, s string) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			_, err := c.try(cctx, s, request{method: "GET", path: "/statusz"}, "")
+			rtt := time.Since(start)
+			errs[i] = err
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+			st := c.state(s)
+			st.checkedAt = time.Now()
+			st.err = err
+			st.down = err != nil
+			if err != nil {
+				l.Debugf("server %s is down: %v", s, err)
+				return
+			}
+			if st.latency == 0 {
+				st.latency = rtt
+			} else {
+				st.latency = (st.latency*3 + rtt) / 4
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	var last error
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+		last = err
+	}
+	return &allDownError{last: last}
+}
+
+// CheckHealthEvery runs CheckHealth every interval until ctx is done.
+func (c *Client) CheckHealthEvery(ctx context.Context, interval time.Duration) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "CheckHealthEvery",
+	})
+	for {
+		if err := c.CheckHealth(ctx); err != nil && ctx.Err() == nil {
+			l.Errorf("health check failed: %v", err)
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// isServerFailure reports whether err means the server itself failed, as
+// opposed to rejecting the request.
+func isServerFailure(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode >= 500
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
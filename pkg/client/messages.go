@@ -0,0 +1,458 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/api"
+	"github.com/robertlestak/centauri/pkg/keys"
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageMeta describes a message held by the cluster.
+type MessageMeta struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	PubKeyID  string    `json:"pubKeyID,omitempty"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type (
+	// MessageStatus is the replication state of a message across the
+	// cluster.
+	MessageStatus = api.Status
+	// PeerMessageStatus is the replication state of a message on a
+	// single peer.
+	PeerMessageStatus = api.PeerStatus
+)
+
+// Message is a decrypted message. Type is "file" if the message was sent
+// with a file name, "bytes" otherwise.
+type Message struct {
+	ID       string
+	Channel  string
+	Type     string
+	FileName string
+	Data     []byte
+}
+
+func messagePath(keyID, channel, id string) string {
+	return "/message/" + keyID + "/" + api.CleanString(channel) + "/" + id
+}
+
+// Send encrypts data for the public key pubKey and sends it to channel.
+func (c *Client) Send(ctx context.Context, pubKey []byte, channel string, data io.Reader) (*MessageMeta, error) {
+	return c.send(ctx, pubKey, channel, "bytes", "", data)
+}
+
+// SendFile is like Send but sends the data as a file named fileName.
+func (c *Client) SendFile(ctx context.Context, pubKey []byte, channel string, fileName string, data io.Reader) (*MessageMeta, error) {
+	return c.send(ctx, pubKey, channel, "file", fileName, data)
+}
+
+func (c *Client) send(ctx context.Context, pubKey []byte, channel, mType, fileName string, data io.Reader) (*MessageMeta, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "send",
+	})
+	l.Debug("sending message")
+	m, err := api.CreateMessage(mType, fileName, channel, keys.PubKeyID(pubKey), pubKey, ioutil.NopCloser(data))
+	if err != nil {
+		l.Errorf("error creating message: %v", err)
+		return nil, err
+	}
+	return c.SendMessage(ctx, m)
+}
+
+// SendMessage sends a message which is already encrypted.
+func (c *Client) SendMessage(ctx context.Context, m *api.Message) (*MessageMeta, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "SendMessage",
+	})
+	jd, err := json.Marshal(m)
+	if err != nil {
+		l.Errorf("error marshalling message: %v", err)
+		return nil, err
+	}
+	md := &MessageMeta{}
+	if err := c.getJSON(ctx, request{
+		method: "POST",
+		path:   "/message",
+		body:   jd,
+		status: http.StatusAccepted,
+	}, md); err != nil {
+		l.Errorf("error sending message: %v", err)
+		return nil, err
+	}
+	return md, nil
+}
+
+// List returns the messages for the client's key in channel, or in all
+// channels if channel is empty.
+func (c *Client) List(ctx context.Context, channel string) ([]MessageMeta, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "List",
+		"ch":  channel,
+	})
+	l.Debug("listing messages")
+	path := "/messages"
+	if channel != "" {
+		path += "?channel=" + api.CleanString(channel)
+	}
+	var msgs []MessageMeta
+	if err := c.getJSON(ctx, request{method: "GET", path: path, signed: true}, &msgs); err != nil {
+		l.Errorf("error listing messages: %v", err)
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// ListQuery selects, orders and pages the messages listed by ListPage.
+// The zero value lists all messages of all channels, oldest first.
+type ListQuery struct {
+	// Channel selects a channel, all channels if empty.
+	Channel string
+	// CreatedAfter and CreatedBefore select the messages stored within
+	// the interval, they are ignored if zero.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// MinSize and MaxSize select the messages of at least and at most
+	// this many bytes, they are ignored if 0.
+	MinSize int64
+	MaxSize int64
+	// Sort is "created" or "size", "created" if empty.
+	Sort string
+	// Desc reverses the order.
+	Desc bool
+	// Limit is the most messages returned, all if 0.
+	Limit int
+	// Cursor continues a listing, see MessagePage.NextCursor.
+	Cursor string
+}
+
+func (q ListQuery) values() url.Values {
+	v := url.Values{}
+	if q.Channel != "" {
+		v.Set("channel", api.CleanString(q.Channel))
+	}
+	if !q.CreatedAfter.IsZero() {
+		v.Set("createdAfter", q.CreatedAfter.Format(time.RFC3339Nano))
+	}
+	if !q.CreatedBefore.IsZero() {
+		v.Set("createdBefore", q.CreatedBefore.Format(time.RFC3339Nano))
+	}
+	if q.MinSize > 0 {
+		v.Set("minSize", strconv.FormatInt(q.MinSize, 10))
+	}
+	if q.MaxSize > 0 {
+		v.Set("maxSize", strconv.FormatInt(q.MaxSize, 10))
+	}
+	if q.Sort != "" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Desc {
+		v.Set("order", "desc")
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Cursor != "" {
+		v.Set("cursor", q.Cursor)
+	}
+	return v
+}
+
+// MessagePage is a page of a message listing.
+type MessagePage struct {
+	Messages []MessageMeta `json:"messages"`
+	// Total is the number of messages matching the query on all pages.
+	Total int `json:"total"`
+	// NextCursor is the Cursor of the next page, empty on the last page.
+	// A cursor is only valid for the same Sort and on the peer which
+	// returned it, ListPage tries the servers of the client until it
+	// finds that peer.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ListPage returns the page of the messages for the client's key
+// selected by q.
+func (c *Client) ListPage(ctx context.Context, q ListQuery) (*MessagePage, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "ListPage",
+		"ch":  q.Channel,
+	})
+	l.Debug("listing messages")
+	hd := http.Header{}
+	page := &MessagePage{}
+	if err := c.getJSON(ctx, request{
+		method: "GET",
+		path:   "/messages?" + q.values().Encode(),
+		signed: true,
+		header: hd,
+	}, &page.Messages); err != nil {
+		l.Errorf("error listing messages: %v", err)
+		return nil, err
+	}
+	page.Total = len(page.Messages)
+	if t, err := strconv.Atoi(hd.Get("X-Total-Count")); err == nil {
+		page.Total = t
+	}
+	page.NextCursor = hd.Get("X-Next-Cursor")
+	return page, nil
+}
+
+// ListWait is like List but waits up to wait for the listing to differ
+// from the one of the messages known, given by their IDs. Servers which
+// do not support waiting answer at once.
+func (c *Client) ListWait(ctx context.Context, channel string, known []string, wait time.Duration) ([]MessageMeta, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "ListWait",
+		"ch":  channel,
+	})
+	l.Debug("waiting for messages")
+	q := url.Values{}
+	if channel != "" {
+		q.Set("channel", api.CleanString(channel))
+	}
+	q.Set("wait", strconv.Itoa(int(wait/time.Second)))
+	q.Set("known", api.ListingDigest(known))
+	var msgs []MessageMeta
+	if err := c.getJSON(ctx, request{method: "GET", path: "/messages?" + q.Encode(), signed: true}, &msgs); err != nil {
+		// waiting until ctx is done is the normal way to stop
+		if ctx.Err() == nil {
+			l.Errorf("error listing messages: %v", err)
+		}
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// GetEncrypted returns the message as stored in the cluster, without
+// decrypting it.
+func (c *Client) GetEncrypted(ctx context.Context, channel, id string) (*api.Message, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "GetEncrypted",
+		"id":  id,
+		"ch":  channel,
+	})
+	l.Debug("getting message")
+	if channel == "" || id == "" {
+		return nil, errors.New("centauri: missing channel or id")
+	}
+	keyID, err := c.PublicKeyID()
+	if err != nil {
+		return nil, err
+	}
+	bd, err := c.do(ctx, request{method: "GET", path: messagePath(keyID, channel, id), signed: true})
+	if err != nil {
+		l.Errorf("error getting message: %v", err)
+		return nil, err
+	}
+	return &api.Message{
+		ID:          id,
+		Channel:     channel,
+		PublicKeyID: keyID,
+		Data:        bd,
+	}, nil
+}
+
+// Get returns the decrypted message.
+func (c *Client) Get(ctx context.Context, channel, id string) (*Message, error) {
+	m, err := c.GetEncrypted(ctx, channel, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.Decrypt(m.Data)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMessage(id, channel, data), nil
+}
+
+// Decrypt decrypts the data of a message with the client's private key.
+func (c *Client) Decrypt(data []byte) ([]byte, error) {
+	if c.PrivateKey == nil {
+		return nil, ErrNoPrivateKey
+	}
+	kb := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(c.PrivateKey),
+	})
+	return keys.DecryptMessage(kb, strings.TrimSpace(string(data)))
+}
+
+// ParseMessage splits the optional file name prefix from the decrypted
+// data of a message.
+func ParseMessage(id, channel string, data []byte) *Message {
+	m := &Message{
+		ID:      id,
+		Channel: channel,
+		Type:    "bytes",
+		Data:    data,
+	}
+	// format:
+	// file:<filename>|<[]byte of file data>
+	if !bytes.HasPrefix(data, []byte("file:")) {
+		return m
+	}
+	i := bytes.IndexByte(data, '|')
+	if i <= len("file:") {
+		return m
+	}
+	m.Type = "file"
+	m.FileName = string(data[len("file:"):i])
+	m.Data = data[i+1:]
+	return m
+}
+
+// Status returns which peers hold the message.
+func (c *Client) Status(ctx context.Context, channel, id string) (*MessageStatus, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "Status",
+		"id":  id,
+		"ch":  channel,
+	})
+	l.Debug("getting message status")
+	if channel == "" || id == "" {
+		return nil, errors.New("centauri: missing channel or id")
+	}
+	keyID, err := c.PublicKeyID()
+	if err != nil {
+		return nil, err
+	}
+	st := &MessageStatus{}
+	if err := c.getJSON(ctx, request{method: "GET", path: messagePath(keyID, channel, id) + "/status", signed: true}, st); err != nil {
+		l.Errorf("error getting message status: %v", err)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Confirm confirms that the message has been received, which deletes it
+// from the cluster.
+func (c *Client) Confirm(ctx context.Context, channel, id string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "Confirm",
+		"id":  id,
+		"ch":  channel,
+	})
+	l.Debug("confirming message receive")
+	if channel == "" || id == "" {
+		return errors.New("centauri: missing channel or id")
+	}
+	keyID, err := c.PublicKeyID()
+	if err != nil {
+		return err
+	}
+	if _, err := c.do(ctx, request{method: "DELETE", path: messagePath(keyID, channel, id), signed: true}); err != nil {
+		l.Errorf("error confirming message receive: %v", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteMessages deletes the messages refs of the client's key in
+// batches of up to api.MaxDeletionSet, each announced to the cluster
+// as one deletion set. It returns the number of messages which were
+// stored on the peers which deleted them.
+func (c *Client) DeleteMessages(ctx context.Context, refs []api.MessageRef) (int, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "DeleteMessages",
+	})
+	l.Debugf("deleting %d messages", len(refs))
+	var deleted int
+	for len(refs) > 0 {
+		batch := refs
+		if len(batch) > api.MaxDeletionSet {
+			batch = batch[:api.MaxDeletionSet]
+		}
+		refs = refs[len(batch):]
+		jd, err := json.Marshal(api.DeleteRequest{Messages: batch})
+		if err != nil {
+			l.Errorf("error marshalling delete request: %v", err)
+			return deleted, err
+		}
+		res := &api.DeleteResult{}
+		if err := c.getJSON(ctx, request{
+			method: "POST",
+			path:   "/messages/delete",
+			body:   jd,
+			signed: true,
+		}, res); err != nil {
+			l.Errorf("error deleting messages: %v", err)
+			return deleted, err
+		}
+		deleted += res.Deleted
+	}
+	return deleted, nil
+}
+
+// Handler processes a message received by Subscribe.
+type Handler func(ctx context.Context, m *Message) error
+
+// Subscribe polls channel every PollInterval and calls h for each message.
+// A message is confirmed once h returns nil; if h returns an error the
+// message is handed to h again on the next poll. Subscribe returns when
+// ctx is done or when listing fails with an error which is not Temporary.
+func (c *Client) Subscribe(ctx context.Context, channel string, h Handler) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "Subscribe",
+		"ch":  channel,
+	})
+	l.Debug("subscribing")
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = time.Second * 10
+	}
+	for {
+		msgs, err := c.List(ctx, channel)
+		if err != nil && ctx.Err() == nil && !Temporary(err) {
+			return err
+		}
+		for _, md := range msgs {
+			if ctx.Err() != nil {
+				break
+			}
+			m, err := c.Get(ctx, md.Channel, md.ID)
+			if err != nil {
+				l.Errorf("error getting message %s: %v", md.ID, err)
+				continue
+			}
+			if err := h(ctx, m); err != nil {
+				l.Errorf("error handling message %s: %v", md.ID, err)
+				continue
+			}
+			if err := c.Confirm(ctx, md.Channel, md.ID); err != nil {
+				l.Errorf("error confirming message %s: %v", md.ID, err)
+			}
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
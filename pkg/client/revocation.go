@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+// PublishRevocation publishes the revocation r to the cluster. Requests
+// signed by the revoked key are then refused with ErrForbidden, and
+// messages to it with ErrGone.
+func (c *Client) PublishRevocation(ctx context.Context, r *sign.Revocation) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "PublishRevocation",
+	})
+	l.Debug("publishing revocation")
+	jd, err := json.Marshal(r)
+	if err != nil {
+		l.Errorf("error marshalling revocation: %v", err)
+		return err
+	}
+	if _, err := c.do(ctx, request{method: "POST", path: "/revocation", body: jd, idempotent: true}); err != nil {
+		l.Errorf("error publishing revocation: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Revocation returns the verified revocation of the key keyID, or an
+// error matching ErrNotFound if the key was not revoked.
+func (c *Client) Revocation(ctx context.Context, keyID string) (*sign.Revocation, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "Revocation",
+		"key": keyID,
+	})
+	l.Debug("getting revocation")
+	r := &sign.Revocation{}
+	if err := c.getJSON(ctx, request{method: "GET", path: "/revocation/" + keyID}, r); err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			l.Errorf("error getting revocation: %v", err)
+		}
+		return nil, err
+	}
+	if err := r.Verify(); err != nil {
+		l.Errorf("invalid revocation: %v", err)
+		return nil, err
+	}
+	if r.KeyID() != keyID {
+		return nil, errors.New("centauri: revocation of another key returned")
+	}
+	return r, nil
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+// PublishRotation publishes the key rotation statement r to the cluster.
+// Senders which look the old key up are pointed to the new key, and
+// messages to the old key are refused with ErrGone once it is retired.
+func (c *Client) PublishRotation(ctx context.Context, r *sign.Rotation) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "PublishRotation",
+	})
+	l.Debug("publishing rotation")
+	jd, err := json.Marshal(r)
+	if err != nil {
+		l.Errorf("error marshalling rotation: %v", err)
+		return err
+	}
+	if _, err := c.do(ctx, request{method: "POST", path: "/rotation", body: jd, idempotent: true}); err != nil {
+		l.Errorf("error publishing rotation: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Rotation returns the verified rotation statement of the key keyID, or
+// an error matching ErrNotFound if the key was not rotated.
+func (c *Client) Rotation(ctx context.Context, keyID string) (*sign.Rotation, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "client",
+		"fn":  "Rotation",
+		"key": keyID,
+	})
+	l.Debug("getting rotation")
+	r := &sign.Rotation{}
+	if err := c.getJSON(ctx, request{method: "GET", path: "/rotation/" + keyID}, r); err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			l.Errorf("error getting rotation: %v", err)
+		}
+		return nil, err
+	}
+	// the statement is not trusted because of the server it came from
+	if err := r.Verify(); err != nil {
+		l.Errorf("invalid rotation: %v", err)
+		return nil, err
+	}
+	if r.OldKeyID() != keyID {
+		return nil, errors.New("centauri: rotation of another key returned")
+	}
+	return r, nil
+}
@@ -0,0 +1,217 @@
+// Package contacts is an address book which gives the key IDs of the
+// public key chain human names, and groups names together.
+//
+// The book is a YAML file in the data directory of the agent or cent:
+//
+//	contacts:
+//	  alice:
+//	    keyID: 16afdd13bb1c5429818890db84bb0b5865326d9d2508df447c906d0ff4339133
+//	    note: ops on-call
+//	    expires: 2027-01-01T00:00:00Z
+//	groups:
+//	  ops: [alice, bob]
+package contacts
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/robertlestak/centauri/internal/persist"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the name of the address book in a data directory.
+const FileName = "contacts.yaml"
+
+var (
+	// ErrNotFound is returned if a name is neither a contact nor a group.
+	ErrNotFound = errors.New("contact not found")
+	// ErrExpired is returned when an expired contact is resolved.
+	ErrExpired = errors.New("contact expired")
+)
+
+// Contact is a named public key.
+type Contact struct {
+	KeyID string `yaml:"keyID" json:"keyID"`
+	Note  string `yaml:"note,omitempty" json:"note,omitempty"`
+	// Expires is the time after which the contact is not resolved anymore.
+	Expires *time.Time `yaml:"expires,omitempty" json:"expires,omitempty"`
+}
+
+// Expired reports whether the contact expired at t.
+func (c *Contact) Expired(t time.Time) bool {
+	return c.Expires != nil && t.After(*c.Expires)
+}
+
+// Book maps names to contacts and group names to the names of their members.
+type Book struct {
+	Contacts map[string]*Contact `yaml:"contacts" json:"contacts"`
+	Groups   map[string][]string `yaml:"groups,omitempty" json:"groups,omitempty"`
+}
+
+// New returns an empty book.
+func New() *Book {
+	return &Book{
+		Contacts: map[string]*Contact{},
+		Groups:   map[string][]string{},
+	}
+}
+
+// Load reads the book from file. A missing file is an empty book.
+func Load(file string) (*Book, error) {
+	l := log.WithFields(log.Fields{
+		"pkg":  "contacts",
+		"fn":   "Load",
+		"file": file,
+	})
+	l.Debug("loading contacts")
+	b := New()
+	bd, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		l.Errorf("failed to read contacts: %v", err)
+		return nil, err
+	}
+	if err := yaml.Unmarshal(bd, b); err != nil {
+		l.Errorf("failed to decode contacts: %v", err)
+		return nil, err
+	}
+	if b.Contacts == nil {
+		b.Contacts = map[string]*Contact{}
+	}
+	if b.Groups == nil {
+		b.Groups = map[string][]string{}
+	}
+	return b, nil
+}
+
+// Save writes the book to file.
+func (b *Book) Save(file string) error {
+	l := log.WithFields(log.Fields{
+		"pkg":  "contacts",
+		"fn":   "Save",
+		"file": file,
+	})
+	l.Debug("saving contacts")
+	bd, err := yaml.Marshal(b)
+	if err != nil {
+		l.Errorf("failed to encode contacts: %v", err)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		l.Errorf("failed to create dir: %v", err)
+		return err
+	}
+	return persist.WriteFileAtomic(file, bd, 0644)
+}
+
+// Add adds or replaces the contact name. Names must be usable as the
+// names of outgoing directories and must not be the name of a group.
+func (b *Book) Add(name string, c *Contact) error {
+	if !persist.ValidName(name) {
+		return fmt.Errorf("invalid contact name %q", name)
+	}
+	if _, ok := b.Groups[name]; ok {
+		return fmt.Errorf("%q is a group", name)
+	}
+	b.Contacts[name] = c
+	return nil
+}
+
+// Remove removes the contact name from the book and from its groups, or
+// the group name.
+func (b *Book) Remove(name string) error {
+	if _, ok := b.Groups[name]; ok {
+		delete(b.Groups, name)
+		return nil
+	}
+	if _, ok := b.Contacts[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	delete(b.Contacts, name)
+	for g, members := range b.Groups {
+		var ms []string
+		for _, m := range members {
+			if m != name {
+				ms = append(ms, m)
+			}
+		}
+		b.Groups[g] = ms
+	}
+	return nil
+}
+
+// SetGroup sets the members of the group name, which must be contacts.
+func (b *Book) SetGroup(name string, members []string) error {
+	if !persist.ValidName(name) {
+		return fmt.Errorf("invalid group name %q", name)
+	}
+	if _, ok := b.Contacts[name]; ok {
+		return fmt.Errorf("%q is a contact", name)
+	}
+	for _, m := range members {
+		if _, ok := b.Contacts[m]; !ok {
+			return fmt.Errorf("%w: %s", ErrNotFound, m)
+		}
+	}
+	b.Groups[name] = members
+	return nil
+}
+
+// Has reports whether name is a contact or a group.
+func (b *Book) Has(name string) bool {
+	_, c := b.Contacts[name]
+	_, g := b.Groups[name]
+	return c || g
+}
+
+// Resolve returns the key IDs of the contact or the members of the group
+// name. It fails if one of the contacts expired.
+func (b *Book) Resolve(name string) ([]string, error) {
+	names := []string{name}
+	if members, ok := b.Groups[name]; ok {
+		names = members
+	}
+	now := time.Now()
+	var ids []string
+	for _, n := range names {
+		c, ok := b.Contacts[n]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, n)
+		}
+		if c.Expired(now) {
+			return nil, fmt.Errorf("%w: %s on %s", ErrExpired, n, c.Expires.Format(time.RFC3339))
+		}
+		ids = append(ids, c.KeyID)
+	}
+	return ids, nil
+}
+
+// NameOf returns the sorted names of the contacts of the key ID.
+func (b *Book) NameOf(keyID string) []string {
+	var names []string
+	for n, c := range b.Contacts {
+		if c.KeyID == keyID {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Names returns the sorted names of the contacts.
+func (b *Book) Names() []string {
+	var names []string
+	for n := range b.Contacts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,160 @@
+package contacts
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testBook(t *testing.T) *Book {
+	t.Helper()
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	b := New()
+	for name, c := range map[string]*Contact{
+		"alice": {KeyID: "ka", Note: "ops on-call", Expires: &future},
+		"bob":   {KeyID: "kb"},
+		"carol": {KeyID: "kc", Expires: &past},
+		"al":    {KeyID: "ka"},
+	} {
+		if err := b.Add(name, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.SetGroup("ops", []string{"alice", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestResolve(t *testing.T) {
+	b := testBook(t)
+	tests := []struct {
+		name string
+		want []string
+		err  error
+	}{
+		{"alice", []string{"ka"}, nil},
+		{"ops", []string{"ka", "kb"}, nil},
+		{"carol", nil, ErrExpired},
+		{"dave", nil, ErrNotFound},
+	}
+	for _, tt := range tests {
+		got, err := b.Resolve(tt.name)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// a group fails as a whole if one of its members expired
+	if err := b.SetGroup("all", []string{"bob", "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Resolve("all"); !errors.Is(err, ErrExpired) {
+		t.Errorf("all: got error %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := &Contact{Expires: &at}
+	if c.Expired(at) || !c.Expired(at.Add(time.Second)) {
+		t.Error("a contact expires after its expiry")
+	}
+	if (&Contact{}).Expired(at) {
+		t.Error("a contact without expiry expired")
+	}
+}
+
+func TestAddAndSetGroupNames(t *testing.T) {
+	b := testBook(t)
+	for _, name := range []string{"", ".", "..", "a/b", `a\b`} {
+		if err := b.Add(name, &Contact{KeyID: "k"}); err == nil {
+			t.Errorf("added contact %q", name)
+		}
+		if err := b.SetGroup(name, nil); err == nil {
+			t.Errorf("set group %q", name)
+		}
+	}
+	if err := b.Add("ops", &Contact{KeyID: "k"}); err == nil {
+		t.Error("added a contact with the name of a group")
+	}
+	if err := b.SetGroup("bob", nil); err == nil {
+		t.Error("set a group with the name of a contact")
+	}
+	if err := b.SetGroup("team", []string{"alice", "dave"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("group with unknown member: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	b := testBook(t)
+	if err := b.Remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Has("alice") {
+		t.Error("alice not removed")
+	}
+	if got := b.Groups["ops"]; !reflect.DeepEqual(got, []string{"bob"}) {
+		t.Errorf("ops: got %v, want [bob]", got)
+	}
+	if err := b.Remove("ops"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Has("ops") || !b.Has("bob") {
+		t.Error("removing a group must only remove the group")
+	}
+	if err := b.Remove("alice"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestNames(t *testing.T) {
+	b := testBook(t)
+	if got, want := b.Names(), []string{"al", "alice", "bob", "carol"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names: got %v, want %v", got, want)
+	}
+	if got, want := b.NameOf("ka"), []string{"al", "alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NameOf: got %v, want %v", got, want)
+	}
+	if got := b.NameOf("unknown"); len(got) != 0 {
+		t.Errorf("NameOf unknown key: got %v", got)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data", FileName)
+	b, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Contacts) != 0 || len(b.Groups) != 0 {
+		t.Errorf("missing file: got %+v, want an empty book", b)
+	}
+	b = testBook(t)
+	if err := b.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Groups, b.Groups) {
+		t.Errorf("groups: got %v, want %v", got.Groups, b.Groups)
+	}
+	for name, c := range b.Contacts {
+		gc := got.Contacts[name]
+		if gc == nil || gc.KeyID != c.KeyID || gc.Note != c.Note || (gc.Expires == nil) != (c.Expires == nil) {
+			t.Errorf("%s: got %+v, want %+v", name, gc, c)
+			continue
+		}
+		if c.Expires != nil && !gc.Expires.Equal(*c.Expires) {
+			t.Errorf("%s: got expiry %v, want %v", name, gc.Expires, c.Expires)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package keys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Chain is a set of public keys indexed by key ID.
+type Chain struct {
+	mtx  sync.RWMutex
+	keys map[string][]byte
+	// OnLoad is called when the chain is loaded from a directory, before
+	// the new keys replace the current ones, with the IDs of the loaded
+	// keys and of the keys which are no longer present.
+	OnLoad func(keyIDs []string, removed []string) error
+}
+
+func NewChain() *Chain {
+	return &Chain{
+		keys: make(map[string][]byte),
+	}
+}
+
+// Add adds the public key to the chain and returns its key ID.
+func (c *Chain) Add(k []byte) string {
+	l := log.WithFields(log.Fields{
+		"pkg": "keys",
+		"fn":  "Chain.Add",
+	})
+	l.Debug("Adding key to public chain")
+	keyID := PubKeyID(k)
+	c.mtx.Lock()
+	c.keys[keyID] = k
+	c.mtx.Unlock()
+	return keyID
+}
+
+func (c *Chain) Get(keyID string) ([]byte, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	k, ok := c.keys[keyID]
+	return k, ok
+}
+
+// IDs returns the sorted key IDs in the chain.
+func (c *Chain) IDs() []string {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	var ids []string
+	for id := range c.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (c *Chain) Len() int {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return len(c.keys)
+}
+
+func (c *Chain) LoadFromDirectory(d string) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "keys",
+		"fn":  "Chain.LoadFromDirectory",
+		"dir": d,
+	})
+	l.Debug("Loading public key chain")
+	// check if dir exists
+	if _, err := os.Stat(d); os.IsNotExist(err) {
+		l.Error("Directory does not exist")
+		return err
+	}
+	// loop through files in dir, where file name is the key id
+	// and the contents is the public key
+	newKeys := make(map[string][]byte)
+	files, err := ioutil.ReadDir(d)
+	if err != nil {
+		l.Error("Error reading directory")
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		keyID := file.Name()
+		keyFile := filepath.Join(d, keyID)
+		keyBytes, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			l.Error("Error reading key file")
+			return err
+		}
+		newKeys[keyID] = keyBytes
+	}
+	if c.OnLoad != nil {
+		var ids, removed []string
+		for keyID := range newKeys {
+			ids = append(ids, keyID)
+		}
+		c.mtx.RLock()
+		for keyID := range c.keys {
+			if _, ok := newKeys[keyID]; !ok {
+				removed = append(removed, keyID)
+			}
+		}
+		c.mtx.RUnlock()
+		if err := c.OnLoad(ids, removed); err != nil {
+			l.Error("Error handling loaded keys")
+			return err
+		}
+	}
+	c.mtx.Lock()
+	c.keys = newKeys
+	c.mtx.Unlock()
+	l.Debugf("Public key chain loaded, %d keys loaded", len(newKeys))
+	return nil
+}
+
+// Loader reloads the chain from the directory every minute until stop is closed.
+func (c *Chain) Loader(d string, stop <-chan struct{}) {
+	l := log.WithFields(log.Fields{
+		"pkg": "keys",
+		"fn":  "Chain.Loader",
+		"dir": d,
+	})
+	l.Debug("Loading public key chain")
+	for {
+		err := c.LoadFromDirectory(d)
+		if err != nil {
+			l.Error("Error loading public key chain")
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+var (
+	// ErrKeyNotFound is returned by Resolve if no key matches.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrAmbiguousKey is returned by Resolve if several keys match.
+	ErrAmbiguousKey = errors.New("key prefix matches several keys")
+)
+
+// Resolve returns the ID of the key in the chain whose ID is ref or
+// starts with ref.
+func (c *Chain) Resolve(ref string) (string, error) {
+	ref = strings.ToLower(strings.ReplaceAll(ref, " ", ""))
+	if ref == "" {
+		return "", ErrKeyNotFound
+	}
+	if _, ok := c.Get(ref); ok {
+		return ref, nil
+	}
+	var found []string
+	for _, id := range c.IDs() {
+		if strings.HasPrefix(id, ref) {
+			found = append(found, id)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, ref)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%w: %s matches %s", ErrAmbiguousKey, ref, strings.Join(found, ", "))
+}
+
+// InstallPublicKey validates the PEM encoded public key and writes it to
+// the directory d under its key ID, so that LoadFromDirectory finds it.
+// It returns the key ID.
+func InstallPublicKey(d string, pub []byte) (string, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "keys",
+		"fn":  "InstallPublicKey",
+		"dir": d,
+	})
+	l.Debug("Installing public key")
+	if _, err := BytesToPubKey(pub); err != nil {
+		l.Errorf("Invalid public key: %v", err)
+		return "", err
+	}
+	if !bytes.HasSuffix(pub, []byte{'\n'}) {
+		pub = append(pub, '\n')
+	}
+	if err := os.MkdirAll(d, 0755); err != nil {
+		l.Errorf("Error creating directory: %v", err)
+		return "", err
+	}
+	keyID := PubKeyID(pub)
+	if err := ioutil.WriteFile(filepath.Join(d, keyID), pub, 0644); err != nil {
+		l.Errorf("Error writing key file: %v", err)
+		return "", err
+	}
+	return keyID, nil
+}
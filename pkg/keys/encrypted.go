@@ -0,0 +1,337 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeystoreBlockType is the PEM block type of private keys encrypted by
+// EncryptPrivateKey. The key is sealed with AES-256-GCM under a key
+// derived from the passphrase with scrypt, whose parameters are kept in
+// the block headers. The headers are authenticated with the key.
+const KeystoreBlockType = "CENTAURI ENCRYPTED PRIVATE KEY"
+
+// The scrypt parameters of new keystore blocks, about 100ms on a laptop.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// The largest KDF parameters accepted when decrypting, so that a crafted
+// key cannot make a decryption take minutes or gigabytes of memory.
+const (
+	maxScryptN = 1 << 20
+	maxScryptR = 32
+	maxScryptP = 16
+	// maxScryptMem is the largest memory scrypt may use, 128*N*R bytes.
+	maxScryptMem  = 1 << 30
+	maxPBKDF2Iter = 10000000
+)
+
+var (
+	// ErrPassphraseRequired is returned by BytesToPrivKey for encrypted keys.
+	ErrPassphraseRequired = errors.New("private key is encrypted, a passphrase is required")
+	// ErrBadPassphrase is returned if an encrypted key cannot be decrypted.
+	ErrBadPassphrase = errors.New("wrong passphrase or corrupt private key")
+)
+
+// IsEncryptedPrivateKey reports whether the PEM private key is encrypted:
+// a keystore block, a PKCS#8 encrypted block or a legacy encrypted PEM
+// block as written by openssl.
+func IsEncryptedPrivateKey(privateKey []byte) bool {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return false
+	}
+	switch block.Type {
+	case KeystoreBlockType, "ENCRYPTED PRIVATE KEY":
+		return true
+	}
+	// legacy "Proc-Type: 4,ENCRYPTED" blocks of openssl genrsa -aes256
+	return x509.IsEncryptedPEMBlock(block)
+}
+
+// EncryptPrivateKey encodes the private key as a keystore PEM block
+// encrypted with the passphrase.
+func EncryptPrivateKey(k *rsa.PrivateKey, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	h := map[string]string{
+		"KDF":    "scrypt",
+		"N":      strconv.Itoa(scryptN),
+		"R":      strconv.Itoa(scryptR),
+		"P":      strconv.Itoa(scryptP),
+		"Salt":   hex.EncodeToString(salt),
+		"Cipher": "aes-256-gcm",
+		"Nonce":  hex.EncodeToString(nonce),
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    KeystoreBlockType,
+		Headers: h,
+		Bytes:   gcm.Seal(nil, nonce, x509.MarshalPKCS1PrivateKey(k), headersAAD(h)),
+	}), nil
+}
+
+// headersAAD encodes the headers of a keystore block as the additional
+// data of its encryption, sorted by name, one "name: value" line each.
+func headersAAD(h map[string]string) []byte {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\n", name, h[name])
+	}
+	return b.Bytes()
+}
+
+// DecryptPrivateKey decrypts the encrypted PEM private key with the
+// passphrase. Unencrypted keys are returned as by BytesToPrivKey.
+func DecryptPrivateKey(privateKey []byte, passphrase []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, errors.New("private key error")
+	}
+	var der []byte
+	var err error
+	switch {
+	case block.Type == KeystoreBlockType:
+		der, err = decryptKeystore(block, passphrase)
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		der, err = decryptPKCS8(block.Bytes, passphrase)
+	case x509.IsEncryptedPEMBlock(block):
+		der, err = x509.DecryptPEMBlock(block, passphrase)
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			err = ErrBadPassphrase
+		}
+	default:
+		return BytesToPrivKey(privateKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKeyDER(der)
+}
+
+func parsePrivateKeyDER(der []byte) (*rsa.PrivateKey, error) {
+	if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return k, nil
+	}
+	p, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		// garbage from a wrong passphrase which passed the padding check
+		return nil, ErrBadPassphrase
+	}
+	k, ok := p.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", p)
+	}
+	return k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func decryptKeystore(block *pem.Block, passphrase []byte) ([]byte, error) {
+	h := block.Headers
+	if h["KDF"] != "scrypt" || h["Cipher"] != "aes-256-gcm" {
+		return nil, fmt.Errorf("unsupported keystore KDF %q or cipher %q", h["KDF"], h["Cipher"])
+	}
+	var params [3]int
+	for i, name := range []string{"N", "R", "P"} {
+		v, err := strconv.Atoi(h[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid keystore parameter %s: %v", name, err)
+		}
+		params[i] = v
+	}
+	n, r, p := params[0], params[1], params[2]
+	if n <= 1 || n > maxScryptN || r <= 0 || r > maxScryptR || p <= 0 || p > maxScryptP || 128*int64(n)*int64(r) > maxScryptMem {
+		return nil, fmt.Errorf("keystore parameters N=%d R=%d P=%d out of range", n, r, p)
+	}
+	salt, err := hex.DecodeString(h["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid keystore salt: %v", err)
+	}
+	nonce, err := hex.DecodeString(h["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid keystore nonce: %v", err)
+	}
+	key, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid keystore nonce")
+	}
+	der, err := gcm.Open(nil, nonce, block.Bytes, headersAAD(h))
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return der, nil
+}
+
+// The PKCS#8 encrypted keys written by openssl pkcs8 -topk8 and openssl
+// genpkey, PBES2 with PBKDF2 and AES-CBC (RFC 8018).
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     algorithmIdentifier
+	EncryptedData []byte
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc algorithmIdentifier
+	EncryptionScheme  algorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                 `asn1:"optional"`
+	PRF            algorithmIdentifier `asn1:"optional"`
+}
+
+func decryptPKCS8(data []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid encrypted private key: %v", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %v, use PBES2", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("invalid PBES2 parameters: %v", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %v, use PBKDF2", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("invalid PBKDF2 parameters: %v", err)
+	}
+	if kdf.IterationCount <= 0 || kdf.IterationCount > maxPBKDF2Iter {
+		return nil, fmt.Errorf("PBKDF2 iteration count %d out of range", kdf.IterationCount)
+	}
+	var prf func() hash.Hash
+	switch alg := kdf.PRF.Algorithm; {
+	case len(alg) == 0 || alg.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case alg.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case alg.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 hash %v", alg)
+	}
+	var keyLen int
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen = 16
+	case alg.Equal(oidAES192CBC):
+		keyLen = 24
+	case alg.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported private key cipher %v", alg)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("invalid cipher parameters: %v", err)
+	}
+	key := pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keyLen, prf)
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ct := info.EncryptedData
+	if len(iv) != b.BlockSize() || len(ct) == 0 || len(ct)%b.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted private key")
+	}
+	der := make([]byte, len(ct))
+	cipher.NewCBCDecrypter(b, iv).CryptBlocks(der, ct)
+	return unpad(der, b.BlockSize())
+}
+
+// unpad removes the PKCS#7 padding of data. Invalid padding is what a
+// wrong passphrase usually results in.
+func unpad(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrBadPassphrase
+	}
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, ErrBadPassphrase
+	}
+	pad := make([]byte, n)
+	for i := range pad {
+		pad[i] = byte(n)
+	}
+	if !bytes.Equal(data[len(data)-n:], pad) {
+		return nil, ErrBadPassphrase
+	}
+	return data[:len(data)-n], nil
+}
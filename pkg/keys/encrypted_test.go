@@ -0,0 +1,202 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+// The fixtures in testdata are one key, rsa.pem, encrypted with the
+// passphrase "centauri" by openssl 3:
+//
+//	openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256 -in rsa.pem -out pkcs8_aes256_sha256.pem
+//	openssl pkcs8 -topk8 -v2 aes-128-cbc -v2prf hmacWithSHA1 -in rsa.pem -out pkcs8_aes128_sha1.pem
+//	openssl rsa -traditional -aes256 -in rsa.pem -out genrsa_aes256.pem
+//
+// The last is the legacy PEM encryption of openssl genrsa -aes256.
+const fixturePassphrase = "centauri"
+
+var openSSLFixtures = []string{
+	"pkcs8_aes256_sha256.pem",
+	"pkcs8_aes128_sha1.pem",
+	"genrsa_aes256.pem",
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func fixtureKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	k, err := BytesToPrivKey(readFixture(t, "rsa.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// testKey is the key of the round trip tests, small to keep them fast.
+func testKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	k, err := GenerateKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestEncryptPrivateKeyRoundTrip(t *testing.T) {
+	k := testKey(t)
+	enc, err := EncryptPrivateKey(k, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedPrivateKey(enc) {
+		t.Error("encrypted key not detected as encrypted")
+	}
+	if _, err := BytesToPrivKey(enc); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("BytesToPrivKey: got %v, want %v", err, ErrPassphraseRequired)
+	}
+	got, err := DecryptPrivateKey(enc, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(k) {
+		t.Error("decrypted key differs from the encrypted key")
+	}
+}
+
+func TestEncryptPrivateKeyEmptyPassphrase(t *testing.T) {
+	if _, err := EncryptPrivateKey(testKey(t), nil); err == nil {
+		t.Error("encrypted with an empty passphrase")
+	}
+}
+
+func TestDecryptPrivateKeyWrongPassphrase(t *testing.T) {
+	enc, err := EncryptPrivateKey(testKey(t), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptPrivateKey(enc, []byte("wrong")); !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("got %v, want %v", err, ErrBadPassphrase)
+	}
+}
+
+func TestDecryptPrivateKeyAuthenticatesHeaders(t *testing.T) {
+	enc, err := EncryptPrivateKey(testKey(t), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(enc)
+	block.Headers["Comment"] = "added"
+	if _, err := DecryptPrivateKey(pem.EncodeToMemory(block), []byte("secret")); !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("got %v, want %v", err, ErrBadPassphrase)
+	}
+}
+
+func TestDecryptPrivateKeyParameterCaps(t *testing.T) {
+	enc, err := EncryptPrivateKey(testKey(t), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"N": strconv.Itoa(maxScryptN * 2),
+		"R": strconv.Itoa(maxScryptR + 1),
+		"P": strconv.Itoa(maxScryptP + 1),
+	}
+	for name, v := range tests {
+		block, _ := pem.Decode(enc)
+		block.Headers[name] = v
+		_, err := DecryptPrivateKey(pem.EncodeToMemory(block), []byte("secret"))
+		if err == nil || errors.Is(err, ErrBadPassphrase) {
+			t.Errorf("%s=%s: got %v, want a parameter error", name, v, err)
+		}
+	}
+	// within the caps of each parameter, but over the memory cap
+	block, _ := pem.Decode(enc)
+	block.Headers["N"] = strconv.Itoa(maxScryptN)
+	block.Headers["R"] = strconv.Itoa(maxScryptR)
+	if _, err := DecryptPrivateKey(pem.EncodeToMemory(block), []byte("secret")); err == nil || errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("got %v, want a parameter error", err)
+	}
+}
+
+func TestDecryptOpenSSLKeys(t *testing.T) {
+	want := fixtureKey(t)
+	for _, name := range openSSLFixtures {
+		t.Run(name, func(t *testing.T) {
+			data := readFixture(t, name)
+			if !IsEncryptedPrivateKey(data) {
+				t.Fatal("not detected as encrypted")
+			}
+			k, err := DecryptPrivateKey(data, []byte(fixturePassphrase))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !k.Equal(want) {
+				t.Error("decrypted key differs from rsa.pem")
+			}
+		})
+	}
+}
+
+func TestDecryptOpenSSLKeysWrongPassphrase(t *testing.T) {
+	for _, name := range openSSLFixtures {
+		t.Run(name, func(t *testing.T) {
+			_, err := DecryptPrivateKey(readFixture(t, name), []byte("wrong"))
+			if !errors.Is(err, ErrBadPassphrase) {
+				t.Errorf("got %v, want %v", err, ErrBadPassphrase)
+			}
+		})
+	}
+}
+
+func TestDecryptPKCS8IterationCap(t *testing.T) {
+	block, _ := pem.Decode(readFixture(t, "pkcs8_aes256_sha256.pem"))
+	// the DER encoding of the iteration count 2048 of the fixture
+	i := bytes.Index(block.Bytes, []byte{0x02, 0x02, 0x08, 0x00})
+	if i < 0 {
+		t.Fatal("iteration count not found in fixture")
+	}
+	der := append([]byte{}, block.Bytes...)
+	der[i+2] = 0x00
+	der[i+3] = 0x00
+	if _, err := decryptPKCS8(der, []byte(fixturePassphrase)); err == nil || errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("iteration count 0: got %v, want a parameter error", err)
+	}
+}
+
+func TestUnpad(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want []byte
+		err  error
+	}{
+		{[]byte{1, 2, 3, 1}, []byte{1, 2, 3}, nil},
+		{[]byte{1, 2, 2, 2}, []byte{1, 2}, nil},
+		{[]byte{4, 4, 4, 4}, []byte{}, nil},
+		{[]byte{1, 2, 3, 0}, nil, ErrBadPassphrase},
+		{[]byte{1, 2, 3, 5}, nil, ErrBadPassphrase},
+		{[]byte{1, 2, 3, 2}, nil, ErrBadPassphrase},
+		{[]byte{}, nil, ErrBadPassphrase},
+	}
+	for _, tt := range tests {
+		got, err := unpad(tt.data, 4)
+		if err != tt.err {
+			t.Errorf("unpad(%v): got error %v, want %v", tt.data, err, tt.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(got, tt.want) {
+			t.Errorf("unpad(%v): got %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+)
+
+// DefaultKeyBits is the size of the keys created by GenerateKey if no
+// size is given.
+const DefaultKeyBits = 4096
+
+// GenerateKey creates a new RSA private key of bits size, DefaultKeyBits if 0.
+func GenerateKey(bits int) (*rsa.PrivateKey, error) {
+	if bits == 0 {
+		bits = DefaultKeyBits
+	}
+	return rsa.GenerateKey(rand.Reader, bits)
+}
+
+// MarshalPrivateKey encodes the private key as a PKCS#1 PEM block, as read
+// by BytesToPrivKey.
+func MarshalPrivateKey(k *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(k),
+	})
+}
+
+// MarshalPublicKey encodes the public key as a PKIX PEM block, the form
+// its key ID is computed from.
+func MarshalPublicKey(k *rsa.PublicKey) ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(k)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), nil
+}
+
+// ShortID returns the first 16 characters of the key ID, which is enough
+// to tell keys apart in listings.
+func ShortID(id string) string {
+	if len(id) > 16 {
+		return id[:16]
+	}
+	return id
+}
+
+// FormatID returns the key ID in groups of 8 characters, for reading it
+// out or comparing it by eye.
+func FormatID(id string) string {
+	var groups []string
+	for len(id) > 8 {
+		groups = append(groups, id[:8])
+		id = id[8:]
+	}
+	groups = append(groups, id)
+	return strings.Join(groups, " ")
+}
@@ -15,20 +15,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
-	"path/filepath"
 	"strings"
-	"time"
 
-	"github.com/robertlestak/centauri/internal/persist"
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	PublicKeyChain map[string][]byte
-)
-
 type MessageHeader struct {
 	Key   string `json:"k"`
 	Nonce string `json:"n"`
@@ -61,6 +52,9 @@ func BytesToPrivKey(privateKey []byte) (*rsa.PrivateKey, error) {
 	if block == nil {
 		return nil, errors.New("private key error")
 	}
+	if IsEncryptedPrivateKey(privateKey) {
+		return nil, ErrPassphraseRequired
+	}
 	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
 		p, e := x509.ParsePKCS8PrivateKey(block.Bytes)
@@ -72,105 +66,6 @@ func BytesToPrivKey(privateKey []byte) (*rsa.PrivateKey, error) {
 	return priv, nil
 }
 
-func AddKeyToPublicChain(k []byte) {
-	l := log.WithFields(log.Fields{
-		"pkg": "keys",
-		"fn":  "AddKeyToPublicChain",
-	})
-	l.Debug("Adding key to public chain")
-	keyID := PubKeyID(k)
-	if PublicKeyChain == nil {
-		PublicKeyChain = make(map[string][]byte)
-	}
-	PublicKeyChain[keyID] = k
-}
-
-func LoadPubKeyChainFromDirectory(d string) error {
-	l := log.WithFields(log.Fields{
-		"pkg": "keys",
-		"fn":  "LoadPubKeyChainFromDirectory",
-		"dir": d,
-	})
-	l.Debug("Loading public key chain")
-	// check if dir exists
-	if _, err := os.Stat(d); os.IsNotExist(err) {
-		l.Error("Directory does not exist")
-		return err
-	}
-	// loop through files in dir, where file name is the key id
-	// and the contents is the public key
-	newPubKeyChain := make(map[string][]byte)
-	files, err := ioutil.ReadDir(d)
-	if err != nil {
-		l.Error("Error reading directory")
-		return err
-	}
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-		keyID := file.Name()
-		keyFile := filepath.Join(d, keyID)
-		keyBytes, err := ioutil.ReadFile(keyFile)
-		if err != nil {
-			l.Error("Error reading key file")
-			return err
-		}
-		newPubKeyChain[keyID] = keyBytes
-	}
-	if err := ensureDirs(PublicKeyChain, newPubKeyChain); err != nil {
-		l.Error("Error ensuring directories")
-		return err
-	}
-	PublicKeyChain = newPubKeyChain
-	l.Debugf("Public key chain loaded, %d keys loaded", len(PublicKeyChain))
-	return nil
-}
-
-func ensureDirs(oldKeys map[string][]byte, newKeys map[string][]byte) error {
-	l := log.WithFields(log.Fields{
-		"pkg": "keys",
-		"fn":  "ensureDirs",
-	})
-	l.Debug("Ensuring directories")
-	var removed []string
-	for keyID := range oldKeys {
-		if _, ok := newKeys[keyID]; !ok {
-			removed = append(removed, keyID)
-		}
-	}
-	for k, _ := range newKeys {
-		if _, err := persist.EnsurePubKeyChainOutgoingDir(k); err != nil {
-			l.Error("Error ensuring outgoing directory")
-			return err
-		}
-	}
-	for _, keyID := range removed {
-		if _, err := persist.RemovePubKeyChainOutgoingDir(keyID); err != nil {
-			l.Error("Error ensuring outgoing directory")
-			return err
-		}
-	}
-
-	return nil
-}
-
-func PubKeyLoader(d string) {
-	l := log.WithFields(log.Fields{
-		"pkg": "keys",
-		"fn":  "PubKeyLoader",
-		"dir": d,
-	})
-	l.Debug("Loading public key chain")
-	for {
-		err := LoadPubKeyChainFromDirectory(d)
-		if err != nil {
-			l.Error("Error loading public key chain")
-		}
-		time.Sleep(time.Minute)
-	}
-}
-
 func RsaEncrypt(publicKey []byte, origData []byte) ([]byte, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "keys",
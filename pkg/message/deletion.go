@@ -0,0 +1,181 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/robertlestak/centauri/internal/persist"
+	"github.com/robertlestak/centauri/pkg/api"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidDeletionSet is wrapped by the errors of a deletion set
+	// which is too large or names invalid keys, channels or messages.
+	ErrInvalidDeletionSet = errors.New("invalid deletion set")
+	// ErrEmptyDeletionSet is returned by DeleteMessages without messages.
+	ErrEmptyDeletionSet = fmt.Errorf("%w: no messages to delete", ErrInvalidDeletionSet)
+)
+
+// DeletionSet is a batch of messages of one key deleted together.
+type DeletionSet struct {
+	ID          string `json:"id"`
+	PublicKeyID string `json:"pubKeyID"`
+	// Messages are the IDs of the deleted messages by channel.
+	Messages map[string][]string `json:"messages"`
+}
+
+// validate checks the size of the set and the names of its key and
+// messages.
+func (ds *DeletionSet) validate() error {
+	if !persist.ValidName(ds.PublicKeyID) {
+		return fmt.Errorf("%w: public key id %q", ErrInvalidDeletionSet, ds.PublicKeyID)
+	}
+	var n int
+	for channel, ids := range ds.Messages {
+		if channel != api.CleanString(channel) || !persist.ValidName(channel) {
+			return fmt.Errorf("%w: channel %q", ErrInvalidDeletionSet, channel)
+		}
+		for _, id := range ids {
+			if !persist.ValidName(id) {
+				return fmt.Errorf("%w: message id %q", ErrInvalidDeletionSet, id)
+			}
+		}
+		n += len(ids)
+	}
+	if n == 0 {
+		return ErrEmptyDeletionSet
+	}
+	if n > api.MaxDeletionSet {
+		return fmt.Errorf("%w: %d messages, at most %d", ErrInvalidDeletionSet, n, api.MaxDeletionSet)
+	}
+	return nil
+}
+
+// DeleteMessages deletes the messages refs of the key pubKeyID and
+// announces them to the other peers as a single deletion set. Errors
+// of an invalid set wrap ErrInvalidDeletionSet. Once the set is stored
+// it is announced even if some of its messages could not be deleted
+// here, so that the other peers delete them.
+func (mg *Manager) DeleteMessages(pubKeyID string, refs []api.MessageRef) (*api.DeleteResult, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "message",
+		"fn":  "DeleteMessages",
+		"key": pubKeyID,
+	})
+	l.Debugf("deleting %d messages", len(refs))
+	ds := &DeletionSet{
+		ID:          uuid.New().String(),
+		PublicKeyID: pubKeyID,
+		Messages:    map[string][]string{},
+	}
+	seen := map[api.MessageRef]bool{}
+	for _, r := range refs {
+		r.Channel = api.CleanString(r.Channel)
+		if r.Channel == "" {
+			r.Channel = "default"
+		}
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		ds.Messages[r.Channel] = append(ds.Messages[r.Channel], r.ID)
+	}
+	if err := ds.validate(); err != nil {
+		l.Errorf("invalid deletion set: %v", err)
+		return nil, err
+	}
+	jd, err := json.Marshal(ds)
+	if err != nil {
+		l.Errorf("error marshalling deletion set: %v", err)
+		return nil, err
+	}
+	// the set is stored first, so that it can be fetched by the peers
+	// which receive the broadcast
+	if err := mg.Store.StoreDeletionSet(ds.ID, jd); err != nil {
+		l.Errorf("error storing deletion set: %v", err)
+		return nil, err
+	}
+	n, err := mg.applyDeletionSet(ds)
+	mg.Events.DeleteMessages(pubKeyID, ds.ID)
+	if err != nil {
+		l.Errorf("error deleting messages: %v", err)
+		return nil, err
+	}
+	return &api.DeleteResult{SetID: ds.ID, Deleted: n}, nil
+}
+
+// applyDeletionSet tombstones and deletes the messages of ds and returns
+// the number of them which were stored on this peer.
+func (mg *Manager) applyDeletionSet(ds *DeletionSet) (int, error) {
+	var n int
+	for channel, ids := range ds.Messages {
+		for _, id := range ids {
+			if err := mg.Store.StoreTombstone(ds.PublicKeyID, channel, id); err != nil {
+				return n, err
+			}
+			if !mg.Store.MessageExists(ds.PublicKeyID, channel, id) {
+				continue
+			}
+			if err := mg.Store.DeleteMessageByID(ds.PublicKeyID, channel, id); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// GetDeletionSetFromPeer fetches the deletion set setID announced by
+// another peer and deletes its messages.
+func (mg *Manager) GetDeletionSetFromPeer(pubKeyID string, setID string, peerAddr string, peerPort int) error {
+	l := log.WithFields(log.Fields{
+		"pkg":      "message",
+		"fn":       "GetDeletionSetFromPeer",
+		"pubKeyID": pubKeyID,
+		"set":      setID,
+		"peerAddr": peerAddr,
+		"peerPort": peerPort,
+	})
+	l.Debugf("getting deletion set from peer %s:%d", peerAddr, peerPort)
+	if _, err := mg.Store.GetDeletionSet(setID); err == nil {
+		l.Debug("deletion set already applied, skipping")
+		return nil
+	} else if !os.IsNotExist(err) {
+		l.Errorf("error reading deletion set: %v", err)
+		return err
+	}
+	data, err := mg.Peer.RequestDeletionSetFromPeer(peerAddr, peerPort, pubKeyID, setID)
+	if err != nil {
+		l.Errorf("error getting deletion set: %v", err)
+		return err
+	}
+	ds := &DeletionSet{}
+	if err := json.Unmarshal(data, ds); err != nil {
+		l.Errorf("error unmarshalling deletion set: %v", err)
+		return err
+	}
+	if ds.ID != setID || ds.PublicKeyID != pubKeyID {
+		l.Error("deletion set does not match the announcement")
+		return errors.New("deletion set does not match the announcement")
+	}
+	if err := ds.validate(); err != nil {
+		l.Errorf("invalid deletion set: %v", err)
+		return err
+	}
+	n, err := mg.applyDeletionSet(ds)
+	if err != nil {
+		l.Errorf("error deleting messages: %v", err)
+		return err
+	}
+	// stored last, as a stored set counts as applied
+	if err := mg.Store.StoreDeletionSet(ds.ID, data); err != nil {
+		l.Errorf("error storing deletion set: %v", err)
+		return err
+	}
+	l.Debugf("deleted %d messages", n)
+	return nil
+}
@@ -0,0 +1,40 @@
+package message
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/robertlestak/centauri/pkg/api"
+)
+
+func TestDeletionSetValidate(t *testing.T) {
+	many := make([]string, api.MaxDeletionSet+1)
+	for i := range many {
+		many[i] = strconv.Itoa(i)
+	}
+	tests := []struct {
+		name string
+		ds   DeletionSet
+		err  error
+	}{
+		{"valid", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"default": {"m1"}, "ops": {"m2", "m3"}}}, nil},
+		{"largest", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"default": many[:api.MaxDeletionSet]}}, nil},
+		{"empty", DeletionSet{PublicKeyID: "key"}, ErrEmptyDeletionSet},
+		{"empty channels", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"default": {}}}, ErrEmptyDeletionSet},
+		{"too many", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"default": many}}, ErrInvalidDeletionSet},
+		{"too many over channels", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"default": many[:api.MaxDeletionSet], "ops": {"m1"}}}, ErrInvalidDeletionSet},
+		{"no key", DeletionSet{Messages: map[string][]string{"default": {"m1"}}}, ErrInvalidDeletionSet},
+		{"key path", DeletionSet{PublicKeyID: "../key", Messages: map[string][]string{"default": {"m1"}}}, ErrInvalidDeletionSet},
+		{"channel path", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"..": {"m1"}}}, ErrInvalidDeletionSet},
+		{"empty channel", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"": {"m1"}}}, ErrInvalidDeletionSet},
+		{"unclean channel", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"a b": {"m1"}}}, ErrInvalidDeletionSet},
+		{"message path", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"default": {"m1", "a/b"}}}, ErrInvalidDeletionSet},
+		{"empty message", DeletionSet{PublicKeyID: "key", Messages: map[string][]string{"default": {""}}}, ErrInvalidDeletionSet},
+	}
+	for _, tt := range tests {
+		if err := tt.ds.validate(); !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
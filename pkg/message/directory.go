@@ -0,0 +1,202 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrKeyRecordNotFound is returned for keys without a key directory
+	// record, or whose record expired.
+	ErrKeyRecordNotFound = errors.New("key record not found")
+	// ErrStaleKeyRecord is returned by PublishKeyRecord for a record older
+	// than the one stored for the key.
+	ErrStaleKeyRecord = errors.New("a newer record of the key exists")
+)
+
+// PublishKeyRecord stores the key directory record r and announces it to
+// the other peers. A record only replaces an older one of the same key.
+func (mg *Manager) PublishKeyRecord(r *sign.KeyRecord) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "message",
+		"fn":  "PublishKeyRecord",
+		"key": r.ID,
+	})
+	l.Debug("publishing key record")
+	stored, err := mg.storeKeyRecord(r)
+	if err != nil {
+		l.Errorf("error storing key record: %v", err)
+		return err
+	}
+	if stored {
+		mg.Events.NewKeyRecord(r.ID, strconv.FormatInt(r.CreatedAt.Unix(), 10))
+	}
+	return nil
+}
+
+// storeKeyRecord verifies and stores r and reports whether it was new.
+func (mg *Manager) storeKeyRecord(r *sign.KeyRecord) (bool, error) {
+	if err := r.Verify(); err != nil {
+		return false, err
+	}
+	if r.Expired(time.Now()) {
+		return false, errors.New("key record expired")
+	}
+	if err := mg.CheckRevoked(r.ID); err != nil {
+		return false, err
+	}
+	cur, err := mg.readKeyRecord(r.ID)
+	if err != nil && !errors.Is(err, ErrKeyRecordNotFound) {
+		return false, err
+	}
+	if cur != nil {
+		if cur.CreatedAt.Equal(r.CreatedAt) && cur.Name == r.Name && cur.ExpiresAt.Equal(r.ExpiresAt) {
+			return false, nil
+		}
+		if !r.CreatedAt.After(cur.CreatedAt) {
+			return false, ErrStaleKeyRecord
+		}
+	}
+	jd, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	if err := mg.Store.StoreKeyRecord(r.ID, jd); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readKeyRecord returns the stored record of the key keyID, expired or not.
+func (mg *Manager) readKeyRecord(keyID string) (*sign.KeyRecord, error) {
+	data, err := mg.Store.GetKeyRecord(keyID)
+	if os.IsNotExist(err) {
+		return nil, ErrKeyRecordNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	r := &sign.KeyRecord{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetKeyRecord returns the key directory record of the key keyID.
+func (mg *Manager) GetKeyRecord(keyID string) (*sign.KeyRecord, error) {
+	r, err := mg.readKeyRecord(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if r.Expired(time.Now()) || mg.CheckRevoked(keyID) != nil {
+		return nil, ErrKeyRecordNotFound
+	}
+	return r, nil
+}
+
+// FindKeyRecords returns the key directory records whose name is name,
+// ignoring case, newest first.
+func (mg *Manager) FindKeyRecords(name string) ([]*sign.KeyRecord, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "message",
+		"fn":  "FindKeyRecords",
+	})
+	records, err := mg.Store.ListKeyRecords()
+	if err != nil {
+		l.Errorf("error listing key records: %v", err)
+		return nil, err
+	}
+	now := time.Now()
+	var rs []*sign.KeyRecord
+	for _, data := range records {
+		r := &sign.KeyRecord{}
+		if err := json.Unmarshal(data, r); err != nil {
+			l.Errorf("error decoding key record: %v", err)
+			continue
+		}
+		if r.Expired(now) || !strings.EqualFold(r.Name, name) || mg.CheckRevoked(r.ID) != nil {
+			continue
+		}
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].CreatedAt.After(rs[j].CreatedAt)
+	})
+	return rs, nil
+}
+
+// GetKeyRecordFromPeer fetches and stores the key directory record of the
+// key pubKeyID announced by another peer.
+func (mg *Manager) GetKeyRecordFromPeer(pubKeyID string, peerAddr string, peerPort int) error {
+	l := log.WithFields(log.Fields{
+		"pkg":      "message",
+		"fn":       "GetKeyRecordFromPeer",
+		"pubKeyID": pubKeyID,
+		"peerAddr": peerAddr,
+		"peerPort": peerPort,
+	})
+	l.Debugf("getting key record from peer %s:%d", peerAddr, peerPort)
+	data, err := mg.Peer.RequestKeyRecordFromPeer(peerAddr, peerPort, pubKeyID)
+	if err != nil {
+		l.Errorf("error getting key record: %v", err)
+		return err
+	}
+	r := &sign.KeyRecord{}
+	if err := json.Unmarshal(data, r); err != nil {
+		l.Errorf("error decoding key record: %v", err)
+		return err
+	}
+	if r.ID != pubKeyID {
+		return fmt.Errorf("peer sent the key record of %s for %s", r.ID, pubKeyID)
+	}
+	if _, err := mg.storeKeyRecord(r); err != nil && !errors.Is(err, ErrStaleKeyRecord) {
+		l.Errorf("error storing key record: %v", err)
+		return err
+	}
+	return nil
+}
+
+// SyncDirectoryFromPeer stores the key directory records of another peer
+// which are newer than those held by this peer, so that records whose
+// announcements were missed are eventually known to every peer.
+func (mg *Manager) SyncDirectoryFromPeer(peerAddr string, peerPort int) error {
+	l := log.WithFields(log.Fields{
+		"pkg":      "message",
+		"fn":       "SyncDirectoryFromPeer",
+		"peerAddr": peerAddr,
+		"peerPort": peerPort,
+	})
+	l.Debugf("syncing directory from peer %s:%d", peerAddr, peerPort)
+	records, err := mg.Peer.RequestDirectoryFromPeer(peerAddr, peerPort)
+	if err != nil {
+		l.Errorf("error getting directory: %v", err)
+		return err
+	}
+	var synced int
+	for _, data := range records {
+		r := &sign.KeyRecord{}
+		if err := json.Unmarshal(data, r); err != nil {
+			l.Errorf("error decoding key record: %v", err)
+			continue
+		}
+		stored, err := mg.storeKeyRecord(r)
+		if err != nil {
+			l.Debugf("not storing key record %s: %v", r.ID, err)
+			continue
+		}
+		if stored {
+			synced++
+		}
+	}
+	l.Debugf("synced %d of %d key records", synced, len(records))
+	return nil
+}
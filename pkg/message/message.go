@@ -1,16 +1,16 @@
 package message
 
 import (
+	"context"
 	"errors"
-	"io"
-	"io/ioutil"
-	"regexp"
+	"fmt"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/robertlestak/centauri/internal/events"
 	"github.com/robertlestak/centauri/internal/net"
 	"github.com/robertlestak/centauri/internal/persist"
-	"github.com/robertlestak/centauri/pkg/keys"
+	"github.com/robertlestak/centauri/pkg/api"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,12 +18,23 @@ type Metadata struct {
 	Name string `json:"name"`
 }
 
-type Message struct {
-	Type        string `json:"type"`
-	Channel     string `json:"channel"`
-	ID          string `json:"id"`
-	PublicKeyID string `json:"pubKeyID,omitempty"`
-	Data        []byte `json:"data"`
+// Manager stores, replicates and deletes the messages held by a single peer.
+type Manager struct {
+	Store  *persist.Store
+	Events *events.Bus
+	Peer   *net.Peer
+
+	// waiters are closed when a message for their key is stored
+	waitMtx sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+func NewManager(store *persist.Store, bus *events.Bus, peer *net.Peer) *Manager {
+	return &Manager{
+		Store:  store,
+		Events: bus,
+		Peer:   peer,
+	}
 }
 
 func validateType(t string) error {
@@ -48,22 +59,7 @@ func validateType(t string) error {
 	return nil
 }
 
-// CleanString will clean the string to [a-zA-Z0-9_]
-func CleanString(s string) string {
-	// given input s, replace all characters that are not a-zA-Z0-9_ with _
-	var ns string
-	for _, r := range s {
-		rx := regexp.MustCompile(`[^a-zA-Z0-9\-]`)
-		if !rx.MatchString(string(r)) {
-			ns += string(r)
-		} else {
-			ns += "-"
-		}
-	}
-	return ns
-}
-
-func (m *Message) Create() (*Message, error) {
+func (mg *Manager) Create(m *api.Message) (*api.Message, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "message",
 		"fn":  "Create",
@@ -81,31 +77,40 @@ func (m *Message) Create() (*Message, error) {
 		l.Errorf("invalid type: %v", err)
 		return nil, err
 	}
+	if err := mg.CheckRevoked(m.PublicKeyID); err != nil {
+		l.Errorf("rejecting message: %v", err)
+		return nil, err
+	}
+	if err := mg.checkRetired(m.PublicKeyID); err != nil {
+		l.Errorf("rejecting message: %v", err)
+		return nil, err
+	}
 	m.ID = uuid.New().String()
-	m.Channel = CleanString(m.Channel)
-	if err := m.StoreLocal(); err != nil {
+	m.Channel = api.CleanString(m.Channel)
+	if err := mg.StoreLocal(m); err != nil {
 		l.Errorf("error storing message: %v", err)
 		return nil, err
 	}
-	events.NewMessage(m.PublicKeyID, m.Channel, m.ID)
+	mg.Events.NewMessage(m.PublicKeyID, m.Channel, m.ID)
 	return m, nil
 }
 
-func (m *Message) StoreLocal() error {
+func (mg *Manager) StoreLocal(m *api.Message) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "message",
 		"fn":  "StoreLocal",
 	})
 	l.Debug("storing message locally")
-	m.Channel = CleanString(m.Channel)
-	if err := persist.StoreMessage(m.PublicKeyID, m.Channel, m.ID, m.Data); err != nil {
+	m.Channel = api.CleanString(m.Channel)
+	if err := mg.Store.StoreMessage(m.PublicKeyID, m.Channel, m.ID, m.Data); err != nil {
 		l.Errorf("error storing message: %v", err)
 		return err
 	}
+	mg.notifyStored(m.PublicKeyID)
 	return nil
 }
 
-func ListMessageMetaForPubKeyID(pubKeyID string, channel string) ([]persist.MessageMetaData, error) {
+func (mg *Manager) ListMessageMetaForPubKeyID(pubKeyID string, channel string) ([]persist.MessageMetaData, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "message",
 		"fn":  "ListMessageMetaForPubKeyID",
@@ -113,23 +118,37 @@ func ListMessageMetaForPubKeyID(pubKeyID string, channel string) ([]persist.Mess
 		"ch":  channel,
 	})
 	l.Debug("listing messages for public key")
-	channel = CleanString(channel)
-	return persist.ListMessageMetaForPubKeyID(pubKeyID, channel)
+	channel = api.CleanString(channel)
+	return mg.Store.ListMessageMetaForPubKeyID(pubKeyID, channel)
+}
+
+// QueryMessageMeta returns the page of the messages of the key pubKeyID
+// selected by q.
+func (mg *Manager) QueryMessageMeta(pubKeyID string, q persist.MessageQuery) (*persist.MessagePage, error) {
+	l := log.WithFields(log.Fields{
+		"pkg": "message",
+		"fn":  "QueryMessageMeta",
+		"id":  pubKeyID,
+		"ch":  q.Channel,
+	})
+	l.Debug("querying messages for public key")
+	q.Channel = api.CleanString(q.Channel)
+	return mg.Store.QueryMessageMeta(pubKeyID, q)
 }
 
-func GetMessageByID(pubKeyID string, channel string, id string) (*Message, error) {
+func (mg *Manager) GetMessageByID(pubKeyID string, channel string, id string) (*api.Message, error) {
 	l := log.WithFields(log.Fields{
 		"pkg": "message",
 		"fn":  "GetMessageByID",
 	})
 	l.Debug("getting message by id")
-	channel = CleanString(channel)
-	data, err := persist.GetMessageByID(pubKeyID, channel, id)
+	channel = api.CleanString(channel)
+	data, err := mg.Store.GetMessageByID(pubKeyID, channel, id)
 	if err != nil {
 		l.Errorf("error getting message: %v", err)
 		return nil, err
 	}
-	m := &Message{
+	m := &api.Message{
 		ID:          id,
 		PublicKeyID: pubKeyID,
 		Channel:     channel,
@@ -138,7 +157,7 @@ func GetMessageByID(pubKeyID string, channel string, id string) (*Message, error
 	return m, nil
 }
 
-func GetMessageFromPeer(pubKeyID string, channel string, id string, peerAddr string, peerPort int) error {
+func (mg *Manager) GetMessageFromPeer(pubKeyID string, channel string, id string, peerAddr string, peerPort int) error {
 	l := log.WithFields(log.Fields{
 		"pkg":      "message",
 		"fn":       "GetMessageFromPeer",
@@ -149,86 +168,154 @@ func GetMessageFromPeer(pubKeyID string, channel string, id string, peerAddr str
 		"peerPort": peerPort,
 	})
 	l.Debugf("getting message from peer %s:%d", peerAddr, peerPort)
-	md, err := net.RequestDataFromPeerBestEffort(peerAddr, peerPort, pubKeyID, channel, id)
+	if mg.Store.TombstoneExists(pubKeyID, api.CleanString(channel), id) {
+		l.Debug("message already deleted, skipping")
+		return nil
+	}
+	md, err := mg.Peer.RequestDataFromPeerBestEffort(peerAddr, peerPort, pubKeyID, channel, id)
 	if err != nil {
 		l.Errorf("error getting message: %v", err)
 		return err
 	}
-	channel = CleanString(channel)
-	msg := &Message{
+	channel = api.CleanString(channel)
+	msg := &api.Message{
 		Type:        "bytes",
 		ID:          id,
 		Channel:     channel,
 		PublicKeyID: pubKeyID,
 		Data:        md,
 	}
-	if err := msg.StoreLocal(); err != nil {
+	if err := mg.StoreLocal(msg); err != nil {
 		l.Errorf("error storing message: %v", err)
 		return err
 	}
 	return nil
 }
 
-func DeleteMessageByID(pubKeyID string, channel string, id string, eventTrigger bool) error {
+func (mg *Manager) DeleteMessageByID(pubKeyID string, channel string, id string, eventTrigger bool) error {
 	l := log.WithFields(log.Fields{
 		"pkg": "message",
 		"fn":  "DeleteMessageByID",
 	})
 	l.Debug("deleting message by id")
-	channel = CleanString(channel)
-	if err := persist.DeleteMessageByID(pubKeyID, channel, id); err != nil {
+	channel = api.CleanString(channel)
+	// a message which was never stored here is not tombstoned
+	if !mg.Store.MessageExists(pubKeyID, channel, id) {
+		return errors.New("message does not exist")
+	}
+	if err := mg.Store.StoreTombstone(pubKeyID, channel, id); err != nil {
+		l.Errorf("error storing tombstone: %v", err)
+		return err
+	}
+	if err := mg.Store.DeleteMessageByID(pubKeyID, channel, id); err != nil {
 		l.Errorf("error deleting message: %v", err)
 		return err
 	}
 	if !eventTrigger {
-		events.DeleteMessage(pubKeyID, channel, id)
+		mg.Events.DeleteMessage(pubKeyID, channel, id)
 	}
 	return nil
 }
 
-func CreateMessage(mType string, fileName string, channel string, pubKeyID string, rawDataReader io.ReadCloser) (*Message, error) {
+func (mg *Manager) GetMessageStatus(pubKeyID string, channel string, id string) (*api.Status, error) {
 	l := log.WithFields(log.Fields{
-		"pkg":     "message",
-		"fn":      "CreateMessage",
-		"type":    mType,
-		"file":    fileName,
-		"channel": channel,
-		"pubkey":  pubKeyID,
+		"pkg": "message",
+		"fn":  "GetMessageStatus",
 	})
-	l.Debug("creating message")
-	var pubKey []byte
-	// get public key for pubKeyID
-	channel = CleanString(channel)
-	if k, ok := keys.PublicKeyChain[pubKeyID]; !ok {
-		l.Errorf("public key not found: %s", pubKeyID)
-		return nil, errors.New("public key not found")
-	} else {
-		pubKey = k
-	}
-	var rawData []byte
-	// read rawData from rawDataReader
-	if rawDataReader != nil {
-		var err error
-		rawData, err = ioutil.ReadAll(rawDataReader)
-		if err != nil {
-			l.Errorf("error reading raw data: %v", err)
-			return nil, err
-		}
+	l.Debug("getting message status")
+	if pubKeyID == "" || id == "" {
+		l.Error("public key id or id is empty")
+		return nil, errors.New("public key id and id are required")
+	}
+	channel = api.CleanString(channel)
+	return messageStatus(pubKeyID, channel, id, mg.Peer.QueryMessageStatus(pubKeyID, channel, id)), nil
+}
+
+// messageStatus sums up the states of the message reported by the peers.
+func messageStatus(pubKeyID string, channel string, id string, peers []api.PeerStatus) *api.Status {
+	st := &api.Status{
+		ID:          id,
+		Channel:     channel,
+		PublicKeyID: pubKeyID,
+		Stored:      []string{},
+		Fetching:    []string{},
+		Unreachable: []string{},
+		Peers:       peers,
 	}
-	if mType == "file" && fileName != "" {
-		// add file:<filename>| prefix to rawData
-		rawData = append([]byte("file:"+fileName+"|"), rawData...)
+	for _, p := range st.Peers {
+		if p.Error != "" {
+			st.Unreachable = append(st.Unreachable, p.PeerName)
+			continue
+		}
+		if p.Stored {
+			st.Stored = append(st.Stored, p.PeerName)
+		}
+		if p.Fetching {
+			st.Fetching = append(st.Fetching, p.PeerName)
+		}
+		if p.Tombstone {
+			st.Tombstoned = true
+		}
 	}
-	enc, err := keys.EncryptMessage(pubKey, rawData)
+	return st
+}
+
+// HandoffUniqueMessages pushes every message for which this peer holds the
+// only full copy to another live peer. It is used to drain a peer before it
+// leaves the cluster.
+func (mg *Manager) HandoffUniqueMessages(ctx context.Context) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "message",
+		"fn":  "HandoffUniqueMessages",
+	})
+	l.Debug("handing off unique messages")
+	mds, err := mg.Store.ListAllMessageMeta()
 	if err != nil {
-		l.Errorf("error encrypting data: %v", err)
-		return nil, err
+		l.Errorf("error listing messages: %v", err)
+		return err
 	}
-	m := &Message{
-		Type:        mType,
-		Channel:     channel,
-		PublicKeyID: pubKeyID,
-		Data:        []byte(*enc),
+	// ask each peer once for all the messages
+	refs := make([]net.StatusRef, len(mds))
+	for i, md := range mds {
+		refs[i] = net.StatusRef{PubKeyID: md.PubKeyID, Channel: md.Channel, ID: md.ID}
 	}
-	return m, nil
+	peers := mg.Peer.QueryMessageStatuses(refs)
+	var handedOff, failed int
+	for i, md := range mds {
+		if err := ctx.Err(); err != nil {
+			l.Errorf("handoff interrupted: %v", err)
+			return err
+		}
+		st := messageStatus(md.PubKeyID, md.Channel, md.ID, peers[i])
+		if st.Tombstoned {
+			continue
+		}
+		var replicated bool
+		for _, p := range st.Stored {
+			if p != mg.Peer.Name {
+				replicated = true
+				break
+			}
+		}
+		if replicated {
+			continue
+		}
+		data, err := mg.Store.GetMessageByID(md.PubKeyID, md.Channel, md.ID)
+		if err != nil {
+			l.Errorf("error reading message: %v", err)
+			failed++
+			continue
+		}
+		if err := mg.Peer.HandoffData(md.PubKeyID, md.Channel, md.ID, data); err != nil {
+			l.Errorf("error handing off message %s: %v", md.ID, err)
+			failed++
+			continue
+		}
+		handedOff++
+	}
+	l.Infof("handed off %d messages, %d failed", handedOff, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to hand off %d messages", failed)
+	}
+	return nil
 }
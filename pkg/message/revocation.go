@@ -0,0 +1,166 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotRevoked is returned by GetRevocation for keys which have not
+	// been revoked.
+	ErrNotRevoked = errors.New("key not revoked")
+	// ErrKeyRevoked is returned for requests signed by a revoked key, and
+	// for messages, rotations and key records of a revoked key.
+	ErrKeyRevoked = errors.New("key revoked")
+)
+
+// Revoke stores the revocation r and announces it to the other peers.
+// A key stays revoked; revoking it again keeps the first revocation.
+func (mg *Manager) Revoke(r *sign.Revocation) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "message",
+		"fn":  "Revoke",
+		"key": r.KeyID(),
+	})
+	l.Debug("revoking key")
+	stored, err := mg.storeRevocation(r)
+	if err != nil {
+		l.Errorf("error storing revocation: %v", err)
+		return err
+	}
+	if stored {
+		mg.Events.NewRevocation(r.KeyID())
+	}
+	return nil
+}
+
+// storeRevocation verifies and stores r and reports whether the key was
+// not revoked before.
+func (mg *Manager) storeRevocation(r *sign.Revocation) (bool, error) {
+	if err := r.Verify(); err != nil {
+		return false, err
+	}
+	if _, err := mg.GetRevocation(r.KeyID()); err == nil {
+		return false, nil
+	} else if !errors.Is(err, ErrNotRevoked) {
+		return false, err
+	}
+	jd, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	if err := mg.Store.StoreRevocation(r.KeyID(), jd); err != nil {
+		return false, err
+	}
+	// the rotation may have been made with the key in other hands, so
+	// senders are no longer pointed to its new key. A rotation left
+	// behind is not served, as the key is revoked.
+	if err := mg.Store.DeleteRotation(r.KeyID()); err != nil {
+		log.WithFields(log.Fields{
+			"pkg": "message",
+			"fn":  "storeRevocation",
+			"key": r.KeyID(),
+		}).Errorf("error deleting rotation of revoked key: %v", err)
+	}
+	return true, nil
+}
+
+// GetRevocation returns the revocation of the key pubKeyID.
+func (mg *Manager) GetRevocation(pubKeyID string) (*sign.Revocation, error) {
+	data, err := mg.Store.GetRevocation(pubKeyID)
+	if os.IsNotExist(err) {
+		return nil, ErrNotRevoked
+	} else if err != nil {
+		return nil, err
+	}
+	r := &sign.Revocation{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// CheckRevoked returns an error matching ErrKeyRevoked if the key
+// pubKeyID is revoked.
+func (mg *Manager) CheckRevoked(pubKeyID string) error {
+	r, err := mg.GetRevocation(pubKeyID)
+	if errors.Is(err, ErrNotRevoked) {
+		return nil
+	} else if err != nil {
+		// a revocation which cannot be read must not let the key pass
+		return fmt.Errorf("%w: %s: %v", ErrKeyRevoked, pubKeyID, err)
+	}
+	return fmt.Errorf("%w: %s was revoked at %s", ErrKeyRevoked, pubKeyID, r.RevokedAt.Format(time.RFC3339))
+}
+
+// GetRevocationFromPeer fetches and stores the revocation of the key
+// pubKeyID announced by another peer.
+func (mg *Manager) GetRevocationFromPeer(pubKeyID string, peerAddr string, peerPort int) error {
+	l := log.WithFields(log.Fields{
+		"pkg":      "message",
+		"fn":       "GetRevocationFromPeer",
+		"pubKeyID": pubKeyID,
+		"peerAddr": peerAddr,
+		"peerPort": peerPort,
+	})
+	l.Debugf("getting revocation from peer %s:%d", peerAddr, peerPort)
+	data, err := mg.Peer.RequestRevocationFromPeer(peerAddr, peerPort, pubKeyID)
+	if err != nil {
+		l.Errorf("error getting revocation: %v", err)
+		return err
+	}
+	r := &sign.Revocation{}
+	if err := json.Unmarshal(data, r); err != nil {
+		l.Errorf("error decoding revocation: %v", err)
+		return err
+	}
+	if r.KeyID() != pubKeyID {
+		return fmt.Errorf("peer sent the revocation of %s for %s", r.KeyID(), pubKeyID)
+	}
+	if _, err := mg.storeRevocation(r); err != nil {
+		l.Errorf("error storing revocation: %v", err)
+		return err
+	}
+	return nil
+}
+
+// SyncRevocationsFromPeer stores the revocations of another peer which
+// this peer does not hold.
+func (mg *Manager) SyncRevocationsFromPeer(peerAddr string, peerPort int) error {
+	l := log.WithFields(log.Fields{
+		"pkg":      "message",
+		"fn":       "SyncRevocationsFromPeer",
+		"peerAddr": peerAddr,
+		"peerPort": peerPort,
+	})
+	l.Debugf("syncing revocations from peer %s:%d", peerAddr, peerPort)
+	revocations, err := mg.Peer.RequestRevocationsFromPeer(peerAddr, peerPort)
+	if err != nil {
+		l.Errorf("error getting revocations: %v", err)
+		return err
+	}
+	var synced int
+	for _, data := range revocations {
+		r := &sign.Revocation{}
+		if err := json.Unmarshal(data, r); err != nil {
+			l.Errorf("error decoding revocation: %v", err)
+			continue
+		}
+		stored, err := mg.storeRevocation(r)
+		if err != nil {
+			l.Debugf("not storing revocation of %s: %v", r.KeyID(), err)
+			continue
+		}
+		if stored {
+			synced++
+		}
+	}
+	l.Debugf("synced %d of %d revocations", synced, len(revocations))
+	return nil
+}
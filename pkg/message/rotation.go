@@ -0,0 +1,151 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/sign"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotRotated is returned by GetRotation for keys which have not
+	// been rotated.
+	ErrNotRotated = errors.New("key not rotated")
+	// ErrKeyRetired is returned by Create for messages to a key which was
+	// rotated and whose overlap period is over.
+	ErrKeyRetired = errors.New("key retired")
+	// ErrStaleRotation is returned by Rotate for a statement older than
+	// the one stored for the key.
+	ErrStaleRotation = errors.New("a newer rotation of the key exists")
+	// ErrFutureRotation is returned by Rotate for a statement created
+	// more than maxRotationSkew ahead of the clock of the peer.
+	ErrFutureRotation = errors.New("rotation created in the future")
+)
+
+// maxRotationSkew is the most a rotation statement may be created ahead
+// of the clock of the peer. As a newer statement replaces an older one,
+// a statement dated far ahead could not be replaced until then.
+const maxRotationSkew = time.Minute * 5
+
+// Rotate stores the rotation statement r and announces it to the other
+// peers. A statement only replaces an older one of the same key.
+func (mg *Manager) Rotate(r *sign.Rotation) error {
+	l := log.WithFields(log.Fields{
+		"pkg": "message",
+		"fn":  "Rotate",
+		"key": r.OldKeyID(),
+	})
+	l.Debug("rotating key")
+	stored, err := mg.storeRotation(r)
+	if err != nil {
+		l.Errorf("error storing rotation: %v", err)
+		return err
+	}
+	if stored {
+		mg.Events.NewRotation(r.OldKeyID(), r.NewKeyID())
+	}
+	return nil
+}
+
+// storeRotation verifies and stores r and reports whether it was new.
+func (mg *Manager) storeRotation(r *sign.Rotation) (bool, error) {
+	if err := r.Verify(); err != nil {
+		return false, err
+	}
+	if r.CreatedAt.After(time.Now().Add(maxRotationSkew)) {
+		return false, ErrFutureRotation
+	}
+	// the private key of a revoked key may be in other hands
+	if err := mg.CheckRevoked(r.OldKeyID()); err != nil {
+		return false, err
+	}
+	cur, err := mg.GetRotation(r.OldKeyID())
+	if err != nil && !errors.Is(err, ErrNotRotated) {
+		return false, err
+	}
+	if cur != nil {
+		if cur.NewKeyID() == r.NewKeyID() && cur.CreatedAt.Equal(r.CreatedAt) {
+			return false, nil
+		}
+		if !r.CreatedAt.After(cur.CreatedAt) {
+			return false, ErrStaleRotation
+		}
+	}
+	jd, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	if err := mg.Store.StoreRotation(r.OldKeyID(), jd); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetRotation returns the rotation statement of the key pubKeyID. The
+// rotation of a revoked key is not followed, so an error matching
+// ErrKeyRevoked is returned for it.
+func (mg *Manager) GetRotation(pubKeyID string) (*sign.Rotation, error) {
+	if err := mg.CheckRevoked(pubKeyID); err != nil {
+		return nil, err
+	}
+	data, err := mg.Store.GetRotation(pubKeyID)
+	if os.IsNotExist(err) {
+		return nil, ErrNotRotated
+	} else if err != nil {
+		return nil, err
+	}
+	r := &sign.Rotation{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetRotationFromPeer fetches and stores the rotation statement of the
+// key pubKeyID announced by another peer.
+func (mg *Manager) GetRotationFromPeer(pubKeyID string, peerAddr string, peerPort int) error {
+	l := log.WithFields(log.Fields{
+		"pkg":      "message",
+		"fn":       "GetRotationFromPeer",
+		"pubKeyID": pubKeyID,
+		"peerAddr": peerAddr,
+		"peerPort": peerPort,
+	})
+	l.Debugf("getting rotation from peer %s:%d", peerAddr, peerPort)
+	data, err := mg.Peer.RequestRotationFromPeer(peerAddr, peerPort, pubKeyID)
+	if err != nil {
+		l.Errorf("error getting rotation: %v", err)
+		return err
+	}
+	r := &sign.Rotation{}
+	if err := json.Unmarshal(data, r); err != nil {
+		l.Errorf("error decoding rotation: %v", err)
+		return err
+	}
+	if r.OldKeyID() != pubKeyID {
+		return fmt.Errorf("peer sent the rotation of %s for %s", r.OldKeyID(), pubKeyID)
+	}
+	if _, err := mg.storeRotation(r); err != nil && !errors.Is(err, ErrStaleRotation) {
+		l.Errorf("error storing rotation: %v", err)
+		return err
+	}
+	return nil
+}
+
+// checkRetired returns ErrKeyRetired if the key pubKeyID is retired.
+func (mg *Manager) checkRetired(pubKeyID string) error {
+	r, err := mg.GetRotation(pubKeyID)
+	if err != nil {
+		// not rotated, or the statement cannot be read, which must not
+		// stop messages to the key
+		return nil
+	}
+	if r.Retired(time.Now()) {
+		return fmt.Errorf("%w: %s was rotated to %s", ErrKeyRetired, pubKeyID, r.NewKeyID())
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package message
+
+import (
+	"time"
+)
+
+// MaxListWait is the longest time a listing waits for new messages.
+const MaxListWait = time.Second * 60
+
+// MessageStored returns a channel which is closed when the next message
+// for pubKeyID is stored on this peer.
+func (mg *Manager) MessageStored(pubKeyID string) <-chan struct{} {
+	mg.waitMtx.Lock()
+	defer mg.waitMtx.Unlock()
+	if mg.waiters == nil {
+		mg.waiters = make(map[string]chan struct{})
+	}
+	c, ok := mg.waiters[pubKeyID]
+	if !ok {
+		c = make(chan struct{})
+		mg.waiters[pubKeyID] = c
+	}
+	return c
+}
+
+// notifyStored wakes the listings waiting for messages for pubKeyID.
+func (mg *Manager) notifyStored(pubKeyID string) {
+	mg.waitMtx.Lock()
+	defer mg.waitMtx.Unlock()
+	if c, ok := mg.waiters[pubKeyID]; ok {
+		close(c)
+		delete(mg.waiters, pubKeyID)
+	}
+}
@@ -0,0 +1,115 @@
+package sign
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/robertlestak/centauri/pkg/keys"
+)
+
+// MaxKeyRecordName is the longest display name of a key record.
+const MaxKeyRecordName = 64
+
+// KeyRecord is an entry of the key directory: a public key with the
+// display name of its owner, signed with the key itself. A record is
+// looked up by its ID or name until ExpiresAt.
+type KeyRecord struct {
+	ID        string    `json:"id"`
+	Key       []byte    `json:"key"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Signature []byte    `json:"signature"`
+}
+
+// keyRecordData is the signed part of a key record.
+type keyRecordData struct {
+	Action    string `json:"action"`
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// NewKeyRecord returns the record of the public key of k under the
+// display name name, signed with k and expiring at expiresAt.
+func NewKeyRecord(k *rsa.PrivateKey, name string, expiresAt time.Time) (*KeyRecord, error) {
+	pub, err := keys.MarshalPublicKey(&k.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &KeyRecord{
+		ID:        keys.PubKeyID(pub),
+		Key:       pub,
+		Name:      name,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		ExpiresAt: expiresAt.UTC().Truncate(time.Second),
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return nil, err
+	}
+	if r.Signature, err = Sign(data, k); err != nil {
+		return nil, err
+	}
+	return r, r.Verify()
+}
+
+// Expired reports whether the record expired at t.
+func (r *KeyRecord) Expired(t time.Time) bool {
+	return !t.Before(r.ExpiresAt)
+}
+
+func (r *KeyRecord) signedData() ([]byte, error) {
+	return json.Marshal(keyRecordData{
+		Action:    "publish",
+		ID:        r.ID,
+		Name:      r.Name,
+		CreatedAt: r.CreatedAt.Unix(),
+		ExpiresAt: r.ExpiresAt.Unix(),
+	})
+}
+
+// ValidKeyRecordName reports whether name can be the display name of a
+// key record: printable, without surrounding spaces and at most
+// MaxKeyRecordName characters.
+func ValidKeyRecordName(name string) bool {
+	if name == "" || utf8.RuneCountInString(name) > MaxKeyRecordName || !utf8.ValidString(name) {
+		return false
+	}
+	for i, c := range name {
+		if !unicode.IsPrint(c) || (unicode.IsSpace(c) && (i == 0 || i == len(name)-1)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify checks that the key is a valid public key with the record's ID,
+// that the name is valid and that the record is signed by the key.
+func (r *KeyRecord) Verify() error {
+	if _, err := keys.BytesToPubKey(r.Key); err != nil {
+		return errors.New("invalid key")
+	}
+	if keys.PubKeyID(r.Key) != r.ID {
+		return errors.New("key does not match the record ID")
+	}
+	if !ValidKeyRecordName(r.Name) {
+		return errors.New("invalid name")
+	}
+	if !r.ExpiresAt.After(r.CreatedAt) {
+		return errors.New("expiry is not after creation time")
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return err
+	}
+	if err := Verify(data, r.Signature, r.Key); err != nil {
+		return errors.New("invalid record signature")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package sign
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/keys"
+)
+
+func TestNewKeyRecord(t *testing.T) {
+	r, err := NewKeyRecord(testKey(t, 0), "Alice Ops", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.ID, keys.PubKeyID(testPublicKey(t, 0)); got != want {
+		t.Errorf("got ID %s, want %s", got, want)
+	}
+	got := &KeyRecord{}
+	roundTrip(t, r, got)
+	if err := got.Verify(); err != nil {
+		t.Errorf("decoded record: %v", err)
+	}
+	if _, err := NewKeyRecord(testKey(t, 0), "Alice", time.Now().Add(-time.Hour)); err == nil {
+		t.Error("published a record which expires before its creation")
+	}
+	if _, err := NewKeyRecord(testKey(t, 0), " Alice", time.Now().Add(time.Hour)); err == nil {
+		t.Error("published a record with an invalid name")
+	}
+}
+
+func TestKeyRecordVerifyTampered(t *testing.T) {
+	tests := map[string]func(r *KeyRecord){
+		"name":       func(r *KeyRecord) { r.Name = "Mallory" },
+		"expires at": func(r *KeyRecord) { r.ExpiresAt = r.ExpiresAt.Add(time.Hour) },
+		"id":         func(r *KeyRecord) { r.ID = strings.Repeat("0", len(r.ID)) },
+		// the key of another record under the ID of this one
+		"key": func(r *KeyRecord) { r.Key = testPublicKey(t, 1) },
+		"signature": func(r *KeyRecord) {
+			r.Signature = append([]byte{}, r.Signature...)
+			r.Signature[0] ^= 1
+		},
+	}
+	for name, tamper := range tests {
+		r, err := NewKeyRecord(testKey(t, 0), "Alice", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tamper(r)
+		if err := r.Verify(); err == nil {
+			t.Errorf("%s: tampered record verified", name)
+		}
+	}
+}
+
+func TestValidKeyRecordName(t *testing.T) {
+	tests := map[string]bool{
+		"Alice":                 true,
+		"Alice Ops":             true,
+		"Zoë":                   true,
+		strings.Repeat("ä", 64): true,
+		"":                      false,
+		" Alice":                false,
+		"Alice ":                false,
+		"Alice\nOps":            false,
+		"Alice\x00":             false,
+		"\xff":                  false,
+		strings.Repeat("a", 65): false,
+	}
+	for name, want := range tests {
+		if got := ValidKeyRecordName(name); got != want {
+			t.Errorf("ValidKeyRecordName(%q): got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestKeyRecordExpired(t *testing.T) {
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &KeyRecord{ExpiresAt: at}
+	if r.Expired(at.Add(-time.Second)) || !r.Expired(at) {
+		t.Error("a record expires at ExpiresAt")
+	}
+}
@@ -0,0 +1,88 @@
+package sign
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/robertlestak/centauri/pkg/keys"
+)
+
+// MaxRevocationReason is the longest reason of a revocation.
+const MaxRevocationReason = 256
+
+// Revocation states, signed with the key itself, that a key must not be
+// used anymore, for instance because its private key was stolen. It can
+// be created in advance and kept offline, to be published if the private
+// key is lost.
+type Revocation struct {
+	Key       []byte    `json:"key"`
+	Reason    string    `json:"reason,omitempty"`
+	RevokedAt time.Time `json:"revokedAt"`
+	Signature []byte    `json:"signature"`
+}
+
+// revocationData is the signed part of a revocation.
+type revocationData struct {
+	Action    string `json:"action"`
+	KeyID     string `json:"keyID"`
+	Reason    string `json:"reason"`
+	RevokedAt int64  `json:"revokedAt"`
+}
+
+// NewRevocation returns the revocation of the public key of k, signed
+// with k.
+func NewRevocation(k *rsa.PrivateKey, reason string) (*Revocation, error) {
+	pub, err := keys.MarshalPublicKey(&k.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &Revocation{
+		Key:       pub,
+		Reason:    reason,
+		RevokedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return nil, err
+	}
+	if r.Signature, err = Sign(data, k); err != nil {
+		return nil, err
+	}
+	return r, r.Verify()
+}
+
+// KeyID returns the ID of the revoked key.
+func (r *Revocation) KeyID() string {
+	return keys.PubKeyID(r.Key)
+}
+
+func (r *Revocation) signedData() ([]byte, error) {
+	return json.Marshal(revocationData{
+		Action:    "revoke",
+		KeyID:     r.KeyID(),
+		Reason:    r.Reason,
+		RevokedAt: r.RevokedAt.Unix(),
+	})
+}
+
+// Verify checks that the key is a valid public key and that the
+// revocation is signed by it.
+func (r *Revocation) Verify() error {
+	if _, err := keys.BytesToPubKey(r.Key); err != nil {
+		return errors.New("invalid key")
+	}
+	if !utf8.ValidString(r.Reason) || utf8.RuneCountInString(r.Reason) > MaxRevocationReason {
+		return errors.New("invalid reason")
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return err
+	}
+	if err := Verify(data, r.Signature, r.Key); err != nil {
+		return errors.New("invalid revocation signature")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package sign
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/keys"
+)
+
+func TestNewRevocation(t *testing.T) {
+	r, err := NewRevocation(testKey(t, 0), "key stolen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.KeyID(), keys.PubKeyID(testPublicKey(t, 0)); got != want {
+		t.Errorf("got key ID %s, want %s", got, want)
+	}
+	got := &Revocation{}
+	roundTrip(t, r, got)
+	if err := got.Verify(); err != nil {
+		t.Errorf("decoded revocation: %v", err)
+	}
+	if _, err := NewRevocation(testKey(t, 0), ""); err != nil {
+		t.Errorf("revocation without reason: %v", err)
+	}
+}
+
+func TestNewRevocationReason(t *testing.T) {
+	if _, err := NewRevocation(testKey(t, 0), strings.Repeat("ä", MaxRevocationReason)); err != nil {
+		t.Errorf("reason of %d characters: %v", MaxRevocationReason, err)
+	}
+	if _, err := NewRevocation(testKey(t, 0), strings.Repeat("a", MaxRevocationReason+1)); err == nil {
+		t.Error("revoked with a reason which is too long")
+	}
+	if _, err := NewRevocation(testKey(t, 0), "\xff"); err == nil {
+		t.Error("revoked with an invalid reason")
+	}
+}
+
+func TestRevocationVerifyTampered(t *testing.T) {
+	tests := map[string]func(r *Revocation){
+		"reason":     func(r *Revocation) { r.Reason = "superseded" },
+		"revoked at": func(r *Revocation) { r.RevokedAt = r.RevokedAt.Add(time.Second) },
+		// a revocation of one key must not revoke another
+		"key": func(r *Revocation) { r.Key = testPublicKey(t, 1) },
+		"signature": func(r *Revocation) {
+			r.Signature = append([]byte{}, r.Signature...)
+			r.Signature[0] ^= 1
+		},
+	}
+	for name, tamper := range tests {
+		r, err := NewRevocation(testKey(t, 0), "key stolen")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tamper(r)
+		if err := r.Verify(); err == nil {
+			t.Errorf("%s: tampered revocation verified", name)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package sign
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/robertlestak/centauri/pkg/keys"
+)
+
+// MaxRotationHops is the longest chain of rotations followed from a key.
+const MaxRotationHops = 8
+
+// Rotation is a key rotation statement: the owner of the old key states,
+// signed with the old key, that messages are to be sent to the new key.
+// Messages to the old key are still accepted until RetireAt, so that
+// messages in flight can be received with the old key; after that the
+// old key is retired.
+type Rotation struct {
+	OldKey    []byte    `json:"oldKey"`
+	NewKey    []byte    `json:"newKey"`
+	CreatedAt time.Time `json:"createdAt"`
+	RetireAt  time.Time `json:"retireAt"`
+	Signature []byte    `json:"signature"`
+}
+
+// rotationData is the signed part of a rotation statement.
+type rotationData struct {
+	Action    string `json:"action"`
+	OldKeyID  string `json:"oldKeyID"`
+	NewKeyID  string `json:"newKeyID"`
+	CreatedAt int64  `json:"createdAt"`
+	RetireAt  int64  `json:"retireAt"`
+}
+
+// NewRotation returns the statement, signed with the old private key,
+// that the old key is rotated to the public key newKey and retired after
+// overlap.
+func NewRotation(old *rsa.PrivateKey, newKey []byte, overlap time.Duration) (*Rotation, error) {
+	oldKey, err := keys.MarshalPublicKey(&old.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	r := &Rotation{
+		OldKey:    oldKey,
+		NewKey:    newKey,
+		CreatedAt: now,
+		RetireAt:  now.Add(overlap),
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return nil, err
+	}
+	if r.Signature, err = Sign(data, old); err != nil {
+		return nil, err
+	}
+	return r, r.Verify()
+}
+
+// OldKeyID returns the ID of the rotated key.
+func (r *Rotation) OldKeyID() string {
+	return keys.PubKeyID(r.OldKey)
+}
+
+// NewKeyID returns the ID of the key the old key is rotated to.
+func (r *Rotation) NewKeyID() string {
+	return keys.PubKeyID(r.NewKey)
+}
+
+// Retired reports whether the old key is retired at t.
+func (r *Rotation) Retired(t time.Time) bool {
+	return !t.Before(r.RetireAt)
+}
+
+func (r *Rotation) signedData() ([]byte, error) {
+	return json.Marshal(rotationData{
+		Action:    "rotate",
+		OldKeyID:  r.OldKeyID(),
+		NewKeyID:  r.NewKeyID(),
+		CreatedAt: r.CreatedAt.Unix(),
+		RetireAt:  r.RetireAt.Unix(),
+	})
+}
+
+// Verify checks that both keys are valid public keys, that they differ
+// and that the statement is signed by the old key.
+func (r *Rotation) Verify() error {
+	if _, err := keys.BytesToPubKey(r.OldKey); err != nil {
+		return errors.New("invalid old key")
+	}
+	if _, err := keys.BytesToPubKey(r.NewKey); err != nil {
+		return errors.New("invalid new key")
+	}
+	if r.OldKeyID() == r.NewKeyID() {
+		return errors.New("old and new key are the same")
+	}
+	if r.RetireAt.Before(r.CreatedAt) {
+		return errors.New("retire time is before creation time")
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return err
+	}
+	if err := Verify(data, r.Signature, r.OldKey); err != nil {
+		return errors.New("invalid rotation signature")
+	}
+	return nil
+}
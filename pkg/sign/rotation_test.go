@@ -0,0 +1,67 @@
+package sign
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewRotation(t *testing.T) {
+	r, err := NewRotation(testKey(t, 0), testPublicKey(t, 1), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OldKeyID() == r.NewKeyID() {
+		t.Error("old and new key IDs are equal")
+	}
+	if got := r.RetireAt.Sub(r.CreatedAt); got != time.Hour {
+		t.Errorf("got overlap %v, want %v", got, time.Hour)
+	}
+	got := &Rotation{}
+	roundTrip(t, r, got)
+	if err := got.Verify(); err != nil {
+		t.Errorf("decoded rotation: %v", err)
+	}
+}
+
+func TestNewRotationInvalid(t *testing.T) {
+	if _, err := NewRotation(testKey(t, 0), testPublicKey(t, 0), time.Hour); err == nil {
+		t.Error("rotated a key to itself")
+	}
+	if _, err := NewRotation(testKey(t, 0), []byte("not a key"), time.Hour); err == nil {
+		t.Error("rotated to an invalid key")
+	}
+	if _, err := NewRotation(testKey(t, 0), testPublicKey(t, 1), -time.Hour); err == nil {
+		t.Error("rotated with a negative overlap")
+	}
+}
+
+func TestRotationVerifyTampered(t *testing.T) {
+	tests := map[string]func(r *Rotation){
+		"created at": func(r *Rotation) { r.CreatedAt = r.CreatedAt.Add(-time.Second) },
+		"retire at":  func(r *Rotation) { r.RetireAt = r.RetireAt.Add(time.Hour) },
+		// the new key is the only other valid key, so swap the keys
+		"keys": func(r *Rotation) { r.OldKey, r.NewKey = r.NewKey, r.OldKey },
+		"signature": func(r *Rotation) {
+			r.Signature = append([]byte{}, r.Signature...)
+			r.Signature[0] ^= 1
+		},
+	}
+	for name, tamper := range tests {
+		r, err := NewRotation(testKey(t, 0), testPublicKey(t, 1), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tamper(r)
+		if err := r.Verify(); err == nil {
+			t.Errorf("%s: tampered rotation verified", name)
+		}
+	}
+}
+
+func TestRotationRetired(t *testing.T) {
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &Rotation{RetireAt: at}
+	if r.Retired(at.Add(-time.Second)) || !r.Retired(at) {
+		t.Error("a key is retired from RetireAt on")
+	}
+}
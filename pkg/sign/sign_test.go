@@ -0,0 +1,72 @@
+package sign
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/robertlestak/centauri/pkg/keys"
+)
+
+var (
+	testKeysOnce sync.Once
+	testKeys     [2]*rsa.PrivateKey
+	testKeysErr  error
+)
+
+// testKey returns one of two keys shared by the tests, small to keep
+// them fast.
+func testKey(t *testing.T, i int) *rsa.PrivateKey {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		for j := range testKeys {
+			if testKeys[j], testKeysErr = keys.GenerateKey(1024); testKeysErr != nil {
+				return
+			}
+		}
+	})
+	if testKeysErr != nil {
+		t.Fatal(testKeysErr)
+	}
+	return testKeys[i]
+}
+
+func testPublicKey(t *testing.T, i int) []byte {
+	t.Helper()
+	pub, err := keys.MarshalPublicKey(&testKey(t, i).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+// roundTrip encodes v as JSON and decodes it into out, as a statement
+// travels between the peers.
+func roundTrip(t *testing.T, v interface{}, out interface{}) {
+	t.Helper()
+	jd, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(jd, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	msg := []byte("message")
+	sig, err := Sign(msg, testKey(t, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(msg, sig, testPublicKey(t, 0)); err != nil {
+		t.Errorf("valid signature: %v", err)
+	}
+	if err := Verify([]byte("other message"), sig, testPublicKey(t, 0)); err == nil {
+		t.Error("signature valid for another message")
+	}
+	if err := Verify(msg, sig, testPublicKey(t, 1)); err == nil {
+		t.Error("signature valid for another key")
+	}
+}